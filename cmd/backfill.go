@@ -0,0 +1,490 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"cloud.google.com/go/logging"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/api"
+	db2 "github.com/ajjensen13/stocker/internal/db"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const backfillDateLayout = "2006-01-02"
+
+// backfillCmd represents the backfill command
+var backfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "loads the historical candles of a list of symbols",
+	Long: `Loads the candles of the given symbols between two dates. Long ranges are
+split into chunks that are requested, loaded and staged one at a time, so a
+failed backfill can be resumed without requesting the staged chunks again.
+The symbols must already have been staged by an etl job run.
+
+With --all, every stock of the exchange that has been staged is backfilled.
+This repairs candles that were staged with less precision than the
+provider reports, e.g. those staged before migration 012 whose src rows
+had already been cleaned up, and then recalculates their adjustment
+factors, 52 week candles and indicators:
+
+  stocker backfill --all --exchange US --from 1980-01-01`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger, cleanupLogger := logger()
+		defer cleanupLogger()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ctx = util.WithLogger(ctx, logger)
+
+		err := runBackfill(ctx, cmd)
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+func runBackfill(ctx context.Context, cmd *cobra.Command) error {
+	util.Logf(ctx, logging.Notice, "backfill is starting")
+	defer util.Logf(ctx, logging.Notice, "backfill is stopping")
+
+	pool, poolCleanup, err := pool(ctx)
+	if err != nil {
+		return err
+	}
+	defer poolCleanup()
+
+	waitForLock, err := cmd.Flags().GetBool("wait-for-lock")
+	if err != nil {
+		return fmt.Errorf("failed to read wait-for-lock flag: %w", err)
+	}
+
+	resumeJobRunId, err := cmd.Flags().GetUint64("resume")
+	if err != nil {
+		return fmt.Errorf("failed to read resume flag: %w", err)
+	}
+
+	var backfill db2.Backfill
+	if resumeJobRunId > 0 {
+		_, err = lookupResumableJob(ctx, pool, backfillJobDefinition, resumeJobRunId)
+		if err != nil {
+			return err
+		}
+
+		backfill, err = queryBackfill(backoffContext(ctx, 5*time.Minute), resumeJobRunId, pool)
+	} else {
+		backfill, err = backfillFromFlags(ctx, cmd, pool)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = loadTradingCalendars(ctx, pool, Exchanges{Exchange(backfill.Exchange)}, backfill.To)
+	if err != nil {
+		return err
+	}
+
+	stocks, err := backfillStocks(ctx, pool, backfill)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockJob(ctx, pool, backfillJobDefinition, backfillLockKey(backfill), lockExclusive, waitForLock)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock(ctx)
+
+	var jobRunId uint64
+	if resumeJobRunId > 0 {
+		jobRunId = resumeJobRunId
+		err = resumeJob(ctx, pool, jobRunId)
+		if err != nil {
+			return err
+		}
+	} else {
+		jobRunId, err = startJob(ctx, pool, backfillJobDefinition, symbolWindow{Skip: -1, Limit: -1})
+		if err != nil {
+			return err
+		}
+
+		err = saveBackfill(backoffContext(ctx, 5*time.Minute), jobRunId, pool, backfill)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx = util.WithLoggerValue(ctx, "job_run_id", fmt.Sprintf("job_run_%d", jobRunId))
+	util.Logf(ctx, logging.Info, "backfilling %d symbols of exchange %s from %v to %v", len(stocks), backfill.Exchange, backfill.From, backfill.To)
+
+	err = lock.setOwner(ctx, jobRunId)
+	if err != nil {
+		return err
+	}
+
+	progress, err := queryProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool)
+	if err != nil {
+		return fmt.Errorf("failed to get job run progress: %w", err)
+	}
+
+	concurrency, err := workerConcurrency()
+	if err != nil {
+		return err
+	}
+
+	chunkDays, err := backfillChunkDays()
+	if err != nil {
+		return err
+	}
+
+	runStats := &jobRunStats{}
+	ctx = withJobRunStats(ctx, runStats)
+
+	var failedChunks int64
+	errRun := forEachStock(ctx, concurrency, stocks, func(ctx context.Context, stock api.Stock) error {
+		ctx = util.WithLoggerValue(ctx, "exchange", stock.Exchange)
+		ctx = util.WithLoggerValue(ctx, "symbol", stock.Symbol)
+
+		for _, resolution := range backfill.Resolutions {
+			failed, err := backfillStockCandles(ctx, jobRunId, pool, stockKey(stock), resolution, backfill, chunkDays, progress)
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(&failedChunks, int64(failed))
+		}
+		return nil
+	})
+	if errRun == nil && failedChunks > 0 {
+		errRun = fmt.Errorf("failed to retrieve %d chunks of candles from provider; resume job run %d to retry them", failedChunks, jobRunId)
+	}
+
+	errEnd := endJob(ctx, pool, jobRunId, runStats, errRun)
+	if errEnd != nil {
+		util.Logf(ctx, logging.Error, errEnd.Error())
+	}
+	return errRun
+}
+
+// backfillFromFlags returns the backfill requested by the command line. The
+// dates are interpreted in the configured timezone; the range includes the
+// whole day of --to. With --all, the symbols are those of every staged stock
+// of the exchange at the time the backfill starts.
+func backfillFromFlags(ctx context.Context, cmd *cobra.Command, pool *pgxpool.Pool) (db2.Backfill, error) {
+	tz, err := timezone()
+	if err != nil {
+		return db2.Backfill{}, err
+	}
+
+	fromFlag, err := cmd.Flags().GetString("from")
+	if err != nil {
+		return db2.Backfill{}, fmt.Errorf("failed to read from flag: %w", err)
+	}
+	from, err := time.ParseInLocation(backfillDateLayout, fromFlag, tz)
+	if err != nil {
+		return db2.Backfill{}, fmt.Errorf("invalid from flag %q: %w", fromFlag, err)
+	}
+
+	toFlag, err := cmd.Flags().GetString("to")
+	if err != nil {
+		return db2.Backfill{}, fmt.Errorf("failed to read to flag: %w", err)
+	}
+	var to time.Time
+	if toFlag == "" {
+		now := time.Now().In(tz)
+		to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, tz)
+	} else {
+		to, err = time.ParseInLocation(backfillDateLayout, toFlag, tz)
+		if err != nil {
+			return db2.Backfill{}, fmt.Errorf("invalid to flag %q: %w", toFlag, err)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	to = to.Add(-time.Second)
+
+	if to.Before(from) {
+		return db2.Backfill{}, fmt.Errorf("backfill ends (%v) before it starts (%v)", to, from)
+	}
+
+	exchange, err := cmd.Flags().GetString("exchange")
+	if err != nil {
+		return db2.Backfill{}, fmt.Errorf("failed to read exchange flag: %w", err)
+	}
+
+	all, err := cmd.Flags().GetBool("all")
+	if err != nil {
+		return db2.Backfill{}, fmt.Errorf("failed to read all flag: %w", err)
+	}
+
+	symbolsFlag, err := cmd.Flags().GetStringSlice("symbols")
+	if err != nil {
+		return db2.Backfill{}, fmt.Errorf("failed to read symbols flag: %w", err)
+	}
+	if all && len(symbolsFlag) > 0 {
+		return db2.Backfill{}, fmt.Errorf("--all cannot be combined with --symbols")
+	}
+
+	var symbols []api.Symbol
+	seen := map[string]bool{}
+	for _, s := range symbolsFlag {
+		s = strings.ToUpper(strings.TrimSpace(s))
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		symbols = append(symbols, api.Symbol(s))
+	}
+
+	if all {
+		stocks, err := queryExchangeStocks(backoffContext(ctx, 5*time.Minute), pool, api.Exchange(exchange))
+		if err != nil {
+			return db2.Backfill{}, err
+		}
+		for _, stock := range stocks {
+			symbols = append(symbols, api.Symbol(stock.Symbol))
+		}
+	}
+
+	if len(symbols) == 0 {
+		return db2.Backfill{}, fmt.Errorf("no symbols to backfill")
+	}
+
+	resolutionsFlag, err := cmd.Flags().GetStringSlice("resolutions")
+	if err != nil {
+		return db2.Backfill{}, fmt.Errorf("failed to read resolutions flag: %w", err)
+	}
+	var resolutions []api.Resolution
+	if len(resolutionsFlag) > 0 {
+		for _, r := range resolutionsFlag {
+			resolutions = append(resolutions, api.Resolution(r))
+		}
+	} else {
+		configured, err := candleResolutions()
+		if err != nil {
+			return db2.Backfill{}, err
+		}
+		for _, r := range configured {
+			resolutions = append(resolutions, api.Resolution(r))
+		}
+	}
+
+	return db2.Backfill{
+		Exchange:    api.Exchange(exchange),
+		Symbols:     symbols,
+		Resolutions: resolutions,
+		From:        from,
+		To:          to,
+	}, nil
+}
+
+// backfillLockKey returns the key of the job lock of backfill. Backfills of
+// the same symbols exclude each other. The symbols are hashed, because a
+// backfill of a whole exchange lists tens of thousands of them, which would
+// not fit into the primary key of metadata.job_lock.
+func backfillLockKey(backfill db2.Backfill) string {
+	symbols := make([]string, len(backfill.Symbols))
+	for i, symbol := range backfill.Symbols {
+		symbols[i] = string(symbol)
+	}
+	sort.Strings(symbols)
+
+	sum := sha1.Sum([]byte(strings.Join(symbols, ",")))
+	return fmt.Sprintf("exchange=%s symbols=%d sha1=%s", backfill.Exchange, len(symbols), hex.EncodeToString(sum[:]))
+}
+
+// backfillStocks returns the stocks of the symbols of backfill. It fails if
+// any symbol has not been staged, since its candles could not be staged.
+func backfillStocks(ctx context.Context, pool *pgxpool.Pool, backfill db2.Backfill) ([]api.Stock, error) {
+	stocks, err := queryStagedStocks(backoffContext(ctx, 5*time.Minute), pool, backfill.Exchange, backfill.Symbols)
+	if err != nil {
+		return nil, err
+	}
+
+	staged := map[string]bool{}
+	for _, stock := range stocks {
+		staged[stock.Symbol] = true
+	}
+
+	var missing []string
+	for _, symbol := range backfill.Symbols {
+		if !staged[string(symbol)] {
+			missing = append(missing, string(symbol))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("symbols %s are not stocks of exchange %s; run an etl job first", strings.Join(missing, ", "), backfill.Exchange)
+	}
+
+	return stocks, nil
+}
+
+// backfillStockCandles loads and stages the candles of key at resolution
+// chunk by chunk, skipping the chunks staged before the job run was resumed.
+// Chunks loaded but not staged before are staged from the src schema.
+// A chunk that cannot be retrieved is logged and counted, and the remaining
+// chunks are processed. The 52 week candles and gaps are updated once all
+// chunks have been staged.
+func backfillStockCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, key db2.StockKey, resolution api.Resolution, backfill db2.Backfill, chunkDays BackfillChunkDays, progress db2.Progress) (failed int, err error) {
+	ctx = util.WithLoggerValue(ctx, "type", "candle")
+	ctx = util.WithLoggerValue(ctx, "resolution", resolution)
+	dataType := db2.CandleDataType(resolution)
+	symbol := key.Symbol
+
+	if progress.Status(dataType, key) == db2.ProgressStaged {
+		util.Logf(ctx, logging.Debug, "skipping %q stock candles (%s) already backfilled by this job run", symbol, resolution)
+		return 0, nil
+	}
+
+	var loaded []api.CandlesResponse
+	for _, chunk := range chunkDays.chunks(Resolution(resolution), backfill.From, backfill.To) {
+		chunkType := db2.CandleChunkDataType(resolution, chunk.From)
+
+		select {
+		case <-ctx.Done():
+			return failed, fmt.Errorf("aborting candle request %q (%s) from provider: %w", symbol, resolution, ctx.Err())
+		default:
+		}
+
+		status := progress.Status(chunkType, key)
+		if status == db2.ProgressStaged {
+			continue
+		}
+
+		var candles api.CandlesResponse
+		var ok bool
+		if status == db2.ProgressLoaded {
+			if loaded == nil {
+				loaded, err = queryLoadedCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candleKey(key, resolution))
+				if err != nil {
+					return failed, fmt.Errorf("failed to query previously loaded stock candles %q (%s): %w", symbol, resolution, err)
+				}
+			}
+
+			candles, ok = chunk.find(loaded)
+			if ok {
+				util.Logf(ctx, logging.Debug, "resuming with %d stock candles previously loaded into src schema: %s (%s) for %v — %v", len(candles.Response.T), symbol, resolution, chunk.From, chunk.To)
+			}
+		}
+
+		if !ok {
+			candles, err = requestCandleRange(backoffContext(ctx, 5*time.Minute), key.Exchange, symbol, resolution, api.From(chunk.From), api.To(chunk.To))
+			switch {
+			case err == nil:
+			case abortOnRequestError(err):
+				return failed, fmt.Errorf("failed to retrieve stock candles %q (%s) from provider: %w", symbol, resolution, err)
+			case errors.Is(err, api.ErrNotFound):
+				util.Logf(ctx, logging.Info, "no stock candles %q (%s) for %v — %v from provider", symbol, resolution, chunk.From, chunk.To)
+				err = saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key, chunkType, db2.ProgressStaged)
+				if err != nil {
+					return failed, fmt.Errorf("failed to save stock candles %q (%s) progress: %w", symbol, resolution, err)
+				}
+				continue
+			default:
+				util.Logf(ctx, requestErrorSeverity(err, logging.Error), "failed to retrieve stock candles %q (%s) for %v — %v from provider: %v", symbol, resolution, chunk.From, chunk.To, err)
+				failed++
+				continue
+			}
+
+			err = saveCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candles)
+			if err != nil {
+				return failed, fmt.Errorf("failed to load stock candles %q (%s) into database: %w", symbol, resolution, err)
+			}
+			atomic.AddInt64(&stats(ctx).CandlesLoaded, int64(len(candles.Response.T)))
+
+			err = saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key, chunkType, db2.ProgressLoaded)
+			if err != nil {
+				return failed, fmt.Errorf("failed to save stock candles %q (%s) progress: %w", symbol, resolution, err)
+			}
+		}
+
+		info, err := stageCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candles)
+		if err != nil {
+			return failed, fmt.Errorf("failed to stage candles for symbol %s (%s): %w", symbol, resolution, err)
+		}
+		util.Logf(ctx, logging.Info, "successfully backfilled %d candles for symbol %s (%s) from %v to %v", info.RowsStaged, symbol, resolution, chunk.From, chunk.To)
+		addStagingInfo(&stats(ctx).CandlesStaged, &stats(ctx).CandlesModified, info)
+		atomic.AddInt64(&stats(ctx).CandlesRejected, info.RowsRejected)
+		atomic.AddInt64(&stats(ctx).CandlesFlagged, info.RowsFlagged)
+
+		err = saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key, chunkType, db2.ProgressStaged)
+		if err != nil {
+			return failed, fmt.Errorf("failed to save stock candles %q (%s) progress: %w", symbol, resolution, err)
+		}
+	}
+
+	// the 52 week candles only depend on which candles this job run staged,
+	// not on the chunk that staged them
+	series := api.CandlesResponse{Request: api.CandlesRequest{Exchange: key.Exchange, Symbol: symbol, Resolution: resolution}}
+
+	var wkCtx = util.WithLoggerValue(ctx, "type", "52wk_candle")
+	info, err := stage52WkCandles(backoffContext(wkCtx, 30*time.Minute), jobRunId, pool, series)
+	if err != nil {
+		return failed, fmt.Errorf("failed to stage 52wk candles: %w", err)
+	}
+	util.Logf(wkCtx, logging.Info, "successfully staged %d 52wk candles (%d rows modified)", info.RowsStaged, info.RowsModified)
+	addStagingInfo(&stats(ctx).Candles52WkStaged, &stats(ctx).Candles52WkModified, info)
+
+	var indicatorCtx = util.WithLoggerValue(ctx, "type", "indicator")
+	info, err = stageIndicators(backoffContext(indicatorCtx, 5*time.Minute), jobRunId, pool, candleKey(key, resolution))
+	if err != nil {
+		return failed, fmt.Errorf("failed to stage indicators: %w", err)
+	}
+	util.Logf(indicatorCtx, logging.Info, "successfully staged %d indicator values (%d rows modified)", info.RowsStaged, info.RowsModified)
+	addStagingInfo(&stats(ctx).IndicatorsStaged, &stats(ctx).IndicatorsModified, info)
+
+	gaps, err := detectCandleGaps(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candleKey(key, resolution))
+	if err != nil {
+		return failed, fmt.Errorf("failed to detect candle gaps for symbol %s (%s): %w", symbol, resolution, err)
+	}
+	if gaps.GapsDetected > 0 {
+		util.Logf(ctx, logging.Warning, "%d trading sessions are missing from the candles of symbol %s (%s)", gaps.GapsDetected, symbol, resolution)
+	}
+	atomic.AddInt64(&stats(ctx).CandleGapsDetected, gaps.GapsDetected)
+	atomic.AddInt64(&stats(ctx).CandleGapsFilled, gaps.GapsFilled)
+
+	if failed > 0 {
+		return failed, nil
+	}
+
+	err = saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key, dataType, db2.ProgressStaged)
+	if err != nil {
+		return failed, fmt.Errorf("failed to save stock candles %q (%s) progress: %w", symbol, resolution, err)
+	}
+	return 0, nil
+}
+
+func init() {
+	rootCmd.AddCommand(backfillCmd)
+	backfillCmd.Flags().String("from", "", "first day to backfill, e.g. 1990-01-02")
+	backfillCmd.Flags().String("to", "", "last day to backfill (default yesterday)")
+	backfillCmd.Flags().StringSlice("symbols", nil, "comma-separated symbols to backfill")
+	backfillCmd.Flags().Bool("all", false, "backfill every staged stock of the exchange instead of --symbols")
+	backfillCmd.Flags().String("exchange", string(defaultExchange), "exchange of the symbols")
+	backfillCmd.Flags().StringSlice("resolutions", nil, "candle resolutions to backfill (default the configured resolutions)")
+	backfillCmd.Flags().Uint64("resume", 0, "id of a failed backfill job run to resume instead of starting a new one")
+	backfillCmd.Flags().Bool("wait-for-lock", false, "wait for a concurrent job run to finish instead of failing")
+}
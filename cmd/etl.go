@@ -19,12 +19,20 @@ package cmd
 import (
 	"cloud.google.com/go/logging"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ajjensen13/stocker/internal/api"
+	db2 "github.com/ajjensen13/stocker/internal/db"
+	"github.com/ajjensen13/stocker/internal/fixture"
+	"github.com/ajjensen13/stocker/internal/indicator"
 	"github.com/ajjensen13/stocker/internal/util"
 	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"golang.org/x/sync/errgroup"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -36,6 +44,11 @@ const (
 	apiSecretName = "stocker-api-secret.json"
 )
 
+const (
+	etlJobDefinition      = "Finnhub ETL"
+	backfillJobDefinition = "Finnhub Backfill"
+)
+
 // etlCmd represents the etl command
 var etlCmd = &cobra.Command{
 	Use:   "etl",
@@ -69,64 +82,343 @@ func runEtl(ctx context.Context, cmd *cobra.Command) error {
 	}
 	defer poolCleanup()
 
-	jobRunId, err := startJob(ctx, pool)
+	waitForLock, err := cmd.Flags().GetBool("wait-for-lock")
+	if err != nil {
+		return fmt.Errorf("failed to read wait-for-lock flag: %w", err)
+	}
+
+	includeDelisted, err := cmd.Flags().GetBool("include-delisted")
+	if err != nil {
+		return fmt.Errorf("failed to read include-delisted flag: %w", err)
+	}
+
+	refreshProfiles, err := cmd.Flags().GetBool("refresh-profiles")
+	if err != nil {
+		return fmt.Errorf("failed to read refresh-profiles flag: %w", err)
+	}
+
+	resumeJobRunId, err := cmd.Flags().GetUint64("resume")
+	if err != nil {
+		return fmt.Errorf("failed to read resume flag: %w", err)
+	}
+
+	exchanges, err := stockExchanges()
+	if err != nil {
+		return err
+	}
+
+	end, err := candleEndDate()
+	if err != nil {
+		return err
+	}
+
+	err = loadTradingCalendars(ctx, pool, exchanges, time.Time(end))
+	if err != nil {
+		return err
+	}
+
+	if resumeJobRunId > 0 && (cmd.Flags().Changed("skip") || cmd.Flags().Changed("limit")) {
+		return errors.New("--skip and --limit cannot be combined with --resume; a resumed job run keeps its symbol window")
+	}
+
+	var window symbolWindow
+	if resumeJobRunId > 0 {
+		window, err = lookupResumableJob(ctx, pool, etlJobDefinition, resumeJobRunId)
+	} else {
+		window, err = symbolWindowFromFlags(cmd)
+	}
+	if err != nil {
+		return err
+	}
+
+	// a job run of all symbols locks the whole job definition, shards lock it
+	// shared and lock their own window
+	mode := lockExclusive
+	if window.sharded() {
+		mode = lockShared
+	}
+
+	lock, err := lockJob(ctx, pool, etlJobDefinition, jobLockKey, mode, waitForLock)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock(ctx)
+
+	windowLock := lock
+	if window.sharded() {
+		windowLock, err = lockJob(ctx, pool, etlJobDefinition, window.lockKey(exchanges), lockExclusive, waitForLock)
+		if err != nil {
+			return err
+		}
+		defer windowLock.unlock(ctx)
+	}
+
+	var jobRunId uint64
+	if resumeJobRunId > 0 {
+		jobRunId = resumeJobRunId
+		err = resumeJob(ctx, pool, jobRunId)
+	} else {
+		jobRunId, err = startJob(ctx, pool, etlJobDefinition, window)
+	}
 	if err != nil {
 		return err
 	}
 
 	ctx = util.WithLoggerValue(ctx, "job_run_id", fmt.Sprintf("job_run_%d", jobRunId))
 
+	err = windowLock.setOwner(ctx, jobRunId)
+	if err != nil {
+		return err
+	}
+
+	progress, err := queryProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool)
+	if err != nil {
+		return fmt.Errorf("failed to get job run progress: %w", err)
+	}
+
+	concurrency, err := workerConcurrency()
+	if err != nil {
+		return err
+	}
+
+	resolutions, err := candleResolutions()
+	if err != nil {
+		return err
+	}
+
+	corporateActions, err := corporateActionKinds()
+	if err != nil {
+		return err
+	}
+
+	runStats := &jobRunStats{}
+	ctx = withJobRunStats(ctx, runStats)
+
 	grp, grpCtx := errgroup.WithContext(ctx)
 	grp.Go(func() error {
-		stocks, err := processStocks(grpCtx, jobRunId, pool)
+		listed, delisted, err := processStocks(grpCtx, jobRunId, pool, exchanges, window, includeDelisted)
+		if err != nil {
+			return err
+		}
+
+		stocks, err := processSymbolWindow(grpCtx, jobRunId, pool, window, listed, delisted)
 		if err != nil {
 			return err
 		}
 
 		grp.Go(func() error {
-			return processCandles(grpCtx, jobRunId, pool, stocks)
+			return processCandles(grpCtx, jobRunId, pool, stocks, progress, concurrency, resolutions, corporateActions)
 		})
 
 		grp.Go(func() error {
-			return processCompanyProfiles(grpCtx, jobRunId, pool, stocks)
+			return processCompanyProfiles(grpCtx, jobRunId, pool, stocks, progress, concurrency, refreshProfiles)
 		})
 
 		return nil
 	})
 
 	errWait := grp.Wait()
-	errEnd := endJob(ctx, pool, jobRunId, errWait == nil)
+	errEnd := endJob(ctx, pool, jobRunId, runStats, errWait)
 	if errEnd != nil {
 		util.Logf(ctx, logging.Error, errEnd.Error())
 	}
 	return errWait
 }
 
-func cleanupSrcSchema(ctx context.Context, pool *pgxpool.Pool) error {
-	for _, table := range []string{"stocks", "company_profiles", "candles"} {
-		_, err := pool.Exec(ctx, fmt.Sprintf("truncate table src.%s", table))
+// loadTradingCalendars loads the trading calendar files whose version is not
+// loaded yet. It warns about each of exchanges whose calendar ends before
+// end, because the gaps of the candles after it are not detected.
+func loadTradingCalendars(ctx context.Context, pool *pgxpool.Pool, exchanges Exchanges, end time.Time) error {
+	calendars, err := tradingCalendars()
+	if err != nil {
+		return err
+	}
+
+	for _, cal := range calendars {
+		loaded, err := loadTradingCalendar(backoffContext(ctx, time.Minute), pool, cal)
 		if err != nil {
-			return fmt.Errorf("failed to truncate src.%s: %w", table, err)
+			return fmt.Errorf("failed to load trading calendar of exchange %s: %w", cal.Exchange, err)
+		}
+		if loaded {
+			util.Logf(ctx, logging.Info, "loaded version %s of the trading calendar of exchange %s", cal.Version, cal.Exchange)
+		}
+
+		for _, exchange := range exchanges {
+			if api.Exchange(exchange) == cal.Exchange && !cal.Covers(end) {
+				util.Logf(ctx, logging.Warning, "trading calendar %s of exchange %s only covers sessions up to %v: gaps in the candles up to %v are not detected until a newer version is loaded", cal.Version, cal.Exchange, cal.CoveredTo, end.Format("2006-01-02"))
+			}
 		}
 	}
 	return nil
 }
 
-func startJob(ctx context.Context, pool *pgxpool.Pool) (jobRunId uint64, err error) {
-	err = cleanupSrcSchema(ctx, pool)
+// cleanupSrcSchema deletes the src data of job run jobRunId. It is only
+// needed to resume a job run, so it is deleted once the job run succeeds.
+// The src data of other job runs is left alone, so failed job runs of other
+// shards or job definitions can still be resumed.
+func cleanupSrcSchema(ctx context.Context, pool *pgxpool.Pool, jobRunId uint64) error {
+	for _, table := range []string{"stocks", "company_profiles", "candles", "splits", "dividends"} {
+		_, err := pool.Exec(ctx, fmt.Sprintf("DELETE FROM src.%s WHERE job_run_id = $1", table), jobRunId)
+		if err != nil {
+			return fmt.Errorf("failed to clean up src.%s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+var errJobLocked = errors.New("job is locked by another job run")
+
+// jobLockKey is the key of the job lock on the whole job definition. A job
+// run that processes all symbols holds it exclusively. Shards hold it shared,
+// so they can run concurrently with each other but not with a job run that
+// processes all symbols.
+const jobLockKey = "job"
+
+type lockMode int
+
+const (
+	lockExclusive lockMode = iota
+	lockShared
+)
+
+// jobLock is a postgres session-level advisory lock on a job definition and
+// a lock key, e.g. the symbol window of an etl shard. It keeps two job runs
+// from processing the same symbols at the same time, while the shards of a
+// job can run concurrently. The lock is held for as long as conn is
+// acquired. Exclusive locks are recorded in metadata.job_lock.
+type jobLock struct {
+	conn            *pgxpool.Conn
+	jobDefinitionId uint64
+	key             string
+	mode            lockMode
+}
+
+func lockJob(ctx context.Context, pool *pgxpool.Pool, jobDefinition string, key string, mode lockMode, wait bool) (*jobLock, error) {
+	ctx = util.WithLoggerValue(ctx, "lock_key", key)
+
+	lockFunc, tryLockFunc := "pg_advisory_lock", "pg_try_advisory_lock"
+	if mode == lockShared {
+		lockFunc, tryLockFunc = "pg_advisory_lock_shared", "pg_try_advisory_lock_shared"
+	}
+
+	conn, err := pool.Acquire(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to cleanup src schema: %w", err)
+		return nil, fmt.Errorf("failed to aquire connection for job lock: %w", err)
 	}
-	util.Logf(ctx, logging.Debug, "successfully cleaned up the src schema")
 
 	var did uint64
-	row := pool.QueryRow(ctx, `SELECT id FROM metadata.job_definition WHERE name = 'Finnhub ETL'`)
+	err = conn.QueryRow(ctx, `SELECT id FROM metadata.job_definition WHERE name = $1`, jobDefinition).Scan(&did)
+	if err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("failed to determine job definition id: %w", err)
+	}
+
+	if wait {
+		util.Logf(ctx, logging.Info, "waiting for job lock")
+		_, err = conn.Exec(ctx, fmt.Sprintf(`SELECT %s($1::integer, hashtext($2))`, lockFunc), did, key)
+		if err != nil {
+			conn.Release()
+			return nil, fmt.Errorf("failed to wait for job lock: %w", err)
+		}
+	} else {
+		var locked bool
+		err = conn.QueryRow(ctx, fmt.Sprintf(`SELECT %s($1::integer, hashtext($2))`, tryLockFunc), did, key).Scan(&locked)
+		if err != nil {
+			conn.Release()
+			return nil, fmt.Errorf("failed to acquire job lock: %w", err)
+		}
+
+		if !locked {
+			// the lock on the whole job definition is held shared by shards,
+			// which are only recorded under the key of their window
+			var ownerKey string
+			var owner *uint64
+			err = conn.QueryRow(ctx, `
+				SELECT lock_key, job_run_id 
+				FROM metadata.job_lock 
+				WHERE job_definition_id = $1 AND (lock_key = $2 OR $2 = $3) 
+				ORDER BY lock_key = $2 DESC, acquired 
+				LIMIT 1`, did, key, jobLockKey).Scan(&ownerKey, &owner)
+			conn.Release()
+			switch {
+			case errors.Is(err, pgx.ErrNoRows):
+				return nil, fmt.Errorf("%w: %s", errJobLocked, key)
+			case err != nil:
+				return nil, fmt.Errorf("%w: failed to determine lock owner: %v", errJobLocked, err)
+			case owner == nil:
+				return nil, fmt.Errorf("%w: %s", errJobLocked, ownerKey)
+			default:
+				return nil, fmt.Errorf("%w: job_run_%d holds %s", errJobLocked, *owner, ownerKey)
+			}
+		}
+	}
+
+	if mode == lockShared {
+		util.Logf(ctx, logging.Debug, "acquired shared job lock")
+		return &jobLock{conn: conn, jobDefinitionId: did, key: key, mode: mode}, nil
+	}
+
+	_, err = conn.Exec(ctx, `
+		INSERT INTO metadata.job_lock (job_definition_id, lock_key, job_run_id, acquired) 
+		VALUES ($1, $2, NULL, CURRENT_TIMESTAMP) 
+		ON CONFLICT (job_definition_id, lock_key) 
+		DO UPDATE SET job_run_id = NULL, acquired = excluded.acquired`, did, key)
+	if err != nil {
+		l := &jobLock{conn: conn, jobDefinitionId: did, key: key, mode: mode}
+		l.unlock(ctx)
+		return nil, fmt.Errorf("failed to record job lock: %w", err)
+	}
+
+	util.Logf(ctx, logging.Debug, "acquired job lock")
+	return &jobLock{conn: conn, jobDefinitionId: did, key: key, mode: mode}, nil
+}
+
+func (l *jobLock) setOwner(ctx context.Context, jobRunId uint64) error {
+	if l.mode == lockShared {
+		return nil
+	}
+
+	_, err := l.conn.Exec(ctx, `UPDATE metadata.job_lock SET job_run_id = $1 WHERE job_definition_id = $2 AND lock_key = $3`, jobRunId, l.jobDefinitionId, l.key)
+	if err != nil {
+		return fmt.Errorf("failed to record job lock owner: %w", err)
+	}
+	return nil
+}
+
+func (l *jobLock) unlock(ctx context.Context) {
+	defer l.conn.Release()
+
+	// ctx may already be canceled, but the lock still needs to be released
+	ctx, cancel := context.WithTimeout(util.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+
+	unlockFunc := "pg_advisory_unlock"
+	if l.mode == lockShared {
+		unlockFunc = "pg_advisory_unlock_shared"
+	} else {
+		_, err := l.conn.Exec(ctx, `DELETE FROM metadata.job_lock WHERE job_definition_id = $1 AND lock_key = $2`, l.jobDefinitionId, l.key)
+		if err != nil {
+			util.Logf(ctx, logging.Warning, "failed to clear job lock owner: %v", err)
+		}
+	}
+
+	_, err := l.conn.Exec(ctx, fmt.Sprintf(`SELECT %s($1::integer, hashtext($2))`, unlockFunc), l.jobDefinitionId, l.key)
+	if err != nil {
+		util.Logf(ctx, logging.Warning, "failed to release job lock: %v", err)
+		return
+	}
+	util.Logf(ctx, logging.Debug, "released job lock")
+}
+
+func startJob(ctx context.Context, pool *pgxpool.Pool, jobDefinition string, window symbolWindow) (jobRunId uint64, err error) {
+	var did uint64
+	row := pool.QueryRow(ctx, `SELECT id FROM metadata.job_definition WHERE name = $1`, jobDefinition)
 	err = row.Scan(&did)
 	if err != nil {
 		return 0, fmt.Errorf("failed to determine job definition id: %w", err)
 	}
 
-	row = pool.QueryRow(ctx, `INSERT INTO metadata.job_run (job_definition_id) VALUES ($1) RETURNING id`, did)
+	row = pool.QueryRow(ctx, `INSERT INTO metadata.job_run (job_definition_id, symbol_skip, symbol_limit, started) VALUES ($1, $2, $3, CURRENT_TIMESTAMP) RETURNING id`, did, window.skipOrNil(), window.limitOrNil())
 	err = row.Scan(&jobRunId)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create new job run: %w", err)
@@ -135,79 +427,435 @@ func startJob(ctx context.Context, pool *pgxpool.Pool) (jobRunId uint64, err err
 	return jobRunId, nil
 }
 
-func endJob(ctx context.Context, pool *pgxpool.Pool, jobRunId uint64, success bool) error {
-	_, err := pool.Exec(ctx, `UPDATE metadata.job_run SET success = $1 WHERE id = $2`, success, jobRunId)
+// lookupResumableJob checks that job run jobRunId of jobDefinition failed
+// and returns its symbol window. A failed job run keeps its src data, so it
+// can be resumed no matter which job runs were started since.
+func lookupResumableJob(ctx context.Context, pool *pgxpool.Pool, jobDefinition string, jobRunId uint64) (window symbolWindow, err error) {
+	var success *bool
+	var skip, limit *int
+	row := pool.QueryRow(ctx, `
+		SELECT 
+			job_run.success, 
+			job_run.symbol_skip, 
+			job_run.symbol_limit
+		FROM metadata.job_run
+		JOIN metadata.job_definition
+			ON job_run.job_definition_id = job_definition.id
+		WHERE 
+			job_run.id = $1
+			AND job_definition.name = $2`, jobRunId, jobDefinition)
+	err = row.Scan(&success, &skip, &limit)
+	if err != nil {
+		return symbolWindow{}, fmt.Errorf("failed to look up job run %d to resume: %w", jobRunId, err)
+	}
+
+	if success != nil && *success {
+		return symbolWindow{}, fmt.Errorf("job run %d already completed successfully", jobRunId)
+	}
+
+	window = symbolWindow{Skip: -1, Limit: -1}
+	if skip != nil {
+		window.Skip = *skip
+	}
+	if limit != nil {
+		window.Limit = *limit
+	}
+	return window, nil
+}
+
+// resumeJob prepares job run jobRunId, which was checked by
+// lookupResumableJob, to be resumed. It fails if the job run completed in
+// the meantime.
+func resumeJob(ctx context.Context, pool *pgxpool.Pool, jobRunId uint64) error {
+	r, err := pool.Exec(ctx, `UPDATE metadata.job_run SET success = NULL, resumed = CURRENT_TIMESTAMP, finished = NULL, error = NULL, attempts = attempts + 1, modified = CURRENT_TIMESTAMP WHERE id = $1 AND success IS NOT TRUE`, jobRunId)
+	if err != nil {
+		return fmt.Errorf("failed to reset job run %d: %w", jobRunId, err)
+	}
+	if r.RowsAffected() == 0 {
+		return fmt.Errorf("job run %d already completed successfully", jobRunId)
+	}
+
+	util.Logf(ctx, logging.Notice, "resuming job run %d", jobRunId)
+	return nil
+}
+
+func endJob(ctx context.Context, pool *pgxpool.Pool, jobRunId uint64, runStats *jobRunStats, runErr error) error {
+	ctx = util.WithoutCancel(ctx)
+
+	err := saveJobRunStats(ctx, pool, jobRunId, runStats)
+	if err != nil {
+		return err
+	}
+
+	var errMsg *string
+	if runErr != nil {
+		msg := runErr.Error()
+		errMsg = &msg
+	}
+
+	_, err = pool.Exec(ctx, `UPDATE metadata.job_run SET success = $1, error = $2, finished = CURRENT_TIMESTAMP, modified = CURRENT_TIMESTAMP WHERE id = $3`, runErr == nil, errMsg, jobRunId)
 	if err != nil {
 		return fmt.Errorf("failed to update job_run.success: %w", err)
 	}
 
+	if runErr != nil {
+		return nil
+	}
+
+	err = cleanupSrcSchema(ctx, pool, jobRunId)
+	if err != nil {
+		return fmt.Errorf("failed to clean up src schema: %w", err)
+	}
+	util.Logf(ctx, logging.Debug, "successfully cleaned up the src schema")
 	return nil
 }
 
-func processStocks(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool) (api.StocksResponse, error) {
+// stocksLockKey is the key of the job lock that shards hold while they stage
+// stocks. Every shard stages the full listing of its exchanges, marks the
+// stocks missing from it as delisted and records their history, so shards
+// take turns instead of writing the same stage.stocks rows at once. Staging
+// a listing that another shard already staged does not modify any rows.
+const stocksLockKey = "stocks"
+
+// processStocks loads and stages the stocks of exchanges. It returns the
+// stocks that are currently listed and, if includeDelisted is set, the
+// delisted ones. The stocks of a sharded window are staged under the
+// stocks lock.
+func processStocks(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, exchanges Exchanges, window symbolWindow, includeDelisted bool) (listed []api.Stock, delisted []api.Stock, err error) {
 	ctx = util.WithLoggerValue(ctx, "action", "process")
 	ctx = util.WithLoggerValue(ctx, "type", "stock")
 
-	stocks, err := requestStocks(backoffContext(ctx, 5*time.Minute))
-	if err != nil {
-		return api.StocksResponse{}, fmt.Errorf("failed to retrieve stocks from finnhub: %w", err)
+	if window.sharded() {
+		lock, err := lockJob(ctx, pool, etlJobDefinition, stocksLockKey, lockExclusive, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer lock.unlock(ctx)
+
+		err = lock.setOwner(ctx, jobRunId)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
-	util.Logf(ctx, logging.Info, "successfully received %d stocks from finnhub", len(stocks.Response))
 
-	err = saveStocks(backoffContext(ctx, 5*time.Minute), jobRunId, pool, stocks)
-	if err != nil {
-		return api.StocksResponse{}, fmt.Errorf("failed to load stocks into database: %w", err)
+	for _, exchange := range exchanges {
+		stocks, err := processExchangeStocks(util.WithLoggerValue(ctx, "exchange", exchange), jobRunId, pool, api.Exchange(exchange))
+		if err != nil {
+			return nil, nil, err
+		}
+		listed = append(listed, stocks.Response...)
 	}
-	util.Logf(ctx, logging.Info, "successfully loaded %d stocks into src schema", len(stocks.Response))
 
 	info, err := stageStocks(backoffContext(ctx, 5*time.Minute), jobRunId, pool)
 	if err != nil {
-		return api.StocksResponse{}, fmt.Errorf("failed to stage stocks: %w", err)
+		return nil, nil, fmt.Errorf("failed to stage stocks: %w", err)
 	}
 	util.Logf(ctx, logging.Info, "successfully staged %d stocks into stage schema (%d rows modified)", info.RowsStaged, info.RowsModified)
+	addStagingInfo(&stats(ctx).StocksStaged, &stats(ctx).StocksModified, info)
+
+	if !includeDelisted {
+		return listed, nil, nil
+	}
+
+	for _, exchange := range exchanges {
+		stocks, err := queryDelistedStocks(backoffContext(ctx, 5*time.Minute), pool, api.Exchange(exchange))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to query delisted %s stocks: %w", exchange, err)
+		}
+		util.Logf(ctx, logging.Info, "found %d delisted %s stocks", len(stocks), exchange)
+		delisted = append(delisted, stocks...)
+	}
+
+	return listed, delisted, nil
+}
+
+// processExchangeStocks loads the stocks of exchange into the src schema,
+// unless a resumed job run already loaded them.
+func processExchangeStocks(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, exchange api.Exchange) (api.StocksResponse, error) {
+	stocks, err := queryLoadedStocks(backoffContext(ctx, 5*time.Minute), jobRunId, pool, exchange)
+	if err != nil {
+		return api.StocksResponse{}, fmt.Errorf("failed to query previously loaded %s stocks: %w", exchange, err)
+	}
+
+	if len(stocks.Response) > 0 {
+		util.Logf(ctx, logging.Info, "resuming with %d %s stocks previously loaded into src schema", len(stocks.Response), exchange)
+		return stocks, nil
+	}
+
+	stocks, err = requestStocks(backoffContext(ctx, 5*time.Minute), exchange)
+	if err != nil {
+		return api.StocksResponse{}, fmt.Errorf("failed to retrieve %s stocks from provider: %w", exchange, err)
+	}
+	util.Logf(ctx, logging.Info, "successfully received %d %s stocks from provider", len(stocks.Response), exchange)
+	atomic.AddInt64(&stats(ctx).StocksFetched, int64(len(stocks.Response)))
+
+	err = saveStocks(backoffContext(ctx, 5*time.Minute), jobRunId, pool, stocks)
+	if err != nil {
+		return api.StocksResponse{}, fmt.Errorf("failed to load %s stocks into database: %w", exchange, err)
+	}
+	util.Logf(ctx, logging.Info, "successfully loaded %d %s stocks into src schema", len(stocks.Response), exchange)
 
 	return stocks, nil
 }
 
-func processCompanyProfiles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, stocks api.StocksResponse) error {
+// stockKey returns the key identifying stock across exchanges.
+func stockKey(stock api.Stock) db2.StockKey {
+	return db2.StockKey{Exchange: stock.Exchange, Symbol: api.Symbol(stock.Symbol)}
+}
+
+func candleKey(key db2.StockKey, resolution api.Resolution) db2.CandleKey {
+	return db2.CandleKey{Exchange: key.Exchange, Symbol: key.Symbol, Resolution: resolution}
+}
+
+// symbolWindow selects a deterministic subset of the symbol universe so
+// that a single exchange can be sharded across several jobs.
+type symbolWindow struct {
+	Skip  int
+	Limit int
+}
+
+func symbolWindowFromFlags(cmd *cobra.Command) (symbolWindow, error) {
+	skip, err := cmd.Flags().GetInt("skip")
+	if err != nil {
+		return symbolWindow{}, fmt.Errorf("failed to read skip flag: %w", err)
+	}
+
+	limit, err := cmd.Flags().GetInt("limit")
+	if err != nil {
+		return symbolWindow{}, fmt.Errorf("failed to read limit flag: %w", err)
+	}
+
+	return symbolWindow{Skip: skip, Limit: limit}, nil
+}
+
+// lockKey returns the key of the job lock of the window. Job runs of the
+// same exchanges and window exclude each other; other windows, i.e. other
+// shards, can run concurrently.
+func (w symbolWindow) lockKey(exchanges Exchanges) string {
+	names := make([]string, len(exchanges))
+	for i, exchange := range exchanges {
+		names[i] = string(exchange)
+	}
+	sort.Strings(names)
+
+	skip, limit := w.Skip, w.Limit
+	if skip < 0 {
+		skip = 0
+	}
+	if limit < 0 {
+		limit = -1
+	}
+	return fmt.Sprintf("exchanges=%s skip=%d limit=%d", strings.Join(names, ","), skip, limit)
+}
+
+// sharded reports whether the window selects a subset of the symbols.
+func (w symbolWindow) sharded() bool {
+	return w.Skip > 0 || w.Limit >= 0
+}
+
+func (w symbolWindow) skipOrNil() *int {
+	if w.Skip < 0 {
+		return nil
+	}
+	return &w.Skip
+}
+
+func (w symbolWindow) limitOrNil() *int {
+	if w.Limit < 0 {
+		return nil
+	}
+	return &w.Limit
+}
+
+// contains reports whether the i-th stock, ordered by exchange and symbol,
+// is in the window.
+func (w symbolWindow) contains(i int) bool {
+	if w.Skip > 0 && i < w.Skip {
+		return false
+	}
+
+	skip := w.Skip
+	if skip < 0 {
+		skip = 0
+	}
+	return w.Limit < 0 || i < skip+w.Limit
+}
+
+// apply returns the listed stocks in the window, ordered by exchange and
+// symbol, and the delisted stocks that belong to it. Negative values for
+// skip and limit are ignored.
+//
+// The window only counts listed stocks, so the windows of the shards do not
+// shift as stocks are delisted. A delisted stock belongs to the window of
+// the first listed stock that is ordered after it, or to the window of the
+// last listed stock if there is none. This way every delisted stock is
+// processed by exactly one of a set of adjacent windows.
+func (w symbolWindow) apply(listed []api.Stock, delisted []api.Stock) (inListed []api.Stock, inDelisted []api.Stock) {
+	sorted := make([]api.Stock, len(listed))
+	copy(sorted, listed)
+	sort.Slice(sorted, func(i, j int) bool {
+		return stockLess(sorted[i], sorted[j])
+	})
+
+	for i, stock := range sorted {
+		if w.contains(i) {
+			inListed = append(inListed, stock)
+		}
+	}
+
+	for _, stock := range delisted {
+		i := sort.Search(len(sorted), func(i int) bool {
+			return stockLess(stock, sorted[i])
+		})
+		if i == len(sorted) && i > 0 {
+			i--
+		}
+		if w.contains(i) {
+			inDelisted = append(inDelisted, stock)
+		}
+	}
+
+	return inListed, inDelisted
+}
+
+// stockLess orders stocks by exchange and symbol.
+func stockLess(a, b api.Stock) bool {
+	if a.Exchange != b.Exchange {
+		return a.Exchange < b.Exchange
+	}
+	return a.Symbol < b.Symbol
+}
+
+// processSymbolWindow returns the listed and delisted stocks in window and
+// records its first and last listed stock in the job run.
+func processSymbolWindow(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, window symbolWindow, listed []api.Stock, delisted []api.Stock) ([]api.Stock, error) {
+	inListed, inDelisted := window.apply(listed, delisted)
+
+	var first, last *api.Stock
+	if l := len(inListed); l > 0 {
+		first, last = &inListed[0], &inListed[l-1]
+	}
+
+	_, err := pool.Exec(ctx, `UPDATE metadata.job_run SET exchange_first = $1, symbol_first = $2, exchange_last = $3, symbol_last = $4 WHERE id = $5`,
+		stockExchangeOrNil(first), stockSymbolOrNil(first), stockExchangeOrNil(last), stockSymbolOrNil(last), jobRunId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update job_run symbol window: %w", err)
+	}
+
+	if len(delisted) > 0 {
+		util.Logf(ctx, logging.Info, "including %d of %d delisted stocks", len(inDelisted), len(delisted))
+	}
+	util.Logf(ctx, logging.Info, "processing %d of %d stocks (skip: %d, limit: %d)", len(inListed), len(listed), window.Skip, window.Limit)
+	return append(inListed, inDelisted...), nil
+}
+
+func stockExchangeOrNil(stock *api.Stock) *string {
+	if stock == nil {
+		return nil
+	}
+	ret := string(stock.Exchange)
+	return &ret
+}
+
+func stockSymbolOrNil(stock *api.Stock) *string {
+	if stock == nil {
+		return nil
+	}
+	return &stock.Symbol
+}
+
+// processCompanyProfiles loads and stages the company profiles of the stocks
+// that are due according to the refresh policy, or of all stocks if
+// refreshAll is set.
+func processCompanyProfiles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, stocks []api.Stock, progress db2.Progress, concurrency Concurrency, refreshAll bool) error {
 	ctx = util.WithLoggerValue(ctx, "type", "company_profile")
 
-	success := 0
-	for _, stock := range stocks.Response {
-		ctx := util.WithLoggerValue(ctx, "symbol", stock.Symbol)
+	if !refreshAll {
+		policy, err := profileRefreshPolicy()
+		if err != nil {
+			return err
+		}
+
+		refreshes, err := queryProfileRefreshes(backoffContext(ctx, 5*time.Minute), pool)
+		if err != nil {
+			return fmt.Errorf("failed to get company profile refreshes: %w", err)
+		}
+
+		due := policy.Select(stocks, refreshes, time.Now())
+		util.Logf(ctx, logging.Info, "%d of %d company profiles are due for a refresh", len(due), len(stocks))
+		stocks = due
+	}
+
+	var success int64
+	err := forEachStock(ctx, concurrency, stocks, func(ctx context.Context, stock api.Stock) error {
+		ctx = util.WithLoggerValue(ctx, "exchange", stock.Exchange)
+		ctx = util.WithLoggerValue(ctx, "symbol", stock.Symbol)
 
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("aborting company profile request %q from finnhub: %w", stock.Symbol, ctx.Err())
+			return fmt.Errorf("aborting company profile request %q from provider: %w", stock.Symbol, ctx.Err())
 		default:
-			profile, err := requestCompanyProfile(backoffContext(ctx, 5*time.Minute), api.Symbol(stock.Symbol))
-			if err != nil {
-				util.Logf(ctx, logging.Warning, "failed to retrieve company profile %q from finnhub: %v", stock.Symbol, err)
-				continue
+			if progress.Status(db2.DataTypeCompanyProfile, stockKey(stock)) != db2.ProgressNone {
+				util.Logf(ctx, logging.Debug, "skipping %q company profile already loaded by this job run", stock.Symbol)
+				atomic.AddInt64(&success, 1)
+				return nil
 			}
-			util.Logf(ctx, logging.Debug, "successfully retrieved %q company profile from finnhub", stock.Symbol)
+
+			profile, err := requestCompanyProfile(backoffContext(ctx, 5*time.Minute), stock.Exchange, api.Symbol(stock.Symbol))
+			switch {
+			case err == nil:
+			case abortOnRequestError(err):
+				return fmt.Errorf("failed to retrieve company profile %q from provider: %w", stock.Symbol, err)
+			case errors.Is(err, api.ErrNotFound):
+				util.Logf(ctx, logging.Info, "no company profile %q from provider: %v", stock.Symbol, err)
+				err = saveProfileRefresh(backoffContext(ctx, 5*time.Minute), jobRunId, pool, stockKey(stock))
+				if err != nil {
+					return fmt.Errorf("failed to save company profile %q refresh: %w", stock.Symbol, err)
+				}
+				atomic.AddInt64(&stats(ctx).SymbolsSkipped, 1)
+				return nil
+			default:
+				util.Logf(ctx, requestErrorSeverity(err, logging.Warning), "failed to retrieve company profile %q from provider: %v", stock.Symbol, err)
+				atomic.AddInt64(&stats(ctx).SymbolsSkipped, 1)
+				return nil
+			}
+			util.Logf(ctx, logging.Debug, "successfully retrieved %q company profile from provider", stock.Symbol)
 
 			err = saveCompanyProfile(backoffContext(ctx, 5*time.Minute), jobRunId, pool, profile)
 			if err != nil {
 				return fmt.Errorf("failed to load company profile %q into database: %w", stock.Symbol, err)
 			}
 			util.Logf(ctx, logging.Debug, "successfully loaded %q company profile into src schema", stock.Symbol)
+			atomic.AddInt64(&stats(ctx).CompanyProfilesLoaded, 1)
+
+			err = saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, stockKey(stock), db2.DataTypeCompanyProfile, db2.ProgressLoaded)
+			if err != nil {
+				return fmt.Errorf("failed to save company profile %q progress: %w", stock.Symbol, err)
+			}
 
-			success++
+			atomic.AddInt64(&success, 1)
+			return nil
 		}
+	})
+	if err != nil {
+		return err
 	}
-	util.Logf(ctx, logging.Info, "successfully loaded %d of %d company profiles into src schema", success, len(stocks.Response))
+	util.Logf(ctx, logging.Info, "successfully loaded %d of %d company profiles into src schema", success, len(stocks))
 
 	info, err := stageCompanyProfiles(backoffContext(ctx, 5*time.Minute), jobRunId, pool)
 	if err != nil {
 		return fmt.Errorf("failed to stage company profiles: %w", err)
 	}
 	util.Logf(ctx, logging.Info, "successfully staged %d company profiles into stage schema (%d rows modified)", info.RowsStaged, info.RowsModified)
+	addStagingInfo(&stats(ctx).CompanyProfilesStaged, &stats(ctx).CompanyProfilesModified, info)
 
 	return nil
 }
 
-func processCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, stocks api.StocksResponse) error {
+// processCandles loads and stages the candles of stocks at each of the
+// resolutions. The corporate actions of a stock are processed first, so
+// that its candles are staged with up to date adjustment factors.
+func processCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, stocks []api.Stock, progress db2.Progress, concurrency Concurrency, resolutions Resolutions, corporateActions CorporateActions) error {
 	ctx = util.WithLoggerValue(ctx, "type", "candle")
 
 	latest, err := queryMostRecentCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool)
@@ -216,65 +864,473 @@ func processCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, st
 	}
 	util.Logf(ctx, logging.Info, "extracted %d existing candles from database", len(latest))
 
-	for _, stock := range stocks.Response {
-		ctx := util.WithLoggerValue(ctx, "symbol", stock.Symbol)
+	var latestActions db2.LatestCorporateActions
+	if len(corporateActions) > 0 {
+		latestActions, err = queryLatestCorporateActions(backoffContext(ctx, 5*time.Minute), pool)
+		if err != nil {
+			return fmt.Errorf("failed to get latest corporate actions: %w", err)
+		}
+	}
 
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("aborting candle request %q from finnhub: %w", stock.Symbol, ctx.Err())
-		default:
-			candles, err := requestCandles(backoffContext(ctx, 5*time.Minute), api.Symbol(stock.Symbol), latest)
+	return forEachStock(ctx, concurrency, stocks, func(ctx context.Context, stock api.Stock) error {
+		ctx = util.WithLoggerValue(ctx, "exchange", stock.Exchange)
+		ctx = util.WithLoggerValue(ctx, "symbol", stock.Symbol)
+
+		if len(corporateActions) > 0 {
+			err := processCorporateActions(ctx, jobRunId, pool, stockKey(stock), progress, corporateActions, latestActions[stockKey(stock)])
 			if err != nil {
-				util.Logf(ctx, logging.Error, "failed to retrieve stock candles %q from finnhub: %v", stock.Symbol, err)
-				continue
+				return err
 			}
+		}
 
-			err = saveCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candles)
+		for _, resolution := range resolutions {
+			err := processStockCandles(ctx, jobRunId, pool, stockKey(stock), api.Resolution(resolution), latest, progress)
 			if err != nil {
-				return fmt.Errorf("failed to load stock candles %q into database: %w", stock.Symbol, err)
+				return err
 			}
-			util.Logf(ctx, logging.Info, "requested & loaded %d stock candles from finnhub into database: %s", len(candles.Response.T), stock.Symbol)
+		}
+		return nil
+	})
+}
+
+// processCorporateActions loads and stages the splits and dividends of a
+// stock since the latest staged ones. A failed request is logged and does
+// not keep the candles of the stock from being processed, but the stock is
+// only marked as staged once every kind of corporate action was loaded, so
+// that a resumed job run requests the missing ones again.
+func processCorporateActions(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, key db2.StockKey, progress db2.Progress, corporateActions CorporateActions, latest db2.LatestCorporateActionDates) error {
+	ctx = util.WithLoggerValue(ctx, "type", "corporate_action")
+	symbol := key.Symbol
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("aborting corporate actions request %q from provider: %w", symbol, ctx.Err())
+	default:
+	}
+
+	if progress.Status(db2.DataTypeCorporateActions, key) == db2.ProgressStaged {
+		util.Logf(ctx, logging.Debug, "skipping %q corporate actions already staged by this job run", symbol)
+		return nil
+	}
 
-			info, err := stageCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candles)
+	complete := true
+	if corporateActions.contains(corporateActionSplits) {
+		splits, err := requestSplits(backoffContext(ctx, 5*time.Minute), key.Exchange, symbol, api.From(latest.Split))
+		switch {
+		case err == nil:
+			err = saveSplits(backoffContext(ctx, 5*time.Minute), jobRunId, pool, splits)
 			if err != nil {
-				return fmt.Errorf("failed to stage candles for symbol %s: %w", stock.Symbol, err)
+				return fmt.Errorf("failed to load splits %q into database: %w", symbol, err)
 			}
-			util.Logf(ctx, logging.Info, "successfully staged %d candles for symbol %s", info.RowsStaged, stock.Symbol)
+			atomic.AddInt64(&stats(ctx).CorporateActionsLoaded, int64(len(splits.Response)))
+		case abortOnRequestError(err):
+			return fmt.Errorf("failed to retrieve splits %q from provider: %w", symbol, err)
+		default:
+			util.Logf(ctx, requestErrorSeverity(err, logging.Warning), "failed to retrieve splits %q from provider: %v", symbol, err)
+			complete = false
+		}
+	}
 
-			var ctx = util.WithLoggerValue(ctx, "type", "52wk_candle")
-			info, err = stage52WkCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candles)
+	if corporateActions.contains(corporateActionDividends) {
+		dividends, err := requestDividends(backoffContext(ctx, 5*time.Minute), key.Exchange, symbol, api.From(latest.Dividend))
+		switch {
+		case err == nil:
+			err = saveDividends(backoffContext(ctx, 5*time.Minute), jobRunId, pool, dividends)
 			if err != nil {
-				return fmt.Errorf("failed to stage 52wk candles: %w", err)
+				return fmt.Errorf("failed to load dividends %q into database: %w", symbol, err)
 			}
-			util.Logf(ctx, logging.Info, "successfully staged %d 52wk candles (%d rows modified)", info.RowsStaged, info.RowsModified)
+			atomic.AddInt64(&stats(ctx).CorporateActionsLoaded, int64(len(dividends.Response)))
+		case abortOnRequestError(err):
+			return fmt.Errorf("failed to retrieve dividends %q from provider: %w", symbol, err)
+		default:
+			util.Logf(ctx, requestErrorSeverity(err, logging.Warning), "failed to retrieve dividends %q from provider: %v", symbol, err)
+			complete = false
+		}
+	}
+
+	if complete {
+		err := saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key, db2.DataTypeCorporateActions, db2.ProgressLoaded)
+		if err != nil {
+			return fmt.Errorf("failed to save corporate actions %q progress: %w", symbol, err)
 		}
 	}
+
+	info, err := stageCorporateActions(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key)
+	if err != nil {
+		return fmt.Errorf("failed to stage corporate actions for symbol %s: %w", symbol, err)
+	}
+	util.Logf(ctx, logging.Debug, "successfully staged %d corporate actions for symbol %s (%d rows modified)", info.RowsStaged, symbol, info.RowsModified)
+	addStagingInfo(&stats(ctx).CorporateActionsStaged, &stats(ctx).CorporateActionsModified, info)
+
+	if !complete {
+		return nil
+	}
+
+	err = saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key, db2.DataTypeCorporateActions, db2.ProgressStaged)
+	if err != nil {
+		return fmt.Errorf("failed to save corporate actions %q progress: %w", symbol, err)
+	}
+	return nil
+}
+
+func processStockCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, key db2.StockKey, resolution api.Resolution, latest db2.LatestCandles, progress db2.Progress) error {
+	ctx = util.WithLoggerValue(ctx, "resolution", resolution)
+	dataType := db2.CandleDataType(resolution)
+	symbol := key.Symbol
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("aborting candle request %q (%s) from provider: %w", symbol, resolution, ctx.Err())
+	default:
+	}
+
+	if progress.Status(dataType, key) == db2.ProgressStaged {
+		util.Logf(ctx, logging.Debug, "skipping %q stock candles (%s) already staged by this job run", symbol, resolution)
+		return nil
+	}
+
+	candles, ok, err := loadStockCandles(ctx, jobRunId, pool, key, resolution, latest, progress)
+	if err != nil || !ok {
+		return err
+	}
+
+	info, err := stageCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candles)
+	if err != nil {
+		return fmt.Errorf("failed to stage candles for symbol %s (%s): %w", symbol, resolution, err)
+	}
+	util.Logf(ctx, logging.Info, "successfully staged %d candles for symbol %s (%s)", info.RowsStaged, symbol, resolution)
+	addStagingInfo(&stats(ctx).CandlesStaged, &stats(ctx).CandlesModified, info)
+	atomic.AddInt64(&stats(ctx).CandlesRejected, info.RowsRejected)
+	atomic.AddInt64(&stats(ctx).CandlesFlagged, info.RowsFlagged)
+
+	var wkCtx = util.WithLoggerValue(ctx, "type", "52wk_candle")
+	info, err = stage52WkCandles(backoffContext(wkCtx, 5*time.Minute), jobRunId, pool, candles)
+	if err != nil {
+		return fmt.Errorf("failed to stage 52wk candles: %w", err)
+	}
+	util.Logf(wkCtx, logging.Info, "successfully staged %d 52wk candles (%d rows modified)", info.RowsStaged, info.RowsModified)
+	addStagingInfo(&stats(ctx).Candles52WkStaged, &stats(ctx).Candles52WkModified, info)
+
+	var indicatorCtx = util.WithLoggerValue(ctx, "type", "indicator")
+	info, err = stageIndicators(backoffContext(indicatorCtx, 5*time.Minute), jobRunId, pool, candleKey(key, resolution))
+	if err != nil {
+		return fmt.Errorf("failed to stage indicators: %w", err)
+	}
+	util.Logf(indicatorCtx, logging.Info, "successfully staged %d indicator values (%d rows modified)", info.RowsStaged, info.RowsModified)
+	addStagingInfo(&stats(ctx).IndicatorsStaged, &stats(ctx).IndicatorsModified, info)
+
+	gaps, err := detectCandleGaps(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candleKey(key, resolution))
+	if err != nil {
+		return fmt.Errorf("failed to detect candle gaps for symbol %s (%s): %w", symbol, resolution, err)
+	}
+	if gaps.GapsDetected > 0 {
+		util.Logf(ctx, logging.Warning, "%d trading sessions are missing from the candles of symbol %s (%s)", gaps.GapsDetected, symbol, resolution)
+	}
+	atomic.AddInt64(&stats(ctx).CandleGapsDetected, gaps.GapsDetected)
+	atomic.AddInt64(&stats(ctx).CandleGapsFilled, gaps.GapsFilled)
+
+	err = saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key, dataType, db2.ProgressStaged)
+	if err != nil {
+		return fmt.Errorf("failed to save stock candles %q (%s) progress: %w", symbol, resolution, err)
+	}
 	return nil
 }
 
+// loadStockCandles loads the candles of key at resolution into the src
+// schema. If a resumed job run already loaded them, they are read from the
+// src schema instead of being requested again. ok is false if the symbol is
+// skipped because neither the request nor the requests of its gaps returned
+// any candles.
+func loadStockCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, key db2.StockKey, resolution api.Resolution, latest db2.LatestCandles, progress db2.Progress) (candles api.CandlesResponse, ok bool, err error) {
+	dataType := db2.CandleDataType(resolution)
+	symbol := key.Symbol
+
+	if progress.Status(dataType, key) == db2.ProgressLoaded {
+		loaded, err := queryLoadedCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candleKey(key, resolution))
+		if err != nil {
+			return api.CandlesResponse{}, false, fmt.Errorf("failed to query previously loaded stock candles %q (%s): %w", symbol, resolution, err)
+		}
+
+		if len(loaded) > 0 {
+			candles = loaded[0]
+			for _, more := range loaded[1:] {
+				candles, err = mergeCandles(candles, more)
+				if err != nil {
+					return api.CandlesResponse{}, false, fmt.Errorf("failed to merge previously loaded stock candles %q (%s): %w", symbol, resolution, err)
+				}
+			}
+			util.Logf(ctx, logging.Debug, "resuming with %d stock candles previously loaded into src schema: %s (%s)", len(candles.Response.T), symbol, resolution)
+			return candles, true, nil
+		}
+	}
+
+	candles, err = requestCandles(backoffContext(ctx, 5*time.Minute), key.Exchange, symbol, resolution, latest)
+	switch {
+	case err == nil:
+		ok = true
+	case abortOnRequestError(err):
+		return api.CandlesResponse{}, false, fmt.Errorf("failed to retrieve stock candles %q (%s) from provider: %w", symbol, resolution, err)
+	default:
+		// the gaps are requested anyway, e.g. on weekends or for delisted
+		// stocks, when there are no new candles
+		util.Logf(ctx, requestErrorSeverity(err, logging.Error), "failed to retrieve stock candles %q (%s) from provider: %v", symbol, resolution, err)
+	}
+
+	candles, ok, err = requestCandleGaps(ctx, pool, key, resolution, candles, ok)
+	if err != nil {
+		return api.CandlesResponse{}, false, err
+	}
+	if !ok {
+		atomic.AddInt64(&stats(ctx).SymbolsSkipped, 1)
+		return api.CandlesResponse{}, false, nil
+	}
+
+	err = saveCandles(backoffContext(ctx, 5*time.Minute), jobRunId, pool, candles)
+	if err != nil {
+		return api.CandlesResponse{}, false, fmt.Errorf("failed to load stock candles %q (%s) into database: %w", symbol, resolution, err)
+	}
+	util.Logf(ctx, logging.Info, "requested & loaded %d stock candles from provider into database: %s (%s)", len(candles.Response.T), symbol, resolution)
+	atomic.AddInt64(&stats(ctx).CandlesLoaded, int64(len(candles.Response.T)))
+
+	err = saveProgress(backoffContext(ctx, 5*time.Minute), jobRunId, pool, key, dataType, db2.ProgressLoaded)
+	if err != nil {
+		return api.CandlesResponse{}, false, fmt.Errorf("failed to save stock candles %q (%s) progress: %w", symbol, resolution, err)
+	}
+	return candles, true, nil
+}
+
+// requestCandleGaps re-requests the gaps that earlier job runs detected in
+// the candles of key and adds their candles to candles. ok reports whether
+// candles holds a response; if not, the first gap that is received takes its
+// place. A failed request is logged; the gap is detected again and retried
+// by the next job run.
+func requestCandleGaps(ctx context.Context, pool *pgxpool.Pool, key db2.StockKey, resolution api.Resolution, candles api.CandlesResponse, ok bool) (api.CandlesResponse, bool, error) {
+	symbol := key.Symbol
+
+	gaps, err := queryCandleGaps(backoffContext(ctx, 5*time.Minute), pool, candleKey(key, resolution))
+	if err != nil {
+		return api.CandlesResponse{}, false, fmt.Errorf("failed to get candle gaps for symbol %s (%s): %w", symbol, resolution, err)
+	}
+
+	for _, gap := range gaps {
+		resp, err := requestCandleRange(backoffContext(ctx, 5*time.Minute), key.Exchange, symbol, resolution, api.From(gap.From), api.To(gap.To))
+		switch {
+		case err == nil:
+		case abortOnRequestError(err):
+			return api.CandlesResponse{}, false, fmt.Errorf("failed to retrieve stock candles %q (%s) from provider: %w", symbol, resolution, err)
+		default:
+			util.Logf(ctx, requestErrorSeverity(err, logging.Warning), "failed to retrieve stock candles %q (%s) for gap %v — %v from provider: %v", symbol, resolution, gap.From, gap.To, err)
+			continue
+		}
+
+		if !ok {
+			candles, ok = resp, true
+			continue
+		}
+
+		candles, err = mergeCandles(candles, resp)
+		if err != nil {
+			return api.CandlesResponse{}, false, fmt.Errorf("failed to merge stock candles %q (%s) for gap %v — %v: %w", symbol, resolution, gap.From, gap.To, err)
+		}
+	}
+
+	if len(gaps) > 0 {
+		util.Logf(ctx, logging.Info, "re-requested %d candle gaps of symbol %s (%s)", len(gaps), symbol, resolution)
+	}
+	return candles, ok, nil
+}
+
+// mergeCandles adds the candles of gap that are not in candles to candles,
+// and widens the requested range of candles to include gap, so that staging
+// the merged candles picks up the src rows of both.
+func mergeCandles(candles, gap api.CandlesResponse) (api.CandlesResponse, error) {
+	c, g := candles.Response, gap.Response
+	for _, r := range []api.Candles{c, g} {
+		l := len(r.T)
+		if len(r.O) != l || len(r.H) != l || len(r.L) != l || len(r.C) != l || len(r.V) != l {
+			return api.CandlesResponse{}, fmt.Errorf("candles have %d timestamps but %d/%d/%d/%d/%d values", l, len(r.O), len(r.H), len(r.L), len(r.C), len(r.V))
+		}
+	}
+
+	seen := make(map[int64]bool, len(c.T))
+	for _, t := range c.T {
+		seen[t] = true
+	}
+
+	ret := candles
+	ret.Response = api.Candles{
+		O: append([]float64(nil), c.O...),
+		H: append([]float64(nil), c.H...),
+		L: append([]float64(nil), c.L...),
+		C: append([]float64(nil), c.C...),
+		V: append([]float64(nil), c.V...),
+		T: append([]int64(nil), c.T...),
+		S: c.S,
+	}
+	for i, t := range g.T {
+		if seen[t] {
+			continue
+		}
+		ret.Response.O = append(ret.Response.O, g.O[i])
+		ret.Response.H = append(ret.Response.H, g.H[i])
+		ret.Response.L = append(ret.Response.L, g.L[i])
+		ret.Response.C = append(ret.Response.C, g.C[i])
+		ret.Response.V = append(ret.Response.V, g.V[i])
+		ret.Response.T = append(ret.Response.T, t)
+		ret.Response.S = "ok"
+	}
+
+	if time.Time(gap.Request.From).Before(time.Time(ret.Request.From)) {
+		ret.Request.From = gap.Request.From
+	}
+	if time.Time(gap.Request.To).After(time.Time(ret.Request.To)) {
+		ret.Request.To = gap.Request.To
+	}
+	return ret, nil
+}
+
+// abortOnRequestError reports whether a failed request for a single symbol
+// aborts the run instead of skipping the symbol. A rejected api key fails
+// every remaining request, and so does an endpoint that is not covered by
+// the plan, so there is no point in continuing.
+func abortOnRequestError(err error) bool {
+	switch {
+	case errors.Is(err, api.ErrUnauthorized):
+		return true
+	case errors.Is(err, api.ErrForbidden):
+		return true
+	case errors.Is(err, context.Canceled):
+		return true
+	default:
+		return false
+	}
+}
+
+// requestErrorSeverity returns the severity used to log a skipped symbol.
+// Symbols that are unknown or have no data in the requested range are
+// expected.
+func requestErrorSeverity(err error, def logging.Severity) logging.Severity {
+	switch {
+	case errors.Is(err, api.ErrNotFound):
+		return logging.Info
+	default:
+		return def
+	}
+}
+
+// forEachStock calls f for each stock using a pool of at most concurrency
+// workers. The first error returned by f cancels the context passed to the
+// remaining calls and is returned once all workers have stopped.
+func forEachStock(ctx context.Context, concurrency Concurrency, stocks []api.Stock, f func(ctx context.Context, stock api.Stock) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	grp, grpCtx := errgroup.WithContext(ctx)
+
+	queue := make(chan api.Stock)
+	grp.Go(func() error {
+		defer close(queue)
+		for _, stock := range stocks {
+			select {
+			case <-grpCtx.Done():
+				return nil
+			case queue <- stock:
+			}
+		}
+		return nil
+	})
+
+	for i := 0; i < int(concurrency); i++ {
+		grp.Go(func() error {
+			for stock := range queue {
+				err := f(grpCtx, stock)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	return grp.Wait()
+}
+
 type (
 	MigrationSourceURL string
 	Timezone           string
 	DataSourceName     string
 	Exchange           string
+	Exchanges          []Exchange
 	Resolution         string
+	Resolutions        []Resolution
+	BackfillChunkDays  map[Resolution]int
+	CorporateAction    string
+	CorporateActions   []CorporateAction
+	Concurrency        int
+	RequestsPerMinute  int
+	RequestBurst       int
+	ProviderName       string
+	ProviderDir        string
+	ApiBaseURL         string
+	CalendarDir        string
 )
 
 type appConfig struct {
-	Exchange           Exchange           `json:"exchange"`
-	Resolution         Resolution         `json:"resolution"`
-	StartDate          time.Time          `json:"startDate"`
-	EndDate            time.Time          `json:"endDate"`
-	DataSourceName     DataSourceName     `json:"dataSourceName"`
-	DbConnPoolConfig   dbConnPoolConfig   `json:"dbConnPoolConfig"`
-	Timezone           Timezone           `json:"timezone"`
-	MigrationSourceURL MigrationSourceURL `json:"migrationSourceUrl"`
+	Provider           ProviderName         `json:"provider"`
+	ProviderDir        ProviderDir          `json:"providerDir"`
+	ApiBaseURL         ApiBaseURL           `json:"apiBaseUrl"`
+	Fixtures           fixtureConfig        `json:"fixtures"`
+	Exchange           Exchange             `json:"exchange"`
+	Exchanges          Exchanges            `json:"exchanges"`
+	Resolution         Resolution           `json:"resolution"`
+	Resolutions        Resolutions          `json:"resolutions"`
+	CorporateActions   CorporateActions     `json:"corporateActions"`
+	CandleValidation   db2.CandleValidation `json:"candleValidation"`
+	CandleGaps         db2.CandleGapPolicy  `json:"candleGaps"`
+	CalendarDir        CalendarDir          `json:"calendarDir"`
+	BackfillChunkDays  BackfillChunkDays    `json:"backfillChunkDays"`
+	Indicators         indicator.Config     `json:"indicators"`
+	ProfileRefresh     profileRefreshConfig `json:"companyProfileRefresh"`
+	Stream             streamConfig         `json:"stream"`
+	StartDate          time.Time            `json:"startDate"`
+	EndDate            time.Time            `json:"endDate"`
+	DataSourceName     DataSourceName       `json:"dataSourceName"`
+	DbConnPoolConfig   dbConnPoolConfig     `json:"dbConnPoolConfig"`
+	Timezone           Timezone             `json:"timezone"`
+	MigrationSourceURL MigrationSourceURL   `json:"migrationSourceUrl"`
+	Concurrency        Concurrency          `json:"concurrency"`
+	RequestsPerMinute  RequestsPerMinute    `json:"requestsPerMinute"`
+	RequestBurst       RequestBurst         `json:"requestBurst"`
+}
+
+// fixtureConfig configures recording or replaying of api responses. See
+// package fixture.
+type fixtureConfig struct {
+	Mode fixture.Mode `json:"mode"`
+	Dir  string       `json:"dir"`
 }
 
 type appSecrets struct {
 	ApiKey string `json:"api_key"`
 }
 
+// profileRefreshConfig configures which company profiles are requested. See
+// db.ProfileRefreshPolicy.
+type profileRefreshConfig struct {
+	MaxAge   string  `json:"maxAge"`
+	Fraction float64 `json:"fraction"`
+}
+
+// streamConfig configures the stream command. See StreamSettings.
+type streamConfig struct {
+	URL           string   `json:"url"`
+	Exchange      Exchange `json:"exchange"`
+	Watchlist     []string `json:"watchlist"`
+	FlushInterval string   `json:"flushInterval"`
+	MaxLateness   string   `json:"maxLateness"`
+}
+
 type dbConnPoolConfig struct {
 	MaxConnLifetime   string `json:"maxConnLifetime"`
 	MaxConnIdleTime   string `json:"maxConnIdleTime"`
@@ -285,8 +1341,12 @@ type dbConnPoolConfig struct {
 
 func init() {
 	rootCmd.AddCommand(etlCmd)
-	etlCmd.Flags().IntP("skip", "s", -1, "number of stocks to skip")
-	etlCmd.Flags().IntP("limit", "l", -1, "maximum number of stocks to update")
+	etlCmd.Flags().IntP("skip", "s", -1, "number of stocks to skip, ordered by exchange and symbol")
+	etlCmd.Flags().IntP("limit", "l", -1, "maximum number of stocks to update, ordered by exchange and symbol")
+	etlCmd.Flags().Uint64("resume", 0, "id of a failed job run to resume instead of starting a new one")
+	etlCmd.Flags().Bool("wait-for-lock", false, "wait for a concurrent job run to finish instead of failing")
+	etlCmd.Flags().Bool("include-delisted", false, "also request candles and company profiles of delisted stocks")
+	etlCmd.Flags().Bool("refresh-profiles", false, "request all company profiles, ignoring the refresh policy")
 }
 
 func backoffContext(ctx context.Context, maxElapsedTime time.Duration) backoff.BackOffContext {
@@ -295,5 +1355,3 @@ func backoffContext(ctx context.Context, maxElapsedTime time.Duration) backoff.B
 	result.MaxElapsedTime = maxElapsedTime
 	return backoff.WithContext(result, ctx)
 }
-
-type apiAuthContext context.Context
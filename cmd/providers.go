@@ -20,18 +20,26 @@ package cmd
 import (
 	"cloud.google.com/go/logging"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Finnhub-Stock-API/finnhub-go"
 	"github.com/ajjensen13/config"
 	"github.com/ajjensen13/gke"
 	db2 "github.com/ajjensen13/stocker/internal/db"
+	"github.com/ajjensen13/stocker/internal/fixture"
+	"github.com/ajjensen13/stocker/internal/indicator"
+	"github.com/ajjensen13/stocker/internal/stream"
 	"github.com/ajjensen13/stocker/internal/util"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -61,12 +69,70 @@ func provideAppSecrets() (*appSecrets, error) {
 	return &pkgAppSecrets, nil
 }
 
-func provideApiServiceClient() *finnhub.DefaultApiService {
-	return finnhub.NewAPIClient(finnhub.NewConfiguration()).DefaultApi
+var (
+	pkgRateLimiter     *api.RateLimiter
+	pkgRateLimiterOnce sync.Once
+)
+
+// provideRateLimiter provides the rate limiter shared by all api requests so
+// that the combined request rate of all workers stays within the plan's
+// limit. It defaults to 60 requests per minute, the free-tier limit.
+func provideRateLimiter(rpm RequestsPerMinute, burst RequestBurst) *api.RateLimiter {
+	pkgRateLimiterOnce.Do(func() {
+		pkgRateLimiter = api.NewRateLimiter(int(rpm), int(burst))
+	})
+	return pkgRateLimiter
 }
 
-func provideApiAuthContext(ctx context.Context, secrets *appSecrets) apiAuthContext {
-	return context.WithValue(ctx, finnhub.ContextAPIKey, finnhub.APIKey{Key: secrets.ApiKey})
+// provideApiConfiguration provides the finnhub client configuration. The
+// base url may be overridden, e.g. to point at a fixture.NewServer, and the
+// client's transport records or replays responses as configured by fixtures.
+func provideApiConfiguration(cfg *appConfig) (*finnhub.Configuration, error) {
+	transport, err := fixture.Transport(cfg.Fixtures.Mode, cfg.Fixtures.Dir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	apiCfg := finnhub.NewConfiguration()
+	apiCfg.HTTPClient = &http.Client{Transport: transport}
+	if cfg.ApiBaseURL != "" {
+		apiCfg.BasePath = strings.TrimSuffix(string(cfg.ApiBaseURL), "/")
+	}
+	return apiCfg, nil
+}
+
+const (
+	providerFinnhub ProviderName = "finnhub"
+	providerFile    ProviderName = "file"
+)
+
+// provideProvider provides the market data provider selected by config.
+// Finnhub is used when no provider is configured. The file provider reads
+// from the providerDir directory and needs no api key. Neither does finnhub
+// when its responses are replayed from fixtures.
+func provideProvider(cfg *appConfig, limiter *api.RateLimiter) (api.Provider, error) {
+	switch cfg.Provider {
+	case "", providerFinnhub:
+		apiCfg, err := provideApiConfiguration(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Fixtures.Mode == fixture.ModeReplay {
+			return api.NewFinnhubProvider(apiCfg, limiter, ""), nil
+		}
+		secrets, err := provideAppSecrets()
+		if err != nil {
+			return nil, err
+		}
+		return api.NewFinnhubProvider(apiCfg, limiter, secrets.ApiKey), nil
+	case providerFile:
+		if cfg.ProviderDir == "" {
+			return nil, fmt.Errorf("provider %q requires providerDir", cfg.Provider)
+		}
+		return api.NewFileProvider(string(cfg.ProviderDir)), nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", cfg.Provider)
+	}
 }
 
 var (
@@ -113,22 +179,276 @@ func backoffNotifier(ctx context.Context) backoff.Notify {
 	}
 }
 
-func latestCandleTimeFromLatestCandles(symbol api.Symbol, latestCandles db2.LatestCandles) db2.LatestCandleTime {
-	return latestCandles[symbol]
+func latestCandleTimeFromLatestCandles(exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, latestCandles db2.LatestCandles) db2.LatestCandleTime {
+	return latestCandles[db2.CandleKey{Exchange: exchange, Symbol: symbol, Resolution: resolution}]
+}
+
+const defaultExchange Exchange = "US"
+
+// provideExchanges provides the codes of the exchanges to load. The single
+// exchange setting is still honored when no list is configured.
+func provideExchanges(cfg *appConfig) Exchanges {
+	switch {
+	case len(cfg.Exchanges) > 0:
+		return cfg.Exchanges
+	case cfg.Exchange != "":
+		return Exchanges{cfg.Exchange}
+	default:
+		return Exchanges{defaultExchange}
+	}
+}
+
+const defaultResolution Resolution = "D"
+
+// provideResolutions provides the candle resolutions to load. The single
+// resolution setting is still honored when no list is configured.
+func provideResolutions(cfg *appConfig) Resolutions {
+	switch {
+	case len(cfg.Resolutions) > 0:
+		return cfg.Resolutions
+	case cfg.Resolution != "":
+		return Resolutions{cfg.Resolution}
+	default:
+		return Resolutions{defaultResolution}
+	}
+}
+
+// provideProfileRefreshPolicy provides the policy that decides which company
+// profiles are requested.
+func provideProfileRefreshPolicy(cfg *appConfig) (db2.ProfileRefreshPolicy, error) {
+	var ret db2.ProfileRefreshPolicy
+	if cfg.ProfileRefresh.MaxAge != "" {
+		maxAge, err := time.ParseDuration(cfg.ProfileRefresh.MaxAge)
+		if err != nil {
+			return db2.ProfileRefreshPolicy{}, fmt.Errorf("invalid company profile max age %q: %w", cfg.ProfileRefresh.MaxAge, err)
+		}
+		ret.MaxAge = maxAge
+	}
+
+	if cfg.ProfileRefresh.Fraction < 0 || cfg.ProfileRefresh.Fraction > 1 {
+		return db2.ProfileRefreshPolicy{}, fmt.Errorf("invalid company profile refresh fraction %v: must be between 0 and 1", cfg.ProfileRefresh.Fraction)
+	}
+	ret.Fraction = cfg.ProfileRefresh.Fraction
+	return ret, nil
+}
+
+// provideIndicators provides the technical indicators to stage.
+func provideIndicators(cfg *appConfig) (indicator.Config, error) {
+	err := cfg.Indicators.Validate()
+	if err != nil {
+		return indicator.Config{}, fmt.Errorf("invalid indicators: %w", err)
+	}
+	return cfg.Indicators, nil
+}
+
+// defaultBackfillChunkDays are the number of days of candles of each
+// resolution requested at once by a backfill. They stay well below what
+// finnhub returns for a single request.
+var defaultBackfillChunkDays = BackfillChunkDays{
+	"1":  7,
+	"5":  30,
+	"15": 30,
+	"30": 30,
+	"60": 30,
+	"D":  365,
+	"W":  3650,
+	"M":  3650,
+}
+
+// provideBackfillChunkDays provides the chunk sizes of backfills. Configured
+// sizes take precedence over the defaults.
+func provideBackfillChunkDays(cfg *appConfig) (BackfillChunkDays, error) {
+	ret := make(BackfillChunkDays, len(defaultBackfillChunkDays))
+	for resolution, days := range defaultBackfillChunkDays {
+		ret[resolution] = days
+	}
+	for resolution, days := range cfg.BackfillChunkDays {
+		if days < 1 {
+			return nil, fmt.Errorf("backfill chunk of resolution %q must be at least one day, got %d", resolution, days)
+		}
+		ret[resolution] = days
+	}
+	return ret, nil
+}
+
+// chunks splits [from, to] into consecutive ranges of at most the chunk
+// size of resolution.
+func (c BackfillChunkDays) chunks(resolution Resolution, from, to time.Time) (ret []candleChunk) {
+	days, ok := c[resolution]
+	if !ok {
+		days = c[defaultResolution]
+	}
+
+	for start := from; !start.After(to); {
+		next := start.AddDate(0, 0, days)
+		end := next.Add(-time.Second)
+		if end.After(to) {
+			end = to
+		}
+		ret = append(ret, candleChunk{From: start, To: end})
+		start = next
+	}
+	return ret
+}
+
+// candleChunk is a range of candles requested at once by a backfill.
+type candleChunk struct {
+	From time.Time
+	To   time.Time
+}
+
+// find returns the candles of loaded that were requested for exactly the
+// range of c.
+func (c candleChunk) find(loaded []api.CandlesResponse) (api.CandlesResponse, bool) {
+	for _, candles := range loaded {
+		if time.Time(candles.Request.From).Equal(c.From) && time.Time(candles.Request.To).Equal(c.To) {
+			return candles, true
+		}
+	}
+	return api.CandlesResponse{}, false
+}
+
+// StreamSettings configures the stream command.
+type StreamSettings struct {
+	Exchange  api.Exchange
+	Watchlist []api.Symbol
+	// FlushInterval is the time between saves of the completed bars.
+	FlushInterval time.Duration
+	// MaxLateness is the time trades may arrive after the end of their
+	// minute and still be part of the first save of its bar. Later trades
+	// are merged into the saved bar.
+	MaxLateness time.Duration
 }
 
-func buildStocksRequest(exchange Exchange) api.StocksRequest {
-	return api.StocksRequest{Exchange: api.Exchange(exchange)}
+const (
+	defaultFlushInterval = 10 * time.Second
+	defaultMaxLateness   = 5 * time.Second
+)
+
+// provideStreamSettings provides the settings of the stream command.
+func provideStreamSettings(cfg *appConfig) (StreamSettings, error) {
+	ret := StreamSettings{
+		Exchange:      api.Exchange(defaultExchange),
+		FlushInterval: defaultFlushInterval,
+		MaxLateness:   defaultMaxLateness,
+	}
+	if cfg.Stream.Exchange != "" {
+		ret.Exchange = api.Exchange(cfg.Stream.Exchange)
+	}
+
+	if len(cfg.Stream.Watchlist) == 0 {
+		return StreamSettings{}, errors.New("stream watchlist is empty")
+	}
+	for _, symbol := range cfg.Stream.Watchlist {
+		ret.Watchlist = append(ret.Watchlist, api.Symbol(symbol))
+	}
+
+	if cfg.Stream.FlushInterval != "" {
+		d, err := time.ParseDuration(cfg.Stream.FlushInterval)
+		if err != nil || d <= 0 {
+			return StreamSettings{}, fmt.Errorf("invalid stream flush interval %q", cfg.Stream.FlushInterval)
+		}
+		ret.FlushInterval = d
+	}
+	if cfg.Stream.MaxLateness != "" {
+		d, err := time.ParseDuration(cfg.Stream.MaxLateness)
+		if err != nil || d < 0 {
+			return StreamSettings{}, fmt.Errorf("invalid stream max lateness %q", cfg.Stream.MaxLateness)
+		}
+		ret.MaxLateness = d
+	}
+	return ret, nil
+}
+
+// provideStreamClient provides the websocket client of the stream command.
+// The url may be overridden, e.g. to point at a local server.
+func provideStreamClient(cfg *appConfig, secrets *appSecrets) *stream.Client {
+	return stream.NewClient(cfg.Stream.URL, secrets.ApiKey)
+}
+
+// provideTradingCalendars provides the trading calendar files of the
+// calendarDir directory, one *.json file per exchange. None are provided if
+// no directory is configured.
+func provideTradingCalendars(cfg *appConfig) ([]db2.TradingCalendar, error) {
+	if cfg.CalendarDir == "" {
+		return nil, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(string(cfg.CalendarDir), "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trading calendars: %w", err)
+	}
+
+	ret := make([]db2.TradingCalendar, 0, len(paths))
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trading calendar: %w", err)
+		}
+
+		var cal db2.TradingCalendar
+		err = json.Unmarshal(b, &cal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trading calendar %s: %w", path, err)
+		}
+
+		err = cal.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid trading calendar %s: %w", path, err)
+		}
+		ret = append(ret, cal)
+	}
+	return ret, nil
+}
+
+const (
+	corporateActionSplits    CorporateAction = "splits"
+	corporateActionDividends CorporateAction = "dividends"
+)
+
+// provideCorporateActions provides the kinds of corporate actions to load.
+// None are loaded unless configured, because the api plans differ in which
+// kinds they cover: the free finnhub plan answers dividend requests with
+// 403 Forbidden, which aborts the run.
+func provideCorporateActions(cfg *appConfig) (CorporateActions, error) {
+	for _, action := range cfg.CorporateActions {
+		switch action {
+		case corporateActionSplits, corporateActionDividends:
+		default:
+			return nil, fmt.Errorf("unknown corporate action %q", action)
+		}
+	}
+	return cfg.CorporateActions, nil
+}
+
+func (a CorporateActions) contains(action CorporateAction) bool {
+	for _, v := range a {
+		if v == action {
+			return true
+		}
+	}
+	return false
 }
 
-func buildCandleRequest(cfg *appConfig, lct db2.LatestCandleTime, tz *time.Location, symbol api.Symbol) api.CandlesRequest {
-	var endDate time.Time
+func buildStocksRequest(exchange api.Exchange) api.StocksRequest {
+	return api.StocksRequest{Exchange: exchange}
+}
+
+// CandleEndDate is the end of the candles requested by the etl.
+type CandleEndDate time.Time
+
+// provideCandleEndDate provides the configured end date, or yesterday if
+// none is configured.
+func provideCandleEndDate(cfg *appConfig, tz *time.Location) CandleEndDate {
 	if cfg.EndDate.IsZero() {
 		now := time.Now().In(tz)
-		endDate = time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, tz)
-	} else {
-		endDate = cfg.EndDate.In(tz)
+		return CandleEndDate(time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, tz))
 	}
+	return CandleEndDate(cfg.EndDate.In(tz))
+}
+
+func buildCandleRequest(cfg *appConfig, lct db2.LatestCandleTime, tz *time.Location, end CandleEndDate, exchange api.Exchange, symbol api.Symbol, resolution api.Resolution) api.CandlesRequest {
+	endDate := time.Time(end)
 
 	var startDate time.Time
 	if cfg.StartDate.IsZero() {
@@ -142,33 +462,75 @@ func buildCandleRequest(cfg *appConfig, lct db2.LatestCandleTime, tz *time.Locat
 	}
 
 	return api.CandlesRequest{
+		Exchange:   exchange,
 		Symbol:     symbol,
-		Resolution: api.Resolution(cfg.Resolution),
+		Resolution: resolution,
 		From:       api.From(startDate),
 		To:         api.To(endDate),
 	}
 }
 
-func buildCompanyProfileRequest(symbol api.Symbol) api.CompanyProfileRequest {
-	return api.CompanyProfileRequest{Symbol: symbol}
+// buildCandleRangeRequest requests the candles of an explicit range, e.g. a
+// gap detected by an earlier job run or a chunk of a backfill.
+func buildCandleRangeRequest(exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, from api.From, to api.To) api.CandlesRequest {
+	return api.CandlesRequest{
+		Exchange:   exchange,
+		Symbol:     symbol,
+		Resolution: resolution,
+		From:       from,
+		To:         to,
+	}
+}
+
+func buildCompanyProfileRequest(exchange api.Exchange, symbol api.Symbol) api.CompanyProfileRequest {
+	return api.CompanyProfileRequest{Exchange: exchange, Symbol: symbol}
+}
+
+// buildCorporateActionsRequest requests the splits or dividends since from,
+// the date of the latest staged corporate action of that kind, or the
+// complete history if from is zero. The latest staged corporate action is
+// requested again, so that corrections of it are staged too.
+func buildCorporateActionsRequest(exchange api.Exchange, symbol api.Symbol, from api.From) api.CorporateActionsRequest {
+	if time.Time(from).IsZero() {
+		from = api.From(time.Unix(0, 0).UTC())
+	}
+
+	return api.CorporateActionsRequest{
+		Exchange: exchange,
+		Symbol:   symbol,
+		From:     from,
+		To:       api.To(time.Now().UTC()),
+	}
+}
+
+func requestCandlesImpl(ctx context.Context, provider api.Provider, bo backoff.BackOff, bon backoff.Notify, req api.CandlesRequest) (api.CandlesResponse, error) {
+	ctx = util.WithLoggerValue(ctx, "action", "request")
+	util.Logf(ctx, logging.Debug, "requesting %q candles. (%v — %v) / %s", req.Symbol, req.From, req.To, req.Resolution)
+	return provider.RequestCandles(ctx, bo, countRetries(ctx, bon), req)
+}
+
+func requestStocksImpl(ctx context.Context, provider api.Provider, bo backoff.BackOff, bon backoff.Notify, req api.StocksRequest) (api.StocksResponse, error) {
+	ctx = util.WithLoggerValue(ctx, "action", "request")
+	util.Logf(ctx, logging.Debug, "requesting %q stocks", req.Exchange)
+	return provider.RequestStocks(ctx, bo, countRetries(ctx, bon), req)
 }
 
-func requestCandlesImpl(ctx apiAuthContext, client *finnhub.DefaultApiService, throttler *time.Ticker, bo backoff.BackOff, bon backoff.Notify, req api.CandlesRequest) (api.CandlesResponse, error) {
+func requestCompanyProfileImpl(ctx context.Context, provider api.Provider, bo backoff.BackOff, bon backoff.Notify, req api.CompanyProfileRequest) (api.CompanyProfileResponse, error) {
 	ctx = util.WithLoggerValue(ctx, "action", "request")
-	util.Logf(ctx, logging.Debug, "requesting %q candles from finnhub. (%v — %v) / %s", req.Symbol, req.From, req.To, req.Resolution)
-	return api.RequestCandles(ctx, client, throttler, bo, bon, req)
+	util.Logf(ctx, logging.Debug, "requesting %q company profile", req.Symbol)
+	return provider.RequestCompanyProfile(ctx, bo, countRetries(ctx, bon), req)
 }
 
-func requestStocksImpl(ctx apiAuthContext, client *finnhub.DefaultApiService, throttler *time.Ticker, bo backoff.BackOff, bon backoff.Notify, req api.StocksRequest) (api.StocksResponse, error) {
+func requestSplitsImpl(ctx context.Context, provider api.Provider, bo backoff.BackOff, bon backoff.Notify, req api.CorporateActionsRequest) (api.SplitsResponse, error) {
 	ctx = util.WithLoggerValue(ctx, "action", "request")
-	util.Logf(ctx, logging.Debug, "requesting %q stocks from finnhub", req.Exchange)
-	return api.RequestStocks(ctx, client, throttler, bo, bon, req)
+	util.Logf(ctx, logging.Debug, "requesting %q splits", req.Symbol)
+	return provider.RequestSplits(ctx, bo, countRetries(ctx, bon), req)
 }
 
-func requestCompanyProfileImpl(ctx apiAuthContext, client *finnhub.DefaultApiService, throttler *time.Ticker, bo backoff.BackOff, bon backoff.Notify, req api.CompanyProfileRequest) (api.CompanyProfileResponse, error) {
+func requestDividendsImpl(ctx context.Context, provider api.Provider, bo backoff.BackOff, bon backoff.Notify, req api.CorporateActionsRequest) (api.DividendsResponse, error) {
 	ctx = util.WithLoggerValue(ctx, "action", "request")
-	util.Logf(ctx, logging.Debug, "requesting %q company profiles from finnhub", req.Symbol)
-	return api.RequestCompanyProfile(ctx, client, throttler, bo, bon, req)
+	util.Logf(ctx, logging.Debug, "requesting %q dividends", req.Symbol)
+	return provider.RequestDividends(ctx, bo, countRetries(ctx, bon), req)
 }
 
 func provideDataSourceName(user *url.Userinfo, cfg *appConfig) (dsn *url.URL, err error) {
@@ -0,0 +1,173 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	db2 "github.com/ajjensen13/stocker/internal/db"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"sync/atomic"
+	"time"
+)
+
+// jobRunStats contains the counters of a job run. Counters are updated
+// atomically so they can be shared between goroutines.
+type jobRunStats struct {
+	StocksFetched            int64
+	StocksStaged             int64
+	StocksModified           int64
+	CandlesLoaded            int64
+	CandlesStaged            int64
+	CandlesModified          int64
+	CandlesRejected          int64
+	CandlesFlagged           int64
+	CandleGapsDetected       int64
+	CandleGapsFilled         int64
+	IndicatorsStaged         int64
+	IndicatorsModified       int64
+	Candles52WkStaged        int64
+	Candles52WkModified      int64
+	CompanyProfilesLoaded    int64
+	CompanyProfilesStaged    int64
+	CompanyProfilesModified  int64
+	CorporateActionsLoaded   int64
+	CorporateActionsStaged   int64
+	CorporateActionsModified int64
+	SymbolsSkipped           int64
+	ApiRetries               int64
+}
+
+type statsContextKey struct{}
+
+func withJobRunStats(ctx context.Context, stats *jobRunStats) context.Context {
+	return context.WithValue(ctx, statsContextKey{}, stats)
+}
+
+// stats returns the job run statistics of ctx. If ctx has none, the
+// returned counters are discarded.
+func stats(ctx context.Context) *jobRunStats {
+	if s, ok := ctx.Value(statsContextKey{}).(*jobRunStats); ok {
+		return s
+	}
+	return &jobRunStats{}
+}
+
+func addStagingInfo(staged, modified *int64, info db2.StagingInfo) {
+	atomic.AddInt64(staged, info.RowsStaged)
+	atomic.AddInt64(modified, info.RowsModified)
+}
+
+// countRetries wraps bon so that each retry is counted as an api retry.
+func countRetries(ctx context.Context, bon backoff.Notify) backoff.Notify {
+	s := stats(ctx)
+	return func(err error, duration time.Duration) {
+		atomic.AddInt64(&s.ApiRetries, 1)
+		bon(err, duration)
+	}
+}
+
+func (s *jobRunStats) snapshot() jobRunStats {
+	return jobRunStats{
+		StocksFetched:            atomic.LoadInt64(&s.StocksFetched),
+		StocksStaged:             atomic.LoadInt64(&s.StocksStaged),
+		StocksModified:           atomic.LoadInt64(&s.StocksModified),
+		CandlesLoaded:            atomic.LoadInt64(&s.CandlesLoaded),
+		CandlesStaged:            atomic.LoadInt64(&s.CandlesStaged),
+		CandlesModified:          atomic.LoadInt64(&s.CandlesModified),
+		CandlesRejected:          atomic.LoadInt64(&s.CandlesRejected),
+		CandlesFlagged:           atomic.LoadInt64(&s.CandlesFlagged),
+		CandleGapsDetected:       atomic.LoadInt64(&s.CandleGapsDetected),
+		CandleGapsFilled:         atomic.LoadInt64(&s.CandleGapsFilled),
+		IndicatorsStaged:         atomic.LoadInt64(&s.IndicatorsStaged),
+		IndicatorsModified:       atomic.LoadInt64(&s.IndicatorsModified),
+		Candles52WkStaged:        atomic.LoadInt64(&s.Candles52WkStaged),
+		Candles52WkModified:      atomic.LoadInt64(&s.Candles52WkModified),
+		CompanyProfilesLoaded:    atomic.LoadInt64(&s.CompanyProfilesLoaded),
+		CompanyProfilesStaged:    atomic.LoadInt64(&s.CompanyProfilesStaged),
+		CompanyProfilesModified:  atomic.LoadInt64(&s.CompanyProfilesModified),
+		CorporateActionsLoaded:   atomic.LoadInt64(&s.CorporateActionsLoaded),
+		CorporateActionsStaged:   atomic.LoadInt64(&s.CorporateActionsStaged),
+		CorporateActionsModified: atomic.LoadInt64(&s.CorporateActionsModified),
+		SymbolsSkipped:           atomic.LoadInt64(&s.SymbolsSkipped),
+		ApiRetries:               atomic.LoadInt64(&s.ApiRetries),
+	}
+}
+
+// saveJobRunStats adds the counters of s, i.e. those of the current attempt,
+// to the counters recorded for the job run, so that they cover every
+// attempt of a resumed job run. The symbols an attempt skips because an
+// earlier attempt already processed them are not counted again.
+func saveJobRunStats(ctx context.Context, pool *pgxpool.Pool, jobRunId uint64, s *jobRunStats) error {
+	ss := s.snapshot()
+	_, err := pool.Exec(ctx, `
+		UPDATE metadata.job_run
+		SET 
+			stocks_fetched = stocks_fetched + $2,
+			stocks_staged = stocks_staged + $3,
+			stocks_modified = stocks_modified + $4,
+			candles_loaded = candles_loaded + $5,
+			candles_staged = candles_staged + $6,
+			candles_modified = candles_modified + $7,
+			candles_52wk_staged = candles_52wk_staged + $8,
+			candles_52wk_modified = candles_52wk_modified + $9,
+			company_profiles_loaded = company_profiles_loaded + $10,
+			company_profiles_staged = company_profiles_staged + $11,
+			company_profiles_modified = company_profiles_modified + $12,
+			corporate_actions_loaded = corporate_actions_loaded + $13,
+			corporate_actions_staged = corporate_actions_staged + $14,
+			corporate_actions_modified = corporate_actions_modified + $15,
+			symbols_skipped = symbols_skipped + $16,
+			api_retries = api_retries + $17,
+			candles_rejected = candles_rejected + $18,
+			candles_flagged = candles_flagged + $19,
+			candle_gaps_detected = candle_gaps_detected + $20,
+			candle_gaps_filled = candle_gaps_filled + $21,
+			indicators_staged = indicators_staged + $22,
+			indicators_modified = indicators_modified + $23,
+			modified = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		jobRunId,
+		ss.StocksFetched,
+		ss.StocksStaged,
+		ss.StocksModified,
+		ss.CandlesLoaded,
+		ss.CandlesStaged,
+		ss.CandlesModified,
+		ss.Candles52WkStaged,
+		ss.Candles52WkModified,
+		ss.CompanyProfilesLoaded,
+		ss.CompanyProfilesStaged,
+		ss.CompanyProfilesModified,
+		ss.CorporateActionsLoaded,
+		ss.CorporateActionsStaged,
+		ss.CorporateActionsModified,
+		ss.SymbolsSkipped,
+		ss.ApiRetries,
+		ss.CandlesRejected,
+		ss.CandlesFlagged,
+		ss.CandleGapsDetected,
+		ss.CandleGapsFilled,
+		ss.IndicatorsStaged,
+		ss.IndicatorsModified,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update job_run statistics: %w", err)
+	}
+	return nil
+}
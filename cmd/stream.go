@@ -0,0 +1,206 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"cloud.google.com/go/logging"
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/stream"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/sync/errgroup"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// streamCmd represents the stream command
+var streamCmd = &cobra.Command{
+	Use:   "stream",
+	Short: "streams the trades of the watchlist into one minute bars",
+	Long: `Subscribes to the trades of the watchlist over finnhub's websocket api
+and aggregates them into one minute bars, which are saved in batches. Lost
+connections are reconnected. On SIGINT or SIGTERM, the remaining bars are
+saved before the command exits. The symbols must already have been staged
+by an etl job run.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger, cleanupLogger := logger()
+		defer cleanupLogger()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ctx = util.WithLogger(ctx, logger)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		go func() {
+			select {
+			case sig := <-signals:
+				util.Logf(ctx, logging.Notice, "received %v, stopping stream", sig)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		err := runStream(ctx, cmd)
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+func runStream(ctx context.Context, cmd *cobra.Command) error {
+	util.Logf(ctx, logging.Notice, "stream is starting")
+	defer util.Logf(ctx, logging.Notice, "stream is stopping")
+
+	settings, err := streamSettings()
+	if err != nil {
+		return err
+	}
+
+	pool, poolCleanup, err := pool(ctx)
+	if err != nil {
+		return err
+	}
+	defer poolCleanup()
+
+	symbols, err := streamSymbols(ctx, pool, settings)
+	if err != nil {
+		return err
+	}
+
+	client, err := websocketClient()
+	if err != nil {
+		return err
+	}
+
+	client.Notify = func(err error, wait time.Duration) {
+		util.Logf(ctx, logging.Warning, "websocket connection lost, reconnecting in %v: %v", wait, err)
+	}
+
+	subscribed := make(map[string]bool, len(symbols))
+	for _, symbol := range symbols {
+		subscribed[symbol] = true
+	}
+	client.Subscribe(symbols...)
+
+	util.Logf(ctx, logging.Info, "streaming trades of %d symbols of exchange %s", len(symbols), settings.Exchange)
+
+	trades := make(chan stream.Trade, 1024)
+	grp, grpCtx := errgroup.WithContext(ctx)
+	grp.Go(func() error {
+		return client.Run(grpCtx, trades)
+	})
+	grp.Go(func() error {
+		return aggregateTrades(grpCtx, pool, settings, subscribed, trades)
+	})
+	return grp.Wait()
+}
+
+// streamSymbols returns the symbols of the watchlist that are stocks of the
+// exchange. Other symbols are logged and skipped, since their bars could not
+// be saved.
+func streamSymbols(ctx context.Context, pool *pgxpool.Pool, settings StreamSettings) ([]string, error) {
+	stocks, err := queryStagedStocks(backoffContext(ctx, 5*time.Minute), pool, settings.Exchange, settings.Watchlist)
+	if err != nil {
+		return nil, err
+	}
+
+	staged := map[string]bool{}
+	for _, stock := range stocks {
+		staged[stock.Symbol] = true
+	}
+
+	var ret []string
+	for _, symbol := range settings.Watchlist {
+		if !staged[string(symbol)] {
+			util.Logf(ctx, logging.Warning, "skipping %q: not a stock of exchange %s; run an etl job first", symbol, settings.Exchange)
+			continue
+		}
+		ret = append(ret, string(symbol))
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no symbol of the watchlist is a stock of exchange %s", settings.Exchange)
+	}
+	return ret, nil
+}
+
+// aggregateTrades collects trades into bars and saves the completed bars
+// every flush interval. Bars that cannot be saved are kept and saved with
+// the next flush. Once ctx is done, all bars are saved, including those of
+// the current minute.
+func aggregateTrades(ctx context.Context, pool *pgxpool.Pool, settings StreamSettings, subscribed map[string]bool, trades <-chan stream.Trade) error {
+	agg := stream.NewAggregator()
+	var pending []stream.Bar
+
+	flush := func(ctx context.Context, bars []stream.Bar, maxElapsedTime time.Duration) error {
+		pending = append(pending, bars...)
+		if len(pending) == 0 {
+			return nil
+		}
+
+		info, err := saveIntradayBars(backoffContext(ctx, maxElapsedTime), pool, settings.Exchange, pending)
+		if err != nil {
+			return fmt.Errorf("failed to save %d intraday bars: %w", len(pending), err)
+		}
+
+		util.Logf(ctx, logging.Debug, "saved %d intraday bars (%d rows modified)", info.RowsStaged, info.RowsModified)
+		pending = nil
+		return nil
+	}
+
+	ticker := time.NewTicker(settings.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-trades:
+			if subscribed[t.Symbol] {
+				agg.Add(t)
+			}
+		case now := <-ticker.C:
+			err := flush(ctx, agg.Flush(now.Add(-settings.MaxLateness)), settings.FlushInterval)
+			if err != nil && ctx.Err() == nil {
+				util.Logf(ctx, logging.Warning, "%v; retrying with the next flush", err)
+			}
+		case <-ctx.Done():
+			for drained := false; !drained; {
+				select {
+				case t := <-trades:
+					if subscribed[t.Symbol] {
+						agg.Add(t)
+					}
+				default:
+					drained = true
+				}
+			}
+
+			return flush(util.WithoutCancel(ctx), agg.FlushAll(), time.Minute)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(streamCmd)
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/ajjensen13/gke"
 	"github.com/ajjensen13/stocker/internal/api"
 	db2 "github.com/ajjensen13/stocker/internal/db"
+	"github.com/ajjensen13/stocker/internal/stream"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/google/wire"
@@ -33,13 +34,11 @@ import (
 
 var (
 	cfg    = wire.NewSet(provideAppConfig, provideAppSecrets, provideTimezone, wire.FieldsOf(new(*appConfig), "MigrationSourceURL"))
-	client = wire.NewSet(provideApiServiceClient, provideApiAuthContext, buildCandleRequest, buildStocksRequest, buildCompanyProfileRequest, wire.FieldsOf(new(*appConfig), "Exchange", "Resolution"), wire.Value(clientTicker))
+	client = wire.NewSet(provideProvider, provideCandleEndDate, buildCandleRequest, buildStocksRequest, buildCompanyProfileRequest, buildCorporateActionsRequest, wire.FieldsOf(new(*appConfig), "RequestsPerMinute", "RequestBurst"), provideRateLimiter)
 	db     = wire.NewSet(provideDataSourceName, provideDbSecrets, provideDbConnPool, wire.FieldsOf(new(*appConfig), "DbConnPoolConfig"), provideDbPoolDsn)
 	bo     = wire.NewSet(provideBackOff, provideContext, backoffNotifier)
 )
 
-var clientTicker = time.NewTicker(time.Second)
-
 func provideBackOff(bo backoff.BackOffContext) backoff.BackOff {
 	return bo
 }
@@ -48,7 +47,7 @@ func provideContext(bo backoff.BackOffContext) context.Context {
 	return bo.Context()
 }
 
-func requestStocks(ctx backoff.BackOffContext) (api.StocksResponse, error) {
+func requestStocks(ctx backoff.BackOffContext, exchange api.Exchange) (api.StocksResponse, error) {
 	panic(wire.Build(cfg, client, bo, requestStocksImpl))
 }
 
@@ -60,23 +59,43 @@ func stageStocks(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool
 	panic(wire.Build(bo, db2.StageStocks))
 }
 
-func requestCandles(ctx backoff.BackOffContext, symbol api.Symbol, lc db2.LatestCandles) (api.CandlesResponse, error) {
+func requestCandles(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, lc db2.LatestCandles) (api.CandlesResponse, error) {
 	panic(wire.Build(cfg, client, bo, requestCandlesImpl, latestCandleTimeFromLatestCandles))
 }
 
+func requestCandleRange(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, from api.From, to api.To) (api.CandlesResponse, error) {
+	panic(wire.Build(cfg, client, bo, requestCandlesImpl, buildCandleRangeRequest))
+}
+
+func queryCandleGaps(ctx backoff.BackOffContext, pool *pgxpool.Pool, key db2.CandleKey) ([]db2.CandleGap, error) {
+	panic(wire.Build(cfg, bo, wire.FieldsOf(new(*appConfig), "CandleGaps"), db2.LookupCandleGaps))
+}
+
+func detectCandleGaps(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, key db2.CandleKey) (db2.GapInfo, error) {
+	panic(wire.Build(bo, db2.DetectCandleGaps))
+}
+
+func loadTradingCalendar(ctx backoff.BackOffContext, pool *pgxpool.Pool, cal db2.TradingCalendar) (bool, error) {
+	panic(wire.Build(bo, db2.LoadTradingCalendar))
+}
+
 func saveCandles(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, resp api.CandlesResponse) error {
 	panic(wire.Build(bo, db2.SaveCandles))
 }
 
 func stageCandles(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, resp api.CandlesResponse) (db2.StagingInfo, error) {
-	panic(wire.Build(cfg, bo, db2.StageCandles))
+	panic(wire.Build(cfg, bo, wire.FieldsOf(new(*appConfig), "CandleValidation"), db2.StageCandles))
+}
+
+func stageIndicators(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, key db2.CandleKey) (db2.StagingInfo, error) {
+	panic(wire.Build(cfg, bo, provideIndicators, db2.StageIndicators))
 }
 
 func stage52WkCandles(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, resp api.CandlesResponse) (db2.StagingInfo, error) {
 	panic(wire.Build(bo, db2.StageCandles52Wk))
 }
 
-func requestCompanyProfile(ctx backoff.BackOffContext, symbol api.Symbol) (api.CompanyProfileResponse, error) {
+func requestCompanyProfile(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol) (api.CompanyProfileResponse, error) {
 	panic(wire.Build(cfg, client, bo, requestCompanyProfileImpl))
 }
 
@@ -88,10 +107,126 @@ func stageCompanyProfiles(ctx backoff.BackOffContext, jobRunId uint64, pool *pgx
 	panic(wire.Build(bo, db2.StageCompanyProfiles))
 }
 
+func requestSplits(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol, from api.From) (api.SplitsResponse, error) {
+	panic(wire.Build(cfg, client, bo, requestSplitsImpl))
+}
+
+func requestDividends(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol, from api.From) (api.DividendsResponse, error) {
+	panic(wire.Build(cfg, client, bo, requestDividendsImpl))
+}
+
+func saveSplits(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, splits api.SplitsResponse) error {
+	panic(wire.Build(bo, db2.SaveSplits))
+}
+
+func saveDividends(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, dividends api.DividendsResponse) error {
+	panic(wire.Build(bo, db2.SaveDividends))
+}
+
+func stageCorporateActions(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, key db2.StockKey) (db2.StagingInfo, error) {
+	panic(wire.Build(bo, db2.StageCorporateActions))
+}
+
+func queryLatestCorporateActions(ctx backoff.BackOffContext, pool *pgxpool.Pool) (db2.LatestCorporateActions, error) {
+	panic(wire.Build(bo, db2.LookupLatestCorporateActions))
+}
+
 func queryMostRecentCandles(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool) (db2.LatestCandles, error) {
 	panic(wire.Build(bo, db2.LookupLatestCandles))
 }
 
+func saveProgress(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, key db2.StockKey, dataType db2.DataType, status db2.ProgressStatus) error {
+	panic(wire.Build(bo, db2.SaveProgress))
+}
+
+func queryProgress(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool) (db2.Progress, error) {
+	panic(wire.Build(bo, db2.LookupProgress))
+}
+
+func queryLoadedStocks(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, exchange api.Exchange) (api.StocksResponse, error) {
+	panic(wire.Build(bo, db2.LookupLoadedStocks))
+}
+
+func queryLoadedCandles(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, key db2.CandleKey) ([]api.CandlesResponse, error) {
+	panic(wire.Build(bo, db2.LookupLoadedCandles))
+}
+
+func queryDelistedStocks(ctx backoff.BackOffContext, pool *pgxpool.Pool, exchange api.Exchange) ([]api.Stock, error) {
+	panic(wire.Build(bo, db2.LookupDelistedStocks))
+}
+
+func queryStagedStocks(ctx backoff.BackOffContext, pool *pgxpool.Pool, exchange api.Exchange, symbols []api.Symbol) ([]api.Stock, error) {
+	panic(wire.Build(bo, db2.LookupStagedStocks))
+}
+
+func queryExchangeStocks(ctx backoff.BackOffContext, pool *pgxpool.Pool, exchange api.Exchange) ([]api.Stock, error) {
+	panic(wire.Build(bo, db2.LookupExchangeStocks))
+}
+
+func saveBackfill(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, backfill db2.Backfill) error {
+	panic(wire.Build(bo, db2.SaveBackfill))
+}
+
+func queryBackfill(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool) (db2.Backfill, error) {
+	panic(wire.Build(bo, db2.LookupBackfill))
+}
+
+func queryProfileRefreshes(ctx backoff.BackOffContext, pool *pgxpool.Pool) (db2.ProfileRefreshes, error) {
+	panic(wire.Build(bo, db2.LookupProfileRefreshes))
+}
+
+func saveProfileRefresh(ctx backoff.BackOffContext, jobRunId uint64, pool *pgxpool.Pool, key db2.StockKey) error {
+	panic(wire.Build(bo, db2.SaveProfileRefresh))
+}
+
+func saveIntradayBars(ctx backoff.BackOffContext, pool *pgxpool.Pool, exchange api.Exchange, bars []stream.Bar) (db2.StagingInfo, error) {
+	panic(wire.Build(bo, db2.SaveIntradayBars))
+}
+
+func workerConcurrency() (Concurrency, error) {
+	panic(wire.Build(cfg, wire.FieldsOf(new(*appConfig), "Concurrency")))
+}
+
+func candleResolutions() (Resolutions, error) {
+	panic(wire.Build(cfg, provideResolutions))
+}
+
+func corporateActionKinds() (CorporateActions, error) {
+	panic(wire.Build(cfg, provideCorporateActions))
+}
+
+func profileRefreshPolicy() (db2.ProfileRefreshPolicy, error) {
+	panic(wire.Build(cfg, provideProfileRefreshPolicy))
+}
+
+func backfillChunkDays() (BackfillChunkDays, error) {
+	panic(wire.Build(cfg, provideBackfillChunkDays))
+}
+
+func streamSettings() (StreamSettings, error) {
+	panic(wire.Build(cfg, provideStreamSettings))
+}
+
+func websocketClient() (*stream.Client, error) {
+	panic(wire.Build(cfg, provideStreamClient))
+}
+
+func tradingCalendars() ([]db2.TradingCalendar, error) {
+	panic(wire.Build(cfg, provideTradingCalendars))
+}
+
+func candleEndDate() (CandleEndDate, error) {
+	panic(wire.Build(cfg, provideCandleEndDate))
+}
+
+func timezone() (*time.Location, error) {
+	panic(wire.Build(cfg))
+}
+
+func stockExchanges() (Exchanges, error) {
+	panic(wire.Build(cfg, provideExchanges))
+}
+
 func pool(ctx context.Context) (*pgxpool.Pool, func(), error) {
 	panic(wire.Build(cfg, db))
 }
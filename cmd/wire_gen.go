@@ -10,6 +10,7 @@ import (
 	"github.com/ajjensen13/gke"
 	"github.com/ajjensen13/stocker/internal/api"
 	db2 "github.com/ajjensen13/stocker/internal/db"
+	"github.com/ajjensen13/stocker/internal/stream"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/google/wire"
@@ -24,34 +25,29 @@ import (
 
 // Injectors from wire.go:
 
-func requestStocks(ctx backoff.BackOffContext) (api.StocksResponse, error) {
+func requestStocks(ctx backoff.BackOffContext, exchange api.Exchange) (api.StocksResponse, error) {
 	context := provideContext(ctx)
-	cmdAppSecrets, err := provideAppSecrets()
+	cmdAppConfig, err := provideAppConfig()
 	if err != nil {
 		return api.StocksResponse{}, err
 	}
-	cmdApiAuthContext := provideApiAuthContext(context, cmdAppSecrets)
-	defaultApiService := provideApiServiceClient()
-	ticker := _wireTickerValue
-	backOff := provideBackOff(ctx)
-	notify := backoffNotifier(context)
-	cmdAppConfig, err := provideAppConfig()
+	requestsPerMinute := cmdAppConfig.RequestsPerMinute
+	requestBurst := cmdAppConfig.RequestBurst
+	rateLimiter := provideRateLimiter(requestsPerMinute, requestBurst)
+	provider, err := provideProvider(cmdAppConfig, rateLimiter)
 	if err != nil {
 		return api.StocksResponse{}, err
 	}
-	exchange := cmdAppConfig.Exchange
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
 	stocksRequest := buildStocksRequest(exchange)
-	stocksResponse, err := requestStocksImpl(cmdApiAuthContext, defaultApiService, ticker, backOff, notify, stocksRequest)
+	stocksResponse, err := requestStocksImpl(context, provider, backOff, notify, stocksRequest)
 	if err != nil {
 		return api.StocksResponse{}, err
 	}
 	return stocksResponse, nil
 }
 
-var (
-	_wireTickerValue = clientTicker
-)
-
 func saveStocks(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, resp api.StocksResponse) error {
 	context := provideContext(ctx)
 	backOff := provideBackOff(ctx)
@@ -71,34 +67,96 @@ func stageStocks(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Poo
 	return stagingInfo, nil
 }
 
-func requestCandles(ctx backoff.BackOffContext, symbol api.Symbol, lc db2.LatestCandles) (api.CandlesResponse, error) {
+func requestCandles(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, lc db2.LatestCandles) (api.CandlesResponse, error) {
 	context := provideContext(ctx)
-	cmdAppSecrets, err := provideAppSecrets()
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return api.CandlesResponse{}, err
+	}
+	requestsPerMinute := cmdAppConfig.RequestsPerMinute
+	requestBurst := cmdAppConfig.RequestBurst
+	rateLimiter := provideRateLimiter(requestsPerMinute, requestBurst)
+	provider, err := provideProvider(cmdAppConfig, rateLimiter)
 	if err != nil {
 		return api.CandlesResponse{}, err
 	}
-	cmdApiAuthContext := provideApiAuthContext(context, cmdAppSecrets)
-	defaultApiService := provideApiServiceClient()
-	ticker := _wireTickerValue
 	backOff := provideBackOff(ctx)
 	notify := backoffNotifier(context)
+	latestCandleTime := latestCandleTimeFromLatestCandles(exchange, symbol, resolution, lc)
+	location, err := provideTimezone(cmdAppConfig)
+	if err != nil {
+		return api.CandlesResponse{}, err
+	}
+	cmdCandleEndDate := provideCandleEndDate(cmdAppConfig, location)
+	candlesRequest := buildCandleRequest(cmdAppConfig, latestCandleTime, location, cmdCandleEndDate, exchange, symbol, resolution)
+	candlesResponse, err := requestCandlesImpl(context, provider, backOff, notify, candlesRequest)
+	if err != nil {
+		return api.CandlesResponse{}, err
+	}
+	return candlesResponse, nil
+}
+
+func requestCandleRange(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, from api.From, to api.To) (api.CandlesResponse, error) {
+	context := provideContext(ctx)
 	cmdAppConfig, err := provideAppConfig()
 	if err != nil {
 		return api.CandlesResponse{}, err
 	}
-	latestCandleTime := latestCandleTimeFromLatestCandles(symbol, lc)
-	location, err := provideTimezone(cmdAppConfig)
+	requestsPerMinute := cmdAppConfig.RequestsPerMinute
+	requestBurst := cmdAppConfig.RequestBurst
+	rateLimiter := provideRateLimiter(requestsPerMinute, requestBurst)
+	provider, err := provideProvider(cmdAppConfig, rateLimiter)
 	if err != nil {
 		return api.CandlesResponse{}, err
 	}
-	candlesRequest := buildCandleRequest(cmdAppConfig, latestCandleTime, location, symbol)
-	candlesResponse, err := requestCandlesImpl(cmdApiAuthContext, defaultApiService, ticker, backOff, notify, candlesRequest)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	candlesRequest := buildCandleRangeRequest(exchange, symbol, resolution, from, to)
+	candlesResponse, err := requestCandlesImpl(context, provider, backOff, notify, candlesRequest)
 	if err != nil {
 		return api.CandlesResponse{}, err
 	}
 	return candlesResponse, nil
 }
 
+func queryCandleGaps(ctx backoff.BackOffContext, pool2 *pgxpool.Pool, key db2.CandleKey) ([]db2.CandleGap, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return nil, err
+	}
+	candleGapPolicy := cmdAppConfig.CandleGaps
+	v, err := db2.LookupCandleGaps(context, pool2, backOff, notify, candleGapPolicy, key)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func detectCandleGaps(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, key db2.CandleKey) (db2.GapInfo, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	gapInfo, err := db2.DetectCandleGaps(context, jobRunId, pool2, backOff, notify, key)
+	if err != nil {
+		return db2.GapInfo{}, err
+	}
+	return gapInfo, nil
+}
+
+func loadTradingCalendar(ctx backoff.BackOffContext, pool2 *pgxpool.Pool, cal db2.TradingCalendar) (bool, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	bool2, err := db2.LoadTradingCalendar(context, pool2, backOff, notify, cal)
+	if err != nil {
+		return false, err
+	}
+	return bool2, nil
+}
+
 func saveCandles(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, resp api.CandlesResponse) error {
 	context := provideContext(ctx)
 	backOff := provideBackOff(ctx)
@@ -119,7 +177,27 @@ func stageCandles(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Po
 	if err != nil {
 		return db2.StagingInfo{}, err
 	}
-	stagingInfo, err := db2.StageCandles(context, jobRunId, pool2, backOff, notify, location)
+	candleValidation := cmdAppConfig.CandleValidation
+	stagingInfo, err := db2.StageCandles(context, jobRunId, pool2, backOff, notify, location, candleValidation, resp)
+	if err != nil {
+		return db2.StagingInfo{}, err
+	}
+	return stagingInfo, nil
+}
+
+func stageIndicators(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, key db2.CandleKey) (db2.StagingInfo, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return db2.StagingInfo{}, err
+	}
+	config, err := provideIndicators(cmdAppConfig)
+	if err != nil {
+		return db2.StagingInfo{}, err
+	}
+	stagingInfo, err := db2.StageIndicators(context, jobRunId, pool2, backOff, notify, config, key)
 	if err != nil {
 		return db2.StagingInfo{}, err
 	}
@@ -137,19 +215,23 @@ func stage52WkCandles(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpoo
 	return stagingInfo, nil
 }
 
-func requestCompanyProfile(ctx backoff.BackOffContext, symbol api.Symbol) (api.CompanyProfileResponse, error) {
+func requestCompanyProfile(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol) (api.CompanyProfileResponse, error) {
 	context := provideContext(ctx)
-	cmdAppSecrets, err := provideAppSecrets()
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return api.CompanyProfileResponse{}, err
+	}
+	requestsPerMinute := cmdAppConfig.RequestsPerMinute
+	requestBurst := cmdAppConfig.RequestBurst
+	rateLimiter := provideRateLimiter(requestsPerMinute, requestBurst)
+	provider, err := provideProvider(cmdAppConfig, rateLimiter)
 	if err != nil {
 		return api.CompanyProfileResponse{}, err
 	}
-	cmdApiAuthContext := provideApiAuthContext(context, cmdAppSecrets)
-	defaultApiService := provideApiServiceClient()
-	ticker := _wireTickerValue
 	backOff := provideBackOff(ctx)
 	notify := backoffNotifier(context)
-	companyProfileRequest := buildCompanyProfileRequest(symbol)
-	companyProfileResponse, err := requestCompanyProfileImpl(cmdApiAuthContext, defaultApiService, ticker, backOff, notify, companyProfileRequest)
+	companyProfileRequest := buildCompanyProfileRequest(exchange, symbol)
+	companyProfileResponse, err := requestCompanyProfileImpl(context, provider, backOff, notify, companyProfileRequest)
 	if err != nil {
 		return api.CompanyProfileResponse{}, err
 	}
@@ -175,6 +257,90 @@ func stageCompanyProfiles(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pg
 	return stagingInfo, nil
 }
 
+func requestSplits(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol, from api.From) (api.SplitsResponse, error) {
+	context := provideContext(ctx)
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return api.SplitsResponse{}, err
+	}
+	requestsPerMinute := cmdAppConfig.RequestsPerMinute
+	requestBurst := cmdAppConfig.RequestBurst
+	rateLimiter := provideRateLimiter(requestsPerMinute, requestBurst)
+	provider, err := provideProvider(cmdAppConfig, rateLimiter)
+	if err != nil {
+		return api.SplitsResponse{}, err
+	}
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	corporateActionsRequest := buildCorporateActionsRequest(exchange, symbol, from)
+	splitsResponse, err := requestSplitsImpl(context, provider, backOff, notify, corporateActionsRequest)
+	if err != nil {
+		return api.SplitsResponse{}, err
+	}
+	return splitsResponse, nil
+}
+
+func requestDividends(ctx backoff.BackOffContext, exchange api.Exchange, symbol api.Symbol, from api.From) (api.DividendsResponse, error) {
+	context := provideContext(ctx)
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return api.DividendsResponse{}, err
+	}
+	requestsPerMinute := cmdAppConfig.RequestsPerMinute
+	requestBurst := cmdAppConfig.RequestBurst
+	rateLimiter := provideRateLimiter(requestsPerMinute, requestBurst)
+	provider, err := provideProvider(cmdAppConfig, rateLimiter)
+	if err != nil {
+		return api.DividendsResponse{}, err
+	}
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	corporateActionsRequest := buildCorporateActionsRequest(exchange, symbol, from)
+	dividendsResponse, err := requestDividendsImpl(context, provider, backOff, notify, corporateActionsRequest)
+	if err != nil {
+		return api.DividendsResponse{}, err
+	}
+	return dividendsResponse, nil
+}
+
+func saveSplits(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, splits api.SplitsResponse) error {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	error2 := db2.SaveSplits(context, jobRunId, pool2, backOff, notify, splits)
+	return error2
+}
+
+func saveDividends(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, dividends api.DividendsResponse) error {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	error2 := db2.SaveDividends(context, jobRunId, pool2, backOff, notify, dividends)
+	return error2
+}
+
+func stageCorporateActions(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, key db2.StockKey) (db2.StagingInfo, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	stagingInfo, err := db2.StageCorporateActions(context, jobRunId, pool2, backOff, notify, key)
+	if err != nil {
+		return db2.StagingInfo{}, err
+	}
+	return stagingInfo, nil
+}
+
+func queryLatestCorporateActions(ctx backoff.BackOffContext, pool2 *pgxpool.Pool) (db2.LatestCorporateActions, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	latestCorporateActions, err := db2.LookupLatestCorporateActions(context, pool2, backOff, notify)
+	if err != nil {
+		return nil, err
+	}
+	return latestCorporateActions, nil
+}
+
 func queryMostRecentCandles(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool) (db2.LatestCandles, error) {
 	context := provideContext(ctx)
 	backOff := provideBackOff(ctx)
@@ -186,6 +352,254 @@ func queryMostRecentCandles(ctx backoff.BackOffContext, jobRunId uint64, pool2 *
 	return latestCandles, nil
 }
 
+func saveProgress(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, key db2.StockKey, dataType db2.DataType, status db2.ProgressStatus) error {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	error2 := db2.SaveProgress(context, jobRunId, pool2, backOff, notify, key, dataType, status)
+	return error2
+}
+
+func queryProgress(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool) (db2.Progress, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	progress, err := db2.LookupProgress(context, jobRunId, pool2, backOff, notify)
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+func queryLoadedStocks(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, exchange api.Exchange) (api.StocksResponse, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	stocksResponse, err := db2.LookupLoadedStocks(context, jobRunId, pool2, backOff, notify, exchange)
+	if err != nil {
+		return api.StocksResponse{}, err
+	}
+	return stocksResponse, nil
+}
+
+func queryLoadedCandles(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, key db2.CandleKey) ([]api.CandlesResponse, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	v, err := db2.LookupLoadedCandles(context, jobRunId, pool2, backOff, notify, key)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func queryDelistedStocks(ctx backoff.BackOffContext, pool2 *pgxpool.Pool, exchange api.Exchange) ([]api.Stock, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	v, err := db2.LookupDelistedStocks(context, pool2, backOff, notify, exchange)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func queryStagedStocks(ctx backoff.BackOffContext, pool2 *pgxpool.Pool, exchange api.Exchange, symbols []api.Symbol) ([]api.Stock, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	v, err := db2.LookupStagedStocks(context, pool2, backOff, notify, exchange, symbols)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func queryExchangeStocks(ctx backoff.BackOffContext, pool2 *pgxpool.Pool, exchange api.Exchange) ([]api.Stock, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	v, err := db2.LookupExchangeStocks(context, pool2, backOff, notify, exchange)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func saveBackfill(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, backfill db2.Backfill) error {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	error2 := db2.SaveBackfill(context, jobRunId, pool2, backOff, notify, backfill)
+	return error2
+}
+
+func queryBackfill(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool) (db2.Backfill, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	backfill, err := db2.LookupBackfill(context, jobRunId, pool2, backOff, notify)
+	if err != nil {
+		return db2.Backfill{}, err
+	}
+	return backfill, nil
+}
+
+func queryProfileRefreshes(ctx backoff.BackOffContext, pool2 *pgxpool.Pool) (db2.ProfileRefreshes, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	profileRefreshes, err := db2.LookupProfileRefreshes(context, pool2, backOff, notify)
+	if err != nil {
+		return nil, err
+	}
+	return profileRefreshes, nil
+}
+
+func saveProfileRefresh(ctx backoff.BackOffContext, jobRunId uint64, pool2 *pgxpool.Pool, key db2.StockKey) error {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	error2 := db2.SaveProfileRefresh(context, jobRunId, pool2, backOff, notify, key)
+	return error2
+}
+
+func saveIntradayBars(ctx backoff.BackOffContext, pool2 *pgxpool.Pool, exchange api.Exchange, bars []stream.Bar) (db2.StagingInfo, error) {
+	context := provideContext(ctx)
+	backOff := provideBackOff(ctx)
+	notify := backoffNotifier(context)
+	stagingInfo, err := db2.SaveIntradayBars(context, pool2, backOff, notify, exchange, bars)
+	if err != nil {
+		return db2.StagingInfo{}, err
+	}
+	return stagingInfo, nil
+}
+
+func workerConcurrency() (Concurrency, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return 0, err
+	}
+	concurrency := cmdAppConfig.Concurrency
+	return concurrency, nil
+}
+
+func candleResolutions() (Resolutions, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return nil, err
+	}
+	resolutions := provideResolutions(cmdAppConfig)
+	return resolutions, nil
+}
+
+func corporateActionKinds() (CorporateActions, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return nil, err
+	}
+	cmdCorporateActions, err := provideCorporateActions(cmdAppConfig)
+	if err != nil {
+		return nil, err
+	}
+	return cmdCorporateActions, nil
+}
+
+func profileRefreshPolicy() (db2.ProfileRefreshPolicy, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return db2.ProfileRefreshPolicy{}, err
+	}
+	dbProfileRefreshPolicy, err := provideProfileRefreshPolicy(cmdAppConfig)
+	if err != nil {
+		return db2.ProfileRefreshPolicy{}, err
+	}
+	return dbProfileRefreshPolicy, nil
+}
+
+func backfillChunkDays() (BackfillChunkDays, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return nil, err
+	}
+	cmdBackfillChunkDays, err := provideBackfillChunkDays(cmdAppConfig)
+	if err != nil {
+		return nil, err
+	}
+	return cmdBackfillChunkDays, nil
+}
+
+func streamSettings() (StreamSettings, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return StreamSettings{}, err
+	}
+	cmdStreamSettings, err := provideStreamSettings(cmdAppConfig)
+	if err != nil {
+		return StreamSettings{}, err
+	}
+	return cmdStreamSettings, nil
+}
+
+func websocketClient() (*stream.Client, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return nil, err
+	}
+	cmdAppSecrets, err := provideAppSecrets()
+	if err != nil {
+		return nil, err
+	}
+	streamClient := provideStreamClient(cmdAppConfig, cmdAppSecrets)
+	return streamClient, nil
+}
+
+func tradingCalendars() ([]db2.TradingCalendar, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return nil, err
+	}
+	v, err := provideTradingCalendars(cmdAppConfig)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func candleEndDate() (CandleEndDate, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return CandleEndDate{}, err
+	}
+	location, err := provideTimezone(cmdAppConfig)
+	if err != nil {
+		return CandleEndDate{}, err
+	}
+	cmdCandleEndDate := provideCandleEndDate(cmdAppConfig, location)
+	return cmdCandleEndDate, nil
+}
+
+func timezone() (*time.Location, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return nil, err
+	}
+	location, err := provideTimezone(cmdAppConfig)
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
+
+func stockExchanges() (Exchanges, error) {
+	cmdAppConfig, err := provideAppConfig()
+	if err != nil {
+		return nil, err
+	}
+	exchanges := provideExchanges(cmdAppConfig)
+	return exchanges, nil
+}
+
 func pool(ctx context.Context) (*pgxpool.Pool, func(), error) {
 	userinfo, err := provideDbSecrets()
 	if err != nil {
@@ -245,13 +659,11 @@ func migrator(lg gke.Logger) (*migrate.Migrate, error) {
 
 var (
 	cfg    = wire.NewSet(provideAppConfig, provideAppSecrets, provideTimezone, wire.FieldsOf(new(*appConfig), "MigrationSourceURL"))
-	client = wire.NewSet(provideApiServiceClient, provideApiAuthContext, buildCandleRequest, buildStocksRequest, buildCompanyProfileRequest, wire.FieldsOf(new(*appConfig), "Exchange", "Resolution"), wire.Value(clientTicker))
+	client = wire.NewSet(provideProvider, buildCandleRequest, buildStocksRequest, buildCompanyProfileRequest, buildCorporateActionsRequest, wire.FieldsOf(new(*appConfig), "RequestsPerMinute", "RequestBurst"), provideRateLimiter)
 	db     = wire.NewSet(provideDataSourceName, provideDbSecrets, provideDbConnPool, wire.FieldsOf(new(*appConfig), "DbConnPoolConfig"), provideDbPoolDsn)
 	bo     = wire.NewSet(provideBackOff, provideContext, backoffNotifier)
 )
 
-var clientTicker = time.NewTicker(time.Second)
-
 func provideBackOff(bo2 backoff.BackOffContext) backoff.BackOff {
 	return bo2
 }
@@ -8,11 +8,12 @@ require (
 	github.com/Finnhub-Stock-API/finnhub-go v1.2.1
 	github.com/ajjensen13/config v0.0.16
 	github.com/ajjensen13/gke v0.0.55
-	github.com/antihax/optional v1.0.0
+	github.com/antihax/optional v1.0.0 // indirect
 	github.com/cenkalti/backoff/v4 v4.1.0
 	github.com/golang-migrate/migrate/v4 v4.14.1
 	github.com/google/uuid v1.1.3 // indirect
 	github.com/google/wire v0.4.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/jackc/pgtype v1.6.2
 	github.com/jackc/pgx/v4 v4.10.1
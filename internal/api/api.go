@@ -18,19 +18,23 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package api
 
 import (
-	"cloud.google.com/go/logging"
 	"context"
 	"errors"
-	"fmt"
-	"github.com/Finnhub-Stock-API/finnhub-go"
-	"github.com/ajjensen13/stocker/internal/util"
-	"github.com/antihax/optional"
 	"github.com/cenkalti/backoff/v4"
-	"io/ioutil"
-	"net/http"
 	"time"
 )
 
+// Provider is a source of market data. Implementations convert the data of
+// their vendor into the stocker-owned types below so that the rest of the
+// pipeline does not depend on any one vendor.
+type Provider interface {
+	RequestStocks(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req StocksRequest) (StocksResponse, error)
+	RequestCandles(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CandlesRequest) (CandlesResponse, error)
+	RequestCompanyProfile(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CompanyProfileRequest) (CompanyProfileResponse, error)
+	RequestSplits(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CorporateActionsRequest) (SplitsResponse, error)
+	RequestDividends(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CorporateActionsRequest) (DividendsResponse, error)
+}
+
 type Exchange string
 
 type StocksRequest struct {
@@ -39,12 +43,29 @@ type StocksRequest struct {
 
 type StocksResponse struct {
 	Request  StocksRequest
-	Response []finnhub.Stock
+	Response []Stock
+}
+
+// Stock describes a symbol that is traded on an exchange. The json names
+// match the data stored in src.stocks. Exchange is the code the stock was
+// requested for; it is stored alongside the data rather than in it.
+type Stock struct {
+	Exchange       Exchange `json:"-"`
+	Description    string   `json:"description,omitempty"`
+	DisplaySymbol  string   `json:"displaySymbol,omitempty"`
+	Symbol         string   `json:"symbol,omitempty"`
+	Type           string   `json:"type,omitempty"`
+	Currency       string   `json:"currency,omitempty"`
+	Mic            string   `json:"mic,omitempty"`
+	Figi           string   `json:"figi,omitempty"`
+	ShareClassFigi string   `json:"shareClassFIGI,omitempty"`
+	Isin           string   `json:"isin,omitempty"`
+	Symbol2        string   `json:"symbol2,omitempty"`
 }
 
 var errSymbolMissing = errors.New("stock symbol missing")
 
-func stockIsValid(stock finnhub.Stock) error {
+func stockIsValid(stock Stock) error {
 	switch {
 	case stock.Symbol == "":
 		return errSymbolMissing
@@ -53,42 +74,13 @@ func stockIsValid(stock finnhub.Stock) error {
 	}
 }
 
-func RequestStocks(ctx context.Context, client *finnhub.DefaultApiService, ticker *time.Ticker, bo backoff.BackOff, bon backoff.Notify, req StocksRequest) (result StocksResponse, err error) {
-	err = backoff.RetryNotify(func() error {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("aborting stocks request: %w", ctx.Err())
-		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
-			defer cancel()
-
-			stocks, httpResp, err := client.StockSymbols(ctx, string(req.Exchange))
-			if err != nil {
-				return handleErr("error while getting stocks", httpResp, err)
-			}
-
-			validStocks := make([]finnhub.Stock, 0, len(stocks))
-			for _, stock := range stocks {
-				if err := stockIsValid(stock); err != nil {
-					util.Logf(ctx, logging.Warning, fmt.Errorf("invalid stock will be skipped: %v: %w", stock, err).Error())
-					continue
-				}
-				validStocks = append(validStocks, stock)
-			}
-
-			result = StocksResponse{Request: req, Response: validStocks}
-			return nil
-		}
-	}, bo, bon)
-	return
-}
-
 type Symbol string
 type Resolution string
 type From time.Time
 type To time.Time
 
 type CandlesRequest struct {
+	Exchange
 	Symbol
 	Resolution
 	From // Earlier Date
@@ -97,75 +89,94 @@ type CandlesRequest struct {
 
 type CandlesResponse struct {
 	Request  CandlesRequest
-	Response finnhub.StockCandles
+	Response Candles
 }
 
-func RequestCandles(ctx context.Context, client *finnhub.DefaultApiService, ticker *time.Ticker, bo backoff.BackOff, bon backoff.Notify, req CandlesRequest) (result CandlesResponse, err error) {
-	err = backoff.RetryNotify(func() error {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("aborting candles request: %w", ctx.Err())
-		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-			defer cancel()
-
-			candles, httpResp, err := client.StockCandles(ctx, string(req.Symbol), string(req.Resolution), time.Time(req.From).Unix(), time.Time(req.To).Unix(), nil)
-			if err != nil {
-				return handleErr(fmt.Sprintf("error while requesting candle for stock %q", req.Symbol), httpResp, err)
-			}
-
-			result = CandlesResponse{Request: req, Response: candles}
-			return nil
-		}
-	}, bo, bon)
-	return
+// Candles contains a series of OHLCV candles. Each slice has one element
+// per candle. The json names match the data stored in src.candles.
+type Candles struct {
+	O []float64 `json:"o,omitempty"`
+	H []float64 `json:"h,omitempty"`
+	L []float64 `json:"l,omitempty"`
+	C []float64 `json:"c,omitempty"`
+	V []float64 `json:"v,omitempty"`
+	T []int64   `json:"t,omitempty"`
+	S string    `json:"s,omitempty"`
 }
 
 type CompanyProfileRequest struct {
+	Exchange
 	Symbol
 }
 
 type CompanyProfileResponse struct {
 	Request  CompanyProfileRequest
-	Response finnhub.CompanyProfile2
+	Response CompanyProfile
+}
+
+// CompanyProfile contains general information about a company. The json
+// names match the data stored in src.company_profiles.
+type CompanyProfile struct {
+	Country              string  `json:"country,omitempty"`
+	Currency             string  `json:"currency,omitempty"`
+	Exchange             string  `json:"exchange,omitempty"`
+	Name                 string  `json:"name,omitempty"`
+	Ticker               string  `json:"ticker,omitempty"`
+	Ipo                  string  `json:"ipo,omitempty"`
+	MarketCapitalization float64 `json:"marketCapitalization,omitempty"`
+	SharesOutstanding    float64 `json:"shareOutstanding,omitempty"`
+	Logo                 string  `json:"logo,omitempty"`
+	Phone                string  `json:"phone,omitempty"`
+	WebUrl               string  `json:"weburl,omitempty"`
+	Industry             string  `json:"finnhubIndustry,omitempty"`
 }
 
-func RequestCompanyProfile(ctx context.Context, client *finnhub.DefaultApiService, ticker *time.Ticker, bo backoff.BackOff, bon backoff.Notify, req CompanyProfileRequest) (result CompanyProfileResponse, err error) {
-	err = backoff.RetryNotify(func() error {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("aborting company profile request: %w", ctx.Err())
-		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-			defer cancel()
+// CorporateActionsRequest requests the splits or dividends of a symbol
+// that took effect between From and To.
+type CorporateActionsRequest struct {
+	Exchange
+	Symbol
+	From // Earlier Date
+	To   // Later Date
+}
+
+type SplitsResponse struct {
+	Request  CorporateActionsRequest
+	Response []Split
+}
 
-			profiles, httpResp, err := client.CompanyProfile2(ctx, &finnhub.CompanyProfile2Opts{Symbol: optional.NewString(string(req.Symbol))})
-			if err != nil {
-				return handleErr(fmt.Sprintf("error while getting company profile %q", req.Symbol), httpResp, err)
-			}
-			result = CompanyProfileResponse{Request: req, Response: profiles}
-			return nil
-		}
-	}, bo, bon)
-	return
+// Split is a stock split that took effect on Date. Like finnhub, a
+// 7-for-1 split has a FromFactor of 7 and a ToFactor of 1, so prices before
+// Date are adjusted by ToFactor / FromFactor. The json names match the data
+// stored in src.splits.
+type Split struct {
+	Date       string  `json:"date,omitempty"`
+	FromFactor float64 `json:"fromFactor,omitempty"`
+	ToFactor   float64 `json:"toFactor,omitempty"`
 }
 
-var ErrToManyRequests = errors.New("error: too many requests")
+type DividendsResponse struct {
+	Request  CorporateActionsRequest
+	Response []Dividend
+}
 
-func handleErr(msg string, resp *http.Response, err error) error {
-	switch {
-	case resp == nil:
-		break
-	case resp.StatusCode == http.StatusTooManyRequests:
-		err = fmt.Errorf("%s: %w", msg, ErrToManyRequests)
-	case resp.Body != nil:
-		defer resp.Body.Close()
-		body, readErr := ioutil.ReadAll(resp.Body)
-		if readErr != nil {
-			msg = fmt.Sprintf("error while to parsing error response %v. %s", readErr, msg)
-			break
-		}
-		msg = fmt.Sprintf("%s (%s)", msg, body)
-	}
-	return fmt.Errorf("%s: %w", msg, err)
+// Dividend is a cash dividend. Date is the ex-dividend date and Amount is
+// not adjusted for later splits. The json names match the data stored in
+// src.dividends.
+type Dividend struct {
+	Date            string  `json:"date,omitempty"`
+	Amount          float64 `json:"amount,omitempty"`
+	AdjustedAmount  float64 `json:"adjustedAmount,omitempty"`
+	PayDate         string  `json:"payDate,omitempty"`
+	RecordDate      string  `json:"recordDate,omitempty"`
+	DeclarationDate string  `json:"declarationDate,omitempty"`
+	Currency        string  `json:"currency,omitempty"`
 }
+
+var (
+	ErrUnauthorized   = errors.New("error: unauthorized")
+	ErrForbidden      = errors.New("error: forbidden")
+	ErrNotFound       = errors.New("error: not found")
+	ErrToManyRequests = errors.New("error: too many requests")
+	ErrServer         = errors.New("error: server error")
+)
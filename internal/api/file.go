@@ -0,0 +1,459 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cenkalti/backoff/v4"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileProvider reads market data from a local directory, e.g. a historical
+// dump of candles, instead of requesting it from a vendor. The data of an
+// exchange is read from the subdirectory named after its code, if there is
+// one, and from the directory itself otherwise. It is laid out as follows:
+//
+//	stocks.json or stocks.csv                    the symbol universe (optional)
+//	candles/<RESOLUTION>/<SYMBOL>.csv or .json   candles of a symbol
+//	candles/<SYMBOL>.csv or .json                daily candles of a symbol
+//	profiles/<SYMBOL>.json                       company profile of a symbol (optional)
+//	splits/<SYMBOL>.json                         splits of a symbol (optional)
+//	dividends/<SYMBOL>.json                      dividends of a symbol (optional)
+//
+// When there is no stocks file, the symbol universe consists of the symbols
+// that have a candles file. Candle CSV files need a header row naming the
+// timestamp, open, high, low, close and volume columns. Timestamps are
+// either unix seconds, dates (2006-01-02) or RFC 3339 times.
+type FileProvider struct {
+	dir string
+}
+
+var _ Provider = (*FileProvider)(nil)
+
+func NewFileProvider(dir string) *FileProvider {
+	return &FileProvider{dir: dir}
+}
+
+// root returns the directory that holds the data of exchange.
+func (p *FileProvider) root(exchange Exchange) string {
+	if exchange != "" {
+		dir := filepath.Join(p.dir, string(exchange))
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return p.dir
+}
+
+func (p *FileProvider) RequestStocks(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req StocksRequest) (StocksResponse, error) {
+	stocks, err := readStocks(p.root(req.Exchange))
+	if err != nil {
+		return StocksResponse{}, err
+	}
+
+	validStocks := make([]Stock, 0, len(stocks))
+	for _, stock := range stocks {
+		if err := stockIsValid(stock); err != nil {
+			continue
+		}
+		stock.Exchange = req.Exchange
+		validStocks = append(validStocks, stock)
+	}
+
+	return StocksResponse{Request: req, Response: validStocks}, nil
+}
+
+func readStocks(root string) ([]Stock, error) {
+	var stocks []Stock
+	err := readJsonFile(filepath.Join(root, "stocks.json"), &stocks)
+	switch {
+	case err == nil:
+		return stocks, nil
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+
+	stocks, err = readStocksCsv(filepath.Join(root, "stocks.csv"))
+	switch {
+	case err == nil:
+		return stocks, nil
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+
+	return stocksFromCandleFiles(root)
+}
+
+func stocksFromCandleFiles(root string) ([]Stock, error) {
+	dir := filepath.Join(root, "candles")
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list candle files: %w", err)
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		resolutionInfos, err := ioutil.ReadDir(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list candle files: %w", err)
+		}
+		infos = append(infos, resolutionInfos...)
+	}
+
+	seen := map[string]bool{}
+	var ret []Stock
+	for _, info := range infos {
+		ext := filepath.Ext(info.Name())
+		if info.IsDir() || (ext != ".csv" && ext != ".json") {
+			continue
+		}
+
+		symbol := strings.TrimSuffix(info.Name(), ext)
+		if seen[symbol] {
+			continue
+		}
+		seen[symbol] = true
+		ret = append(ret, Stock{Symbol: symbol, DisplaySymbol: symbol})
+	}
+	return ret, nil
+}
+
+func readStocksCsv(name string) ([]Stock, error) {
+	records, columns, err := readCsvFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	symbolNdx, ok := columns["symbol"]
+	if !ok {
+		return nil, fmt.Errorf("stocks file %s has no symbol column", name)
+	}
+
+	field := func(record []string, columnNames ...string) string {
+		for _, columnName := range columnNames {
+			if ndx, ok := columns[columnName]; ok && ndx < len(record) {
+				return record[ndx]
+			}
+		}
+		return ""
+	}
+
+	ret := make([]Stock, 0, len(records))
+	for _, record := range records {
+		ret = append(ret, Stock{
+			Symbol:         record[symbolNdx],
+			DisplaySymbol:  field(record, "displaysymbol", "display_symbol"),
+			Description:    field(record, "description"),
+			Type:           field(record, "type"),
+			Currency:       field(record, "currency"),
+			Mic:            field(record, "mic"),
+			Figi:           field(record, "figi"),
+			ShareClassFigi: field(record, "shareclassfigi", "share_class_figi"),
+			Isin:           field(record, "isin"),
+			Symbol2:        field(record, "symbol2"),
+		})
+	}
+	return ret, nil
+}
+
+func (p *FileProvider) RequestCandles(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CandlesRequest) (CandlesResponse, error) {
+	root := p.root(req.Exchange)
+	base, err := symbolFile(filepath.Join(root, "candles", string(req.Resolution)), req.Symbol, "")
+	if err != nil {
+		return CandlesResponse{}, backoff.Permanent(err)
+	}
+
+	all, err := readCandlesFile(base)
+	if errors.Is(err, ErrNotFound) && req.Resolution == "D" {
+		all, err = readCandlesFile(filepath.Join(root, "candles", string(req.Symbol)))
+	}
+	if err != nil {
+		return CandlesResponse{}, backoff.Permanent(fmt.Errorf("failed to read candles for stock %q: %w", req.Symbol, err))
+	}
+
+	candles, err := filterCandles(all, time.Time(req.From), time.Time(req.To))
+	if err != nil {
+		return CandlesResponse{}, backoff.Permanent(fmt.Errorf("invalid candles for stock %q: %w", req.Symbol, err))
+	}
+	if candles.S == "no_data" {
+		return CandlesResponse{}, backoff.Permanent(fmt.Errorf("no candles for stock %q: %w", req.Symbol, ErrNotFound))
+	}
+
+	return CandlesResponse{Request: req, Response: candles}, nil
+}
+
+// readCandlesFile reads the candles from base.json, or base.csv if there is
+// no json file.
+func readCandlesFile(base string) (Candles, error) {
+	var ret Candles
+	err := readJsonFile(base+".json", &ret)
+	if errors.Is(err, ErrNotFound) {
+		return readCandlesCsv(base + ".csv")
+	}
+	return ret, err
+}
+
+func readCandlesCsv(name string) (Candles, error) {
+	records, columns, err := readCsvFile(name)
+	if err != nil {
+		return Candles{}, err
+	}
+
+	lookup := func(columnNames ...string) (int, error) {
+		for _, columnName := range columnNames {
+			if ndx, ok := columns[columnName]; ok {
+				return ndx, nil
+			}
+		}
+		return 0, fmt.Errorf("candles file %s has no %s column", name, columnNames[0])
+	}
+
+	var ndx [6]int
+	for i, names := range [][]string{{"timestamp", "t", "date", "time"}, {"open", "o"}, {"high", "h"}, {"low", "l"}, {"close", "c"}, {"volume", "v"}} {
+		ndx[i], err = lookup(names...)
+		if err != nil {
+			return Candles{}, err
+		}
+	}
+
+	var ret Candles
+	for line, record := range records {
+		t, err := parseCandleTime(record[ndx[0]])
+		if err != nil {
+			return Candles{}, fmt.Errorf("%s:%d: %w", name, line+2, err)
+		}
+
+		var values [5]float64
+		for i := range values {
+			values[i], err = strconv.ParseFloat(strings.TrimSpace(record[ndx[i+1]]), 64)
+			if err != nil {
+				return Candles{}, fmt.Errorf("%s:%d: %w", name, line+2, err)
+			}
+		}
+
+		ret.T = append(ret.T, t.Unix())
+		ret.O = append(ret.O, values[0])
+		ret.H = append(ret.H, values[1])
+		ret.L = append(ret.L, values[2])
+		ret.C = append(ret.C, values[3])
+		ret.V = append(ret.V, values[4])
+	}
+	return ret, nil
+}
+
+func parseCandleTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid candle timestamp %q", v)
+}
+
+// filterCandles returns the candles in between from and to, inclusive,
+// ordered by timestamp.
+func filterCandles(in Candles, from, to time.Time) (Candles, error) {
+	l := len(in.T)
+	if len(in.O) != l || len(in.H) != l || len(in.L) != l || len(in.C) != l || len(in.V) != l {
+		return Candles{}, errors.New("candle series have different lengths")
+	}
+
+	ndx := make([]int, 0, l)
+	for i, t := range in.T {
+		if t < from.Unix() || t > to.Unix() {
+			continue
+		}
+		ndx = append(ndx, i)
+	}
+	sort.Slice(ndx, func(i, j int) bool {
+		return in.T[ndx[i]] < in.T[ndx[j]]
+	})
+
+	var ret Candles
+	for _, i := range ndx {
+		ret.T = append(ret.T, in.T[i])
+		ret.O = append(ret.O, in.O[i])
+		ret.H = append(ret.H, in.H[i])
+		ret.L = append(ret.L, in.L[i])
+		ret.C = append(ret.C, in.C[i])
+		ret.V = append(ret.V, in.V[i])
+	}
+
+	// mirror the status reported by finnhub
+	if len(ret.T) == 0 {
+		ret.S = "no_data"
+	} else {
+		ret.S = "ok"
+	}
+	return ret, nil
+}
+
+func (p *FileProvider) RequestCompanyProfile(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CompanyProfileRequest) (CompanyProfileResponse, error) {
+	var profile CompanyProfile
+	name, err := symbolFile(filepath.Join(p.root(req.Exchange), "profiles"), req.Symbol, ".json")
+	if err != nil {
+		return CompanyProfileResponse{}, backoff.Permanent(err)
+	}
+
+	err = readJsonFile(name, &profile)
+	if err != nil {
+		return CompanyProfileResponse{}, backoff.Permanent(fmt.Errorf("failed to read company profile %q: %w", req.Symbol, err))
+	}
+	return CompanyProfileResponse{Request: req, Response: profile}, nil
+}
+
+// RequestSplits reads the splits of a symbol. A symbol without a splits
+// file has no splits.
+func (p *FileProvider) RequestSplits(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CorporateActionsRequest) (SplitsResponse, error) {
+	var splits []Split
+	name, err := symbolFile(filepath.Join(p.root(req.Exchange), "splits"), req.Symbol, ".json")
+	if err != nil {
+		return SplitsResponse{}, backoff.Permanent(err)
+	}
+
+	err = readJsonFile(name, &splits)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return SplitsResponse{}, backoff.Permanent(fmt.Errorf("failed to read splits %q: %w", req.Symbol, err))
+	}
+
+	ret := SplitsResponse{Request: req}
+	for _, split := range splits {
+		if inDateRange(split.Date, req.From, req.To) {
+			ret.Response = append(ret.Response, split)
+		}
+	}
+	return ret, nil
+}
+
+// RequestDividends reads the dividends of a symbol. A symbol without a
+// dividends file has no dividends.
+func (p *FileProvider) RequestDividends(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CorporateActionsRequest) (DividendsResponse, error) {
+	var dividends []Dividend
+	name, err := symbolFile(filepath.Join(p.root(req.Exchange), "dividends"), req.Symbol, ".json")
+	if err != nil {
+		return DividendsResponse{}, backoff.Permanent(err)
+	}
+
+	err = readJsonFile(name, &dividends)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return DividendsResponse{}, backoff.Permanent(fmt.Errorf("failed to read dividends %q: %w", req.Symbol, err))
+	}
+
+	ret := DividendsResponse{Request: req}
+	for _, dividend := range dividends {
+		if inDateRange(dividend.Date, req.From, req.To) {
+			ret.Response = append(ret.Response, dividend)
+		}
+	}
+	return ret, nil
+}
+
+// symbolFile returns the name of the file of symbol in dir. Symbols are
+// used as file names, so symbols that would name a file outside of dir
+// cannot exist and are reported as ErrNotFound.
+func symbolFile(dir string, symbol Symbol, ext string) (string, error) {
+	s := string(symbol)
+	if s == "" || s == "." || strings.Contains(s, "..") || strings.ContainsAny(s, `/\`) {
+		return "", fmt.Errorf("invalid symbol %q: %w", symbol, ErrNotFound)
+	}
+	return filepath.Join(dir, s+ext), nil
+}
+
+// inDateRange reports whether date (2006-01-02) is between from and to.
+// Dates that cannot be parsed are kept so that staging can report them.
+func inDateRange(date string, from From, to To) bool {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return true
+	}
+	return !t.Before(time.Time(from).Truncate(24*time.Hour)) && !t.After(time.Time(to))
+}
+
+// readJsonFile decodes the json file name into v. It returns ErrNotFound
+// when the file does not exist.
+func readJsonFile(name string, v interface{}) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(v)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+	return nil
+}
+
+// readCsvFile reads the records of the csv file name along with the index
+// of each column named by the header row. Column names are lower case.
+// It returns ErrNotFound when the file does not exist.
+func readCsvFile(name string) (records [][]string, columns map[string]int, err error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, map[string]int{}, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read header of %s: %w", name, err)
+	}
+
+	columns = make(map[string]int, len(header))
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+
+	records, err = r.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return records, columns, nil
+}
@@ -0,0 +1,324 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"cloud.google.com/go/logging"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Finnhub-Stock-API/finnhub-go"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// FinnhubProvider requests market data from the finnhub api. Responses are
+// decoded by the provider rather than the generated client, whose models
+// lack newer fields and store prices and volumes as float32.
+type FinnhubProvider struct {
+	httpClient *http.Client
+	basePath   string
+	limiter    *RateLimiter
+	apiKey     string
+}
+
+var _ Provider = (*FinnhubProvider)(nil)
+
+func NewFinnhubProvider(cfg *finnhub.Configuration, limiter *RateLimiter, apiKey string) *FinnhubProvider {
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &FinnhubProvider{
+		httpClient: httpClient,
+		basePath:   cfg.BasePath,
+		limiter:    limiter,
+		apiKey:     apiKey,
+	}
+}
+
+func (p *FinnhubProvider) RequestStocks(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req StocksRequest) (result StocksResponse, err error) {
+	err = backoff.RetryNotify(func() error {
+		return limitedRequest(ctx, p.limiter, bon, "stocks request", "error while getting stocks", func(ctx context.Context) (*http.Response, error) {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			defer cancel()
+
+			stocks, httpResp, err := p.stockSymbols(ctx, req.Exchange)
+			if err != nil {
+				return httpResp, err
+			}
+
+			validStocks := make([]Stock, 0, len(stocks))
+			for _, s := range stocks {
+				stock := fromFinnhubStock(req.Exchange, s)
+				if err := stockIsValid(stock); err != nil {
+					util.Logf(ctx, logging.Warning, fmt.Errorf("invalid stock will be skipped: %v: %w", stock, err).Error())
+					continue
+				}
+				validStocks = append(validStocks, stock)
+			}
+
+			result = StocksResponse{Request: req, Response: validStocks}
+			return httpResp, nil
+		})
+	}, bo, bon)
+	return
+}
+
+func (p *FinnhubProvider) RequestCandles(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CandlesRequest) (result CandlesResponse, err error) {
+	err = backoff.RetryNotify(func() error {
+		return limitedRequest(ctx, p.limiter, bon, "candles request", fmt.Sprintf("error while requesting candle for stock %q", req.Symbol), func(ctx context.Context) (*http.Response, error) {
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+
+			q := url.Values{}
+			q.Set("symbol", string(req.Symbol))
+			q.Set("resolution", string(req.Resolution))
+			q.Set("from", strconv.FormatInt(time.Time(req.From).Unix(), 10))
+			q.Set("to", strconv.FormatInt(time.Time(req.To).Unix(), 10))
+
+			var candles Candles
+			httpResp, err := p.getJson(ctx, "/stock/candle", q, &candles)
+			if err != nil {
+				return httpResp, err
+			}
+
+			// finnhub responds with status no_data when there are no candles in the range
+			if candles.S == "no_data" {
+				return httpResp, backoff.Permanent(fmt.Errorf("no candles: %w", ErrNotFound))
+			}
+
+			result = CandlesResponse{Request: req, Response: candles}
+			return httpResp, nil
+		})
+	}, bo, bon)
+	return
+}
+
+func (p *FinnhubProvider) RequestCompanyProfile(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CompanyProfileRequest) (result CompanyProfileResponse, err error) {
+	err = backoff.RetryNotify(func() error {
+		return limitedRequest(ctx, p.limiter, bon, "company profile request", fmt.Sprintf("error while getting company profile %q", req.Symbol), func(ctx context.Context) (*http.Response, error) {
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+
+			var profile CompanyProfile
+			httpResp, err := p.getJson(ctx, "/stock/profile2", url.Values{"symbol": {string(req.Symbol)}}, &profile)
+			if err != nil {
+				return httpResp, err
+			}
+
+			// finnhub responds with an empty profile for unknown and delisted symbols
+			if profile == (CompanyProfile{}) {
+				return httpResp, backoff.Permanent(fmt.Errorf("empty company profile: %w", ErrNotFound))
+			}
+
+			result = CompanyProfileResponse{Request: req, Response: profile}
+			return httpResp, nil
+		})
+	}, bo, bon)
+	return
+}
+
+func (p *FinnhubProvider) RequestSplits(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CorporateActionsRequest) (result SplitsResponse, err error) {
+	err = backoff.RetryNotify(func() error {
+		return limitedRequest(ctx, p.limiter, bon, "splits request", fmt.Sprintf("error while getting splits %q", req.Symbol), func(ctx context.Context) (*http.Response, error) {
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+
+			var splits []Split
+			httpResp, err := p.getJson(ctx, "/stock/split", corporateActionsQuery(req), &splits)
+			if err != nil {
+				return httpResp, err
+			}
+
+			result = SplitsResponse{Request: req, Response: splits}
+			return httpResp, nil
+		})
+	}, bo, bon)
+	return
+}
+
+func (p *FinnhubProvider) RequestDividends(ctx context.Context, bo backoff.BackOff, bon backoff.Notify, req CorporateActionsRequest) (result DividendsResponse, err error) {
+	err = backoff.RetryNotify(func() error {
+		return limitedRequest(ctx, p.limiter, bon, "dividends request", fmt.Sprintf("error while getting dividends %q", req.Symbol), func(ctx context.Context) (*http.Response, error) {
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+
+			var dividends []Dividend
+			httpResp, err := p.getJson(ctx, "/stock/dividend", corporateActionsQuery(req), &dividends)
+			if err != nil {
+				return httpResp, err
+			}
+
+			result = DividendsResponse{Request: req, Response: dividends}
+			return httpResp, nil
+		})
+	}, bo, bon)
+	return
+}
+
+func corporateActionsQuery(req CorporateActionsRequest) url.Values {
+	q := url.Values{}
+	q.Set("symbol", string(req.Symbol))
+	q.Set("from", time.Time(req.From).Format("2006-01-02"))
+	q.Set("to", time.Time(req.To).Format("2006-01-02"))
+	return q
+}
+
+// finnhubStock is a stock symbol as returned by /stock/symbol. The
+// generated finnhub.Stock lacks the fields that were added to the api
+// later, like mic and figi.
+type finnhubStock struct {
+	Description    string `json:"description"`
+	DisplaySymbol  string `json:"displaySymbol"`
+	Symbol         string `json:"symbol"`
+	Type           string `json:"type"`
+	Currency       string `json:"currency"`
+	Mic            string `json:"mic"`
+	Figi           string `json:"figi"`
+	ShareClassFigi string `json:"shareClassFIGI"`
+	Isin           string `json:"isin"`
+	Symbol2        string `json:"symbol2"`
+}
+
+// stockSymbols requests the stock symbols of exchange.
+func (p *FinnhubProvider) stockSymbols(ctx context.Context, exchange Exchange) ([]finnhubStock, *http.Response, error) {
+	var ret []finnhubStock
+	httpResp, err := p.getJson(ctx, "/stock/symbol", url.Values{"exchange": {string(exchange)}}, &ret)
+	return ret, httpResp, err
+}
+
+// getJson requests path with the query q and decodes the json response
+// into v. A response with an error status is returned along with an error
+// that includes its body, so that handleErr can classify it.
+func (p *FinnhubProvider) getJson(ctx context.Context, path string, q url.Values, v interface{}) (*http.Response, error) {
+	q.Set("token", p.apiKey)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, p.basePath+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "application/json")
+
+	httpResp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return httpResp, err
+	}
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	_ = httpResp.Body.Close()
+	if err != nil {
+		return httpResp, err
+	}
+
+	if httpResp.StatusCode >= http.StatusMultipleChoices {
+		return httpResp, fmt.Errorf("%s (%s)", httpResp.Status, body)
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return httpResp, fmt.Errorf("failed to decode %s response: %w", path, err)
+	}
+	return httpResp, nil
+}
+
+func fromFinnhubStock(exchange Exchange, in finnhubStock) Stock {
+	return Stock{
+		Exchange:       exchange,
+		Description:    in.Description,
+		DisplaySymbol:  in.DisplaySymbol,
+		Symbol:         in.Symbol,
+		Type:           in.Type,
+		Currency:       in.Currency,
+		Mic:            in.Mic,
+		Figi:           in.Figi,
+		ShareClassFigi: in.ShareClassFigi,
+		Isin:           in.Isin,
+		Symbol2:        in.Symbol2,
+	}
+}
+
+// maxPausedRetries is the number of times limitedRequest retries a request
+// that was rejected because of the rate limit. Once it is reached, the
+// ErrToManyRequests is returned to the caller's backoff, which gives up
+// after its MaxElapsedTime if the api keeps rejecting requests.
+const maxPausedRetries = 3
+
+// limitedRequest waits for limiter before calling f and passes the
+// response of f back to limiter. When a request is rejected because of the
+// rate limit and the server said when to retry, the request is retried at
+// exactly that time instead of waiting for the exponential backoff, at most
+// maxPausedRetries times and only if that time is before the deadline of
+// ctx.
+func limitedRequest(ctx context.Context, limiter *RateLimiter, bon backoff.Notify, name string, msg string, f func(ctx context.Context) (*http.Response, error)) error {
+	for retries := 0; ; retries++ {
+		err := limiter.Wait(ctx)
+		if err != nil {
+			return fmt.Errorf("aborting %s: %w", name, err)
+		}
+
+		httpResp, err := f(ctx)
+		paused := limiter.Observe(httpResp)
+		if err == nil {
+			return nil
+		}
+
+		err = handleErr(msg, httpResp, err)
+		if !paused || !errors.Is(err, ErrToManyRequests) || retries >= maxPausedRetries {
+			return err
+		}
+
+		until := limiter.PausedUntil()
+		if deadline, ok := ctx.Deadline(); ok && until.After(deadline) {
+			return err
+		}
+
+		bon(err, time.Until(until))
+	}
+}
+
+// handleErr sorts a failed request into one of the typed errors in api.go.
+// Errors that retrying cannot fix are wrapped with backoff.Permanent so
+// that they end the retry loop immediately.
+func handleErr(msg string, resp *http.Response, err error) error {
+	switch {
+	case resp == nil:
+		return fmt.Errorf("%s: %w", msg, err)
+	case resp.StatusCode == http.StatusUnauthorized:
+		return backoff.Permanent(fmt.Errorf("%s: %w: %v", msg, ErrUnauthorized, err))
+	case resp.StatusCode == http.StatusForbidden:
+		return backoff.Permanent(fmt.Errorf("%s: %w: %v", msg, ErrForbidden, err))
+	case resp.StatusCode == http.StatusNotFound:
+		return backoff.Permanent(fmt.Errorf("%s: %w: %v", msg, ErrNotFound, err))
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%s: %w: %v", msg, ErrToManyRequests, err)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%s: %w: %v", msg, ErrServer, err)
+	case resp.StatusCode >= http.StatusBadRequest:
+		return backoff.Permanent(fmt.Errorf("%s: %w", msg, err))
+	default:
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/Finnhub-Stock-API/finnhub-go"
+	"github.com/ajjensen13/gke"
+	"github.com/ajjensen13/stocker/internal/fixture"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newReplayProvider returns a FinnhubProvider that replays the fixtures in
+// testdata. They are hand-written; testdata/README.md describes how to
+// re-record them. Each test gets its own rate limiter, so that a replayed 429
+// does not pause the other tests.
+func newReplayProvider(t *testing.T) (context.Context, *FinnhubProvider) {
+	t.Helper()
+
+	server := fixture.NewServer("testdata")
+	t.Cleanup(server.Close)
+
+	lg, cleanup, err := gke.NewLogger(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	t.Cleanup(cleanup)
+
+	cfg := finnhub.NewConfiguration()
+	cfg.BasePath = server.URL + "/api/v1"
+	cfg.HTTPClient = server.Client()
+	return util.WithLogger(context.Background(), lg), NewFinnhubProvider(cfg, NewRateLimiter(6000, 100), "token")
+}
+
+func noRetry() backoff.BackOff {
+	return &backoff.StopBackOff{}
+}
+
+func noNotify(error, time.Duration) {}
+
+func date(t *testing.T, s string) time.Time {
+	t.Helper()
+	ret, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestFinnhubProvider_RequestStocks(t *testing.T) {
+	ctx, p := newReplayProvider(t)
+
+	resp, err := p.RequestStocks(ctx, noRetry(), noNotify, StocksRequest{Exchange: "US"})
+	if err != nil {
+		t.Fatalf("RequestStocks() error = %v", err)
+	}
+
+	// the recorded response includes a stock without a symbol, which is skipped
+	var symbols []string
+	for _, s := range resp.Response {
+		symbols = append(symbols, s.Symbol)
+	}
+	if want := []string{"AAPL", "MSFT"}; !reflect.DeepEqual(symbols, want) {
+		t.Errorf("RequestStocks() symbols = %v, want %v", symbols, want)
+	}
+
+	got := resp.Response[0]
+	want := Stock{
+		Exchange:       "US",
+		Description:    "APPLE INC",
+		DisplaySymbol:  "AAPL",
+		Symbol:         "AAPL",
+		Type:           "Common Stock",
+		Currency:       "USD",
+		Mic:            "XNAS",
+		Figi:           "BBG000B9XRY4",
+		ShareClassFigi: "BBG001S5N8V8",
+	}
+	if got != want {
+		t.Errorf("RequestStocks() stock = %+v, want %+v", got, want)
+	}
+}
+
+func TestFinnhubProvider_RequestCandles(t *testing.T) {
+	ctx, p := newReplayProvider(t)
+
+	req := CandlesRequest{Exchange: "US", Symbol: "AAPL", Resolution: "D", From: From(date(t, "2021-01-04")), To: To(date(t, "2021-01-08"))}
+	resp, err := p.RequestCandles(ctx, noRetry(), noNotify, req)
+	if err != nil {
+		t.Fatalf("RequestCandles() error = %v", err)
+	}
+
+	if resp.Request != req {
+		t.Errorf("RequestCandles() request = %+v, want %+v", resp.Request, req)
+	}
+
+	want := Candles{
+		O: []float64{133.52, 128.89, 127.72, 128.36, 132.43},
+		H: []float64{133.6116, 131.74, 131.0499, 131.6261, 132.63},
+		L: []float64{126.76, 128.43, 126.382, 127.86, 130.23},
+		C: []float64{129.41, 131.01, 126.6, 130.92, 132.05},
+		V: []float64{143301887, 97664898, 155087970, 109578157, 105158245},
+		T: []int64{1609718400, 1609804800, 1609891200, 1609977600, 1610064000},
+		S: "ok",
+	}
+	if !reflect.DeepEqual(resp.Response, want) {
+		t.Errorf("RequestCandles() candles = %+v, want %+v", resp.Response, want)
+	}
+}
+
+func TestFinnhubProvider_RequestCompanyProfile(t *testing.T) {
+	ctx, p := newReplayProvider(t)
+
+	resp, err := p.RequestCompanyProfile(ctx, noRetry(), noNotify, CompanyProfileRequest{Exchange: "US", Symbol: "AAPL"})
+	if err != nil {
+		t.Fatalf("RequestCompanyProfile() error = %v", err)
+	}
+
+	want := CompanyProfile{
+		Country:              "US",
+		Currency:             "USD",
+		Exchange:             "NASDAQ NMS - GLOBAL MARKET",
+		Name:                 "Apple Inc",
+		Ticker:               "AAPL",
+		Ipo:                  "1980-12-12",
+		MarketCapitalization: 2221040,
+		SharesOutstanding:    16788.096,
+		Logo:                 "https://finnhub.io/api/logo?symbol=AAPL",
+		Phone:                "14089961010",
+		WebUrl:               "https://www.apple.com/",
+		Industry:             "Technology",
+	}
+	if resp.Response != want {
+		t.Errorf("RequestCompanyProfile() profile = %+v, want %+v", resp.Response, want)
+	}
+}
+
+func TestFinnhubProvider_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func(ctx context.Context, p *FinnhubProvider) error
+		want    error
+	}{
+		{
+			name: "401 unauthorized",
+			request: func(ctx context.Context, p *FinnhubProvider) error {
+				_, err := p.RequestStocks(ctx, noRetry(), noNotify, StocksRequest{Exchange: "XX"})
+				return err
+			},
+			want: ErrUnauthorized,
+		},
+		{
+			name: "403 forbidden",
+			request: func(ctx context.Context, p *FinnhubProvider) error {
+				_, err := p.RequestDividends(ctx, noRetry(), noNotify, CorporateActionsRequest{Exchange: "US", Symbol: "AAPL", From: From(date(t, "2020-01-01")), To: To(date(t, "2021-01-01"))})
+				return err
+			},
+			want: ErrForbidden,
+		},
+		{
+			name: "404 not found",
+			request: func(ctx context.Context, p *FinnhubProvider) error {
+				_, err := p.RequestCandles(ctx, noRetry(), noNotify, CandlesRequest{Exchange: "US", Symbol: "MISSING", Resolution: "D", From: From(date(t, "2021-01-04")), To: To(date(t, "2021-01-08"))})
+				return err
+			},
+			want: ErrNotFound,
+		},
+		{
+			name: "no_data candles",
+			request: func(ctx context.Context, p *FinnhubProvider) error {
+				_, err := p.RequestCandles(ctx, noRetry(), noNotify, CandlesRequest{Exchange: "US", Symbol: "AAPL", Resolution: "D", From: From(date(t, "2020-01-01")), To: To(date(t, "2020-01-01"))})
+				return err
+			},
+			want: ErrNotFound,
+		},
+		{
+			name: "empty company profile",
+			request: func(ctx context.Context, p *FinnhubProvider) error {
+				_, err := p.RequestCompanyProfile(ctx, noRetry(), noNotify, CompanyProfileRequest{Exchange: "US", Symbol: "DELISTED"})
+				return err
+			},
+			want: ErrNotFound,
+		},
+		{
+			// the recorded response asks to retry after 60s, which is past the deadline
+			name: "429 too many requests",
+			request: func(ctx context.Context, p *FinnhubProvider) error {
+				ctx, cancel := context.WithTimeout(ctx, time.Second)
+				defer cancel()
+				_, err := p.RequestCompanyProfile(ctx, noRetry(), noNotify, CompanyProfileRequest{Exchange: "US", Symbol: "MSFT"})
+				return err
+			},
+			want: ErrToManyRequests,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, p := newReplayProvider(t)
+
+			err := tt.request(ctx, p)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
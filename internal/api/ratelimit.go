@@ -0,0 +1,185 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	headerRateLimitRemaining = "X-Ratelimit-Remaining"
+	headerRateLimitReset     = "X-Ratelimit-Reset"
+	headerRetryAfter         = "Retry-After"
+)
+
+// RateLimiter is a token bucket shared by every api request. Tokens are
+// refilled at a fixed rate up to burst. The pace is further restricted by
+// the rate limit headers of each response: once the server reports that no
+// requests remain, or asks the client to retry after some time, all
+// requests wait until that time.
+type RateLimiter struct {
+	mu          sync.Mutex
+	rate        float64 // tokens per second
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	now         func() time.Time
+}
+
+func NewRateLimiter(perMinute int, burst int) *RateLimiter {
+	if perMinute <= 0 {
+		perMinute = 60
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   float64(perMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Wait blocks until a request may be sent or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.reserve(l.now())
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes a token and returns zero, or returns how long to wait
+// before trying again.
+func (l *RateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	return time.Duration(math.Ceil((1 - l.tokens) / l.rate * float64(time.Second)))
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	if elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed*l.rate)
+		l.last = now
+	}
+}
+
+// Observe adjusts the pace of the limiter to the rate limit headers of
+// resp. It reports whether requests have been paused, in which case the
+// next call to Wait sleeps until the server's reset time. A Retry-After
+// header takes precedence over the X-Ratelimit headers.
+func (l *RateLimiter) Observe(resp *http.Response) (paused bool) {
+	if resp == nil {
+		return false
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if retryAfter, ok := parseRetryAfter(resp.Header.Get(headerRetryAfter), now); ok {
+		if !retryAfter.After(now) {
+			return false
+		}
+		l.pause(retryAfter)
+		return true
+	}
+
+	remaining, errRemaining := strconv.Atoi(resp.Header.Get(headerRateLimitRemaining))
+	reset, errReset := strconv.ParseInt(resp.Header.Get(headerRateLimitReset), 10, 64)
+	if errRemaining != nil || errReset != nil {
+		return paused
+	}
+
+	resetTime := time.Unix(reset, 0)
+	if !resetTime.After(now) {
+		return paused
+	}
+
+	l.refill(now)
+	switch {
+	case remaining <= 0:
+		l.pause(resetTime)
+		paused = true
+	case float64(remaining) < l.tokens:
+		l.tokens = float64(remaining)
+	}
+
+	return paused
+}
+
+func (l *RateLimiter) pause(until time.Time) {
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	l.tokens = 1
+	l.last = l.pausedUntil
+}
+
+// PausedUntil returns the time until which requests are paused.
+func (l *RateLimiter) PausedUntil() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pausedUntil
+}
+
+func parseRetryAfter(v string, now time.Time) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var rateLimitStart = time.Date(2021, 1, 7, 12, 0, 0, 0, time.UTC)
+
+// testClock is the clock of a RateLimiter under test. It only moves when
+// advanced.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestRateLimiter returns a RateLimiter with a full bucket whose clock
+// starts at rateLimitStart.
+func newTestRateLimiter(perMinute int, burst int) (*RateLimiter, *testClock) {
+	clock := &testClock{now: rateLimitStart}
+	l := NewRateLimiter(perMinute, burst)
+	l.now = clock.Now
+	l.last = clock.now
+	return l, clock
+}
+
+func TestRateLimiter_reserve(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		want    time.Duration
+	}
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		steps     []step
+	}{
+		{
+			name:      "burst",
+			perMinute: 60,
+			burst:     3,
+			steps:     []step{{0, 0}, {0, 0}, {0, 0}, {0, time.Second}},
+		},
+		{
+			name:      "refill",
+			perMinute: 60,
+			burst:     1,
+			steps:     []step{{0, 0}, {0, time.Second}, {400 * time.Millisecond, 600 * time.Millisecond}, {600 * time.Millisecond, 0}, {0, time.Second}},
+		},
+		{
+			name:      "refill up to burst",
+			perMinute: 120,
+			burst:     2,
+			steps:     []step{{0, 0}, {0, 0}, {time.Minute, 0}, {0, 0}, {0, 500 * time.Millisecond}},
+		},
+		{
+			name:      "defaults",
+			perMinute: 0,
+			burst:     0,
+			steps:     []step{{0, 0}, {0, time.Second}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestRateLimiter(tt.perMinute, tt.burst)
+			for i, s := range tt.steps {
+				clock.advance(s.advance)
+				if got := l.reserve(clock.Now()); got != s.want {
+					t.Errorf("step %d: reserve() = %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Observe(t *testing.T) {
+	unix := func(d time.Duration) string {
+		return strconv.FormatInt(rateLimitStart.Add(d).Unix(), 10)
+	}
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantPaused bool
+		wantUntil  time.Time
+		// wantDelays are the delays of the reservations right after the
+		// response was observed
+		wantDelays []time.Duration
+	}{
+		{
+			name:       "no headers",
+			header:     http.Header{},
+			wantDelays: []time.Duration{0, 0, 0, 0, 0},
+		},
+		{
+			name:       "requests remaining",
+			header:     http.Header{headerRateLimitRemaining: {"2"}, headerRateLimitReset: {unix(time.Minute)}},
+			wantDelays: []time.Duration{0, 0, time.Second},
+		},
+		{
+			name:       "more requests remaining than tokens",
+			header:     http.Header{headerRateLimitRemaining: {"50"}, headerRateLimitReset: {unix(time.Minute)}},
+			wantDelays: []time.Duration{0, 0, 0, 0, 0, time.Second},
+		},
+		{
+			name:       "no requests remaining",
+			header:     http.Header{headerRateLimitRemaining: {"0"}, headerRateLimitReset: {unix(30 * time.Second)}},
+			wantPaused: true,
+			wantUntil:  rateLimitStart.Add(30 * time.Second),
+			wantDelays: []time.Duration{30 * time.Second},
+		},
+		{
+			name:       "reset in the past",
+			header:     http.Header{headerRateLimitRemaining: {"0"}, headerRateLimitReset: {unix(-time.Second)}},
+			wantDelays: []time.Duration{0, 0, 0, 0, 0, time.Second},
+		},
+		{
+			name:       "malformed reset",
+			header:     http.Header{headerRateLimitRemaining: {"0"}, headerRateLimitReset: {"soon"}},
+			wantDelays: []time.Duration{0},
+		},
+		{
+			name:       "retry after seconds",
+			header:     http.Header{headerRetryAfter: {"10"}},
+			wantPaused: true,
+			wantUntil:  rateLimitStart.Add(10 * time.Second),
+			wantDelays: []time.Duration{10 * time.Second},
+		},
+		{
+			name:       "retry after date",
+			header:     http.Header{headerRetryAfter: {rateLimitStart.Add(20 * time.Second).Format(http.TimeFormat)}},
+			wantPaused: true,
+			wantUntil:  rateLimitStart.Add(20 * time.Second),
+			wantDelays: []time.Duration{20 * time.Second},
+		},
+		{
+			name:       "retry after takes precedence",
+			header:     http.Header{headerRetryAfter: {"10"}, headerRateLimitRemaining: {"0"}, headerRateLimitReset: {unix(time.Minute)}},
+			wantPaused: true,
+			wantUntil:  rateLimitStart.Add(10 * time.Second),
+			wantDelays: []time.Duration{10 * time.Second},
+		},
+		{
+			name:       "retry after in the past",
+			header:     http.Header{headerRetryAfter: {"0"}, headerRateLimitRemaining: {"0"}, headerRateLimitReset: {unix(time.Minute)}},
+			wantDelays: []time.Duration{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestRateLimiter(60, 5)
+
+			paused := l.Observe(&http.Response{Header: tt.header})
+			if paused != tt.wantPaused {
+				t.Errorf("Observe() = %v, want %v", paused, tt.wantPaused)
+			}
+			if got := l.PausedUntil(); !got.Equal(tt.wantUntil) {
+				t.Errorf("PausedUntil() = %v, want %v", got, tt.wantUntil)
+			}
+			for i, want := range tt.wantDelays {
+				if got := l.reserve(clock.Now()); got != want {
+					t.Errorf("reservation %d: reserve() = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestRateLimiter_pause checks that requests resume with a single token once
+// a pause ends, and that a pause is only ever extended.
+func TestRateLimiter_pause(t *testing.T) {
+	l, clock := newTestRateLimiter(60, 5)
+
+	l.Observe(&http.Response{Header: http.Header{headerRetryAfter: {"30"}}})
+	l.Observe(&http.Response{Header: http.Header{headerRetryAfter: {"10"}}})
+	if got, want := l.PausedUntil(), rateLimitStart.Add(30*time.Second); !got.Equal(want) {
+		t.Errorf("PausedUntil() = %v, want %v", got, want)
+	}
+
+	clock.advance(10 * time.Second)
+	if got, want := l.reserve(clock.Now()), 20*time.Second; got != want {
+		t.Errorf("reserve() during pause = %v, want %v", got, want)
+	}
+
+	clock.advance(20 * time.Second)
+	if got := l.reserve(clock.Now()); got != 0 {
+		t.Errorf("reserve() after pause = %v, want 0", got)
+	}
+	if got, want := l.reserve(clock.Now()), time.Second; got != want {
+		t.Errorf("second reserve() after pause = %v, want %v", got, want)
+	}
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	l, _ := newTestRateLimiter(60, 1)
+
+	err := l.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("Wait() with a token error = %v", err)
+	}
+
+	l.Observe(&http.Response{Header: http.Header{headerRetryAfter: {"60"}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = l.Wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() while paused error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if l.Observe(nil) {
+		t.Errorf("Observe(nil) paused requests")
+	}
+}
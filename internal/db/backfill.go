@@ -0,0 +1,164 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+// Backfill describes the candles a backfill job run loads.
+type Backfill struct {
+	Exchange    api.Exchange
+	Symbols     []api.Symbol
+	Resolutions []api.Resolution
+	From        time.Time
+	To          time.Time
+}
+
+// CandleChunkDataType returns the data type that tracks the progress of the
+// chunk of candles at resolution that starts at from, e.g.
+// candle_D_20200101 for the daily candles starting on January 1st, 2020.
+func CandleChunkDataType(resolution api.Resolution, from time.Time) DataType {
+	return DataType(fmt.Sprintf("%s_%s", CandleDataType(resolution), from.UTC().Format("20060102")))
+}
+
+func SaveBackfill(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, backfill Backfill) error {
+	symbols := make([]string, len(backfill.Symbols))
+	for i, s := range backfill.Symbols {
+		symbols[i] = string(s)
+	}
+	resolutions := make([]string, len(backfill.Resolutions))
+	for i, r := range backfill.Resolutions {
+		resolutions[i] = string(r)
+	}
+
+	return backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		_, err := pool.Exec(ctx, `
+			INSERT INTO metadata.job_run_backfill 
+				(job_run_id, exchange_code, symbols, resolutions, "from", "to") 
+			VALUES 
+				($1, $2, $3, $4, $5, $6)`, jobRunId, backfill.Exchange, symbols, resolutions, backfill.From, backfill.To)
+		if err != nil {
+			return fmt.Errorf("failed to save backfill of job run %d: %w", jobRunId, err)
+		}
+		return nil
+	}, bo, bon)
+}
+
+func LookupBackfill(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify) (ret Backfill, err error) {
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		var symbols, resolutions []string
+		err := pool.QueryRow(ctx, `
+			SELECT exchange_code, symbols, resolutions, "from", "to" 
+			FROM metadata.job_run_backfill 
+			WHERE job_run_id = $1`, jobRunId).Scan(&ret.Exchange, &symbols, &resolutions, &ret.From, &ret.To)
+		switch {
+		case err == pgx.ErrNoRows:
+			return backoff.Permanent(fmt.Errorf("job run %d is not a backfill", jobRunId))
+		case err != nil:
+			return fmt.Errorf("failed to get backfill of job run %d: %w", jobRunId, err)
+		}
+
+		ret.Symbols = make([]api.Symbol, len(symbols))
+		for i, s := range symbols {
+			ret.Symbols[i] = api.Symbol(s)
+		}
+		ret.Resolutions = make([]api.Resolution, len(resolutions))
+		for i, r := range resolutions {
+			ret.Resolutions[i] = api.Resolution(r)
+		}
+		return nil
+	}, bo, bon)
+	return
+}
+
+// LookupStagedStocks returns the stocks of exchange among symbols that are
+// in stage.stocks. Candles can only be staged for those.
+func LookupStagedStocks(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, exchange api.Exchange, symbols []api.Symbol) (ret []api.Stock, err error) {
+	ss := make([]string, len(symbols))
+	for i, s := range symbols {
+		ss[i] = string(s)
+	}
+
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		rows, err := pool.Query(ctx, `
+			SELECT `+stageStockColumns+`
+			FROM stage.stocks 
+			WHERE exchange_code = $1 AND symbol = ANY($2)`, string(exchange), ss)
+		if err != nil {
+			return fmt.Errorf("failed to get staged stocks: %w", err)
+		}
+		defer rows.Close()
+
+		ret = nil
+		for rows.Next() {
+			stock, err := scanStageStock(rows, exchange)
+			if err != nil {
+				return fmt.Errorf("failed to scan staged stocks: %w", err)
+			}
+			ret = append(ret, stock)
+		}
+		return rows.Err()
+	}, bo, bon)
+	return
+}
+
+// LookupExchangeStocks returns every stock of exchange in stage.stocks,
+// including delisted ones, ordered by symbol.
+func LookupExchangeStocks(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, exchange api.Exchange) (ret []api.Stock, err error) {
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		rows, err := pool.Query(ctx, `
+			SELECT `+stageStockColumns+`
+			FROM stage.stocks 
+			WHERE exchange_code = $1
+			ORDER BY symbol`, string(exchange))
+		if err != nil {
+			return fmt.Errorf("failed to get stocks of exchange %s: %w", exchange, err)
+		}
+		defer rows.Close()
+
+		ret = nil
+		for rows.Next() {
+			stock, err := scanStageStock(rows, exchange)
+			if err != nil {
+				return fmt.Errorf("failed to scan stocks of exchange %s: %w", exchange, err)
+			}
+			ret = append(ret, stock)
+		}
+		return rows.Err()
+	}, bo, bon)
+	return
+}
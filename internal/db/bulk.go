@@ -0,0 +1,40 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+// copyToTemp creates the temporary table name with the given column
+// definitions and copies rows into it with COPY. The table is dropped when
+// tx ends, so it can be used to feed a set-based upsert into the real table.
+func copyToTemp(ctx context.Context, tx pgx.Tx, name string, definitions string, columns []string, rows [][]interface{}) (int64, error) {
+	_, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TEMPORARY TABLE %s (%s) ON COMMIT DROP`, pgx.Identifier{name}.Sanitize(), definitions))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary table %s: %w", name, err)
+	}
+
+	n, err := tx.CopyFrom(ctx, pgx.Identifier{name}, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy into temporary table %s: %w", name, err)
+	}
+	return n, nil
+}
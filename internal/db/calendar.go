@@ -0,0 +1,310 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+// gapResolution is the only resolution whose candles are checked for gaps.
+// Each of its candles is one trading session, stamped at midnight UTC of the
+// session.
+const gapResolution api.Resolution = "D"
+
+// maxGapMerge is the distance up to which gaps are requested together.
+// Requesting a few candles that are already staged is cheaper than another
+// request, and staging them again leaves them unchanged.
+const maxGapMerge = 7 * 24 * time.Hour
+
+// calendarDateLayout is the layout of the dates of trading calendar files.
+const calendarDateLayout = "2006-01-02"
+
+// CalendarDate is a date of a trading calendar file, e.g. "2021-12-24".
+type CalendarDate time.Time
+
+// UnmarshalJSON parses a date in calendarDateLayout.
+func (d *CalendarDate) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	t, err := time.Parse(calendarDateLayout, s)
+	if err != nil {
+		return fmt.Errorf("invalid calendar date %q: %w", s, err)
+	}
+	*d = CalendarDate(t)
+	return nil
+}
+
+// String formats d in calendarDateLayout.
+func (d CalendarDate) String() string {
+	return time.Time(d).Format(calendarDateLayout)
+}
+
+// TradingCalendar is the content of a trading calendar file: the weekdays
+// between CoveredFrom and CoveredTo on which an exchange is closed. Version
+// identifies the content; it is bumped whenever holidays are added or
+// corrected, so that LoadTradingCalendar replaces the loaded holidays.
+type TradingCalendar struct {
+	Exchange    api.Exchange     `json:"exchange"`
+	Version     string           `json:"version"`
+	CoveredFrom CalendarDate     `json:"coveredFrom"`
+	CoveredTo   CalendarDate     `json:"coveredTo"`
+	Holidays    []TradingHoliday `json:"holidays"`
+}
+
+// TradingHoliday is a weekday on which an exchange is closed.
+type TradingHoliday struct {
+	Date CalendarDate `json:"date"`
+	Name string       `json:"name"`
+}
+
+// Validate returns an error if the calendar is incomplete or one of its
+// holidays falls outside of the dates it covers.
+func (c TradingCalendar) Validate() error {
+	switch {
+	case c.Exchange == "":
+		return errors.New("trading calendar has no exchange")
+	case c.Version == "":
+		return fmt.Errorf("trading calendar of exchange %s has no version", c.Exchange)
+	case time.Time(c.CoveredTo).Before(time.Time(c.CoveredFrom)):
+		return fmt.Errorf("trading calendar of exchange %s covers %v to %v", c.Exchange, c.CoveredFrom, c.CoveredTo)
+	}
+
+	for _, holiday := range c.Holidays {
+		date := time.Time(holiday.Date)
+		if date.Before(time.Time(c.CoveredFrom)) || date.After(time.Time(c.CoveredTo)) {
+			return fmt.Errorf("holiday %v (%s) is outside of the trading calendar of exchange %s", holiday.Date, holiday.Name, c.Exchange)
+		}
+	}
+	return nil
+}
+
+// Covers reports whether the calendar covers every session up to t.
+func (c TradingCalendar) Covers(t time.Time) bool {
+	return !time.Time(c.CoveredTo).Before(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+}
+
+// LoadTradingCalendar replaces the trading calendar of the exchange of cal
+// unless the version of cal is loaded already. loaded is false if it was.
+func LoadTradingCalendar(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, cal TradingCalendar) (loaded bool, err error) {
+	ctx = util.WithLoggerValue(ctx, "action", "load_trading_calendar")
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			tag, err := tx.Exec(ctx, `
+				INSERT INTO metadata.trading_calendars 
+					(exchange_code, version, covered_from, covered_to, created, modified)
+				VALUES 
+					($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+				ON CONFLICT 
+					(exchange_code)
+				DO UPDATE
+					SET
+						version = excluded.version,
+						covered_from = excluded.covered_from,
+						covered_to = excluded.covered_to,
+						modified = excluded.modified
+					WHERE
+						trading_calendars.version IS DISTINCT FROM excluded.version`,
+				cal.Exchange, cal.Version, time.Time(cal.CoveredFrom), time.Time(cal.CoveredTo))
+			if err != nil {
+				return fmt.Errorf("failed to save trading calendar of exchange %s: %w", cal.Exchange, err)
+			}
+
+			loaded = tag.RowsAffected() > 0
+			if !loaded {
+				return nil
+			}
+
+			_, err = tx.Exec(ctx, `DELETE FROM metadata.trading_holidays WHERE exchange_code = $1`, cal.Exchange)
+			if err != nil {
+				return fmt.Errorf("failed to delete trading holidays of exchange %s: %w", cal.Exchange, err)
+			}
+
+			rows := make([][]interface{}, len(cal.Holidays))
+			for i, holiday := range cal.Holidays {
+				rows[i] = []interface{}{cal.Exchange, time.Time(holiday.Date), holiday.Name}
+			}
+
+			_, err = tx.CopyFrom(ctx, pgx.Identifier{"metadata", "trading_holidays"},
+				[]string{"exchange_code", "date", "name"},
+				pgx.CopyFromRows(rows))
+			if err != nil {
+				return fmt.Errorf("failed to save trading holidays of exchange %s: %w", cal.Exchange, err)
+			}
+			return nil
+		})
+	}, bo, bon)
+
+	return
+}
+
+// CandleGapPolicy configures how missing trading sessions are handled.
+type CandleGapPolicy struct {
+	// MaxRetries is the number of job runs that re-request a gap after it
+	// was first detected. Gaps detected more often are assumed to be
+	// sessions the symbol did not trade in, e.g. because it was halted.
+	// Zero disables re-requesting gaps.
+	MaxRetries int `json:"maxRetries"`
+}
+
+// CandleGap is a range of trading sessions missing from stage.candles.
+type CandleGap struct {
+	From time.Time
+	To   time.Time
+}
+
+// GapInfo summarizes a gap-detection pass.
+type GapInfo struct {
+	// GapsDetected is the number of sessions still missing.
+	GapsDetected int64
+	// GapsFilled is the number of sessions missing before the pass that
+	// are no longer missing.
+	GapsFilled int64
+}
+
+// DetectCandleGaps records the trading sessions missing from stage.candles
+// between the first and the last candle of key in stage.candle_gaps, and
+// removes the gaps that were filled. Sessions come from the trading calendar
+// of the exchange; exchanges without a calendar have no gaps, and neither
+// do the days outside of the dates the calendar covers.
+func DetectCandleGaps(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, key CandleKey) (ret GapInfo, err error) {
+	if key.Resolution != gapResolution {
+		return GapInfo{}, nil
+	}
+
+	ctx = util.WithLoggerValue(ctx, "action", "detect_gaps")
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			err := tx.QueryRow(ctx, `
+				WITH bounds AS (
+					SELECT 
+						MIN((timestamp AT TIME ZONE 'UTC')::date) AS first, 
+						MAX((timestamp AT TIME ZONE 'UTC')::date) AS last
+					FROM stage.candles
+					WHERE exchange_code = $2 AND symbol = $3 AND resolution = $4
+				), missing AS (
+					SELECT sessions.session AS date
+					FROM bounds, metadata.trading_sessions($2, bounds.first, bounds.last) sessions
+					WHERE NOT EXISTS (
+						SELECT 
+						FROM stage.candles
+						WHERE 
+							candles.exchange_code = $2 AND 
+							candles.symbol = $3 AND 
+							candles.resolution = $4 AND
+							candles.timestamp >= sessions.session::timestamp AT TIME ZONE 'UTC' AND 
+							candles.timestamp < (sessions.session + 1)::timestamp AT TIME ZONE 'UTC'
+					)
+				), filled AS (
+					DELETE FROM stage.candle_gaps
+					WHERE 
+						exchange_code = $2 AND 
+						symbol = $3 AND 
+						resolution = $4 AND
+						date NOT IN (SELECT date FROM missing)
+					RETURNING 1
+				), detected AS (
+					INSERT INTO stage.candle_gaps 
+						(job_run_id, exchange_code, symbol, resolution, date, detections, created, modified)
+					SELECT 
+						$1, $2, $3, $4, date, 1, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+					FROM missing
+					ON CONFLICT 
+						(exchange_code, symbol, resolution, date)
+					DO UPDATE
+						SET
+							job_run_id = excluded.job_run_id,
+							detections = candle_gaps.detections + 1,
+							modified = excluded.modified
+						WHERE
+							candle_gaps.job_run_id IS DISTINCT FROM excluded.job_run_id
+				)
+				SELECT
+					(SELECT COUNT(*) FROM missing),
+					(SELECT COUNT(*) FROM filled)
+				`, jobRunId, key.Exchange, key.Symbol, key.Resolution).Scan(&ret.GapsDetected, &ret.GapsFilled)
+			if err != nil {
+				return fmt.Errorf("failed to detect candle gaps of %v (%v): %w", key.Symbol, key.Resolution, err)
+			}
+			return nil
+		})
+	}, bo, bon)
+
+	return
+}
+
+// LookupCandleGaps returns the gaps of key that are to be re-requested,
+// ordered by time. Gaps less than maxGapMerge apart are merged.
+func LookupCandleGaps(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, policy CandleGapPolicy, key CandleKey) (ret []CandleGap, err error) {
+	if key.Resolution != gapResolution || policy.MaxRetries <= 0 {
+		return nil, nil
+	}
+
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		rows, err := pool.Query(ctx, `
+			SELECT date 
+			FROM stage.candle_gaps 
+			WHERE exchange_code = $1 AND symbol = $2 AND resolution = $3 AND detections <= $4
+			ORDER BY date`, key.Exchange, key.Symbol, key.Resolution, policy.MaxRetries)
+		if err != nil {
+			return fmt.Errorf("failed to query candle gaps: %w", err)
+		}
+		defer rows.Close()
+
+		ret = nil
+		for rows.Next() {
+			var date time.Time
+			err := rows.Scan(&date)
+			if err != nil {
+				return fmt.Errorf("failed to scan candle gaps: %w", err)
+			}
+
+			from := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+			to := from.Add(24*time.Hour - time.Second)
+			if n := len(ret); n > 0 && from.Sub(ret[n-1].To) <= maxGapMerge {
+				ret[n-1].To = to
+				continue
+			}
+			ret = append(ret, CandleGap{From: from, To: to})
+		}
+		return rows.Err()
+	}, bo, bon)
+
+	return
+}
@@ -0,0 +1,149 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTradingCalendarFiles checks the trading calendar files shipped with
+// the image: they must validate and list each holiday once, in order, on a
+// weekday.
+func TestTradingCalendarFiles(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "..", "calendars", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no trading calendar files found")
+	}
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var cal TradingCalendar
+			err = json.Unmarshal(b, &cal)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = cal.Validate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var previous time.Time
+			for _, holiday := range cal.Holidays {
+				date := time.Time(holiday.Date)
+				if !date.After(previous) {
+					t.Errorf("holiday %v (%s) is not after %v", holiday.Date, holiday.Name, previous.Format(calendarDateLayout))
+				}
+				if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+					t.Errorf("holiday %v (%s) is on a %v", holiday.Date, holiday.Name, date.Weekday())
+				}
+				previous = date
+			}
+		})
+	}
+}
+
+func TestTradingCalendar_Validate(t *testing.T) {
+	date := func(s string) CalendarDate {
+		d, err := time.Parse(calendarDateLayout, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CalendarDate(d)
+	}
+
+	valid := func() TradingCalendar {
+		return TradingCalendar{
+			Exchange:    "US",
+			Version:     "1",
+			CoveredFrom: date("2021-01-01"),
+			CoveredTo:   date("2021-12-31"),
+			Holidays:    []TradingHoliday{{Date: date("2021-01-01"), Name: "New Year's Day"}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *TradingCalendar)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(c *TradingCalendar) {}},
+		{name: "no holidays", modify: func(c *TradingCalendar) { c.Holidays = nil }},
+		{name: "no exchange", modify: func(c *TradingCalendar) { c.Exchange = "" }, wantErr: true},
+		{name: "no version", modify: func(c *TradingCalendar) { c.Version = "" }, wantErr: true},
+		{name: "covered to before covered from", modify: func(c *TradingCalendar) { c.CoveredTo = date("2020-12-31") }, wantErr: true},
+		{name: "holiday before covered from", modify: func(c *TradingCalendar) { c.Holidays[0].Date = date("2020-12-25") }, wantErr: true},
+		{name: "holiday after covered to", modify: func(c *TradingCalendar) { c.Holidays[0].Date = date("2022-01-17") }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal := valid()
+			tt.modify(&cal)
+			err := cal.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTradingCalendar_Covers(t *testing.T) {
+	cal := TradingCalendar{CoveredTo: CalendarDate(time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC))}
+
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{t: time.Date(2021, 12, 30, 0, 0, 0, 0, time.UTC), want: true},
+		{t: time.Date(2021, 12, 31, 23, 59, 59, 0, time.UTC), want: true},
+		{t: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), want: false},
+	}
+	for _, tt := range tests {
+		if got := cal.Covers(tt.t); got != tt.want {
+			t.Errorf("Covers(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestCalendarDate_UnmarshalJSON(t *testing.T) {
+	var d CalendarDate
+	err := json.Unmarshal([]byte(`"2021-12-24"`), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2021, 12, 24, 0, 0, 0, 0, time.UTC); !time.Time(d).Equal(want) {
+		t.Errorf("got %v, want %v", d, want)
+	}
+
+	err = json.Unmarshal([]byte(`"2021-12-24T00:00:00Z"`), &d)
+	if err == nil {
+		t.Error("expected an error for a timestamp")
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"cloud.google.com/go/logging"
 	"context"
 	"fmt"
-	"github.com/Finnhub-Stock-API/finnhub-go"
 	"github.com/ajjensen13/stocker/internal/api"
 	"github.com/ajjensen13/stocker/internal/util"
 	"github.com/cenkalti/backoff/v4"
@@ -32,16 +31,19 @@ import (
 )
 
 type Candle struct {
-	Symbol    pgtype.Text
-	Timestamp pgtype.Timestamptz
-	Open      pgtype.Float4
-	High      pgtype.Float4
-	Low       pgtype.Float4
-	Close     pgtype.Float4
-	Volume    pgtype.Float4
+	ExchangeCode pgtype.Text
+	Symbol       pgtype.Text
+	Resolution   pgtype.Text
+	Timestamp    pgtype.Timestamptz
+	Open         pgtype.Float8
+	High         pgtype.Float8
+	Low          pgtype.Float8
+	Close        pgtype.Float8
+	Volume       pgtype.Float8
 }
 
 type CompanyProfile struct {
+	ExchangeCode         pgtype.Text
 	Symbol               pgtype.Text
 	Country              pgtype.Text
 	Currency             pgtype.Text
@@ -49,8 +51,8 @@ type CompanyProfile struct {
 	Name                 pgtype.Text
 	Ticker               pgtype.Text
 	Ipo                  pgtype.Date
-	MarketCapitalization pgtype.Float4
-	SharesOutstanding    pgtype.Float4
+	MarketCapitalization pgtype.Float8
+	SharesOutstanding    pgtype.Float8
 	Logo                 pgtype.Text
 	Phone                pgtype.Text
 	WebUrl               pgtype.Text
@@ -58,12 +60,20 @@ type CompanyProfile struct {
 }
 
 type Stock struct {
-	Symbol        pgtype.Text
-	DisplaySymbol pgtype.Text
-	Description   pgtype.Text
+	ExchangeCode   pgtype.Text
+	Symbol         pgtype.Text
+	DisplaySymbol  pgtype.Text
+	Description    pgtype.Text
+	SecurityType   pgtype.Text
+	Currency       pgtype.Text
+	Mic            pgtype.Text
+	Figi           pgtype.Text
+	ShareClassFigi pgtype.Text
+	Isin           pgtype.Text
+	Symbol2        pgtype.Text
 }
 
-func TransformStocks(in []finnhub.Stock) (out []Stock) {
+func TransformStocks(in []api.Stock) (out []Stock) {
 	out = make([]Stock, len(in))
 	for i, es := range in {
 		out[i] = TransformStock(es)
@@ -71,26 +81,44 @@ func TransformStocks(in []finnhub.Stock) (out []Stock) {
 	return out
 }
 
-func TransformStock(s finnhub.Stock) (out Stock) {
+func TransformStock(s api.Stock) (out Stock) {
+	_ = out.ExchangeCode.Set(string(s.Exchange))
 	_ = out.Symbol.Set(s.Symbol)
 	_ = out.DisplaySymbol.Set(s.DisplaySymbol)
 	_ = out.Description.Set(s.Description)
+	setOptionalText(&out.SecurityType, s.Type)
+	setOptionalText(&out.Currency, s.Currency)
+	setOptionalText(&out.Mic, s.Mic)
+	setOptionalText(&out.Figi, s.Figi)
+	setOptionalText(&out.ShareClassFigi, s.ShareClassFigi)
+	setOptionalText(&out.Isin, s.Isin)
+	setOptionalText(&out.Symbol2, s.Symbol2)
 	return
 }
 
+// setOptionalText sets dst to s, or to NULL when s is empty. Providers
+// omit the metadata they do not know rather than sending null.
+func setOptionalText(dst *pgtype.Text, s string) {
+	if s == "" {
+		_ = dst.Set(nil)
+		return
+	}
+	_ = dst.Set(s)
+}
+
 func TransformStockCandles(in []api.CandlesResponse, tz *time.Location) (out [][]Candle, err error) {
 	ret := make([][]Candle, len(in))
 	for i, candle := range in {
-		c, err := TransformCandles(candle.Request.Symbol, candle.Response, tz)
+		c, err := TransformCandles(candle.Request.Exchange, candle.Request.Symbol, candle.Request.Resolution, candle.Response, tz)
 		if err != nil {
-			return nil, fmt.Errorf("failed to transform %s stock candles: %w", candle.Request.Symbol, err)
+			return nil, fmt.Errorf("failed to transform %s stock candles (%s): %w", candle.Request.Symbol, candle.Request.Resolution, err)
 		}
 		ret[i] = c
 	}
 	return ret, nil
 }
 
-func TransformCandles(symbol api.Symbol, in finnhub.StockCandles, tz *time.Location) (out []Candle, err error) {
+func TransformCandles(exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, in api.Candles, tz *time.Location) (out []Candle, err error) {
 	l := len(in.T)
 	switch {
 	case l == 0:
@@ -109,7 +137,9 @@ func TransformCandles(symbol api.Symbol, in finnhub.StockCandles, tz *time.Locat
 
 	out = make([]Candle, l)
 	for ndx, ts := range in.T {
+		_ = out[ndx].ExchangeCode.Set(string(exchange))
 		_ = out[ndx].Symbol.Set(string(symbol))
+		_ = out[ndx].Resolution.Set(string(resolution))
 		_ = out[ndx].Timestamp.Set(time.Unix(ts, 0).In(tz))
 		_ = out[ndx].Open.Set(in.O[ndx])
 		_ = out[ndx].High.Set(in.H[ndx])
@@ -121,7 +151,8 @@ func TransformCandles(symbol api.Symbol, in finnhub.StockCandles, tz *time.Locat
 	return out, nil
 }
 
-func TransformCompanyProfile(symbol api.Symbol, in finnhub.CompanyProfile2) (out CompanyProfile) {
+func TransformCompanyProfile(exchange api.Exchange, symbol api.Symbol, in api.CompanyProfile) (out CompanyProfile) {
+	_ = out.ExchangeCode.Set(string(exchange))
 	_ = out.Symbol.Set(string(symbol))
 	_ = out.Country.Set(in.Country)
 	_ = out.Currency.Set(in.Currency)
@@ -130,11 +161,11 @@ func TransformCompanyProfile(symbol api.Symbol, in finnhub.CompanyProfile2) (out
 	_ = out.Ticker.Set(in.Ticker)
 	_ = out.Ipo.Set(in.Ipo)
 	_ = out.MarketCapitalization.Set(in.MarketCapitalization)
-	_ = out.SharesOutstanding.Set(in.ShareOutstanding)
+	_ = out.SharesOutstanding.Set(in.SharesOutstanding)
 	_ = out.Logo.Set(in.Logo)
 	_ = out.Phone.Set(in.Phone)
-	_ = out.WebUrl.Set(in.Weburl)
-	_ = out.Industry.Set(in.FinnhubIndustry)
+	_ = out.WebUrl.Set(in.WebUrl)
+	_ = out.Industry.Set(in.Industry)
 	return
 }
 
@@ -145,22 +176,38 @@ func SaveStocks(ctx context.Context, pool *pgxpool.Pool, jobRunId uint64, bo bac
 		defer cancel()
 
 		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
-			success := 0
+			rows := make([][]interface{}, len(stocks.Response))
+			for i, stock := range stocks.Response {
+				rows[i] = []interface{}{stock.Exchange, stock.Symbol, stock}
+			}
 
-			for _, stock := range stocks.Response {
-				_, err := tx.Exec(ctx, `INSERT INTO src.stocks (job_run_id, symbol, data) VALUES ($1, $2, $3)`, jobRunId, stock.Symbol, stock)
-				if err != nil {
-					return fmt.Errorf("failed to load stock symbol %q: %w", stock.Symbol, err)
-				}
-				success++
+			_, err := copyToTemp(ctx, tx, "stocks_load", `exchange_code text NOT NULL, symbol text NOT NULL, data jsonb`, []string{"exchange_code", "symbol", "data"}, rows)
+			if err != nil {
+				return fmt.Errorf("failed to load stocks: %w", err)
+			}
+
+			r, err := tx.Exec(ctx, `
+				INSERT INTO src.stocks 
+					(job_run_id, exchange_code, symbol, data) 
+				SELECT DISTINCT ON (exchange_code, symbol) 
+					$1, exchange_code, symbol, data 
+				FROM stocks_load
+				ON CONFLICT 
+					(job_run_id, exchange_code, symbol) 
+				DO UPDATE 
+					SET data = excluded.data`, jobRunId)
+			if err != nil {
+				return fmt.Errorf("failed to load stocks: %w", err)
 			}
 
-			util.Logf(ctx, logging.Debug, "successfully inserted %d of %d stocks into src.stocks", success, len(stocks.Response))
+			util.Logf(ctx, logging.Debug, "successfully inserted %d of %d stocks into src.stocks", r.RowsAffected(), len(stocks.Response))
 			return nil
 		})
 	}, bo, bon)
 }
 
+// SaveCandles saves candles to src.candles. Each requested range is kept in
+// its own row, so the chunks of a backfill do not replace each other.
 func SaveCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, candles api.CandlesResponse) error {
 	ctx = util.WithLoggerValue(ctx, "action", "load")
 	return backoff.RetryNotify(func() (err error) {
@@ -168,9 +215,9 @@ func SaveCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo ba
 		defer cancel()
 
 		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
-			_, err = tx.Exec(ctx, `INSERT INTO src.candles (job_run_id, symbol, "from", "to", data) VALUES ($1, $2, $3, $4, $5)`, jobRunId, candles.Request.Symbol, candles.Request.From, candles.Request.To, candles.Response)
+			_, err = tx.Exec(ctx, `INSERT INTO src.candles (job_run_id, exchange_code, symbol, resolution, "from", "to", data) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (job_run_id, exchange_code, symbol, resolution, "from", "to") DO UPDATE SET data = excluded.data`, jobRunId, candles.Request.Exchange, candles.Request.Symbol, candles.Request.Resolution, candles.Request.From, candles.Request.To, candles.Response)
 			if err != nil {
-				return fmt.Errorf("failed to load stock symbol %q: %w", candles.Request.Symbol, err)
+				return fmt.Errorf("failed to load stock symbol %q (%s): %w", candles.Request.Symbol, candles.Request.Resolution, err)
 			}
 			return nil
 		})
@@ -184,7 +231,7 @@ func SaveCompanyProfile(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool
 		defer cancel()
 
 		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
-			_, err = tx.Exec(ctx, `INSERT INTO src.company_profiles (job_run_id, symbol, data) VALUES ($1, $2, $3)`, jobRunId, profiles.Request.Symbol, profiles.Response)
+			_, err = tx.Exec(ctx, `INSERT INTO src.company_profiles (job_run_id, exchange_code, symbol, data) VALUES ($1, $2, $3, $4) ON CONFLICT (job_run_id, exchange_code, symbol) DO UPDATE SET data = excluded.data`, jobRunId, profiles.Request.Exchange, profiles.Request.Symbol, profiles.Response)
 			if err != nil {
 				return fmt.Errorf("failed to load company profile %q: %w", profiles.Request.Symbol, err)
 			}
@@ -211,36 +258,96 @@ func StageStocks(ctx context.Context, pool *pgxpool.Pool, jobRunId uint64, bo ba
 			stocks := TransformStocks(srcStocks)
 
 			summary := make(map[string]bool, len(stocks))
-			for _, stock := range stocks {
-				ctx := util.WithLoggerValue(ctx, "symbol", stock.Symbol)
+			rows := make([][]interface{}, len(stocks))
+			for i, stock := range stocks {
+				rows[i] = []interface{}{stock.ExchangeCode, stock.Symbol, stock.DisplaySymbol, stock.Description, stock.SecurityType, stock.Currency, stock.Mic, stock.Figi, stock.ShareClassFigi, stock.Isin, stock.Symbol2}
+				summary[stock.ExchangeCode.String+":"+stock.Symbol.String] = false
+			}
 
-				sql := `
-					INSERT INTO stage.stocks
-						(job_run_id, symbol, display_symbol, description, created, modified) 
-					VALUES 
-						($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
-					ON CONFLICT 
-						(symbol) 
-					DO UPDATE 
-						SET 
-							job_run_id = excluded.job_run_id,
-							display_symbol = excluded.display_symbol,
-							description = excluded.description,
-							modified = excluded.modified
-						WHERE
-							stocks.display_symbol IS DISTINCT FROM excluded.display_symbol OR
-							stocks.description IS DISTINCT FROM excluded.description`
+			rowsStaged, err = copyToTemp(ctx, tx, "stocks_stage", `exchange_code text NOT NULL, symbol text NOT NULL, display_symbol text, description text, security_type text, currency text, mic text, figi text, share_class_figi text, isin text, symbol2 text`, []string{"exchange_code", "symbol", "display_symbol", "description", "security_type", "currency", "mic", "figi", "share_class_figi", "isin", "symbol2"}, rows)
+			if err != nil {
+				return fmt.Errorf("error while staging stocks: %w", err)
+			}
+
+			var restored int64
+			err = tx.QueryRow(ctx, `
+				SELECT COUNT(*)
+				FROM stage.stocks
+				JOIN stocks_stage USING (exchange_code, symbol)
+				WHERE stocks.delisted_at IS NOT NULL`).Scan(&restored)
+			if err != nil {
+				return fmt.Errorf("error while looking up restored stocks: %w", err)
+			}
+
+			sql := `
+				INSERT INTO stage.stocks
+					(job_run_id, exchange_code, symbol, display_symbol, description, security_type, currency, mic, figi, share_class_figi, isin, symbol2, created, modified) 
+				SELECT DISTINCT ON (exchange_code, symbol)
+					$1, exchange_code, symbol, display_symbol, description, security_type, currency, mic, figi, share_class_figi, isin, symbol2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+				FROM stocks_stage
+				ON CONFLICT 
+					(exchange_code, symbol) 
+				DO UPDATE 
+					SET 
+						job_run_id = excluded.job_run_id,
+						display_symbol = excluded.display_symbol,
+						description = excluded.description,
+						security_type = excluded.security_type,
+						currency = excluded.currency,
+						mic = excluded.mic,
+						figi = excluded.figi,
+						share_class_figi = excluded.share_class_figi,
+						isin = excluded.isin,
+						symbol2 = excluded.symbol2,
+						delisted_at = NULL,
+						delisted_job_run_id = NULL,
+						modified = excluded.modified
+					WHERE
+						stocks.delisted_at IS NOT NULL OR
+						stocks.display_symbol IS DISTINCT FROM excluded.display_symbol OR
+						stocks.description IS DISTINCT FROM excluded.description OR
+						stocks.security_type IS DISTINCT FROM excluded.security_type OR
+						stocks.currency IS DISTINCT FROM excluded.currency OR
+						stocks.mic IS DISTINCT FROM excluded.mic OR
+						stocks.figi IS DISTINCT FROM excluded.figi OR
+						stocks.share_class_figi IS DISTINCT FROM excluded.share_class_figi OR
+						stocks.isin IS DISTINCT FROM excluded.isin OR
+						stocks.symbol2 IS DISTINCT FROM excluded.symbol2
+				RETURNING exchange_code, symbol`
+
+			modified, err := tx.Query(ctx, sql, jobRunId)
+			if err != nil {
+				return fmt.Errorf("error while staging stocks: %w", err)
+			}
+			defer modified.Close()
 
-				r, err := tx.Exec(ctx, sql, jobRunId, stock.Symbol, stock.DisplaySymbol, stock.Description)
+			for modified.Next() {
+				var exchange, symbol string
+				err := modified.Scan(&exchange, &symbol)
 				if err != nil {
-					return fmt.Errorf("error while staging stocks: %w", err)
+					return fmt.Errorf("error while reading staged stocks: %w", err)
 				}
 
-				rowsModified += r.RowsAffected()
-				rowsStaged++
+				rowsModified++
+				summary[exchange+":"+symbol] = true
+			}
+			if err := modified.Err(); err != nil {
+				return fmt.Errorf("error while staging stocks: %w", err)
+			}
+			modified.Close()
 
-				summary[stock.Symbol.String] = r.RowsAffected() > 0
+			delisted, err := delistMissingStocks(ctx, tx, jobRunId)
+			if err != nil {
+				return fmt.Errorf("error while staging stocks: %w", err)
 			}
+			rowsModified += delisted
+			util.Logf(ctx, logging.Info, "marked %d stocks as delisted, restored %d stocks", delisted, restored)
+
+			versions, err := updateHistory(ctx, tx, jobRunId, "stocks", stocksHistoryColumns)
+			if err != nil {
+				return fmt.Errorf("error while staging stocks: %w", err)
+			}
+			util.Logf(ctx, logging.Debug, "recorded %d new versions of stocks", versions)
 
 			util.Logf(util.WithLoggerValue(ctx, "stock_stage_info", summary), logging.Debug, "successfully staged stocks")
 
@@ -258,16 +365,87 @@ func StageStocks(ctx context.Context, pool *pgxpool.Pool, jobRunId uint64, bo ba
 	return
 }
 
-func lookupStocksToStage(ctx context.Context, jobRunId uint64, tx pgx.Tx) (ret []finnhub.Stock, err error) {
-	rows, err := tx.Query(ctx, `SELECT data FROM src.stocks WHERE job_run_id = $1`, jobRunId)
+// delistMissingStocks marks the listed stocks of the staged exchanges
+// that are missing from stocks_stage as delisted by jobRunId. Exchanges
+// without any staged stock are left alone, so that an empty response does
+// not delist a whole exchange.
+func delistMissingStocks(ctx context.Context, tx pgx.Tx, jobRunId uint64) (int64, error) {
+	sql := `
+		UPDATE stage.stocks
+		SET 
+			job_run_id = $1,
+			delisted_at = CURRENT_TIMESTAMP,
+			delisted_job_run_id = $1,
+			modified = CURRENT_TIMESTAMP
+		WHERE 
+			delisted_at IS NULL AND
+			exchange_code IN (SELECT DISTINCT exchange_code FROM stocks_stage) AND
+			NOT EXISTS (
+				SELECT 1 
+				FROM stocks_stage 
+				WHERE stocks_stage.exchange_code = stocks.exchange_code AND stocks_stage.symbol = stocks.symbol
+			)`
+
+	tag, err := tx.Exec(ctx, sql, jobRunId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark missing stocks as delisted: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// LookupDelistedStocks returns the stocks of exchange that are marked as
+// delisted in the stage schema.
+func LookupDelistedStocks(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, exchange api.Exchange) (ret []api.Stock, err error) {
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		ret = nil
+		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, `
+				SELECT `+stageStockColumns+`
+				FROM stage.stocks 
+				WHERE exchange_code = $1 AND delisted_at IS NOT NULL`, string(exchange))
+			if err != nil {
+				return fmt.Errorf("failed to get delisted stocks: %w", err)
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				stock, err := scanStageStock(rows, exchange)
+				if err != nil {
+					return fmt.Errorf("failed to scan delisted stocks: %w", err)
+				}
+				ret = append(ret, stock)
+			}
+			return rows.Err()
+		})
+	}, bo, bon)
+	return
+}
+
+// stageStockColumns are the columns of stage.stocks read by scanStageStock.
+const stageStockColumns = `symbol, display_symbol, description, COALESCE(security_type, ''), COALESCE(currency, ''),
+	COALESCE(mic, ''), COALESCE(figi, ''), COALESCE(share_class_figi, ''), COALESCE(isin, ''), COALESCE(symbol2, '')`
+
+// scanStageStock scans a row of stageStockColumns of a stock on exchange.
+func scanStageStock(rows pgx.Rows, exchange api.Exchange) (api.Stock, error) {
+	stock := api.Stock{Exchange: exchange}
+	err := rows.Scan(&stock.Symbol, &stock.DisplaySymbol, &stock.Description, &stock.Type, &stock.Currency,
+		&stock.Mic, &stock.Figi, &stock.ShareClassFigi, &stock.Isin, &stock.Symbol2)
+	return stock, err
+}
+
+func lookupStocksToStage(ctx context.Context, jobRunId uint64, tx pgx.Tx) (ret []api.Stock, err error) {
+	rows, err := tx.Query(ctx, `SELECT exchange_code, data FROM src.stocks WHERE job_run_id = $1`, jobRunId)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get source stocks: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var src finnhub.Stock
-		err := rows.Scan(&src)
+		var src api.Stock
+		err := rows.Scan(&src.Exchange, &src)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan source stocks: %w", err)
 		}
@@ -277,17 +455,22 @@ func lookupStocksToStage(ctx context.Context, jobRunId uint64, tx pgx.Tx) (ret [
 	return ret, nil
 }
 
-func StageCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, tz *time.Location) (ret StagingInfo, err error) {
+// StageCandles stages the candles of resp that were saved to src.candles by
+// jobRunId, i.e. those of the ranges within the requested range of resp. The
+// candles are checked by ValidateCandles first. Quarantined
+// candles are not staged, and all rejections are recorded in
+// stage.candle_rejections.
+func StageCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, tz *time.Location, validation CandleValidation, resp api.CandlesResponse) (ret StagingInfo, err error) {
 	ctx = util.WithLoggerValue(ctx, "action", "stage")
 	err = backoff.RetryNotify(func() error {
-		var rowsStaged, rowsModified int64
+		var rowsStaged, rowsModified, rowsRejected, rowsFlagged int64
 		var srcCandles []api.CandlesResponse
 
 		err := util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) (err error) {
 			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 			defer cancel()
 
-			srcCandles, err = lookupCandlesToStage(ctx, jobRunId, tx)
+			srcCandles, err = lookupCandlesToStage(ctx, jobRunId, resp.Request, tx)
 			return err
 		})
 		if err != nil {
@@ -303,48 +486,91 @@ func StageCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo b
 				return err
 			}
 
+			var all []Candle
 			for _, stockCandles := range candles {
-				summary := map[string]int{}
-
-				for _, stockCandle := range stockCandles {
-					ctx := util.WithLoggerValue(ctx, "symbol", stockCandle.Symbol)
-
-					sql := `
-						INSERT INTO stage.candles
-							(job_run_id, symbol, timestamp, open, high, low, close, volume, modified, created) 
-						VALUES 
-							($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
-						ON CONFLICT 
-							(symbol, timestamp) 
-						DO UPDATE 
-							SET 
-								job_run_id = excluded.job_run_id,
-								open = excluded.open,
-								high = excluded.high,
-								low = excluded.low,
-								close = excluded.close,
-								volume = excluded.volume,
-								modified = excluded.modified
-							WHERE
-								candles.open IS DISTINCT FROM excluded.open OR
-								candles.high IS DISTINCT FROM excluded.high OR
-								candles.low IS DISTINCT FROM excluded.low OR
-								candles.close IS DISTINCT FROM excluded.close OR
-								candles.volume IS DISTINCT FROM excluded.volume`
-
-					r, err := tx.Exec(ctx, sql, jobRunId, stockCandle.Symbol, stockCandle.Timestamp, stockCandle.Open, stockCandle.High, stockCandle.Low, stockCandle.Close, stockCandle.Volume)
-					if err != nil {
-						return fmt.Errorf("error while staging candles: %w", err)
+				all = append(all, stockCandles...)
+			}
+
+			var valid []Candle
+			var rejections []CandleRejection
+			if len(all) > 0 {
+				from := all[0].Timestamp.Time
+				for _, c := range all {
+					if c.Timestamp.Time.Before(from) {
+						from = c.Timestamp.Time
 					}
+				}
 
-					rowsModified += r.RowsAffected()
-					rowsStaged++
+				previous, splits, err := lookupValidationContext(ctx, tx, resp.Request.Exchange, resp.Request.Symbol, resp.Request.Resolution, from)
+				if err != nil {
+					return fmt.Errorf("failed to validate candles: %w", err)
+				}
+				valid, rejections = ValidateCandles(all, previous, splits, validation)
+			}
 
-					summary[stockCandle.Symbol.String] = 1 + summary[stockCandle.Symbol.String]
+			rowsRejected, rowsFlagged = 0, 0
+			for _, r := range rejections {
+				if r.Staged {
+					rowsFlagged++
+				} else {
+					rowsRejected++
 				}
+			}
+
+			err = saveCandleRejections(ctx, tx, jobRunId, resp.Request, rejections)
+			if err != nil {
+				return err
+			}
+			if len(rejections) > 0 {
+				util.Logf(ctx, logging.Warning, "candles for symbol %s (%s) failed validation: %d rejected, %d flagged", resp.Request.Symbol, resp.Request.Resolution, rowsRejected, rowsFlagged)
+			}
+
+			summary := map[string]int{}
+			var rows [][]interface{}
+			for _, c := range valid {
+				rows = append(rows, []interface{}{c.ExchangeCode, c.Symbol, c.Resolution, c.Timestamp, c.Open, c.High, c.Low, c.Close, c.Volume})
+				key := c.ExchangeCode.String + ":" + c.Symbol.String
+				summary[key] = 1 + summary[key]
+			}
 
-				util.Logf(util.WithLoggerValue(ctx, "candle_stage_info", summary), logging.Debug, "successfully staged %d candles", len(candles))
+			rowsStaged, err = copyToTemp(ctx, tx, "candles_stage",
+				`exchange_code text NOT NULL, symbol text NOT NULL, resolution text NOT NULL, timestamp timestamp WITH TIME ZONE NOT NULL, open double precision, high double precision, low double precision, close double precision, volume double precision`,
+				[]string{"exchange_code", "symbol", "resolution", "timestamp", "open", "high", "low", "close", "volume"}, rows)
+			if err != nil {
+				return fmt.Errorf("error while staging candles: %w", err)
+			}
+
+			sql := `
+				INSERT INTO stage.candles
+					(job_run_id, exchange_code, symbol, resolution, timestamp, open, high, low, close, volume, modified, created) 
+				SELECT DISTINCT ON (exchange_code, symbol, resolution, timestamp)
+					$1, exchange_code, symbol, resolution, timestamp, open, high, low, close, volume, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+				FROM candles_stage
+				ON CONFLICT 
+					(exchange_code, symbol, resolution, timestamp) 
+				DO UPDATE 
+					SET 
+						job_run_id = excluded.job_run_id,
+						open = excluded.open,
+						high = excluded.high,
+						low = excluded.low,
+						close = excluded.close,
+						volume = excluded.volume,
+						modified = excluded.modified
+					WHERE
+						candles.open IS DISTINCT FROM excluded.open OR
+						candles.high IS DISTINCT FROM excluded.high OR
+						candles.low IS DISTINCT FROM excluded.low OR
+						candles.close IS DISTINCT FROM excluded.close OR
+						candles.volume IS DISTINCT FROM excluded.volume`
+
+			r, err := tx.Exec(ctx, sql, jobRunId)
+			if err != nil {
+				return fmt.Errorf("error while staging candles: %w", err)
 			}
+			rowsModified = r.RowsAffected()
+
+			util.Logf(util.WithLoggerValue(ctx, "candle_stage_info", summary), logging.Debug, "successfully staged %d candles", rowsStaged)
 
 			return nil
 		})
@@ -353,15 +579,19 @@ func StageCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo b
 			return fmt.Errorf("failed to stage candles: %w", err)
 		}
 
-		ret = StagingInfo{RowsModified: rowsModified, RowsStaged: rowsStaged}
+		ret = StagingInfo{RowsModified: rowsModified, RowsStaged: rowsStaged, RowsRejected: rowsRejected, RowsFlagged: rowsFlagged}
 		return nil
 	}, bo, bon)
 
 	return
 }
 
-func lookupCandlesToStage(ctx context.Context, jobRunId uint64, tx pgx.Tx) (ret []api.CandlesResponse, err error) {
-	rows, err := tx.Query(ctx, `SELECT symbol, data FROM src.candles WHERE job_run_id = $1`, jobRunId)
+func lookupCandlesToStage(ctx context.Context, jobRunId uint64, req api.CandlesRequest, tx pgx.Tx) (ret []api.CandlesResponse, err error) {
+	rows, err := tx.Query(ctx, `
+		SELECT exchange_code, symbol, resolution, data 
+		FROM src.candles 
+		WHERE job_run_id = $1 AND exchange_code = $2 AND symbol = $3 AND resolution = $4 AND "from" >= $5 AND "to" <= $6`,
+		jobRunId, req.Exchange, req.Symbol, req.Resolution, time.Time(req.From), time.Time(req.To))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get source candles: %w", err)
 	}
@@ -369,7 +599,7 @@ func lookupCandlesToStage(ctx context.Context, jobRunId uint64, tx pgx.Tx) (ret
 
 	for rows.Next() {
 		var d api.CandlesResponse
-		err := rows.Scan(&d.Request.Symbol, &d.Response)
+		err := rows.Scan(&d.Request.Exchange, &d.Request.Symbol, &d.Request.Resolution, &d.Response)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan source candles: %w", err)
 		}
@@ -401,18 +631,17 @@ func StageCompanyProfiles(ctx context.Context, jobRunId uint64, pool *pgxpool.Po
 			ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 			defer cancel()
 
+			batch := &pgx.Batch{}
 			for _, response := range responses {
-				ctx := util.WithLoggerValue(ctx, "symbol", response.Request.Symbol)
-
-				profile := TransformCompanyProfile(response.Request.Symbol, response.Response)
+				profile := TransformCompanyProfile(response.Request.Exchange, response.Request.Symbol, response.Response)
 
 				sql := `
 					INSERT INTO stage.company_profiles
-						(job_run_id, symbol, exchange, country, currency, name, ticker, ipo, market_capitalization, shares_outstanding, logo, phone, web_url, industry, created, modified)
+						(job_run_id, exchange_code, symbol, exchange, country, currency, name, ticker, ipo, market_capitalization, shares_outstanding, logo, phone, web_url, industry, created, modified)
 					VALUES
-						($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) 
+						($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) 
 					ON CONFLICT 
-						(symbol) 
+						(exchange_code, symbol) 
 					DO UPDATE 
 						SET 
 							job_run_id = excluded.job_run_id,
@@ -444,17 +673,38 @@ func StageCompanyProfiles(ctx context.Context, jobRunId uint64, pool *pgxpool.Po
 							company_profiles.industry IS DISTINCT FROM excluded.industry
 `
 
-				r, err := tx.Exec(ctx, sql, jobRunId, response.Request.Symbol, profile.Exchange, profile.Country, profile.Currency, profile.Name, profile.Ticker, profile.Ipo, profile.MarketCapitalization, profile.SharesOutstanding, profile.Logo, profile.Phone, profile.WebUrl, profile.Industry)
+				batch.Queue(sql, jobRunId, profile.ExchangeCode, response.Request.Symbol, profile.Exchange, profile.Country, profile.Currency, profile.Name, profile.Ticker, profile.Ipo, profile.MarketCapitalization, profile.SharesOutstanding, profile.Logo, profile.Phone, profile.WebUrl, profile.Industry)
+			}
+
+			results := tx.SendBatch(ctx, batch)
+			defer results.Close()
+
+			for _, response := range responses {
+				r, err := results.Exec()
 				if err != nil {
-					return fmt.Errorf("error while staging company profiles: %w", err)
+					return fmt.Errorf("error while staging company profile %q: %w", response.Request.Symbol, err)
 				}
 
 				rowsModified += r.RowsAffected()
 				rowsStaged++
+			}
 
-				util.Logf(ctx, logging.Debug, "successfully staged company profile: %v", response.Request.Symbol)
+			if err := results.Close(); err != nil {
+				return err
+			}
+
+			// unchanged profiles are not updated above, but they are still up to date
+			err := saveStagedProfileRefreshes(ctx, tx, jobRunId)
+			if err != nil {
+				return fmt.Errorf("error while marking company profiles refreshed: %w", err)
 			}
 
+			versions, err := updateHistory(ctx, tx, jobRunId, "company_profiles", companyProfilesHistoryColumns)
+			if err != nil {
+				return fmt.Errorf("error while staging company profiles: %w", err)
+			}
+
+			util.Logf(ctx, logging.Debug, "successfully staged %d company profiles, recorded %d new versions", rowsStaged, versions)
 			return nil
 		})
 
@@ -472,7 +722,7 @@ func StageCompanyProfiles(ctx context.Context, jobRunId uint64, pool *pgxpool.Po
 func lookupCompanyProfilesToStage(ctx context.Context, jobRunId uint64, tx pgx.Tx) (ret []api.CompanyProfileResponse, err error) {
 	ret = make([]api.CompanyProfileResponse, 0, 50_000) // should be big enough for a while
 
-	rows, err := tx.Query(ctx, `SELECT symbol, data FROM src.company_profiles WHERE job_run_id = $1`, jobRunId)
+	rows, err := tx.Query(ctx, `SELECT exchange_code, symbol, data FROM src.company_profiles WHERE job_run_id = $1`, jobRunId)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get source company profiles: %w", err)
 	}
@@ -480,7 +730,7 @@ func lookupCompanyProfilesToStage(ctx context.Context, jobRunId uint64, tx pgx.T
 
 	for rows.Next() {
 		var d api.CompanyProfileResponse
-		err := rows.Scan(&d.Request.Symbol, &d.Response)
+		err := rows.Scan(&d.Request.Exchange, &d.Request.Symbol, &d.Response)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan source company profile: %w", err)
 		}
@@ -492,24 +742,29 @@ func lookupCompanyProfilesToStage(ctx context.Context, jobRunId uint64, tx pgx.T
 
 func StageCandles52Wk(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, candles api.CandlesResponse) (ret StagingInfo, err error) {
 	ctx = util.WithLoggerValue(ctx, "action", "stage")
+	ctx = util.WithLoggerValue(ctx, "exchange", candles.Request.Exchange)
+	ctx = util.WithLoggerValue(ctx, "symbol", candles.Request.Symbol)
+	ctx = util.WithLoggerValue(ctx, "resolution", candles.Request.Resolution)
 
 	err = backoff.RetryNotify(func() error {
 		err := util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
 			ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 			defer cancel()
 
-			a, ac, err := calcAffected52WkCandles(ctx, jobRunId, tx, candles)
+			adjusted, err := adjustCandles(ctx, tx, jobRunId, candles.Request.Exchange, candles.Request.Symbol, candles.Request.Resolution, false)
 			if err != nil {
 				return err
 			}
-			util.Logf(ctx, logging.Debug, "successfully calculated %d affected 52wk candles for symbol %s", ac, candles.Request.Symbol)
+			if adjusted > 0 {
+				util.Logf(ctx, logging.Info, "adjusted %d candles for symbol %s (%s) to corporate actions", adjusted, candles.Request.Symbol, candles.Request.Resolution)
+			}
 
-			r, err := updateAffected52WkCandles(ctx, tx, jobRunId, a)
+			ret, err = update52WkCandles(ctx, tx, jobRunId, candles.Request.Exchange, candles.Request.Symbol, candles.Request.Resolution)
 			if err != nil {
 				return err
 			}
 
-			ret = StagingInfo{RowsModified: r, RowsStaged: ac}
+			util.Logf(ctx, logging.Debug, "successfully updated %d affected 52wk candles for symbol %s (%s) (%d rows modified)", ret.RowsStaged, candles.Request.Symbol, candles.Request.Resolution, ret.RowsModified)
 			return nil
 		})
 
@@ -523,126 +778,122 @@ func StageCandles52Wk(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool,
 	return
 }
 
-func updateAffected52WkCandles(ctx context.Context, tx pgx.Tx, jobRunId uint64, affected map[string][]time.Time) (int64, error) {
-	var rowsModified int64
-	var rowsAffected int64
-
-	for symbol, timestamps := range affected {
-		var symbolRowsModified int64
-		ctx := util.WithLoggerValue(ctx, "symbol", symbol)
-		for _, timestamp := range timestamps {
-			modified, err := updateOneAffected52WkCandle(ctx, tx, jobRunId, symbol, timestamp)
-			if err != nil {
-				return 0, err
-			}
-			symbolRowsModified += modified
-		}
-
-		util.Logf(ctx, logging.Debug, fmt.Sprintf("successfully updated %d affected 52wk candles for symbol %s (%d rows modified)", len(timestamps), symbol, symbolRowsModified))
-
-		rowsModified += symbolRowsModified
-		rowsAffected += int64(len(timestamps))
-	}
-
-	util.Logf(ctx, logging.Debug, "successfully updated %d affected 52wk candles for %d symbols (%d rows modified)", rowsAffected, len(affected), rowsModified)
-	return rowsModified, nil
-}
-
-func updateOneAffected52WkCandle(ctx context.Context, tx pgx.Tx, jobRunId uint64, symbol string, timestamp time.Time) (int64, error) {
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-
-	r, err := tx.Exec(ctx, `
-		INSERT INTO stage.candles_52wk 
-			(job_run_id, symbol, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified) 
-		SELECT 
-			$1 as job_run_id, symbol, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified
-		FROM stage.calculate_candles_52wk 
-		WHERE 
-			calculate_candles_52wk.symbol = $2
-			AND calculate_candles_52wk.timestamp = $3
-		ON CONFLICT (symbol, timestamp) 
-		DO UPDATE 
-			SET 
-				job_run_id = excluded.job_run_id,
-				high_52wk = excluded.high_52wk, 
-				low_52wk = excluded.low_52wk, 
-				volume_52wk_avg = excluded.volume_52wk_avg, 
-				open = excluded.open, 
-				high = excluded.high, 
-				low = excluded.low,
-				close = excluded.close, 
-				volume = excluded.volume, 
-				modified = excluded.modified,
-				timestamp_52wk_count = excluded.timestamp_52wk_count
-			WHERE 
-				candles_52wk.high_52wk IS DISTINCT FROM excluded.high_52wk OR 
-				candles_52wk.low_52wk IS DISTINCT FROM excluded.low_52wk OR 
-				candles_52wk.volume_52wk_avg IS DISTINCT FROM excluded.volume_52wk_avg OR 
-				candles_52wk.open IS DISTINCT FROM excluded.open OR 
-				candles_52wk.high IS DISTINCT FROM excluded.high OR 
-				candles_52wk.low IS DISTINCT FROM excluded.low OR
-				candles_52wk.close IS DISTINCT FROM excluded.close OR 
-				candles_52wk.volume IS DISTINCT FROM excluded.volume OR
-				candles_52wk.timestamp_52wk_count IS DISTINCT FROM excluded.timestamp_52wk_count
-		`, jobRunId, symbol, timestamp)
-
-	if err != nil {
-		return 0, fmt.Errorf("failed to update 52 week candle %v %v: %w", symbol, timestamp, err)
-	}
-
-	return r.RowsAffected(), nil
-}
-
-func calcAffected52WkCandles(ctx context.Context, jobRunId uint64, tx pgx.Tx, resp api.CandlesResponse) (map[string][]time.Time, int64, error) {
-	var rowsAffected int64
-	rs, err := tx.Query(ctx, `
+// update52WkCandles recalculates the 52 week candles of symbol on exchange
+// at resolution that are affected by the candles staged by job run
+// jobRunId, i.e. the candles up to 52 weeks after a staged candle. It
+// computes the same values as the stage.calculate_candles_52wk view, but
+// with a single pass of window functions over the symbol's candles instead
+// of a self-join per candle.
+// RANGE frames with an interval offset require PostgreSQL 11 or later.
+//
+// The statistics are calculated from adjusted prices and volumes, see
+// adjustCandles, and then converted back to the raw scale of each candle.
+// That way a split inside the 52 week window does not show up as a new
+// high or low, and corporate actions after the window do not change them.
+func update52WkCandles(ctx context.Context, tx pgx.Tx, jobRunId uint64, exchange api.Exchange, symbol api.Symbol, resolution api.Resolution) (StagingInfo, error) {
+	var ret StagingInfo
+	err := tx.QueryRow(ctx, `
+		WITH calculated AS (
+			SELECT
+				exchange_code,
+				symbol,
+				resolution,
+				timestamp,
+				open,
+				high,
+				low,
+				close,
+				volume,
+				created,
+				modified,
+				MAX(high * split_factor * dividend_factor) OVER w / (split_factor * dividend_factor) AS high_52wk,
+				MIN(low * split_factor * dividend_factor) OVER w / (split_factor * dividend_factor)  AS low_52wk,
+				AVG(volume / split_factor) OVER w * split_factor                                     AS volume_52wk_avg,
+				COUNT(timestamp) OVER w                                                              AS timestamp_52wk_count,
+				MAX(CASE WHEN job_run_id = $1 THEN timestamp END) OVER w                             AS staged_52wk
+			FROM stage.candles
+			WHERE
+				exchange_code = $2
+				AND symbol = $3
+				AND resolution = $4
+				AND timestamp >= (
+					SELECT MIN(timestamp) - INTERVAL '52 weeks'
+					FROM stage.candles
+					WHERE exchange_code = $2 AND symbol = $3 AND resolution = $4 AND job_run_id = $1
+				)
+			WINDOW w AS (ORDER BY timestamp RANGE BETWEEN INTERVAL '52 weeks' PRECEDING AND CURRENT ROW)
+		),
+		affected AS (
+			SELECT * FROM calculated WHERE staged_52wk IS NOT NULL
+		),
+		upserted AS (
+			INSERT INTO stage.candles_52wk 
+				(job_run_id, exchange_code, symbol, resolution, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified, timestamp_52wk_count) 
+			SELECT 
+				$1 as job_run_id, exchange_code, symbol, resolution, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified, timestamp_52wk_count
+			FROM affected
+			ON CONFLICT (exchange_code, symbol, resolution, timestamp) 
+			DO UPDATE 
+				SET 
+					job_run_id = excluded.job_run_id,
+					high_52wk = excluded.high_52wk, 
+					low_52wk = excluded.low_52wk, 
+					volume_52wk_avg = excluded.volume_52wk_avg, 
+					open = excluded.open, 
+					high = excluded.high, 
+					low = excluded.low,
+					close = excluded.close, 
+					volume = excluded.volume, 
+					modified = excluded.modified,
+					timestamp_52wk_count = excluded.timestamp_52wk_count
+				WHERE 
+					candles_52wk.high_52wk IS DISTINCT FROM excluded.high_52wk OR 
+					candles_52wk.low_52wk IS DISTINCT FROM excluded.low_52wk OR 
+					candles_52wk.volume_52wk_avg IS DISTINCT FROM excluded.volume_52wk_avg OR 
+					candles_52wk.open IS DISTINCT FROM excluded.open OR 
+					candles_52wk.high IS DISTINCT FROM excluded.high OR 
+					candles_52wk.low IS DISTINCT FROM excluded.low OR
+					candles_52wk.close IS DISTINCT FROM excluded.close OR 
+					candles_52wk.volume IS DISTINCT FROM excluded.volume OR
+					candles_52wk.timestamp_52wk_count IS DISTINCT FROM excluded.timestamp_52wk_count
+			RETURNING 1
+		)
 		SELECT
-			affected.symbol,
-			affected.timestamp
-		FROM stage.candles modified
-		JOIN stage.candles affected
-			ON modified.symbol = affected.symbol
-			AND affected.timestamp BETWEEN modified.timestamp - INTERVAL '52 week' AND modified.timestamp
-		WHERE
-			modified.symbol = $1
-			AND modified.job_run_id = $2
-		GROUP BY
-			affected.symbol,
-			affected.timestamp
-		`, resp.Request.Symbol, jobRunId)
-	if err != nil {
-		return nil, 0, fmt.Errorf("error while determining affected 52 week candles: %w", err)
-	}
-	defer rs.Close()
+			(SELECT COUNT(*) FROM affected),
+			(SELECT COUNT(*) FROM upserted)
+		`, jobRunId, exchange, symbol, resolution).Scan(&ret.RowsStaged, &ret.RowsModified)
 
-	var ret = map[string][]time.Time{}
-	for rs.Next() {
-		var symbol string
-		var timestamp time.Time
-		err := rs.Scan(&symbol, &timestamp)
-		if err != nil {
-			return nil, 0, fmt.Errorf("error while reading affected 52 week candles: %w", err)
-		}
-
-		rowsAffected++
-		if _, ok := ret[symbol]; !ok {
-			ret[symbol] = []time.Time{timestamp}
-			continue
-		}
-
-		ret[symbol] = append(ret[symbol], timestamp)
+	if err != nil {
+		return StagingInfo{}, fmt.Errorf("failed to update 52 week candles %v (%v): %w", symbol, resolution, err)
 	}
 
-	return ret, rowsAffected, nil
+	return ret, nil
 }
 
 type StagingInfo struct {
 	RowsModified int64
 	RowsStaged   int64
+	// RowsRejected and RowsFlagged count the candles that failed validation
+	// and were quarantined or staged anyway, respectively.
+	RowsRejected int64
+	RowsFlagged  int64
+}
+
+// StockKey identifies a symbol on an exchange. The same symbol may be
+// listed on several exchanges.
+type StockKey struct {
+	Exchange api.Exchange
+	Symbol   api.Symbol
+}
+
+// CandleKey identifies the candle series of a symbol at one resolution.
+type CandleKey struct {
+	Exchange   api.Exchange
+	Symbol     api.Symbol
+	Resolution api.Resolution
 }
 
-type LatestCandles map[api.Symbol]LatestCandleTime
+type LatestCandles map[CandleKey]LatestCandleTime
 type LatestCandleTime time.Time
 
 func LookupLatestCandles(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify) (LatestCandles, error) {
@@ -654,12 +905,12 @@ func LookupLatestCandles(ctx context.Context, pool *pgxpool.Pool, bo backoff.Bac
 		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
 			rows, err := pool.Query(ctx, `
 				SELECT DISTINCT 
-					candles.symbol, max(candles.timestamp) 
+					candles.exchange_code, candles.symbol, candles.resolution, max(candles.timestamp) 
 				FROM stage.candles 
 				JOIN metadata.job_run
 					ON candles.job_run_id = job_run.id
 				WHERE job_run.success = TRUE
-				GROUP BY candles.symbol`)
+				GROUP BY candles.exchange_code, candles.symbol, candles.resolution`)
 			if err != nil {
 				return fmt.Errorf("failed to query latest stocks: %w", err)
 			}
@@ -667,13 +918,13 @@ func LookupLatestCandles(ctx context.Context, pool *pgxpool.Pool, bo backoff.Bac
 
 			ret = make(LatestCandles)
 			for rows.Next() {
-				var symbol api.Symbol
+				var key CandleKey
 				var timestamp time.Time
-				err := rows.Scan(&symbol, &timestamp)
+				err := rows.Scan(&key.Exchange, &key.Symbol, &key.Resolution, &timestamp)
 				if err != nil {
 					return fmt.Errorf("failed to parse latest stocks: %w", err)
 				}
-				ret[symbol] = LatestCandleTime(timestamp)
+				ret[key] = LatestCandleTime(timestamp)
 			}
 			return nil
 		})
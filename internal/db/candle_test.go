@@ -0,0 +1,226 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDatabaseUrl names the environment variable that holds the url of a
+// migrated database for tests that need one. The tests roll back their
+// changes, but should not be pointed at a production database anyway.
+const testDatabaseUrl = "STOCKER_TEST_DATABASE_URL"
+
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	u := os.Getenv(testDatabaseUrl)
+	if u == "" {
+		t.Skipf("%s is not set", testDatabaseUrl)
+	}
+
+	pool, err := pgxpool.Connect(context.Background(), u)
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// TestUpdate52WkCandles_matchesView checks that update52WkCandles stages
+// the same values as the stage.calculate_candles_52wk view. The fixture
+// series has a candle exactly 52 weeks after the first one and one a day
+// later, a gap of three months and a gap longer than 52 weeks, and is
+// adjusted for a split and a dividend inside the window.
+func TestUpdate52WkCandles_matchesView(t *testing.T) {
+	ctx := context.Background()
+	pool := testPool(t)
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var jobRunId uint64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO metadata.job_run (job_definition_id, started) 
+		SELECT id, CURRENT_TIMESTAMP FROM metadata.job_definition WHERE name = 'Finnhub ETL'
+		RETURNING id`).Scan(&jobRunId)
+	if err != nil {
+		t.Fatalf("failed to create job run: %v", err)
+	}
+
+	const exchange, symbol, resolution = "TEST", "TEST52WK", "D"
+	_, err = tx.Exec(ctx, `
+		INSERT INTO stage.stocks (job_run_id, exchange_code, symbol, description, created, modified) 
+		VALUES ($1, $2, $3, 'update52WkCandles fixture', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`, jobRunId, exchange, symbol)
+	if err != nil {
+		t.Fatalf("failed to create stock: %v", err)
+	}
+
+	first := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var timestamps []time.Time
+	for ts := first; ts.Before(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)); ts = ts.AddDate(0, 0, 1) {
+		switch {
+		case ts.Weekday() == time.Saturday || ts.Weekday() == time.Sunday:
+		case !ts.Before(time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)) && ts.Before(time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)):
+		default:
+			timestamps = append(timestamps, ts)
+		}
+	}
+	timestamps = append(timestamps, time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	for i, ts := range timestamps {
+		price := 100 + float64(i%37) - float64(i%11)*1.5
+		_, err = tx.Exec(ctx, `
+			INSERT INTO stage.candles (job_run_id, exchange_code, symbol, resolution, timestamp, open, high, low, close, volume, created, modified) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+			jobRunId, exchange, symbol, resolution, ts, price, price+float64(i%5), price-float64(i%7), price+0.5, float64(1000+i*13%997))
+		if err != nil {
+			t.Fatalf("failed to create candle %v: %v", ts, err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE stage.candles 
+		SET 
+			split_factor = CASE WHEN timestamp < '2020-03-02' THEN 0.25 ELSE 1 END,
+			dividend_factor = CASE WHEN timestamp < '2020-06-01' THEN 0.99 ELSE 1 END
+		WHERE exchange_code = $1 AND symbol = $2 AND resolution = $3`, exchange, symbol, resolution)
+	if err != nil {
+		t.Fatalf("failed to adjust candles: %v", err)
+	}
+
+	info, err := update52WkCandles(ctx, tx, jobRunId, exchange, symbol, resolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RowsStaged != int64(len(timestamps)) {
+		t.Errorf("update52WkCandles() staged %d rows, want %d", info.RowsStaged, len(timestamps))
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT COALESCE(w.timestamp, v.timestamp), w.timestamp_52wk_count, v.timestamp_52wk_count
+		FROM (SELECT * FROM stage.candles_52wk WHERE exchange_code = $1 AND symbol = $2 AND resolution = $3) w
+			FULL JOIN (SELECT * FROM stage.calculate_candles_52wk WHERE exchange_code = $1 AND symbol = $2 AND resolution = $3) v
+			ON w.timestamp = v.timestamp
+		WHERE 
+			w.timestamp IS NULL 
+			OR v.timestamp IS NULL
+			OR w.timestamp_52wk_count IS DISTINCT FROM v.timestamp_52wk_count
+			OR ABS(w.high_52wk - v.high_52wk) > 1e-6 * ABS(v.high_52wk)
+			OR ABS(w.low_52wk - v.low_52wk) > 1e-6 * ABS(v.low_52wk)
+			OR ABS(w.volume_52wk_avg - v.volume_52wk_avg) > 1e-6 * ABS(v.volume_52wk_avg)
+		ORDER BY 1`, exchange, symbol, resolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ts time.Time
+		var got, want *int64
+		err = rows.Scan(&ts, &got, &want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Errorf("52 week candle %v differs from view (count %v, want %v)", ts, got, want)
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+
+	// the window of the candle 52 weeks after the first one still includes
+	// it, the window of the candle a day later starts a day later
+	for ts, want := range map[time.Time]int64{first: 1, first.AddDate(0, 0, 364): 195, first.AddDate(0, 0, 365): 195, timestamps[len(timestamps)-1]: 1} {
+		var got int64
+		err = tx.QueryRow(ctx, `
+			SELECT timestamp_52wk_count FROM stage.candles_52wk 
+			WHERE exchange_code = $1 AND symbol = $2 AND resolution = $3 AND timestamp = $4`, exchange, symbol, resolution, ts).Scan(&got)
+		if err != nil {
+			t.Fatalf("failed to get 52 week candle %v: %v", ts, err)
+		}
+		if got != want {
+			t.Errorf("52 week candle %v count = %d, want %d", ts, got, want)
+		}
+	}
+}
+
+// TestLookupCandlesToStage_keepsChunks checks that the chunks of a backfill
+// are kept side by side in src.candles and that each chunk stages only its
+// own candles.
+func TestLookupCandlesToStage_keepsChunks(t *testing.T) {
+	ctx := context.Background()
+	pool := testPool(t)
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var jobRunId uint64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO metadata.job_run (job_definition_id, started) 
+		SELECT id, CURRENT_TIMESTAMP FROM metadata.job_definition WHERE name = 'Finnhub ETL'
+		RETURNING id`).Scan(&jobRunId)
+	if err != nil {
+		t.Fatalf("failed to create job run: %v", err)
+	}
+
+	chunks := []api.CandlesRequest{
+		{Exchange: "TEST", Symbol: "TESTCHUNK", Resolution: "D", From: api.From(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)), To: api.To(time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC))},
+		{Exchange: "TEST", Symbol: "TESTCHUNK", Resolution: "D", From: api.From(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)), To: api.To(time.Date(2020, 12, 31, 23, 59, 59, 0, time.UTC))},
+	}
+	for i, req := range chunks {
+		data := api.Candles{O: []float64{1}, H: []float64{1}, L: []float64{1}, C: []float64{1}, V: []float64{1}, T: []int64{time.Time(req.From).Unix()}, S: "ok"}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO src.candles (job_run_id, exchange_code, symbol, resolution, "from", "to", data) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			jobRunId, req.Exchange, req.Symbol, req.Resolution, time.Time(req.From), time.Time(req.To), data)
+		if err != nil {
+			t.Fatalf("failed to save chunk %d: %v", i, err)
+		}
+	}
+
+	for i, req := range chunks {
+		got, err := lookupCandlesToStage(ctx, jobRunId, req, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || len(got[0].Response.T) != 1 || got[0].Response.T[0] != time.Time(req.From).Unix() {
+			t.Errorf("chunk %d: got %+v, want the candles of the chunk only", i, got)
+		}
+	}
+
+	all := chunks[0]
+	all.To = chunks[1].To
+	got, err := lookupCandlesToStage(ctx, jobRunId, all, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(chunks) {
+		t.Errorf("got %d chunks, want %d", len(got), len(chunks))
+	}
+}
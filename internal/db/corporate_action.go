@@ -0,0 +1,468 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"cloud.google.com/go/logging"
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+type Split struct {
+	ExchangeCode pgtype.Text
+	Symbol       pgtype.Text
+	Date         pgtype.Date
+	FromFactor   pgtype.Float8
+	ToFactor     pgtype.Float8
+}
+
+type Dividend struct {
+	ExchangeCode    pgtype.Text
+	Symbol          pgtype.Text
+	Date            pgtype.Date
+	Amount          pgtype.Float8
+	AdjustedAmount  pgtype.Float8
+	PayDate         pgtype.Date
+	RecordDate      pgtype.Date
+	DeclarationDate pgtype.Date
+	Currency        pgtype.Text
+}
+
+func TransformSplit(exchange api.Exchange, symbol api.Symbol, in api.Split) (out Split, err error) {
+	_ = out.ExchangeCode.Set(string(exchange))
+	_ = out.Symbol.Set(string(symbol))
+	err = out.Date.Set(in.Date)
+	if err != nil {
+		return Split{}, fmt.Errorf("invalid split date %q: %w", in.Date, err)
+	}
+	if in.FromFactor <= 0 || in.ToFactor <= 0 {
+		return Split{}, fmt.Errorf("invalid split factors %v:%v", in.FromFactor, in.ToFactor)
+	}
+	_ = out.FromFactor.Set(in.FromFactor)
+	_ = out.ToFactor.Set(in.ToFactor)
+	return out, nil
+}
+
+func TransformDividend(exchange api.Exchange, symbol api.Symbol, in api.Dividend) (out Dividend, err error) {
+	_ = out.ExchangeCode.Set(string(exchange))
+	_ = out.Symbol.Set(string(symbol))
+	err = out.Date.Set(in.Date)
+	if err != nil {
+		return Dividend{}, fmt.Errorf("invalid ex-dividend date %q: %w", in.Date, err)
+	}
+	_ = out.Amount.Set(in.Amount)
+	_ = out.AdjustedAmount.Set(in.AdjustedAmount)
+	setOptionalDate(&out.PayDate, in.PayDate)
+	setOptionalDate(&out.RecordDate, in.RecordDate)
+	setOptionalDate(&out.DeclarationDate, in.DeclarationDate)
+	setOptionalText(&out.Currency, in.Currency)
+	return out, nil
+}
+
+// setOptionalDate sets dst to the date s, or to NULL when s is empty or
+// not a date.
+func setOptionalDate(dst *pgtype.Date, s string) {
+	if s == "" || dst.Set(s) != nil {
+		_ = dst.Set(nil)
+	}
+}
+
+func SaveSplits(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, splits api.SplitsResponse) error {
+	ctx = util.WithLoggerValue(ctx, "action", "load")
+	return backoff.RetryNotify(func() (err error) {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		_, err = pool.Exec(ctx, `INSERT INTO src.splits (job_run_id, exchange_code, symbol, "from", "to", data) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (job_run_id, exchange_code, symbol) DO UPDATE SET "from" = excluded."from", "to" = excluded."to", data = excluded.data`, jobRunId, splits.Request.Exchange, splits.Request.Symbol, splits.Request.From, splits.Request.To, splits.Response)
+		if err != nil {
+			return fmt.Errorf("failed to load splits %q: %w", splits.Request.Symbol, err)
+		}
+		return nil
+	}, bo, bon)
+}
+
+func SaveDividends(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, dividends api.DividendsResponse) error {
+	ctx = util.WithLoggerValue(ctx, "action", "load")
+	return backoff.RetryNotify(func() (err error) {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		_, err = pool.Exec(ctx, `INSERT INTO src.dividends (job_run_id, exchange_code, symbol, "from", "to", data) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (job_run_id, exchange_code, symbol) DO UPDATE SET "from" = excluded."from", "to" = excluded."to", data = excluded.data`, jobRunId, dividends.Request.Exchange, dividends.Request.Symbol, dividends.Request.From, dividends.Request.To, dividends.Response)
+		if err != nil {
+			return fmt.Errorf("failed to load dividends %q: %w", dividends.Request.Symbol, err)
+		}
+		return nil
+	}, bo, bon)
+}
+
+// StageCorporateActions stages the splits and dividends of a stock that
+// were loaded by jobRunId. The src schema holds every corporate action of
+// the requested range, so staged corporate actions in that range that are
+// no longer reported are removed. If any corporate action of the stock
+// changed, the adjustment factors of all of its candles are updated, see
+// adjustCandles.
+func StageCorporateActions(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, key StockKey) (ret StagingInfo, err error) {
+	ctx = util.WithLoggerValue(ctx, "action", "stage")
+
+	err = backoff.RetryNotify(func() error {
+		ret = StagingInfo{}
+
+		err := util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			defer cancel()
+
+			splits, err := stageSplits(ctx, tx, jobRunId, key)
+			if err != nil {
+				return err
+			}
+
+			dividends, err := stageDividends(ctx, tx, jobRunId, key)
+			if err != nil {
+				return err
+			}
+
+			ret = StagingInfo{RowsModified: splits.RowsModified + dividends.RowsModified, RowsStaged: splits.RowsStaged + dividends.RowsStaged}
+			if ret.RowsModified == 0 {
+				return nil
+			}
+
+			return adjustStockCandles(ctx, tx, jobRunId, key)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to stage corporate actions of %v: %w", key, err)
+		}
+
+		util.Logf(ctx, logging.Debug, "successfully staged %d corporate actions of %s (%d rows modified)", ret.RowsStaged, key.Symbol, ret.RowsModified)
+		return nil
+	}, bo, bon)
+
+	return
+}
+
+func stageSplits(ctx context.Context, tx pgx.Tx, jobRunId uint64, key StockKey) (ret StagingInfo, err error) {
+	var src []api.Split
+	var from, to *time.Time
+	err = tx.QueryRow(ctx, `SELECT "from", "to", data FROM src.splits WHERE job_run_id = $1 AND exchange_code = $2 AND symbol = $3`, jobRunId, key.Exchange, key.Symbol).Scan(&from, &to, &src)
+	if err == pgx.ErrNoRows {
+		return StagingInfo{}, nil
+	}
+	if err != nil {
+		return StagingInfo{}, fmt.Errorf("failed to get source splits: %w", err)
+	}
+
+	dates := make([]pgtype.Date, 0, len(src))
+	batch := &pgx.Batch{}
+	for _, s := range src {
+		split, err := TransformSplit(key.Exchange, key.Symbol, s)
+		if err != nil {
+			util.Logf(ctx, logging.Warning, "invalid split of %s will be skipped: %v", key.Symbol, err)
+			continue
+		}
+		dates = append(dates, split.Date)
+
+		batch.Queue(`
+			INSERT INTO stage.splits
+				(job_run_id, exchange_code, symbol, date, from_factor, to_factor, created, modified)
+			VALUES
+				($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT
+				(exchange_code, symbol, date)
+			DO UPDATE
+				SET
+					job_run_id = excluded.job_run_id,
+					from_factor = excluded.from_factor,
+					to_factor = excluded.to_factor,
+					modified = excluded.modified
+				WHERE
+					splits.from_factor IS DISTINCT FROM excluded.from_factor OR
+					splits.to_factor IS DISTINCT FROM excluded.to_factor`,
+			jobRunId, split.ExchangeCode, split.Symbol, split.Date, split.FromFactor, split.ToFactor)
+	}
+	batch.Queue(`
+		DELETE FROM stage.splits 
+		WHERE 
+			exchange_code = $1 
+			AND symbol = $2 
+			AND date <> ALL($3) 
+			AND ($4::timestamptz IS NULL OR date >= $4::timestamptz::date) 
+			AND ($5::timestamptz IS NULL OR date <= $5::timestamptz::date)`, key.Exchange, key.Symbol, dates, from, to)
+
+	return execStagingBatch(ctx, tx, batch, int64(len(dates)))
+}
+
+func stageDividends(ctx context.Context, tx pgx.Tx, jobRunId uint64, key StockKey) (ret StagingInfo, err error) {
+	var src []api.Dividend
+	var from, to *time.Time
+	err = tx.QueryRow(ctx, `SELECT "from", "to", data FROM src.dividends WHERE job_run_id = $1 AND exchange_code = $2 AND symbol = $3`, jobRunId, key.Exchange, key.Symbol).Scan(&from, &to, &src)
+	if err == pgx.ErrNoRows {
+		return StagingInfo{}, nil
+	}
+	if err != nil {
+		return StagingInfo{}, fmt.Errorf("failed to get source dividends: %w", err)
+	}
+
+	dates := make([]pgtype.Date, 0, len(src))
+	batch := &pgx.Batch{}
+	for _, d := range src {
+		dividend, err := TransformDividend(key.Exchange, key.Symbol, d)
+		if err != nil {
+			util.Logf(ctx, logging.Warning, "invalid dividend of %s will be skipped: %v", key.Symbol, err)
+			continue
+		}
+		dates = append(dates, dividend.Date)
+
+		batch.Queue(`
+			INSERT INTO stage.dividends
+				(job_run_id, exchange_code, symbol, date, amount, adjusted_amount, pay_date, record_date, declaration_date, currency, created, modified)
+			VALUES
+				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT
+				(exchange_code, symbol, date)
+			DO UPDATE
+				SET
+					job_run_id = excluded.job_run_id,
+					amount = excluded.amount,
+					adjusted_amount = excluded.adjusted_amount,
+					pay_date = excluded.pay_date,
+					record_date = excluded.record_date,
+					declaration_date = excluded.declaration_date,
+					currency = excluded.currency,
+					modified = excluded.modified
+				WHERE
+					dividends.amount IS DISTINCT FROM excluded.amount OR
+					dividends.adjusted_amount IS DISTINCT FROM excluded.adjusted_amount OR
+					dividends.pay_date IS DISTINCT FROM excluded.pay_date OR
+					dividends.record_date IS DISTINCT FROM excluded.record_date OR
+					dividends.declaration_date IS DISTINCT FROM excluded.declaration_date OR
+					dividends.currency IS DISTINCT FROM excluded.currency`,
+			jobRunId, dividend.ExchangeCode, dividend.Symbol, dividend.Date, dividend.Amount, dividend.AdjustedAmount, dividend.PayDate, dividend.RecordDate, dividend.DeclarationDate, dividend.Currency)
+	}
+	batch.Queue(`
+		DELETE FROM stage.dividends 
+		WHERE 
+			exchange_code = $1 
+			AND symbol = $2 
+			AND date <> ALL($3) 
+			AND ($4::timestamptz IS NULL OR date >= $4::timestamptz::date) 
+			AND ($5::timestamptz IS NULL OR date <= $5::timestamptz::date)`, key.Exchange, key.Symbol, dates, from, to)
+
+	return execStagingBatch(ctx, tx, batch, int64(len(dates)))
+}
+
+// execStagingBatch sends batch and sums the rows affected by its
+// statements.
+func execStagingBatch(ctx context.Context, tx pgx.Tx, batch *pgx.Batch, rowsStaged int64) (StagingInfo, error) {
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	ret := StagingInfo{RowsStaged: rowsStaged}
+	for i := 0; i < batch.Len(); i++ {
+		r, err := results.Exec()
+		if err != nil {
+			return StagingInfo{}, fmt.Errorf("error while staging corporate actions: %w", err)
+		}
+		ret.RowsModified += r.RowsAffected()
+	}
+	return ret, results.Close()
+}
+
+// adjustStockCandles updates the adjustment factors of the candles of the
+// stock at every staged resolution.
+func adjustStockCandles(ctx context.Context, tx pgx.Tx, jobRunId uint64, key StockKey) error {
+	rows, err := tx.Query(ctx, `SELECT DISTINCT resolution FROM stage.candles WHERE exchange_code = $1 AND symbol = $2`, key.Exchange, key.Symbol)
+	if err != nil {
+		return fmt.Errorf("failed to query resolutions of %v: %w", key, err)
+	}
+	var resolutions []api.Resolution
+	for rows.Next() {
+		var resolution api.Resolution
+		err := rows.Scan(&resolution)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to parse resolutions of %v: %w", key, err)
+		}
+		resolutions = append(resolutions, resolution)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query resolutions of %v: %w", key, err)
+	}
+
+	for _, resolution := range resolutions {
+		adjusted, err := adjustCandles(ctx, tx, jobRunId, key.Exchange, key.Symbol, resolution, true)
+		if err != nil {
+			return err
+		}
+		if adjusted > 0 {
+			util.Logf(ctx, logging.Info, "adjusted %d candles for symbol %s (%s) to corporate actions", adjusted, key.Symbol, resolution)
+		}
+	}
+	return nil
+}
+
+// adjustCandles updates the split and dividend adjustment factors of the
+// candles of symbol on exchange at resolution. Candles whose factors change
+// are marked as staged by jobRunId, so that update52WkCandles recalculates
+// the 52 week statistics around them.
+//
+// Unless all is set, only the candles staged by jobRunId are adjusted. The
+// corporate actions are then assumed unchanged, but a staged candle before
+// an ex-dividend date may be the close the dividend factor is based on, so
+// every candle is adjusted in that case as well.
+//
+// The split factor of a candle is the product of ToFactor / FromFactor of
+// every later split. The dividend factor is the product of
+// 1 - amount / close of every later dividend, where close is the close of
+// the last candle before the ex-dividend date. Adjusted prices are the raw
+// prices multiplied by both factors; adjusted volumes are the raw volumes
+// divided by the split factor.
+func adjustCandles(ctx context.Context, tx pgx.Tx, jobRunId uint64, exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, all bool) (int64, error) {
+	tag, err := tx.Exec(ctx, `
+		WITH dividends AS (
+			SELECT
+				dividends.date,
+				1 - dividends.amount / (
+					SELECT candles.close
+					FROM stage.candles
+					WHERE
+						candles.exchange_code = $2
+						AND candles.symbol = $3
+						AND candles.resolution = $4
+						AND candles.timestamp < dividends.date
+					ORDER BY candles.timestamp DESC
+					LIMIT 1
+				) AS factor
+			FROM stage.dividends
+			WHERE dividends.exchange_code = $2 AND dividends.symbol = $3
+		),
+		factors AS (
+			SELECT
+				candles.timestamp,
+				COALESCE((
+					SELECT EXP(SUM(LN(splits.to_factor / splits.from_factor)))
+					FROM stage.splits
+					WHERE splits.exchange_code = $2 AND splits.symbol = $3 AND candles.timestamp < splits.date
+				), 1) AS split_factor,
+				COALESCE((
+					SELECT EXP(SUM(LN(dividends.factor)))
+					FROM dividends
+					WHERE candles.timestamp < dividends.date AND dividends.factor > 0
+				), 1) AS dividend_factor
+			FROM stage.candles
+			WHERE
+				candles.exchange_code = $2
+				AND candles.symbol = $3
+				AND candles.resolution = $4
+				AND (
+					$5
+					OR candles.job_run_id = $1
+					OR EXISTS (
+						SELECT
+						FROM stage.candles staged
+						JOIN stage.dividends
+							ON dividends.exchange_code = staged.exchange_code
+							AND dividends.symbol = staged.symbol
+							AND staged.timestamp < dividends.date
+						WHERE
+							staged.exchange_code = $2
+							AND staged.symbol = $3
+							AND staged.resolution = $4
+							AND staged.job_run_id = $1
+					)
+				)
+		)
+		UPDATE stage.candles
+		SET
+			job_run_id = $1,
+			split_factor = factors.split_factor,
+			dividend_factor = factors.dividend_factor,
+			modified = CURRENT_TIMESTAMP
+		FROM factors
+		WHERE
+			candles.exchange_code = $2
+			AND candles.symbol = $3
+			AND candles.resolution = $4
+			AND candles.timestamp = factors.timestamp
+			AND (
+				candles.split_factor IS DISTINCT FROM factors.split_factor OR
+				candles.dividend_factor IS DISTINCT FROM factors.dividend_factor
+			)`, jobRunId, exchange, symbol, resolution, all)
+	if err != nil {
+		return 0, fmt.Errorf("failed to adjust candles %v (%v): %w", symbol, resolution, err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// LatestCorporateActions holds the date of the latest staged split and
+// dividend of each stock. Dates are zero for stocks without any.
+type LatestCorporateActions map[StockKey]LatestCorporateActionDates
+
+type LatestCorporateActionDates struct {
+	Split    time.Time
+	Dividend time.Time
+}
+
+func LookupLatestCorporateActions(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify) (LatestCorporateActions, error) {
+	var ret LatestCorporateActions
+	err := backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		rows, err := pool.Query(ctx, `
+			SELECT exchange_code, symbol, 'split', MAX(date) FROM stage.splits GROUP BY exchange_code, symbol
+			UNION ALL
+			SELECT exchange_code, symbol, 'dividend', MAX(date) FROM stage.dividends GROUP BY exchange_code, symbol`)
+		if err != nil {
+			return fmt.Errorf("failed to query latest corporate actions: %w", err)
+		}
+		defer rows.Close()
+
+		ret = make(LatestCorporateActions)
+		for rows.Next() {
+			var key StockKey
+			var kind string
+			var date time.Time
+			err := rows.Scan(&key.Exchange, &key.Symbol, &kind, &date)
+			if err != nil {
+				return fmt.Errorf("failed to parse latest corporate actions: %w", err)
+			}
+
+			latest := ret[key]
+			if kind == "split" {
+				latest.Split = date
+			} else {
+				latest.Dividend = date
+			}
+			ret[key] = latest
+		}
+		return rows.Err()
+	}, bo, bon)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strings"
+)
+
+var (
+	stocksHistoryColumns = []string{
+		"exchange_code", "symbol", "display_symbol", "description", "security_type", "currency", "mic", "figi",
+		"share_class_figi", "isin", "symbol2", "delisted_at",
+	}
+	companyProfilesHistoryColumns = []string{
+		"exchange_code", "symbol", "country", "currency", "exchange", "name", "ticker", "ipo", "market_capitalization",
+		"shares_outstanding", "logo", "phone", "web_url", "industry",
+	}
+)
+
+// updateHistory records the rows of stage.<table> that were staged by
+// jobRunId as new versions in stage.<table>_history. The current version of
+// each of those rows is closed at the time the new one was staged. Rows that
+// were already recorded, e.g. by a retried transaction, are left alone.
+func updateHistory(ctx context.Context, tx pgx.Tx, jobRunId uint64, table string, columns []string) (int64, error) {
+	stage := pgx.Identifier{"stage", table}.Sanitize()
+	history := pgx.Identifier{"stage", table + "_history"}.Sanitize()
+
+	_, err := tx.Exec(ctx, fmt.Sprintf(`
+		UPDATE %[2]s AS h
+		SET valid_to = s.modified
+		FROM %[1]s AS s
+		WHERE s.job_run_id = $1
+			AND h.exchange_code = s.exchange_code
+			AND h.symbol = s.symbol
+			AND h.valid_to IS NULL
+			AND h.valid_from < s.modified`, stage, history), jobRunId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to close history of %s: %w", table, err)
+	}
+
+	cols := strings.Join(columns, ", ")
+	tag, err := tx.Exec(ctx, fmt.Sprintf(`
+		INSERT INTO %[2]s
+			(job_run_id, %[3]s, valid_from, valid_to)
+		SELECT
+			job_run_id, %[3]s, modified, NULL
+		FROM %[1]s
+		WHERE job_run_id = $1
+		ON CONFLICT DO NOTHING`, stage, history, cols), jobRunId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record history of %s: %w", table, err)
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,237 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/indicator"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"math"
+	"time"
+)
+
+// StageIndicators recalculates the indicators of the candles of key that are
+// affected by the candles staged by job run jobRunId, i.e. the candles from
+// the first staged candle on. Since recursive indicators like the EMA
+// depend on the whole series, they are calculated from the first candle of
+// key, but only the affected rows are written. Like update52WkCandles, the
+// indicators are calculated from adjusted prices, and prices are converted
+// back to the raw scale of each candle.
+//
+// An indicator that has no values before its first calculable candle, e.g.
+// because it was configured after the candles were staged, is written for
+// the whole series instead. This also happens when the job run did not
+// stage any candles of key.
+//
+// The calculation is not seeded from the values stored before the first
+// staged candle, because stage.indicators holds the values of the
+// indicators and not their state, e.g. the average gain and loss of the RSI
+// or the closes in the window of an SMA, and the EMA is seeded with the SMA
+// of the first candles of the series, so starting anywhere else yields
+// different values. Reading the full series costs one query per key and
+// time linear in its candles, which is small next to requesting them.
+func StageIndicators(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, cfg indicator.Config, key CandleKey) (ret StagingInfo, err error) {
+	if cfg.Empty() {
+		return StagingInfo{}, nil
+	}
+
+	ctx = util.WithLoggerValue(ctx, "action", "stage")
+	err = backoff.RetryNotify(func() error {
+		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			defer cancel()
+
+			var first *time.Time
+			err := tx.QueryRow(ctx, `
+				SELECT MIN(timestamp) 
+				FROM stage.candles 
+				WHERE exchange_code = $2 AND symbol = $3 AND resolution = $4 AND job_run_id = $1`, jobRunId, key.Exchange, key.Symbol, key.Resolution).Scan(&first)
+			if err != nil {
+				return fmt.Errorf("failed to get first staged candle: %w", err)
+			}
+
+			stored, err := lookupFirstIndicators(ctx, tx, key)
+			if err != nil {
+				return err
+			}
+
+			missing := false
+			for _, name := range cfg.Names() {
+				if _, ok := stored[name]; !ok {
+					missing = true
+				}
+			}
+			if first == nil && !missing {
+				ret = StagingInfo{}
+				return nil
+			}
+
+			rows, err := tx.Query(ctx, `
+				SELECT 
+					timestamp, 
+					COALESCE(high, close) * split_factor * dividend_factor, 
+					COALESCE(low, close) * split_factor * dividend_factor, 
+					close * split_factor * dividend_factor, 
+					split_factor * dividend_factor
+				FROM stage.candles 
+				WHERE exchange_code = $1 AND symbol = $2 AND resolution = $3 AND close IS NOT NULL
+				ORDER BY timestamp`, key.Exchange, key.Symbol, key.Resolution)
+			if err != nil {
+				return fmt.Errorf("failed to get candles: %w", err)
+			}
+
+			var timestamps []time.Time
+			var factors []float64
+			var in indicator.Candles
+			for rows.Next() {
+				var ts time.Time
+				var high, low, close, factor float64
+				err := rows.Scan(&ts, &high, &low, &close, &factor)
+				if err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to scan candles: %w", err)
+				}
+				timestamps = append(timestamps, ts)
+				factors = append(factors, factor)
+				in.High = append(in.High, high)
+				in.Low = append(in.Low, low)
+				in.Close = append(in.Close, close)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to get candles: %w", err)
+			}
+
+			var staged [][]interface{}
+			for _, series := range indicator.Compute(cfg, in) {
+				from := seriesFrom(series, timestamps, stored, first)
+				for i, v := range series.Values {
+					if from == nil || timestamps[i].Before(*from) || math.IsNaN(v) || math.IsInf(v, 0) {
+						continue
+					}
+					if series.Price {
+						v /= factors[i]
+					}
+					staged = append(staged, []interface{}{key.Exchange, key.Symbol, key.Resolution, timestamps[i], series.Name, v})
+				}
+			}
+
+			rowsStaged, err := copyToTemp(ctx, tx, "indicators_stage",
+				`exchange_code text NOT NULL, symbol text NOT NULL, resolution text NOT NULL, timestamp timestamp WITH TIME ZONE NOT NULL, indicator text NOT NULL, value double precision NOT NULL`,
+				[]string{"exchange_code", "symbol", "resolution", "timestamp", "indicator", "value"}, staged)
+			if err != nil {
+				return fmt.Errorf("error while staging indicators: %w", err)
+			}
+
+			var rowsModified int64
+			err = tx.QueryRow(ctx, `
+				WITH upserted AS (
+					INSERT INTO stage.indicators 
+						(job_run_id, exchange_code, symbol, resolution, timestamp, indicator, value, created, modified)
+					SELECT 
+						$1, exchange_code, symbol, resolution, timestamp, indicator, value, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+					FROM indicators_stage
+					ON CONFLICT 
+						(exchange_code, symbol, resolution, timestamp, indicator)
+					DO UPDATE 
+						SET 
+							job_run_id = excluded.job_run_id,
+							value = excluded.value,
+							modified = excluded.modified
+						WHERE 
+							indicators.value IS DISTINCT FROM excluded.value
+					RETURNING 1
+				), removed AS (
+					DELETE FROM stage.indicators
+					WHERE 
+						exchange_code = $2 AND 
+						symbol = $3 AND 
+						resolution = $4 AND 
+						timestamp >= $5 AND
+						NOT EXISTS (
+							SELECT 
+							FROM indicators_stage 
+							WHERE 
+								indicators_stage.timestamp = indicators.timestamp AND 
+								indicators_stage.indicator = indicators.indicator
+						)
+					RETURNING 1
+				)
+				SELECT (SELECT COUNT(*) FROM upserted) + (SELECT COUNT(*) FROM removed)
+				`, jobRunId, key.Exchange, key.Symbol, key.Resolution, first).Scan(&rowsModified)
+			if err != nil {
+				return fmt.Errorf("error while staging indicators: %w", err)
+			}
+
+			ret = StagingInfo{RowsStaged: rowsStaged, RowsModified: rowsModified}
+			return nil
+		})
+	}, bo, bon)
+
+	if err != nil {
+		return StagingInfo{}, fmt.Errorf("failed to stage indicators of %v (%v): %w", key.Symbol, key.Resolution, err)
+	}
+	return ret, nil
+}
+
+// lookupFirstIndicators returns the timestamp of the first value of each
+// indicator of the candles of key.
+func lookupFirstIndicators(ctx context.Context, tx pgx.Tx, key CandleKey) (map[string]time.Time, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT indicator, MIN(timestamp) 
+		FROM stage.indicators 
+		WHERE exchange_code = $1 AND symbol = $2 AND resolution = $3 
+		GROUP BY indicator`, key.Exchange, key.Symbol, key.Resolution)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get first indicators: %w", err)
+	}
+	defer rows.Close()
+
+	ret := map[string]time.Time{}
+	for rows.Next() {
+		var name string
+		var ts time.Time
+		err := rows.Scan(&name, &ts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan first indicators: %w", err)
+		}
+		ret[name] = ts
+	}
+	return ret, rows.Err()
+}
+
+// seriesFrom returns the timestamp from which the values of series are
+// written: the first value of the series if stored lacks the values up to
+// it, otherwise first, the first staged candle. It returns nil if no values
+// are written.
+func seriesFrom(series indicator.Series, timestamps []time.Time, stored map[string]time.Time, first *time.Time) *time.Time {
+	for i, v := range series.Values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		if s, ok := stored[series.Name]; !ok || s.After(timestamps[i]) {
+			return &timestamps[i]
+		}
+		break
+	}
+	return first
+}
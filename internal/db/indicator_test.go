@@ -0,0 +1,57 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"github.com/ajjensen13/stocker/internal/indicator"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSeriesFrom(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	timestamps := []time.Time{day(1), day(2), day(3), day(4)}
+	series := indicator.Series{Name: "sma_2", Values: []float64{math.NaN(), 1, 2, 3}}
+	staged := day(4)
+
+	tests := []struct {
+		name   string
+		stored map[string]time.Time
+		first  *time.Time
+		want   *time.Time
+	}{
+		{name: "stored from first value", stored: map[string]time.Time{"sma_2": day(2)}, first: &staged, want: &staged},
+		{name: "nothing staged", stored: map[string]time.Time{"sma_2": day(2)}, first: nil, want: nil},
+		{name: "new indicator", stored: map[string]time.Time{"ema_2": day(2)}, first: &staged, want: &timestamps[1]},
+		{name: "new indicator, nothing staged", stored: map[string]time.Time{}, first: nil, want: &timestamps[1]},
+		{name: "values missing before stored", stored: map[string]time.Time{"sma_2": day(3)}, first: &staged, want: &timestamps[1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := seriesFrom(series, timestamps, tt.stored, tt.first)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil || !got.Equal(*tt.want):
+				t.Errorf("seriesFrom() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/ajjensen13/stocker/internal/stream"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+// SaveIntradayBars merges bars into stage.intraday_bars. Bars of the same
+// symbol and minute, whether in bars or already saved, are combined, so
+// trades that arrive after their bar was saved are added to it.
+func SaveIntradayBars(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, exchange api.Exchange, bars []stream.Bar) (ret StagingInfo, err error) {
+	if len(bars) == 0 {
+		return StagingInfo{}, nil
+	}
+
+	rows := make([][]interface{}, 0, len(bars))
+	for _, b := range bars {
+		rows = append(rows, []interface{}{string(exchange), b.Symbol, b.Timestamp, b.Open, b.High, b.Low, b.Close, b.Volume, b.Trades, b.FirstTrade, b.LastTrade})
+	}
+
+	ctx = util.WithLoggerValue(ctx, "action", "save")
+	err = backoff.RetryNotify(func() error {
+		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			ctx, cancel := context.WithTimeout(ctx, time.Minute)
+			defer cancel()
+
+			rowsStaged, err := copyToTemp(ctx, tx, "intraday_bars_stage",
+				`exchange_code text NOT NULL, symbol text NOT NULL, timestamp timestamp WITH TIME ZONE NOT NULL, open double precision NOT NULL, high double precision NOT NULL, low double precision NOT NULL, close double precision NOT NULL, volume double precision NOT NULL, trades integer NOT NULL, first_trade timestamp WITH TIME ZONE NOT NULL, last_trade timestamp WITH TIME ZONE NOT NULL`,
+				[]string{"exchange_code", "symbol", "timestamp", "open", "high", "low", "close", "volume", "trades", "first_trade", "last_trade"}, rows)
+			if err != nil {
+				return fmt.Errorf("error while saving intraday bars: %w", err)
+			}
+
+			var rowsModified int64
+			err = tx.QueryRow(ctx, `
+				WITH upserted AS (
+					INSERT INTO stage.intraday_bars 
+						(exchange_code, symbol, timestamp, open, high, low, close, volume, trades, first_trade, last_trade, created, modified)
+					SELECT 
+						exchange_code, 
+						symbol, 
+						timestamp, 
+						(array_agg(open ORDER BY first_trade))[1], 
+						MAX(high), 
+						MIN(low), 
+						(array_agg(close ORDER BY last_trade DESC))[1], 
+						SUM(volume), 
+						SUM(trades), 
+						MIN(first_trade), 
+						MAX(last_trade), 
+						CURRENT_TIMESTAMP, 
+						CURRENT_TIMESTAMP
+					FROM intraday_bars_stage
+					GROUP BY exchange_code, symbol, timestamp
+					ON CONFLICT 
+						(exchange_code, symbol, timestamp)
+					DO UPDATE 
+						SET 
+							open = CASE WHEN excluded.first_trade < intraday_bars.first_trade THEN excluded.open ELSE intraday_bars.open END,
+							high = GREATEST(intraday_bars.high, excluded.high),
+							low = LEAST(intraday_bars.low, excluded.low),
+							close = CASE WHEN excluded.last_trade >= intraday_bars.last_trade THEN excluded.close ELSE intraday_bars.close END,
+							volume = intraday_bars.volume + excluded.volume,
+							trades = intraday_bars.trades + excluded.trades,
+							first_trade = LEAST(intraday_bars.first_trade, excluded.first_trade),
+							last_trade = GREATEST(intraday_bars.last_trade, excluded.last_trade),
+							modified = excluded.modified
+					RETURNING 1
+				)
+				SELECT COUNT(*) FROM upserted`).Scan(&rowsModified)
+			if err != nil {
+				return fmt.Errorf("failed to merge intraday bars: %w", err)
+			}
+
+			ret = StagingInfo{RowsStaged: rowsStaged, RowsModified: rowsModified}
+			return nil
+		})
+	}, bo, bon)
+	return
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"github.com/ajjensen13/gke"
+	"github.com/ajjensen13/stocker/internal/stream"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSaveIntradayBars_mergesPartialBars checks that the bar flushed for a
+// minute and the partial bars of trades that arrived after the flush merge
+// into the bar of all trades of the minute. SaveIntradayBars commits, so the
+// fixture stock and its bars are deleted afterwards.
+func TestSaveIntradayBars_mergesPartialBars(t *testing.T) {
+	ctx := context.Background()
+	pool := testPool(t)
+
+	lg, cleanup, err := gke.NewLogger(ctx)
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	t.Cleanup(cleanup)
+	ctx = util.WithLogger(ctx, lg)
+
+	const exchange, symbol = "TEST", "TESTINTRADAY"
+	minute := time.Date(2021, 3, 1, 15, 30, 0, 0, time.UTC)
+	at := func(offset time.Duration, price, volume float64) stream.Trade {
+		return stream.Trade{Symbol: symbol, Price: price, Volume: volume, Time: minute.Add(offset)}
+	}
+
+	var jobRunId uint64
+	err = pool.QueryRow(ctx, `
+		INSERT INTO metadata.job_run (job_definition_id, started) 
+		SELECT id, CURRENT_TIMESTAMP FROM metadata.job_definition WHERE name = 'Finnhub ETL'
+		RETURNING id`).Scan(&jobRunId)
+	if err != nil {
+		t.Fatalf("failed to create job run: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, sql := range []string{
+			`DELETE FROM stage.intraday_bars WHERE exchange_code = $1 AND symbol = $2`,
+			`DELETE FROM stage.stocks WHERE exchange_code = $1 AND symbol = $2`,
+		} {
+			if _, err := pool.Exec(ctx, sql, exchange, symbol); err != nil {
+				t.Errorf("failed to clean up: %v", err)
+			}
+		}
+		if _, err := pool.Exec(ctx, `DELETE FROM metadata.job_run WHERE id = $1`, jobRunId); err != nil {
+			t.Errorf("failed to clean up: %v", err)
+		}
+	})
+
+	_, err = pool.Exec(ctx, `
+		INSERT INTO stage.stocks (job_run_id, exchange_code, symbol, description, created, modified) 
+		VALUES ($1, $2, $3, 'SaveIntradayBars fixture', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`, jobRunId, exchange, symbol)
+	if err != nil {
+		t.Fatalf("failed to create stock: %v", err)
+	}
+
+	onTime := []stream.Trade{at(5*time.Second, 100, 1), at(25*time.Second, 104, 2), at(45*time.Second, 101, 3)}
+	late := [][]stream.Trade{
+		{at(50*time.Second, 97, 4), at(2*time.Second, 99, 5)},
+		{at(59*time.Second, 102, 6)},
+	}
+
+	var all []stream.Trade
+	agg := stream.NewAggregator()
+	for _, trades := range append([][]stream.Trade{onTime}, late...) {
+		for _, trade := range trades {
+			agg.Add(trade)
+		}
+		all = append(all, trades...)
+
+		bars := agg.Flush(minute.Add(stream.BarInterval))
+		if len(bars) != 1 {
+			t.Fatalf("got %d bars, want 1", len(bars))
+		}
+		_, err := SaveIntradayBars(ctx, pool, &backoff.StopBackOff{}, func(error, time.Duration) {}, exchange, bars)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want stream.Bar
+	for _, trade := range all {
+		want.Add(trade)
+	}
+
+	got := stream.Bar{Symbol: symbol}
+	err = pool.QueryRow(ctx, `
+		SELECT timestamp, open, high, low, close, volume, trades, first_trade, last_trade 
+		FROM stage.intraday_bars 
+		WHERE exchange_code = $1 AND symbol = $2`, exchange, symbol).
+		Scan(&got.Timestamp, &got.Open, &got.High, &got.Low, &got.Close, &got.Volume, &got.Trades, &got.FirstTrade, &got.LastTrade)
+	if err != nil {
+		t.Fatalf("failed to get merged bar: %v", err)
+	}
+	got.Timestamp, got.FirstTrade, got.LastTrade = got.Timestamp.UTC(), got.FirstTrade.UTC(), got.LastTrade.UTC()
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged bar = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"math"
+	"sort"
+	"time"
+)
+
+// ProfileRefreshPolicy decides which company profiles a job run requests.
+// Profiles that have never been requested are always requested. The zero
+// value requests all profiles.
+type ProfileRefreshPolicy struct {
+	// MaxAge is the age after which a profile is requested again. Zero
+	// disables the check.
+	MaxAge time.Duration
+	// Fraction is the fraction of the stocks whose profiles are requested on
+	// every job run at least. If fewer profiles are due otherwise, the least
+	// recently refreshed ones are added, which spreads a full refresh over
+	// about 1/Fraction job runs. Zero disables the rotation.
+	Fraction float64
+}
+
+// ProfileRefreshes contains the time each company profile was last
+// requested, whether or not the provider had a profile for the stock.
+type ProfileRefreshes map[StockKey]time.Time
+
+// SaveProfileRefresh records that the provider had no company profile for
+// key when job run jobRunId requested it. The request still counts as a
+// refresh, so that such stocks are not requested again on every job run.
+// The refreshes of the profiles that were found are recorded when they are
+// staged, see StageCompanyProfiles.
+func SaveProfileRefresh(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, key StockKey) error {
+	return backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		_, err := pool.Exec(ctx, `
+			INSERT INTO metadata.company_profile_refreshes 
+				(job_run_id, exchange_code, symbol, found, refreshed) 
+			VALUES 
+				($1, $2, $3, FALSE, CURRENT_TIMESTAMP) 
+			ON CONFLICT 
+				(exchange_code, symbol) 
+			DO UPDATE 
+				SET 
+					job_run_id = excluded.job_run_id, 
+					found = excluded.found, 
+					refreshed = excluded.refreshed`, jobRunId, key.Exchange, key.Symbol)
+		if err != nil {
+			return fmt.Errorf("failed to save company profile refresh of %q: %w", key.Symbol, err)
+		}
+		return nil
+	}, bo, bon)
+}
+
+// saveStagedProfileRefreshes records the refreshes of the company profiles
+// that job run jobRunId loaded into the src schema. It runs in the
+// transaction that stages them, so that a profile that failed to stage is
+// requested again.
+func saveStagedProfileRefreshes(ctx context.Context, tx pgx.Tx, jobRunId uint64) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO metadata.company_profile_refreshes 
+			(job_run_id, exchange_code, symbol, found, refreshed) 
+		SELECT 
+			job_run_id, exchange_code, symbol, TRUE, CURRENT_TIMESTAMP 
+		FROM src.company_profiles 
+		WHERE job_run_id = $1 
+		ON CONFLICT 
+			(exchange_code, symbol) 
+		DO UPDATE 
+			SET 
+				job_run_id = excluded.job_run_id, 
+				found = excluded.found, 
+				refreshed = excluded.refreshed`, jobRunId)
+	return err
+}
+
+func LookupProfileRefreshes(ctx context.Context, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify) (ret ProfileRefreshes, err error) {
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		rows, err := pool.Query(ctx, `SELECT exchange_code, symbol, refreshed FROM metadata.company_profile_refreshes`)
+		if err != nil {
+			return fmt.Errorf("failed to query company profile refreshes: %w", err)
+		}
+		defer rows.Close()
+
+		ret = make(ProfileRefreshes)
+		for rows.Next() {
+			var key StockKey
+			var refreshed time.Time
+			err := rows.Scan(&key.Exchange, &key.Symbol, &refreshed)
+			if err != nil {
+				return fmt.Errorf("failed to parse company profile refreshes: %w", err)
+			}
+			ret[key] = refreshed
+		}
+		return rows.Err()
+	}, bo, bon)
+	return
+}
+
+// Select returns the stocks whose company profiles are due according to p,
+// in the order of stocks.
+func (p ProfileRefreshPolicy) Select(stocks []api.Stock, refreshes ProfileRefreshes, now time.Time) []api.Stock {
+	if p.MaxAge <= 0 && p.Fraction <= 0 {
+		return stocks
+	}
+
+	due := make([]bool, len(stocks))
+	var rest []int
+	for i, stock := range stocks {
+		refreshed, ok := refreshes[StockKey{Exchange: stock.Exchange, Symbol: api.Symbol(stock.Symbol)}]
+		switch {
+		case !ok:
+			due[i] = true
+		case p.MaxAge > 0 && now.Sub(refreshed) >= p.MaxAge:
+			due[i] = true
+		default:
+			rest = append(rest, i)
+		}
+	}
+
+	if p.Fraction > 0 {
+		n := int(math.Ceil(p.Fraction * float64(len(stocks))))
+		for _, d := range due {
+			if d {
+				n--
+			}
+		}
+
+		key := func(i int) StockKey {
+			return StockKey{Exchange: stocks[i].Exchange, Symbol: api.Symbol(stocks[i].Symbol)}
+		}
+		sort.SliceStable(rest, func(a, b int) bool {
+			return refreshes[key(rest[a])].Before(refreshes[key(rest[b])])
+		})
+		for i := 0; i < n && i < len(rest); i++ {
+			due[rest[i]] = true
+		}
+	}
+
+	var ret []api.Stock
+	for i, stock := range stocks {
+		if due[i] {
+			ret = append(ret, stock)
+		}
+	}
+	return ret
+}
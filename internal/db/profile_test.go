@@ -0,0 +1,67 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"github.com/ajjensen13/stocker/internal/api"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProfileRefreshPolicy_Select(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	stocks := []api.Stock{
+		{Exchange: "US", Symbol: "A"},
+		{Exchange: "US", Symbol: "B"},
+		{Exchange: "US", Symbol: "C"},
+		{Exchange: "US", Symbol: "D"},
+	}
+
+	// B has no profile at the provider, but its request was recorded like
+	// the others, so it is only due once it is old enough
+	refreshes := ProfileRefreshes{
+		{Exchange: "US", Symbol: "A"}: now.Add(-48 * time.Hour),
+		{Exchange: "US", Symbol: "B"}: now.Add(-time.Hour),
+		{Exchange: "US", Symbol: "C"}: now.Add(-24 * time.Hour),
+	}
+
+	tests := []struct {
+		name   string
+		policy ProfileRefreshPolicy
+		want   []api.Symbol
+	}{
+		{name: "zero value requests all", policy: ProfileRefreshPolicy{}, want: []api.Symbol{"A", "B", "C", "D"}},
+		{name: "never requested", policy: ProfileRefreshPolicy{MaxAge: 72 * time.Hour}, want: []api.Symbol{"D"}},
+		{name: "max age", policy: ProfileRefreshPolicy{MaxAge: 24 * time.Hour}, want: []api.Symbol{"A", "C", "D"}},
+		{name: "rotation adds least recently requested", policy: ProfileRefreshPolicy{MaxAge: 72 * time.Hour, Fraction: 0.5}, want: []api.Symbol{"A", "D"}},
+		{name: "rotation without max age", policy: ProfileRefreshPolicy{Fraction: 0.75}, want: []api.Symbol{"A", "C", "D"}},
+		{name: "rotation covered by due profiles", policy: ProfileRefreshPolicy{MaxAge: 24 * time.Hour, Fraction: 0.25}, want: []api.Symbol{"A", "C", "D"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []api.Symbol
+			for _, stock := range tt.policy.Select(stocks, refreshes, now) {
+				got = append(got, api.Symbol(stock.Symbol))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Select() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+type DataType string
+
+const (
+	DataTypeCandle           DataType = "candle"
+	DataTypeCompanyProfile   DataType = "company_profile"
+	DataTypeCorporateActions DataType = "corporate_actions"
+)
+
+// CandleDataType returns the data type that tracks the progress of candles
+// of the given resolution, e.g. candle_D for daily candles.
+func CandleDataType(resolution api.Resolution) DataType {
+	return DataType(fmt.Sprintf("%s_%s", DataTypeCandle, resolution))
+}
+
+type ProgressStatus string
+
+const (
+	ProgressNone   ProgressStatus = ""
+	ProgressLoaded ProgressStatus = "loaded"
+	ProgressStaged ProgressStatus = "staged"
+)
+
+// Progress contains the per-symbol checkpoints of a job run.
+type Progress map[DataType]map[StockKey]ProgressStatus
+
+func (p Progress) Status(dataType DataType, key StockKey) ProgressStatus {
+	return p[dataType][key]
+}
+
+func SaveProgress(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, key StockKey, dataType DataType, status ProgressStatus) error {
+	ctx = util.WithLoggerValue(ctx, "action", "checkpoint")
+	return backoff.RetryNotify(func() (err error) {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		_, err = pool.Exec(ctx, `
+			INSERT INTO metadata.job_run_progress 
+				(job_run_id, exchange_code, symbol, data_type, status, created, modified) 
+			VALUES 
+				($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT 
+				(job_run_id, exchange_code, symbol, data_type)
+			DO UPDATE 
+				SET 
+					status = excluded.status,
+					modified = excluded.modified`, jobRunId, key.Exchange, key.Symbol, dataType, status)
+		if err != nil {
+			return fmt.Errorf("failed to save %s progress for %v: %w", dataType, key, err)
+		}
+		return nil
+	}, bo, bon)
+}
+
+func LookupProgress(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify) (Progress, error) {
+	var ret Progress
+	err := backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, `SELECT exchange_code, symbol, data_type, status FROM metadata.job_run_progress WHERE job_run_id = $1`, jobRunId)
+			if err != nil {
+				return fmt.Errorf("failed to query job run progress: %w", err)
+			}
+			defer rows.Close()
+
+			ret = make(Progress)
+			for rows.Next() {
+				var key StockKey
+				var dataType DataType
+				var status ProgressStatus
+				err := rows.Scan(&key.Exchange, &key.Symbol, &dataType, &status)
+				if err != nil {
+					return fmt.Errorf("failed to parse job run progress: %w", err)
+				}
+
+				if _, ok := ret[dataType]; !ok {
+					ret[dataType] = map[StockKey]ProgressStatus{}
+				}
+				ret[dataType][key] = status
+			}
+			return rows.Err()
+		})
+	}, bo, bon)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// LookupLoadedStocks returns the stocks of exchange that have already been
+// loaded into the src schema for the job run. It is used to resume a job
+// run without requesting the stocks again.
+func LookupLoadedStocks(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, exchange api.Exchange) (ret api.StocksResponse, err error) {
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			stocks, err := lookupStocksToStage(ctx, jobRunId, tx)
+			if err != nil {
+				return err
+			}
+			ret = api.StocksResponse{Request: api.StocksRequest{Exchange: exchange}}
+			for _, stock := range stocks {
+				if stock.Exchange == exchange {
+					ret.Response = append(ret.Response, stock)
+				}
+			}
+			return nil
+		})
+	}, bo, bon)
+	return
+}
+
+// LookupLoadedCandles returns the candles of key that have already been
+// loaded into the src schema for the job run. It is used to stage them on
+// resume without requesting them again.
+func LookupLoadedCandles(ctx context.Context, jobRunId uint64, pool *pgxpool.Pool, bo backoff.BackOff, bon backoff.Notify, key CandleKey) (ret []api.CandlesResponse, err error) {
+	err = backoff.RetryNotify(func() error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		return util.RunTx(ctx, pool, func(ctx context.Context, tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, `
+				SELECT "from", "to", data 
+				FROM src.candles 
+				WHERE job_run_id = $1 AND exchange_code = $2 AND symbol = $3 AND resolution = $4
+				ORDER BY "from"`, jobRunId, key.Exchange, key.Symbol, key.Resolution)
+			if err != nil {
+				return fmt.Errorf("failed to get loaded candles: %w", err)
+			}
+			defer rows.Close()
+
+			ret = nil
+			for rows.Next() {
+				var from, to time.Time
+				d := api.CandlesResponse{Request: api.CandlesRequest{Exchange: key.Exchange, Symbol: key.Symbol, Resolution: key.Resolution}}
+				err := rows.Scan(&from, &to, &d.Response)
+				if err != nil {
+					return fmt.Errorf("failed to scan loaded candles: %w", err)
+				}
+				d.Request.From, d.Request.To = api.From(from), api.To(to)
+				ret = append(ret, d)
+			}
+			return rows.Err()
+		})
+	}, bo, bon)
+	return
+}
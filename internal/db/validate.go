@@ -0,0 +1,216 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"sort"
+	"time"
+)
+
+// CandleValidation configures the checks of ValidateCandles.
+type CandleValidation struct {
+	// MaxCloseChange is the largest change between consecutive closes, as a
+	// fraction of the smaller close, that is not flagged. Zero disables the
+	// check.
+	MaxCloseChange float64 `json:"maxCloseChange"`
+}
+
+type RejectionReason string
+
+const (
+	RejectionHighBelowLow       RejectionReason = "high_below_low"
+	RejectionOpenOutOfRange     RejectionReason = "open_out_of_range"
+	RejectionCloseOutOfRange    RejectionReason = "close_out_of_range"
+	RejectionNegativeVolume     RejectionReason = "negative_volume"
+	RejectionDuplicateTimestamp RejectionReason = "duplicate_timestamp"
+	RejectionCloseJump          RejectionReason = "close_jump"
+)
+
+// CandleRejection records a candle that failed a check. Staged reports
+// whether the candle was staged nonetheless, which is the case for checks
+// that real market data may fail, like a close jump.
+type CandleRejection struct {
+	Candle
+	Reason RejectionReason
+	Detail string
+	Staged bool
+}
+
+// ValidateCandles checks candles and returns the candles to stage, ordered
+// by timestamp, along with the rejections. Candles that are inconsistent in
+// themselves are quarantined: high below low, open or close outside of
+// [low, high] and negative volumes. Of several candles with the same
+// timestamp, only the last is checked and staged; the others are recorded
+// as one rejection. A close that changes by more than v.MaxCloseChange from
+// the previous close, after adjusting for splits in between, is flagged but
+// staged. previous is the staged candle before candles, if any.
+func ValidateCandles(candles []Candle, previous *Candle, splits []Split, v CandleValidation) (valid []Candle, rejections []CandleRejection) {
+	sorted := make([]Candle, len(candles))
+	copy(sorted, candles)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Time.Before(sorted[j].Timestamp.Time)
+	})
+
+	prev := previous
+	for i := 0; i < len(sorted); i++ {
+		// a run of candles with the same timestamp is recorded as a single
+		// rejection, since timestamp and reason identify a rejection
+		last := i
+		for last+1 < len(sorted) && sorted[last+1].Timestamp.Time.Equal(sorted[i].Timestamp.Time) {
+			last++
+		}
+		if last > i {
+			detail := "superseded by a later candle with the same timestamp"
+			if last-i > 1 {
+				detail = fmt.Sprintf("%d candles superseded by a later candle with the same timestamp", last-i)
+			}
+			rejections = append(rejections, CandleRejection{Candle: sorted[i], Reason: RejectionDuplicateTimestamp, Detail: detail})
+			i = last
+		}
+		c := sorted[i]
+
+		reasons := checkCandle(c)
+		if len(reasons) > 0 {
+			rejections = append(rejections, reasons...)
+			continue
+		}
+
+		if prev != nil && v.MaxCloseChange > 0 {
+			prevClose := prev.Close.Float * splitFactorBetween(splits, prev.Timestamp.Time, c.Timestamp.Time)
+			lower := math.Min(prevClose, c.Close.Float)
+			if lower > 0 {
+				change := math.Abs(c.Close.Float-prevClose) / lower
+				if change > v.MaxCloseChange {
+					detail := fmt.Sprintf("close changed by %.1f%% from %v on %s", change*100, prevClose, prev.Timestamp.Time.Format(time.RFC3339))
+					rejections = append(rejections, CandleRejection{Candle: c, Reason: RejectionCloseJump, Detail: detail, Staged: true})
+				}
+			}
+		}
+
+		valid = append(valid, c)
+		prev = &sorted[i]
+	}
+
+	return valid, rejections
+}
+
+// checkCandle returns the rejections of a candle that is inconsistent in
+// itself.
+func checkCandle(c Candle) (ret []CandleRejection) {
+	o, h, l, cl, v := c.Open.Float, c.High.Float, c.Low.Float, c.Close.Float, c.Volume.Float
+
+	if h < l {
+		ret = append(ret, CandleRejection{Candle: c, Reason: RejectionHighBelowLow, Detail: fmt.Sprintf("high %v < low %v", h, l)})
+	}
+	if o < l || o > h {
+		ret = append(ret, CandleRejection{Candle: c, Reason: RejectionOpenOutOfRange, Detail: fmt.Sprintf("open %v outside of [%v, %v]", o, l, h)})
+	}
+	if cl < l || cl > h {
+		ret = append(ret, CandleRejection{Candle: c, Reason: RejectionCloseOutOfRange, Detail: fmt.Sprintf("close %v outside of [%v, %v]", cl, l, h)})
+	}
+	if v < 0 {
+		ret = append(ret, CandleRejection{Candle: c, Reason: RejectionNegativeVolume, Detail: fmt.Sprintf("volume %v", v)})
+	}
+	return ret
+}
+
+// splitFactorBetween returns the factor that adjusts a price at from to the
+// scale of a price at to, i.e. the product of ToFactor / FromFactor of the
+// splits that took effect after from and no later than to.
+func splitFactorBetween(splits []Split, from, to time.Time) float64 {
+	f := 1.0
+	for _, s := range splits {
+		d := s.Date.Time
+		if d.After(from) && !d.After(to) && s.FromFactor.Float > 0 {
+			f *= s.ToFactor.Float / s.FromFactor.Float
+		}
+	}
+	return f
+}
+
+// lookupValidationContext returns the last staged candle before from and
+// the staged splits of symbol, which ValidateCandles needs to check the
+// first of the candles to stage.
+func lookupValidationContext(ctx context.Context, tx pgx.Tx, exchange api.Exchange, symbol api.Symbol, resolution api.Resolution, from time.Time) (previous *Candle, splits []Split, err error) {
+	var c Candle
+	err = tx.QueryRow(ctx, `
+		SELECT timestamp, open, high, low, close, volume
+		FROM stage.candles
+		WHERE exchange_code = $1 AND symbol = $2 AND resolution = $3 AND timestamp < $4
+		ORDER BY timestamp DESC
+		LIMIT 1`, exchange, symbol, resolution, from).Scan(&c.Timestamp, &c.Open, &c.High, &c.Low, &c.Close, &c.Volume)
+	switch {
+	case err == pgx.ErrNoRows:
+	case err != nil:
+		return nil, nil, fmt.Errorf("failed to get previous candle: %w", err)
+	default:
+		previous = &c
+	}
+
+	rows, err := tx.Query(ctx, `SELECT date, from_factor, to_factor FROM stage.splits WHERE exchange_code = $1 AND symbol = $2`, exchange, symbol)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get splits: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Split
+		err := rows.Scan(&s.Date, &s.FromFactor, &s.ToFactor)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan splits: %w", err)
+		}
+		splits = append(splits, s)
+	}
+	return previous, splits, rows.Err()
+}
+
+// saveCandleRejections replaces the rejections of the candles requested by
+// req that were recorded by jobRunId, so that staging the same candles again
+// does not record them twice. The rejections of other requests, e.g. the
+// other chunks of a backfill, are kept.
+func saveCandleRejections(ctx context.Context, tx pgx.Tx, jobRunId uint64, req api.CandlesRequest, rejections []CandleRejection) error {
+	_, err := tx.Exec(ctx, `
+		DELETE FROM stage.candle_rejections 
+		WHERE job_run_id = $1 AND exchange_code = $2 AND symbol = $3 AND resolution = $4 AND timestamp BETWEEN $5 AND $6`,
+		jobRunId, req.Exchange, req.Symbol, req.Resolution, time.Time(req.From), time.Time(req.To))
+	if err != nil {
+		return fmt.Errorf("failed to clear candle rejections: %w", err)
+	}
+
+	if len(rejections) == 0 {
+		return nil
+	}
+
+	rows := make([][]interface{}, len(rejections))
+	for i, r := range rejections {
+		rows[i] = []interface{}{jobRunId, r.ExchangeCode, r.Symbol, r.Resolution, r.Timestamp, r.Open, r.High, r.Low, r.Close, r.Volume, string(r.Reason), r.Detail, r.Staged, time.Now()}
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"stage", "candle_rejections"},
+		[]string{"job_run_id", "exchange_code", "symbol", "resolution", "timestamp", "open", "high", "low", "close", "volume", "reason", "detail", "staged", "created"},
+		pgx.CopyFromRows(rows))
+	if err != nil {
+		return fmt.Errorf("failed to save candle rejections: %w", err)
+	}
+	return nil
+}
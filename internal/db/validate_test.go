@@ -0,0 +1,274 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"github.com/ajjensen13/stocker/internal/api"
+	"github.com/jackc/pgtype"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var validateDay = time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// testCandle returns a candle of day days after validateDay.
+func testCandle(day int, open, high, low, close, volume float64) Candle {
+	var c Candle
+	_ = c.ExchangeCode.Set("US")
+	_ = c.Symbol.Set("TEST")
+	_ = c.Resolution.Set("D")
+	_ = c.Timestamp.Set(validateDay.AddDate(0, 0, day))
+	_ = c.Open.Set(open)
+	_ = c.High.Set(high)
+	_ = c.Low.Set(low)
+	_ = c.Close.Set(close)
+	_ = c.Volume.Set(volume)
+	return c
+}
+
+func testSplit(day int, from, to float64) Split {
+	var s Split
+	_ = s.Date.Set(validateDay.AddDate(0, 0, day))
+	_ = s.FromFactor.Set(from)
+	_ = s.ToFactor.Set(to)
+	return s
+}
+
+func TestValidateCandles(t *testing.T) {
+	type rejection struct {
+		day    int
+		reason RejectionReason
+		staged bool
+	}
+
+	previous := testCandle(-1, 100, 101, 99, 100, 1000)
+
+	tests := []struct {
+		name           string
+		candles        []Candle
+		previous       *Candle
+		splits         []Split
+		maxCloseChange float64
+		wantValid      []int
+		wantRejections []rejection
+	}{
+		{
+			name:      "valid candles are sorted",
+			candles:   []Candle{testCandle(1, 10, 11, 9, 10, 100), testCandle(0, 10, 11, 9, 10, 100)},
+			wantValid: []int{0, 1},
+		},
+		{
+			name:           "high below low",
+			candles:        []Candle{testCandle(0, 10, 9, 11, 10, 100)},
+			wantRejections: []rejection{{0, RejectionHighBelowLow, false}, {0, RejectionOpenOutOfRange, false}, {0, RejectionCloseOutOfRange, false}},
+		},
+		{
+			name:           "open below low",
+			candles:        []Candle{testCandle(0, 8, 11, 9, 10, 100)},
+			wantRejections: []rejection{{0, RejectionOpenOutOfRange, false}},
+		},
+		{
+			name:           "open above high",
+			candles:        []Candle{testCandle(0, 12, 11, 9, 10, 100)},
+			wantRejections: []rejection{{0, RejectionOpenOutOfRange, false}},
+		},
+		{
+			name:           "close below low",
+			candles:        []Candle{testCandle(0, 10, 11, 9, 8, 100)},
+			wantRejections: []rejection{{0, RejectionCloseOutOfRange, false}},
+		},
+		{
+			name:           "close above high",
+			candles:        []Candle{testCandle(0, 10, 11, 9, 12, 100)},
+			wantRejections: []rejection{{0, RejectionCloseOutOfRange, false}},
+		},
+		{
+			name:      "open and close on the bounds",
+			candles:   []Candle{testCandle(0, 9, 11, 9, 11, 0)},
+			wantValid: []int{0},
+		},
+		{
+			name:           "negative volume",
+			candles:        []Candle{testCandle(0, 10, 11, 9, 10, -1)},
+			wantRejections: []rejection{{0, RejectionNegativeVolume, false}},
+		},
+		{
+			name:           "duplicate timestamp",
+			candles:        []Candle{testCandle(0, 10, 11, 9, 10, 100), testCandle(0, 10, 12, 9, 11, 200)},
+			wantValid:      []int{0},
+			wantRejections: []rejection{{0, RejectionDuplicateTimestamp, false}},
+		},
+		{
+			name:           "three candles with the same timestamp are one rejection",
+			candles:        []Candle{testCandle(0, 10, 11, 9, 10, 100), testCandle(0, 10, 12, 9, 11, 200), testCandle(0, 10, 13, 9, 12, 300), testCandle(1, 10, 11, 9, 10, 100)},
+			wantValid:      []int{0, 1},
+			wantRejections: []rejection{{0, RejectionDuplicateTimestamp, false}},
+		},
+		{
+			name:           "the last duplicate is checked",
+			candles:        []Candle{testCandle(0, 10, 11, 9, 10, 100), testCandle(0, 10, 11, 9, 10, -1)},
+			wantRejections: []rejection{{0, RejectionDuplicateTimestamp, false}, {0, RejectionNegativeVolume, false}},
+		},
+		{
+			name:           "close jump above threshold is flagged and staged",
+			candles:        []Candle{testCandle(0, 100, 101, 99, 100, 100), testCandle(1, 250, 310, 240, 301, 100)},
+			maxCloseChange: 2,
+			wantValid:      []int{0, 1},
+			wantRejections: []rejection{{1, RejectionCloseJump, true}},
+		},
+		{
+			name:           "close jump at threshold",
+			candles:        []Candle{testCandle(0, 100, 101, 99, 100, 100), testCandle(1, 250, 310, 240, 300, 100)},
+			maxCloseChange: 2,
+			wantValid:      []int{0, 1},
+		},
+		{
+			name:           "close drop is relative to the smaller close",
+			candles:        []Candle{testCandle(0, 100, 101, 99, 100, 100), testCandle(1, 30, 31, 29, 30, 100)},
+			maxCloseChange: 2,
+			wantValid:      []int{0, 1},
+			wantRejections: []rejection{{1, RejectionCloseJump, true}},
+		},
+		{
+			name:           "close jump from the previous staged candle",
+			candles:        []Candle{testCandle(0, 400, 401, 399, 400, 100)},
+			previous:       &previous,
+			maxCloseChange: 2,
+			wantValid:      []int{0},
+			wantRejections: []rejection{{0, RejectionCloseJump, true}},
+		},
+		{
+			name:           "split between the closes is exempt",
+			candles:        []Candle{testCandle(0, 100, 101, 99, 100, 100), testCandle(1, 25, 26, 24, 25, 400)},
+			splits:         []Split{testSplit(1, 4, 1)},
+			maxCloseChange: 2,
+			wantValid:      []int{0, 1},
+		},
+		{
+			name:           "split after the closes is not exempt",
+			candles:        []Candle{testCandle(0, 100, 101, 99, 100, 100), testCandle(1, 25, 26, 24, 25, 400)},
+			splits:         []Split{testSplit(2, 4, 1)},
+			maxCloseChange: 2,
+			wantValid:      []int{0, 1},
+			wantRejections: []rejection{{1, RejectionCloseJump, true}},
+		},
+		{
+			name:           "rejected candles are not the previous close",
+			candles:        []Candle{testCandle(0, 100, 101, 99, 100, 100), testCandle(1, 10, 11, 9, 10, -1), testCandle(2, 100, 101, 99, 100, 100)},
+			maxCloseChange: 2,
+			wantValid:      []int{0, 2},
+			wantRejections: []rejection{{1, RejectionNegativeVolume, false}},
+		},
+		{
+			name:           "zero threshold disables the jump check",
+			candles:        []Candle{testCandle(0, 100, 101, 99, 100, 100), testCandle(1, 1000, 1001, 999, 1000, 100)},
+			maxCloseChange: 0,
+			wantValid:      []int{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, rejections := ValidateCandles(tt.candles, tt.previous, tt.splits, CandleValidation{MaxCloseChange: tt.maxCloseChange})
+
+			var gotValid []int
+			for _, c := range valid {
+				gotValid = append(gotValid, validateDays(c.Timestamp))
+			}
+			if !reflect.DeepEqual(gotValid, tt.wantValid) {
+				t.Errorf("ValidateCandles() valid days = %v, want %v", gotValid, tt.wantValid)
+			}
+
+			var gotRejections []rejection
+			for _, r := range rejections {
+				gotRejections = append(gotRejections, rejection{validateDays(r.Timestamp), r.Reason, r.Staged})
+			}
+			if !reflect.DeepEqual(gotRejections, tt.wantRejections) {
+				t.Errorf("ValidateCandles() rejections = %v, want %v", gotRejections, tt.wantRejections)
+			}
+		})
+	}
+}
+
+func validateDays(ts pgtype.Timestamptz) int {
+	return int(ts.Time.Sub(validateDay) / (24 * time.Hour))
+}
+
+// TestSaveCandleRejections_keepsChunks checks that saving the rejections of
+// one chunk of a backfill keeps those of the other chunks, and that saving
+// a chunk again replaces its own rejections.
+func TestSaveCandleRejections_keepsChunks(t *testing.T) {
+	ctx := context.Background()
+	pool := testPool(t)
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var jobRunId uint64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO metadata.job_run (job_definition_id, started) 
+		SELECT id, CURRENT_TIMESTAMP FROM metadata.job_definition WHERE name = 'Finnhub ETL'
+		RETURNING id`).Scan(&jobRunId)
+	if err != nil {
+		t.Fatalf("failed to create job run: %v", err)
+	}
+
+	chunks := []api.CandlesRequest{
+		{Exchange: "US", Symbol: "TEST", Resolution: "D", From: api.From(validateDay), To: api.To(validateDay.AddDate(0, 0, 10))},
+		{Exchange: "US", Symbol: "TEST", Resolution: "D", From: api.From(validateDay.AddDate(0, 0, 11)), To: api.To(validateDay.AddDate(0, 0, 20))},
+	}
+	for i, req := range chunks {
+		c := testCandle(i*11+1, 10, 9, 11, 10, 100)
+		err = saveCandleRejections(ctx, tx, jobRunId, req, []CandleRejection{{Candle: c, Reason: RejectionHighBelowLow}})
+		if err != nil {
+			t.Fatalf("failed to save rejections of chunk %d: %v", i, err)
+		}
+	}
+
+	err = saveCandleRejections(ctx, tx, jobRunId, chunks[1], []CandleRejection{{Candle: testCandle(13, 10, 9, 11, 10, 100), Reason: RejectionHighBelowLow}})
+	if err != nil {
+		t.Fatalf("failed to save rejections of chunk 1 again: %v", err)
+	}
+
+	rows, err := tx.Query(ctx, `SELECT timestamp FROM stage.candle_rejections WHERE job_run_id = $1 ORDER BY timestamp`, jobRunId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []time.Time
+	for rows.Next() {
+		var ts time.Time
+		if err := rows.Scan(&ts); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ts.UTC())
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []time.Time{validateDay.AddDate(0, 0, 1), validateDay.AddDate(0, 0, 13)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got rejections at %v, want %v", got, want)
+	}
+}
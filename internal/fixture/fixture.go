@@ -0,0 +1,230 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package fixture records http responses to disk and replays them later so
+// that the api and etl code can be exercised offline and repeatably.
+//
+// A Recorder wraps a live transport and writes one fixture file per request.
+// A Replayer, or a Server built on top of one, answers requests from those
+// files without touching the network. Requests are matched by method, path
+// and query, ignoring the api token, so recorded fixtures never contain
+// secrets. Because candle requests include their date range, replayed runs
+// should configure a fixed startDate and endDate.
+package fixture
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoFixture is returned by a Replayer when no fixture was recorded for
+// a request.
+var ErrNoFixture = errors.New("no fixture recorded for request")
+
+// Mode selects whether fixtures are recorded, replayed or not used at all.
+type Mode string
+
+const (
+	ModeOff    Mode = ""
+	ModeRecord Mode = "record"
+	ModeReplay Mode = "replay"
+)
+
+// Transport returns the http.RoundTripper for mode. Recordings are written
+// to and replayed from dir. The base transport is used by ModeOff and
+// ModeRecord; http.DefaultTransport is used when base is nil.
+func Transport(mode Mode, dir string, base http.RoundTripper) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	switch mode {
+	case ModeOff:
+		return base, nil
+	case ModeRecord:
+		return &Recorder{Dir: dir, Transport: base}, nil
+	case ModeReplay:
+		return &Replayer{Dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown fixture mode %q", mode)
+	}
+}
+
+// fixture is the on-disk representation of a recorded exchange.
+type fixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// secretParams are query parameters that are left out of fixtures.
+var secretParams = []string{"token"}
+
+// requestURL returns the path and query of req without secrets, with the
+// query parameters in a stable order.
+func requestURL(req *http.Request) string {
+	q := req.URL.Query()
+	for _, p := range secretParams {
+		q.Del(p)
+	}
+
+	if len(q) == 0 {
+		return req.URL.Path
+	}
+	return req.URL.Path + "?" + q.Encode()
+}
+
+// fileName returns the name of the fixture file for req. It starts with
+// a readable form of the request path followed by a hash of the request.
+func fileName(req *http.Request) string {
+	u := requestURL(req)
+	sum := sha1.Sum([]byte(req.Method + " " + u))
+
+	path := strings.Trim(req.URL.Path, "/")
+	path = strings.NewReplacer("/", "-", ".", "-").Replace(path)
+	return strings.ToLower(req.Method) + "-" + path + "-" + hex.EncodeToString(sum[:6]) + ".json"
+}
+
+// Recorder is an http.RoundTripper that saves each response it receives
+// into Dir.
+type Recorder struct {
+	Dir       string
+	Transport http.RoundTripper
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body for recording: %w", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	f := fixture{
+		Method: req.Method,
+		URL:    requestURL(req),
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   string(body),
+	}
+
+	err = writeFixture(filepath.Join(r.Dir, fileName(req)), f)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func writeFixture(name string, f fixture) error {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create fixture directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode fixture %s: %w", name, err)
+	}
+
+	err = ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write fixture %s: %w", name, err)
+	}
+	return nil
+}
+
+// Replayer is an http.RoundTripper that answers requests with the responses
+// recorded in Dir.
+type Replayer struct {
+	Dir string
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, err := readFixture(filepath.Join(r.Dir, fileName(req)))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, requestURL(req), err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+		StatusCode:    f.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        f.Header.Clone(),
+		Body:          ioutil.NopCloser(strings.NewReader(f.Body)),
+		ContentLength: int64(len(f.Body)),
+		Request:       req,
+	}, nil
+}
+
+func readFixture(name string) (fixture, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return fixture{}, ErrNoFixture
+	}
+	if err != nil {
+		return fixture{}, fmt.Errorf("failed to read fixture %s: %w", name, err)
+	}
+
+	var f fixture
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return fixture{}, fmt.Errorf("failed to decode fixture %s: %w", name, err)
+	}
+	return f, nil
+}
+
+// NewServer starts an httptest.Server that serves the fixtures recorded in
+// dir. Point the api base url at the server's URL followed by the path
+// prefix that was used when recording, e.g. server.URL + "/api/v1".
+// Requests without a fixture are answered with 404 Not Found.
+func NewServer(dir string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f, err := readFixture(filepath.Join(dir, fileName(req)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		for k, vs := range f.Header {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(f.Status)
+		_, _ = w.Write([]byte(f.Body))
+	}))
+}
@@ -0,0 +1,342 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package indicator computes technical indicators from a series of candles.
+//
+// All indicators are causal: the value at a candle only depends on that
+// candle and the ones before it. Several of them, like the EMA, RSI and ATR,
+// are recursive, so their values depend on the whole series before the
+// candle and not only on a fixed window. Values that are not defined yet,
+// e.g. the SMA of the first candles, are NaN.
+package indicator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Config selects the indicators to compute. The zero value computes none.
+type Config struct {
+	// SMA and EMA are the windows of simple and exponential moving averages
+	// of the close.
+	SMA []int `json:"sma"`
+	EMA []int `json:"ema"`
+	// RSI and ATR are the windows of the relative strength index and of the
+	// average true range, both smoothed like Wilder.
+	RSI       []int             `json:"rsi"`
+	ATR       []int             `json:"atr"`
+	MACD      []MACDConfig      `json:"macd"`
+	Bollinger []BollingerConfig `json:"bollinger"`
+	// Returns enables the simple and the log return of the close since the
+	// previous candle.
+	Returns bool `json:"returns"`
+}
+
+type MACDConfig struct {
+	Fast   int `json:"fast"`
+	Slow   int `json:"slow"`
+	Signal int `json:"signal"`
+}
+
+// BollingerConfig configures Bollinger bands K population standard
+// deviations around the SMA of Window closes.
+type BollingerConfig struct {
+	Window int     `json:"window"`
+	K      float64 `json:"k"`
+}
+
+// Empty reports whether c selects no indicators.
+func (c Config) Empty() bool {
+	return len(c.SMA) == 0 && len(c.EMA) == 0 && len(c.RSI) == 0 && len(c.ATR) == 0 && len(c.MACD) == 0 && len(c.Bollinger) == 0 && !c.Returns
+}
+
+var errWindow = errors.New("window must be positive")
+
+func (c Config) Validate() error {
+	for name, windows := range map[string][]int{"sma": c.SMA, "ema": c.EMA, "rsi": c.RSI, "atr": c.ATR} {
+		for _, w := range windows {
+			if w < 1 {
+				return fmt.Errorf("invalid %s window %d: %w", name, w, errWindow)
+			}
+		}
+	}
+	for _, m := range c.MACD {
+		switch {
+		case m.Fast < 1 || m.Slow < 1 || m.Signal < 1:
+			return fmt.Errorf("invalid macd %d/%d/%d: %w", m.Fast, m.Slow, m.Signal, errWindow)
+		case m.Fast >= m.Slow:
+			return fmt.Errorf("invalid macd %d/%d/%d: fast window must be shorter than slow window", m.Fast, m.Slow, m.Signal)
+		}
+	}
+	for _, b := range c.Bollinger {
+		switch {
+		case b.Window < 1:
+			return fmt.Errorf("invalid bollinger window %d: %w", b.Window, errWindow)
+		case b.K <= 0:
+			return fmt.Errorf("invalid bollinger k %v: must be positive", b.K)
+		}
+	}
+	return nil
+}
+
+// Candles are the inputs of the indicators, one element per candle in
+// chronological order. Prices should be adjusted for corporate actions so
+// that splits do not show up as price moves.
+type Candles struct {
+	High  []float64
+	Low   []float64
+	Close []float64
+}
+
+// Series are the values of one indicator, one per candle. Price is set for
+// indicators that are denominated in the price of the candles, like moving
+// averages, as opposed to ratios like the RSI.
+type Series struct {
+	Name   string
+	Values []float64
+	Price  bool
+}
+
+// Compute computes the indicators selected by c.
+func Compute(c Config, in Candles) (ret []Series) {
+	for _, w := range c.SMA {
+		ret = append(ret, Series{Name: name("sma", w), Values: SMA(in.Close, w), Price: true})
+	}
+	for _, w := range c.EMA {
+		ret = append(ret, Series{Name: name("ema", w), Values: EMA(in.Close, w), Price: true})
+	}
+	for _, w := range c.RSI {
+		ret = append(ret, Series{Name: name("rsi", w), Values: RSI(in.Close, w)})
+	}
+	for _, w := range c.ATR {
+		ret = append(ret, Series{Name: name("atr", w), Values: ATR(in.High, in.Low, in.Close, w), Price: true})
+	}
+	for _, m := range c.MACD {
+		line, signal, histogram := MACD(in.Close, m.Fast, m.Slow, m.Signal)
+		ret = append(ret,
+			Series{Name: name("macd", m.Fast, m.Slow, m.Signal), Values: line, Price: true},
+			Series{Name: name("macd_signal", m.Fast, m.Slow, m.Signal), Values: signal, Price: true},
+			Series{Name: name("macd_histogram", m.Fast, m.Slow, m.Signal), Values: histogram, Price: true})
+	}
+	for _, b := range c.Bollinger {
+		upper, middle, lower := Bollinger(in.Close, b.Window, b.K)
+		k := strconv.FormatFloat(b.K, 'f', -1, 64)
+		ret = append(ret,
+			Series{Name: name("bollinger_upper", b.Window) + "_" + k, Values: upper, Price: true},
+			Series{Name: name("bollinger_middle", b.Window) + "_" + k, Values: middle, Price: true},
+			Series{Name: name("bollinger_lower", b.Window) + "_" + k, Values: lower, Price: true})
+	}
+	if c.Returns {
+		simple, log := Returns(in.Close)
+		ret = append(ret, Series{Name: "return", Values: simple}, Series{Name: "log_return", Values: log})
+	}
+	return ret
+}
+
+// Names returns the names of the indicators selected by c, in the order
+// Compute returns them.
+func (c Config) Names() []string {
+	series := Compute(c, Candles{})
+	ret := make([]string, len(series))
+	for i, s := range series {
+		ret[i] = s.Name
+	}
+	return ret
+}
+
+// name returns the name of an indicator with the given parameters, e.g.
+// sma_20.
+func name(indicator string, params ...int) string {
+	for _, p := range params {
+		indicator += "_" + strconv.Itoa(p)
+	}
+	return indicator
+}
+
+func nans(n int) []float64 {
+	ret := make([]float64, n)
+	for i := range ret {
+		ret[i] = math.NaN()
+	}
+	return ret
+}
+
+// SMA returns the simple moving average of the last n values.
+func SMA(values []float64, n int) []float64 {
+	ret := nans(len(values))
+	var sum float64
+	for i, v := range values {
+		sum += v
+		if i >= n {
+			sum -= values[i-n]
+		}
+		if i >= n-1 {
+			ret[i] = sum / float64(n)
+		}
+	}
+	return ret
+}
+
+// EMA returns the exponential moving average with a smoothing factor of
+// 2 / (n + 1), seeded with the SMA of the first n values. NaNs at the start
+// of values are skipped, so EMA can smooth other indicators.
+func EMA(values []float64, n int) []float64 {
+	ret := nans(len(values))
+
+	start := 0
+	for start < len(values) && math.IsNaN(values[start]) {
+		start++
+	}
+	if len(values)-start < n {
+		return ret
+	}
+
+	var sum float64
+	for _, v := range values[start : start+n] {
+		sum += v
+	}
+	prev := sum / float64(n)
+	ret[start+n-1] = prev
+
+	alpha := 2 / float64(n+1)
+	for i := start + n; i < len(values); i++ {
+		prev = alpha*values[i] + (1-alpha)*prev
+		ret[i] = prev
+	}
+	return ret
+}
+
+// wilder smooths values like Wilder: the first value is the mean of the
+// first n values, and every later one is (previous * (n - 1) + value) / n.
+// values[0] is skipped if skipFirst is set, e.g. because it is a change
+// that has no previous value.
+func wilder(values []float64, n int, skipFirst bool) []float64 {
+	ret := nans(len(values))
+
+	start := 0
+	if skipFirst {
+		start = 1
+	}
+	if len(values)-start < n {
+		return ret
+	}
+
+	var sum float64
+	for _, v := range values[start : start+n] {
+		sum += v
+	}
+	prev := sum / float64(n)
+	ret[start+n-1] = prev
+
+	for i := start + n; i < len(values); i++ {
+		prev = (prev*float64(n-1) + values[i]) / float64(n)
+		ret[i] = prev
+	}
+	return ret
+}
+
+// RSI returns the relative strength index of closes over n changes. It is
+// 50 if the closes did not change at all.
+func RSI(closes []float64, n int) []float64 {
+	gains := make([]float64, len(closes))
+	losses := make([]float64, len(closes))
+	for i := 1; i < len(closes); i++ {
+		if d := closes[i] - closes[i-1]; d > 0 {
+			gains[i] = d
+		} else {
+			losses[i] = -d
+		}
+	}
+
+	avgGains, avgLosses := wilder(gains, n, true), wilder(losses, n, true)
+	ret := nans(len(closes))
+	for i := range closes {
+		g, l := avgGains[i], avgLosses[i]
+		switch {
+		case math.IsNaN(g):
+		case l == 0 && g == 0:
+			ret[i] = 50
+		case l == 0:
+			ret[i] = 100
+		default:
+			ret[i] = 100 - 100/(1+g/l)
+		}
+	}
+	return ret
+}
+
+// ATR returns the average true range over n candles. The true range of the
+// first candle is its high minus its low.
+func ATR(highs, lows, closes []float64, n int) []float64 {
+	tr := make([]float64, len(closes))
+	for i := range closes {
+		tr[i] = highs[i] - lows[i]
+		if i > 0 {
+			tr[i] = math.Max(tr[i], math.Max(math.Abs(highs[i]-closes[i-1]), math.Abs(lows[i]-closes[i-1])))
+		}
+	}
+	return wilder(tr, n, false)
+}
+
+// MACD returns the moving average convergence divergence of closes, i.e.
+// the difference of the fast and slow EMA, its signal EMA and the
+// difference of both.
+func MACD(closes []float64, fast, slow, signal int) (line, signals, histogram []float64) {
+	f, s := EMA(closes, fast), EMA(closes, slow)
+	line = nans(len(closes))
+	for i := range closes {
+		line[i] = f[i] - s[i]
+	}
+
+	signals = EMA(line, signal)
+	histogram = nans(len(closes))
+	for i := range closes {
+		histogram[i] = line[i] - signals[i]
+	}
+	return line, signals, histogram
+}
+
+// Bollinger returns the Bollinger bands k population standard deviations
+// around the SMA of the last n closes.
+func Bollinger(closes []float64, n int, k float64) (upper, middle, lower []float64) {
+	middle = SMA(closes, n)
+	upper, lower = nans(len(closes)), nans(len(closes))
+	for i := n - 1; i < len(closes); i++ {
+		var sq float64
+		for _, v := range closes[i-n+1 : i+1] {
+			sq += (v - middle[i]) * (v - middle[i])
+		}
+		sd := math.Sqrt(sq / float64(n))
+		upper[i], lower[i] = middle[i]+k*sd, middle[i]-k*sd
+	}
+	return upper, middle, lower
+}
+
+// Returns returns the simple and the log return of each close since the
+// previous close.
+func Returns(closes []float64) (simple, log []float64) {
+	simple, log = nans(len(closes)), nans(len(closes))
+	for i := 1; i < len(closes); i++ {
+		if closes[i-1] > 0 && closes[i] > 0 {
+			simple[i] = closes[i]/closes[i-1] - 1
+			log[i] = math.Log(closes[i] / closes[i-1])
+		}
+	}
+	return simple, log
+}
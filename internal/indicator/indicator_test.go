@@ -0,0 +1,283 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package indicator
+
+import (
+	"math"
+	"testing"
+)
+
+var nan = math.NaN()
+
+// assertSeries fails t unless got and want have the same length, NaNs at the
+// same positions and values within tolerance of each other.
+func assertSeries(t *testing.T, name string, got, want []float64, tolerance float64) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d values, want %d", name, len(got), len(want))
+	}
+	for i := range want {
+		switch {
+		case math.IsNaN(want[i]) != math.IsNaN(got[i]):
+			t.Errorf("%s[%d] = %v, want %v", name, i, got[i], want[i])
+		case math.Abs(got[i]-want[i]) > tolerance:
+			t.Errorf("%s[%d] = %v, want %v ± %v", name, i, got[i], want[i], tolerance)
+		}
+	}
+}
+
+// emaCloses and emaReference are the closes and the 10 day EMA of the EMA
+// example of StockCharts ChartSchool, rounded to cents.
+var (
+	emaCloses = []float64{
+		22.27, 22.19, 22.08, 22.17, 22.18, 22.13, 22.23, 22.43, 22.24, 22.29,
+		22.15, 22.39, 22.38, 22.61, 23.36, 24.05, 23.75, 23.83, 23.95, 23.63,
+		23.82, 23.87, 23.65, 23.19, 23.10, 23.33, 22.68, 23.10, 22.40, 22.17,
+	}
+	emaReference = []float64{
+		nan, nan, nan, nan, nan, nan, nan, nan, nan, 22.22,
+		22.21, 22.24, 22.27, 22.33, 22.52, 22.80, 22.97, 23.13, 23.28, 23.34,
+		23.43, 23.51, 23.53, 23.47, 23.40, 23.39, 23.26, 23.23, 23.08, 22.92,
+	}
+)
+
+// rsiCloses and rsiReference are the closes and the 14 day RSI of Wilder's
+// RSI example as published by StockCharts ChartSchool. The published values
+// were calculated from averages rounded to cents and differ from the exact
+// ones by up to 0.08.
+var (
+	rsiCloses = []float64{
+		44.34, 44.09, 44.15, 43.61, 44.33, 44.83, 45.10, 45.42, 45.84, 46.08,
+		45.89, 46.03, 45.61, 46.28, 46.28, 46.00, 46.03, 46.41, 46.22, 45.64,
+		46.21, 46.25, 45.71, 46.45, 45.78, 45.35, 44.03, 44.18, 44.22, 44.57,
+		43.42, 42.66, 43.13,
+	}
+	rsiReference = []float64{
+		nan, nan, nan, nan, nan, nan, nan, nan, nan, nan,
+		nan, nan, nan, nan, 70.53, 66.32, 66.55, 69.41, 66.36, 57.97,
+		62.93, 63.26, 56.06, 62.38, 54.71, 50.42, 39.99, 41.46, 41.87, 45.46,
+		37.30, 33.08, 37.77,
+	}
+)
+
+func TestSMA(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		n      int
+		want   []float64
+	}{
+		{name: "window 3", values: []float64{1, 2, 3, 4, 5}, n: 3, want: []float64{nan, nan, 2, 3, 4}},
+		{name: "window 1", values: []float64{1, 2, 3}, n: 1, want: []float64{1, 2, 3}},
+		{name: "window longer than values", values: []float64{1, 2}, n: 3, want: []float64{nan, nan}},
+		{name: "empty", values: nil, n: 3, want: []float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertSeries(t, "SMA", SMA(tt.values, tt.n), tt.want, 1e-12)
+		})
+	}
+}
+
+func TestEMA(t *testing.T) {
+	t.Run("reference", func(t *testing.T) {
+		assertSeries(t, "EMA", EMA(emaCloses, 10), emaReference, 0.005)
+	})
+
+	// the EMA of a straight line lags it by (n - 1) / 2
+	t.Run("line", func(t *testing.T) {
+		assertSeries(t, "EMA", EMA([]float64{1, 2, 3, 4, 5, 6}, 3), []float64{nan, nan, 2, 3, 4, 5}, 1e-12)
+	})
+
+	t.Run("leading NaNs", func(t *testing.T) {
+		assertSeries(t, "EMA", EMA([]float64{nan, nan, 1, 2, 3, 4}, 3), []float64{nan, nan, nan, nan, 2, 3}, 1e-12)
+	})
+
+	t.Run("too short", func(t *testing.T) {
+		assertSeries(t, "EMA", EMA([]float64{1, 2}, 3), []float64{nan, nan}, 1e-12)
+	})
+}
+
+func TestRSI(t *testing.T) {
+	t.Run("reference", func(t *testing.T) {
+		assertSeries(t, "RSI", RSI(rsiCloses, 14), rsiReference, 0.1)
+	})
+
+	t.Run("unchanged", func(t *testing.T) {
+		assertSeries(t, "RSI", RSI([]float64{5, 5, 5, 5}, 2), []float64{nan, nan, 50, 50}, 1e-12)
+	})
+
+	t.Run("only gains", func(t *testing.T) {
+		assertSeries(t, "RSI", RSI([]float64{1, 2, 3, 4}, 2), []float64{nan, nan, 100, 100}, 1e-12)
+	})
+
+	t.Run("only losses", func(t *testing.T) {
+		assertSeries(t, "RSI", RSI([]float64{4, 3, 2, 1}, 2), []float64{nan, nan, 0, 0}, 1e-12)
+	})
+}
+
+func TestATR(t *testing.T) {
+	// true ranges: 2 (high - low), 3 (high - previous close), 2 (previous
+	// close - low) and 5 (a gap above the previous close)
+	highs := []float64{10, 12, 11, 15}
+	lows := []float64{8, 9, 9, 14}
+	closes := []float64{9, 11, 10, 14.5}
+
+	assertSeries(t, "ATR", ATR(highs, lows, closes, 2), []float64{nan, 2.5, 2.25, 3.625}, 1e-12)
+}
+
+func TestMACD(t *testing.T) {
+	// both EMAs of a straight line lag it by a constant, so the line is the
+	// difference of the lags and the histogram is zero
+	closes := []float64{1, 2, 3, 4, 5, 6, 7, 8}
+	line, signal, histogram := MACD(closes, 3, 5, 2)
+
+	assertSeries(t, "line", line, []float64{nan, nan, nan, nan, 1, 1, 1, 1}, 1e-12)
+	assertSeries(t, "signal", signal, []float64{nan, nan, nan, nan, nan, 1, 1, 1}, 1e-12)
+	assertSeries(t, "histogram", histogram, []float64{nan, nan, nan, nan, nan, 0, 0, 0}, 1e-12)
+}
+
+func TestBollinger(t *testing.T) {
+	// the population standard deviation of 3 consecutive integers is
+	// sqrt(2 / 3)
+	sd := math.Sqrt(2.0 / 3)
+	upper, middle, lower := Bollinger([]float64{1, 2, 3, 4, 5}, 3, 2)
+
+	assertSeries(t, "upper", upper, []float64{nan, nan, 2 + 2*sd, 3 + 2*sd, 4 + 2*sd}, 1e-12)
+	assertSeries(t, "middle", middle, []float64{nan, nan, 2, 3, 4}, 1e-12)
+	assertSeries(t, "lower", lower, []float64{nan, nan, 2 - 2*sd, 3 - 2*sd, 4 - 2*sd}, 1e-12)
+
+	upper, _, lower = Bollinger([]float64{7, 7, 7}, 2, 2)
+	assertSeries(t, "flat upper", upper, []float64{nan, 7, 7}, 1e-12)
+	assertSeries(t, "flat lower", lower, []float64{nan, 7, 7}, 1e-12)
+}
+
+func TestReturns(t *testing.T) {
+	simple, log := Returns([]float64{100, 110, 99, 0, 5})
+
+	assertSeries(t, "simple", simple, []float64{nan, 0.1, -0.1, nan, nan}, 1e-12)
+	assertSeries(t, "log", log, []float64{nan, math.Log(1.1), math.Log(0.9), nan, nan}, 1e-12)
+}
+
+func TestCompute(t *testing.T) {
+	cfg := Config{
+		SMA:       []int{3},
+		EMA:       []int{10},
+		RSI:       []int{14},
+		ATR:       []int{2},
+		MACD:      []MACDConfig{{Fast: 3, Slow: 5, Signal: 2}},
+		Bollinger: []BollingerConfig{{Window: 3, K: 2.5}},
+		Returns:   true,
+	}
+	in := Candles{High: rsiCloses, Low: rsiCloses, Close: rsiCloses}
+
+	want := []struct {
+		name  string
+		price bool
+	}{
+		{"sma_3", true},
+		{"ema_10", true},
+		{"rsi_14", false},
+		{"atr_2", true},
+		{"macd_3_5_2", true},
+		{"macd_signal_3_5_2", true},
+		{"macd_histogram_3_5_2", true},
+		{"bollinger_upper_3_2.5", true},
+		{"bollinger_middle_3_2.5", true},
+		{"bollinger_lower_3_2.5", true},
+		{"return", false},
+		{"log_return", false},
+	}
+
+	got := Compute(cfg, in)
+	if len(got) != len(want) {
+		t.Fatalf("got %d series, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Name != w.name || got[i].Price != w.price {
+			t.Errorf("series %d = %s (price %v), want %s (price %v)", i, got[i].Name, got[i].Price, w.name, w.price)
+		}
+		if len(got[i].Values) != len(rsiCloses) {
+			t.Errorf("series %s has %d values, want %d", got[i].Name, len(got[i].Values), len(rsiCloses))
+		}
+	}
+	assertSeries(t, "rsi_14", got[2].Values, rsiReference, 0.1)
+
+	names := cfg.Names()
+	if len(names) != len(want) {
+		t.Fatalf("got %d names, want %d", len(names), len(want))
+	}
+	for i, w := range want {
+		if names[i] != w.name {
+			t.Errorf("name %d = %s, want %s", i, names[i], w.name)
+		}
+	}
+
+	if got := Compute(Config{}, in); len(got) != 0 {
+		t.Errorf("zero config computed %d series", len(got))
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "empty", cfg: Config{}},
+		{name: "valid", cfg: Config{SMA: []int{20}, MACD: []MACDConfig{{Fast: 12, Slow: 26, Signal: 9}}, Bollinger: []BollingerConfig{{Window: 20, K: 2}}}},
+		{name: "zero window", cfg: Config{EMA: []int{0}}, wantErr: true},
+		{name: "negative window", cfg: Config{ATR: []int{-1}}, wantErr: true},
+		{name: "macd without signal", cfg: Config{MACD: []MACDConfig{{Fast: 12, Slow: 26}}}, wantErr: true},
+		{name: "macd fast not shorter than slow", cfg: Config{MACD: []MACDConfig{{Fast: 26, Slow: 26, Signal: 9}}}, wantErr: true},
+		{name: "bollinger without window", cfg: Config{Bollinger: []BollingerConfig{{K: 2}}}, wantErr: true},
+		{name: "bollinger without k", cfg: Config{Bollinger: []BollingerConfig{{Window: 20}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCompute_causal checks that appending candles leaves the values of the
+// earlier candles unchanged, which StageIndicators relies on to only write
+// the values from the first staged candle on.
+func TestCompute_causal(t *testing.T) {
+	cfg := Config{
+		SMA:       []int{5},
+		EMA:       []int{10},
+		RSI:       []int{14},
+		ATR:       []int{3},
+		MACD:      []MACDConfig{{Fast: 3, Slow: 5, Signal: 2}},
+		Bollinger: []BollingerConfig{{Window: 5, K: 2}},
+		Returns:   true,
+	}
+	full := Compute(cfg, Candles{High: rsiCloses, Low: rsiCloses, Close: rsiCloses})
+
+	for _, n := range []int{1, 15, 20} {
+		prefix := Compute(cfg, Candles{High: rsiCloses[:n], Low: rsiCloses[:n], Close: rsiCloses[:n]})
+		for i, series := range prefix {
+			assertSeries(t, series.Name, series.Values, full[i].Values[:n], 0)
+		}
+	}
+}
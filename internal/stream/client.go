@@ -0,0 +1,290 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package stream
+
+import (
+	"cloud.google.com/go/logging"
+	"context"
+	"fmt"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gorilla/websocket"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultURL is the url of finnhub's websocket api.
+const DefaultURL = "wss://ws.finnhub.io"
+
+// DefaultReadTimeout is the time a connection may stay silent before it is
+// considered dead and reconnected. Finnhub pings idle connections, so it
+// only expires if the connection is lost.
+const DefaultReadTimeout = time.Minute
+
+// message is a message exchanged with the websocket api. Clients send
+// subscribe and unsubscribe messages. The server sends trade, ping and
+// error messages.
+type message struct {
+	Type   string         `json:"type"`
+	Symbol string         `json:"symbol,omitempty"`
+	Data   []tradeMessage `json:"data,omitempty"`
+	Msg    string         `json:"msg,omitempty"`
+}
+
+// tradeMessage is a trade as encoded by the websocket api. T is the time of
+// the trade in milliseconds since the unix epoch.
+type tradeMessage struct {
+	S string  `json:"s"`
+	P float64 `json:"p"`
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+func (m tradeMessage) trade() Trade {
+	return Trade{Symbol: m.S, Price: m.P, Volume: m.V, Time: time.Unix(0, m.T*int64(time.Millisecond)).UTC()}
+}
+
+func newTradeMessage(t Trade) tradeMessage {
+	return tradeMessage{S: t.Symbol, P: t.Price, T: t.Time.UnixNano() / int64(time.Millisecond), V: t.Volume}
+}
+
+// Client receives the trades of its subscribed symbols. The subscriptions
+// outlive connections: they are sent again whenever Run reconnects.
+type Client struct {
+	// URL is the url of the websocket api, DefaultURL if empty.
+	URL string
+	// Token is the api key. It is left out of the url if empty.
+	Token string
+	// ReadTimeout is the time after which a silent connection is
+	// reconnected, DefaultReadTimeout if zero.
+	ReadTimeout time.Duration
+	// BackOff returns the back off used between reconnects. It is reset
+	// after each successful connection. By default, Run retries forever.
+	BackOff func() backoff.BackOff
+	// Notify is called before waiting to reconnect.
+	Notify backoff.Notify
+
+	mu      sync.Mutex
+	symbols map[string]bool
+	conn    *websocket.Conn
+}
+
+func NewClient(url, token string) *Client {
+	return &Client{URL: url, Token: token}
+}
+
+// Subscribe adds symbols to the subscriptions. If a message cannot be sent,
+// the connection is broken and the subscription is sent again once Run has
+// reconnected.
+func (c *Client) Subscribe(symbols ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.symbols == nil {
+		c.symbols = map[string]bool{}
+	}
+	for _, symbol := range symbols {
+		if c.symbols[symbol] {
+			continue
+		}
+		c.symbols[symbol] = true
+		c.send(message{Type: "subscribe", Symbol: symbol})
+	}
+}
+
+// Unsubscribe removes symbols from the subscriptions.
+func (c *Client) Unsubscribe(symbols ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, symbol := range symbols {
+		if !c.symbols[symbol] {
+			continue
+		}
+		delete(c.symbols, symbol)
+		c.send(message{Type: "unsubscribe", Symbol: symbol})
+	}
+}
+
+// Symbols returns the subscribed symbols in order.
+func (c *Client) Symbols() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make([]string, 0, len(c.symbols))
+	for symbol := range c.symbols {
+		ret = append(ret, symbol)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// send writes msg to the current connection, if any. Errors are ignored;
+// a broken connection is noticed and replaced by Run. c.mu must be held.
+func (c *Client) send(msg message) {
+	if c.conn == nil {
+		return
+	}
+	_ = c.conn.WriteJSON(msg)
+}
+
+func (c *Client) url() (string, error) {
+	raw := c.URL
+	if raw == "" {
+		raw = DefaultURL
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid websocket url %q: %w", raw, err)
+	}
+	if c.Token != "" {
+		q := u.Query()
+		q.Set("token", c.Token)
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+func (c *Client) backOff() backoff.BackOff {
+	if c.BackOff != nil {
+		return c.BackOff()
+	}
+	result := backoff.NewExponentialBackOff()
+	result.InitialInterval = time.Second
+	result.MaxInterval = time.Minute
+	result.MaxElapsedTime = 0
+	return result
+}
+
+// Run connects to the websocket api and sends the trades it receives to out
+// until ctx is done. Lost connections are reconnected with back off. Run
+// returns nil once ctx is done, after closing the connection, or the last
+// error once the back off gives up.
+func (c *Client) Run(ctx context.Context, out chan<- Trade) error {
+	u, err := c.url()
+	if err != nil {
+		return err
+	}
+
+	bo := c.backOff()
+	for {
+		connected, err := c.session(ctx, u, out)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			bo.Reset()
+		}
+
+		wait := bo.NextBackOff()
+		if wait == backoff.Stop {
+			return err
+		}
+		if c.Notify != nil {
+			c.Notify(err, wait)
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// session connects once and reads trades until the connection is lost or
+// ctx is done. connected reports whether the connection was established.
+func (c *Client) session(ctx context.Context, u string, out chan<- Trade) (connected bool, err error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to websocket api: %w", err)
+	}
+	defer conn.Close()
+
+	c.mu.Lock()
+	c.conn = conn
+	symbols := make([]string, 0, len(c.symbols))
+	for symbol := range c.symbols {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	for _, symbol := range symbols {
+		c.send(message{Type: "subscribe", Symbol: symbol})
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+
+	util.Logf(ctx, logging.Info, "connected to websocket api, subscribed to %d symbols", len(symbols))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Ask the server to close the connection and give it a
+			// moment to answer before closing it ourselves.
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(5*time.Second))
+			time.AfterFunc(5*time.Second, func() { _ = conn.Close() })
+		case <-done:
+		}
+	}()
+
+	readTimeout := c.ReadTimeout
+	if readTimeout == 0 {
+		readTimeout = DefaultReadTimeout
+	}
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+		var msg message
+		err := conn.ReadJSON(&msg)
+		if err != nil && ctx.Err() != nil {
+			return true, nil
+		}
+		if err != nil {
+			return true, fmt.Errorf("failed to read from websocket api: %w", err)
+		}
+
+		switch msg.Type {
+		case "trade":
+			for _, m := range msg.Data {
+				select {
+				case out <- m.trade():
+				case <-ctx.Done():
+					return true, nil
+				}
+			}
+		case "ping":
+		case "error":
+			util.Logf(ctx, logging.Warning, "websocket api reported an error: %s", msg.Msg)
+		default:
+			util.Logf(ctx, logging.Debug, "ignoring websocket message of type %q", msg.Type)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package stream
+
+import (
+	"context"
+	"github.com/ajjensen13/gke"
+	"github.com/ajjensen13/stocker/internal/util"
+	"github.com/cenkalti/backoff/v4"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// runClient starts a client of standIn that reconnects quickly and returns
+// the channel it sends trades to. The client is stopped when the test ends,
+// before standIn is closed, and the test fails unless Run returns nil then.
+func runClient(t *testing.T, standIn *StandIn, symbols ...string) (*Client, <-chan Trade, *int32) {
+	t.Helper()
+
+	lg, cleanup, err := gke.NewLogger(context.Background())
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	t.Cleanup(cleanup)
+
+	var notified int32
+	client := NewClient(standIn.URL, "")
+	client.BackOff = func() backoff.BackOff { return backoff.NewConstantBackOff(10 * time.Millisecond) }
+	client.Notify = func(error, time.Duration) { atomic.AddInt32(&notified, 1) }
+	client.Subscribe(symbols...)
+
+	ctx, cancel := context.WithCancel(util.WithLogger(context.Background(), lg))
+	trades := make(chan Trade, 16)
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx, trades) }()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run returned %v", err)
+			}
+		case <-time.After(testTimeout):
+			t.Error("Run did not return")
+		}
+	})
+	return client, trades, &notified
+}
+
+func waitForSubscriptions(t *testing.T, standIn *StandIn, symbols ...string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := standIn.WaitForSubscriptions(ctx, symbols...); err != nil {
+		t.Fatalf("client did not subscribe to %v: %v", symbols, err)
+	}
+}
+
+// waitFor waits until cond holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// publish publishes trade and fails t unless the client receives it.
+func publish(t *testing.T, standIn *StandIn, trades <-chan Trade, trade Trade) {
+	t.Helper()
+
+	if n := standIn.Publish(trade); n != 1 {
+		t.Fatalf("published %d trades of %s, want 1", n, trade.Symbol)
+	}
+	select {
+	case got := <-trades:
+		if !reflect.DeepEqual(got, trade) {
+			t.Errorf("received %+v, want %+v", got, trade)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("did not receive trade of %s", trade.Symbol)
+	}
+}
+
+func TestClient_reconnect(t *testing.T) {
+	standIn := NewStandIn()
+	t.Cleanup(standIn.Close)
+
+	_, trades, notified := runClient(t, standIn, "AAPL", "MSFT")
+	waitForSubscriptions(t, standIn, "AAPL", "MSFT")
+
+	standIn.Ping()
+	publish(t, standIn, trades, at("AAPL", time.Second, 100, 1))
+
+	standIn.Drop()
+	waitFor(t, "reconnect", func() bool {
+		open, dials := standIn.Connections()
+		return open == 1 && dials == 2
+	})
+	waitForSubscriptions(t, standIn, "AAPL", "MSFT")
+
+	publish(t, standIn, trades, at("MSFT", 2*time.Second, 200, 2))
+	if atomic.LoadInt32(notified) == 0 {
+		t.Error("lost connection was not notified")
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	standIn := NewStandIn()
+	t.Cleanup(standIn.Close)
+
+	client, trades, _ := runClient(t, standIn, "AAPL")
+	waitForSubscriptions(t, standIn, "AAPL")
+
+	client.Subscribe("MSFT", "AAPL")
+	waitForSubscriptions(t, standIn, "AAPL", "MSFT")
+
+	client.Unsubscribe("AAPL", "GOOG")
+	waitFor(t, "unsubscribe", func() bool {
+		return reflect.DeepEqual(standIn.Subscriptions(), []string{"MSFT"})
+	})
+	if got := client.Symbols(); !reflect.DeepEqual(got, []string{"MSFT"}) {
+		t.Errorf("Symbols() = %v, want [MSFT]", got)
+	}
+
+	if n := standIn.Publish(at("AAPL", time.Second, 100, 1)); n != 0 {
+		t.Errorf("published %d trades of an unsubscribed symbol", n)
+	}
+	publish(t, standIn, trades, at("MSFT", time.Second, 200, 1))
+
+	// only the remaining subscriptions are sent again after a reconnect
+	standIn.Drop()
+	waitFor(t, "reconnect", func() bool {
+		open, dials := standIn.Connections()
+		return open == 1 && dials == 2
+	})
+	waitForSubscriptions(t, standIn, "MSFT")
+	if got := standIn.Subscriptions(); !reflect.DeepEqual(got, []string{"MSFT"}) {
+		t.Errorf("resubscribed to %v, want [MSFT]", got)
+	}
+}
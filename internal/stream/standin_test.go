@@ -0,0 +1,205 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package stream
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StandIn is a local stand-in for the websocket api. It accepts any token,
+// keeps track of the subscriptions of each connection and sends the trades
+// passed to Publish to the connections subscribed to their symbols.
+type StandIn struct {
+	// URL is the websocket url of the stand-in, for use as Client.URL.
+	URL string
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu    sync.Mutex
+	conns map[*websocket.Conn]map[string]bool
+	dials int
+}
+
+// NewStandIn starts a StandIn. It must be closed when no longer needed.
+func NewStandIn() *StandIn {
+	s := &StandIn{conns: map[*websocket.Conn]map[string]bool{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = "ws" + strings.TrimPrefix(s.server.URL, "http")
+	return s
+}
+
+func (s *StandIn) serve(w http.ResponseWriter, req *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conns[conn] = map[string]bool{}
+	s.dials++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	for {
+		var msg message
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		switch msg.Type {
+		case "subscribe":
+			s.conns[conn][msg.Symbol] = true
+		case "unsubscribe":
+			delete(s.conns[conn], msg.Symbol)
+		default:
+			_ = conn.WriteJSON(message{Type: "error", Msg: "unknown message type " + msg.Type})
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Publish sends each trade to the connections subscribed to its symbol and
+// returns the number of trades sent.
+func (s *StandIn) Publish(trades ...Trade) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sent int
+	for conn, symbols := range s.conns {
+		var data []tradeMessage
+		for _, t := range trades {
+			if symbols[t.Symbol] {
+				data = append(data, newTradeMessage(t))
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if conn.WriteJSON(message{Type: "trade", Data: data}) == nil {
+			sent += len(data)
+		}
+	}
+	return sent
+}
+
+// Ping sends a ping message to all connections, like the api does to idle
+// connections.
+func (s *StandIn) Ping() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.WriteJSON(message{Type: "ping"})
+	}
+}
+
+// Subscriptions returns the symbols that any connection is subscribed to,
+// in order.
+func (s *StandIn) Subscriptions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := map[string]bool{}
+	for _, symbols := range s.conns {
+		for symbol := range symbols {
+			set[symbol] = true
+		}
+	}
+
+	ret := make([]string, 0, len(set))
+	for symbol := range set {
+		ret = append(ret, symbol)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Connections returns the number of open connections and the number of
+// connections accepted since the stand-in started.
+func (s *StandIn) Connections() (open int, dials int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), s.dials
+}
+
+// WaitForSubscriptions waits until a connection is subscribed to all of
+// symbols, or ctx is done.
+func (s *StandIn) WaitForSubscriptions(ctx context.Context, symbols ...string) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if s.subscribed(symbols) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *StandIn) subscribed(symbols []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, subscriptions := range s.conns {
+		all := true
+		for _, symbol := range symbols {
+			all = all && subscriptions[symbol]
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// Drop closes all connections without a close message, as happens when the
+// network fails, so that clients have to reconnect.
+func (s *StandIn) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.UnderlyingConn().Close()
+	}
+}
+
+// Close closes all connections and stops the stand-in.
+func (s *StandIn) Close() {
+	s.Drop()
+	s.server.Close()
+}
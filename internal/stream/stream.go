@@ -0,0 +1,158 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package stream ingests trades in real time from finnhub's websocket api
+// and aggregates them into one minute bars.
+//
+// A Client keeps a websocket connection open, reconnecting with backoff and
+// resubscribing to its symbols whenever the connection drops. An Aggregator
+// collects the trades into bars that are handed out once their minute has
+// passed. The tests serve the websocket protocol locally so that both can
+// be tested without an api key or network access.
+package stream
+
+import (
+	"sort"
+	"time"
+)
+
+// BarInterval is the length of the bars built by an Aggregator.
+const BarInterval = time.Minute
+
+// Trade is a single trade reported by the websocket api.
+type Trade struct {
+	Symbol string
+	Price  float64
+	Volume float64
+	Time   time.Time
+}
+
+// Bar summarizes the trades of a symbol during the BarInterval starting at
+// Timestamp. FirstTrade and LastTrade are the times of the trades that set
+// Open and Close, so that partial bars of the same minute can be merged.
+type Bar struct {
+	Symbol     string
+	Timestamp  time.Time
+	Open       float64
+	High       float64
+	Low        float64
+	Close      float64
+	Volume     float64
+	Trades     int
+	FirstTrade time.Time
+	LastTrade  time.Time
+}
+
+// Add updates b with t.
+func (b *Bar) Add(t Trade) {
+	if b.Trades == 0 {
+		*b = Bar{
+			Symbol:     t.Symbol,
+			Timestamp:  t.Time.UTC().Truncate(BarInterval),
+			Open:       t.Price,
+			High:       t.Price,
+			Low:        t.Price,
+			Close:      t.Price,
+			Volume:     t.Volume,
+			Trades:     1,
+			FirstTrade: t.Time,
+			LastTrade:  t.Time,
+		}
+		return
+	}
+
+	if t.Time.Before(b.FirstTrade) {
+		b.Open = t.Price
+		b.FirstTrade = t.Time
+	}
+	if !t.Time.Before(b.LastTrade) {
+		b.Close = t.Price
+		b.LastTrade = t.Time
+	}
+	if t.Price > b.High {
+		b.High = t.Price
+	}
+	if t.Price < b.Low {
+		b.Low = t.Price
+	}
+	b.Volume += t.Volume
+	b.Trades++
+}
+
+type barKey struct {
+	symbol    string
+	timestamp time.Time
+}
+
+// Aggregator collects trades into bars. It is not safe for concurrent use.
+type Aggregator struct {
+	bars map[barKey]*Bar
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{bars: map[barKey]*Bar{}}
+}
+
+// Add adds t to the bar of its symbol and minute. A trade of a minute that
+// was already flushed starts a new, partial bar for that minute.
+func (a *Aggregator) Add(t Trade) {
+	key := barKey{symbol: t.Symbol, timestamp: t.Time.UTC().Truncate(BarInterval)}
+	b, ok := a.bars[key]
+	if !ok {
+		b = &Bar{}
+		a.bars[key] = b
+	}
+	b.Add(t)
+}
+
+// Len returns the number of bars that have not been flushed.
+func (a *Aggregator) Len() int {
+	return len(a.bars)
+}
+
+// Flush removes and returns the bars that ended at or before before, ordered
+// by symbol and timestamp.
+func (a *Aggregator) Flush(before time.Time) []Bar {
+	var ret []Bar
+	for key, b := range a.bars {
+		if key.timestamp.Add(BarInterval).After(before) {
+			continue
+		}
+		ret = append(ret, *b)
+		delete(a.bars, key)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Symbol != ret[j].Symbol {
+			return ret[i].Symbol < ret[j].Symbol
+		}
+		return ret[i].Timestamp.Before(ret[j].Timestamp)
+	})
+	return ret
+}
+
+// FlushAll removes and returns all bars, including those of the current
+// minute. It is used on shutdown.
+func (a *Aggregator) FlushAll() []Bar {
+	var latest time.Time
+	for key := range a.bars {
+		if key.timestamp.After(latest) {
+			latest = key.timestamp
+		}
+	}
+	return a.Flush(latest.Add(BarInterval))
+}
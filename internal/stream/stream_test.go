@@ -0,0 +1,128 @@
+/*
+Copyright © 2020 A. Jensen <jensen.aaro@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package stream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var minute = time.Date(2021, 3, 1, 15, 30, 0, 0, time.UTC)
+
+// at returns a trade of symbol offset after minute.
+func at(symbol string, offset time.Duration, price, volume float64) Trade {
+	return Trade{Symbol: symbol, Price: price, Volume: volume, Time: minute.Add(offset)}
+}
+
+// barOf returns the bar of trades, added in order.
+func barOf(trades ...Trade) Bar {
+	var b Bar
+	for _, t := range trades {
+		b.Add(t)
+	}
+	return b
+}
+
+func TestBar_Add(t *testing.T) {
+	// trades arrive out of order; open and close follow the trade times
+	got := barOf(
+		at("AAPL", 20*time.Second, 101, 1),
+		at("AAPL", 10*time.Second, 100, 2),
+		at("AAPL", 40*time.Second, 99, 3),
+		at("AAPL", 30*time.Second, 103, 4),
+		at("AAPL", 40*time.Second, 102, 5),
+	)
+
+	want := Bar{
+		Symbol:     "AAPL",
+		Timestamp:  minute,
+		Open:       100,
+		High:       103,
+		Low:        99,
+		Close:      102,
+		Volume:     15,
+		Trades:     5,
+		FirstTrade: minute.Add(10 * time.Second),
+		LastTrade:  minute.Add(40 * time.Second),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAggregator_Flush(t *testing.T) {
+	agg := NewAggregator()
+	agg.Add(at("MSFT", 0, 200, 1))
+	agg.Add(at("AAPL", 0, 100, 1))
+	agg.Add(at("AAPL", BarInterval-time.Millisecond, 101, 1))
+	agg.Add(at("AAPL", BarInterval, 102, 1))
+	agg.Add(at("AAPL", -BarInterval, 99, 1))
+
+	if got := agg.Flush(minute.Add(BarInterval - time.Millisecond)); len(got) != 1 || !got[0].Timestamp.Equal(minute.Add(-BarInterval)) {
+		t.Fatalf("flush before the end of the minute = %+v, want only the bar of the minute before", got)
+	}
+
+	got := agg.Flush(minute.Add(BarInterval))
+	want := []Bar{
+		barOf(at("AAPL", 0, 100, 1), at("AAPL", BarInterval-time.Millisecond, 101, 1)),
+		barOf(at("MSFT", 0, 200, 1)),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flush at the end of the minute = %+v, want %+v", got, want)
+	}
+
+	if got := agg.Flush(minute.Add(BarInterval)); len(got) != 0 {
+		t.Errorf("second flush = %+v, want no bars", got)
+	}
+	if agg.Len() != 1 {
+		t.Errorf("%d bars left, want the bar of the next minute", agg.Len())
+	}
+
+	// a late trade of a flushed minute starts a partial bar of that minute
+	agg.Add(at("AAPL", 30*time.Second, 98, 2))
+	got = agg.Flush(minute.Add(BarInterval))
+	want = []Bar{barOf(at("AAPL", 30*time.Second, 98, 2))}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flush of the late trade = %+v, want %+v", got, want)
+	}
+}
+
+func TestAggregator_FlushAll(t *testing.T) {
+	agg := NewAggregator()
+	if got := agg.FlushAll(); len(got) != 0 {
+		t.Errorf("FlushAll of no trades = %+v, want no bars", got)
+	}
+
+	agg.Add(at("AAPL", 0, 100, 1))
+	agg.Add(at("AAPL", BarInterval+time.Second, 101, 1))
+	agg.Add(at("MSFT", 2*BarInterval+59*time.Second, 200, 1))
+
+	got := agg.FlushAll()
+	var timestamps []time.Time
+	for _, b := range got {
+		timestamps = append(timestamps, b.Timestamp)
+	}
+	want := []time.Time{minute, minute.Add(BarInterval), minute.Add(2 * BarInterval)}
+	if !reflect.DeepEqual(timestamps, want) {
+		t.Errorf("FlushAll returned bars of %v, want %v", timestamps, want)
+	}
+	if agg.Len() != 0 {
+		t.Errorf("%d bars left after FlushAll", agg.Len())
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"sync/atomic"
+	"time"
 )
 
 type contextKey string
@@ -65,6 +66,33 @@ func newLogPayload(ctx context.Context, msg string) logPayload {
 	return ret
 }
 
+// WithoutCancel returns a context that carries the values of ctx, such as
+// the logger, but is never canceled. It is used for cleanup that must run
+// after ctx has been canceled.
+func WithoutCancel(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (d detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (d detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (d detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
+
 var nextTxId uint32
 
 func RunTx(ctx context.Context, pool *pgxpool.Pool, f func(ctx context.Context, tx pgx.Tx) error) error {
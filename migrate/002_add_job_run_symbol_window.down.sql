@@ -0,0 +1,6 @@
+ALTER TABLE metadata.job_run
+    DROP COLUMN IF EXISTS symbol_skip,
+    DROP COLUMN IF EXISTS symbol_limit,
+    DROP COLUMN IF EXISTS symbol_first,
+    DROP COLUMN IF EXISTS symbol_last
+;
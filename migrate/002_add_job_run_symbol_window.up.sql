@@ -0,0 +1,18 @@
+ALTER TABLE metadata.job_run
+    ADD COLUMN IF NOT EXISTS symbol_skip  integer,
+    ADD COLUMN IF NOT EXISTS symbol_limit integer,
+    ADD COLUMN IF NOT EXISTS symbol_first text,
+    ADD COLUMN IF NOT EXISTS symbol_last  text
+;
+
+COMMENT ON COLUMN metadata.job_run.symbol_skip IS 'Number of symbols (ordered by symbol) skipped by the job run, or NULL when no symbols were skipped'
+;
+
+COMMENT ON COLUMN metadata.job_run.symbol_limit IS 'Maximum number of symbols (ordered by symbol) processed by the job run, or NULL when unlimited'
+;
+
+COMMENT ON COLUMN metadata.job_run.symbol_first IS 'First symbol in the window of symbols processed by the job run'
+;
+
+COMMENT ON COLUMN metadata.job_run.symbol_last IS 'Last symbol in the window of symbols processed by the job run'
+;
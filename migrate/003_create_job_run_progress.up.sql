@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS metadata.job_run_progress (
+    job_run_id bigint                   NOT NULL,
+    symbol     text                     NOT NULL,
+    data_type  text                     NOT NULL,
+    status     text                     NOT NULL,
+    created    timestamp WITH TIME ZONE NOT NULL,
+    modified   timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT job_run_progress_pk
+        PRIMARY KEY (job_run_id, symbol, data_type),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE CASCADE
+)
+;
+
+COMMENT ON TABLE metadata.job_run_progress IS 'Contains per-symbol checkpoints used to resume a job run'
+;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS metadata.job_lock
+;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS metadata.job_lock (
+    job_definition_id bigint                   NOT NULL,
+    lock_key          text                     NOT NULL,
+    job_run_id        bigint,
+    acquired          timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT job_lock_pk
+        PRIMARY KEY (job_definition_id, lock_key),
+    CONSTRAINT job_lock_job_definition_id_fk
+        FOREIGN KEY (job_definition_id)
+            REFERENCES metadata.job_definition
+            ON DELETE CASCADE,
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE metadata.job_lock IS 'Contains the exclusive advisory locks currently held by job runs. A job run of all symbols locks the whole job definition (lock key job). Shards of a job hold that lock shared, which is not recorded, and lock their symbol window, so that they can run concurrently'
+;
+
+COMMENT ON COLUMN metadata.job_lock.lock_key IS 'What the lock is held for: job for the whole job definition, stocks while a shard stages stocks, or the exchanges and symbol window of an etl shard'
+;
+
+COMMENT ON COLUMN metadata.job_lock.job_run_id IS 'Job run currently holding the lock'
+;
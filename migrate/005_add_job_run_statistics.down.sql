@@ -0,0 +1,18 @@
+ALTER TABLE metadata.job_run
+    DROP COLUMN IF EXISTS started,
+    DROP COLUMN IF EXISTS finished,
+    DROP COLUMN IF EXISTS error,
+    DROP COLUMN IF EXISTS stocks_fetched,
+    DROP COLUMN IF EXISTS stocks_staged,
+    DROP COLUMN IF EXISTS stocks_modified,
+    DROP COLUMN IF EXISTS candles_loaded,
+    DROP COLUMN IF EXISTS candles_staged,
+    DROP COLUMN IF EXISTS candles_modified,
+    DROP COLUMN IF EXISTS candles_52wk_staged,
+    DROP COLUMN IF EXISTS candles_52wk_modified,
+    DROP COLUMN IF EXISTS company_profiles_loaded,
+    DROP COLUMN IF EXISTS company_profiles_staged,
+    DROP COLUMN IF EXISTS company_profiles_modified,
+    DROP COLUMN IF EXISTS symbols_skipped,
+    DROP COLUMN IF EXISTS api_retries
+;
@@ -0,0 +1,38 @@
+ALTER TABLE metadata.job_run
+    ADD COLUMN IF NOT EXISTS started                   timestamp WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS finished                  timestamp WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS error                     text,
+    ADD COLUMN IF NOT EXISTS stocks_fetched            bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS stocks_staged             bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS stocks_modified           bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS candles_loaded            bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS candles_staged            bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS candles_modified          bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS candles_52wk_staged       bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS candles_52wk_modified     bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS company_profiles_loaded   bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS company_profiles_staged   bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS company_profiles_modified bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS symbols_skipped           bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS api_retries               bigint DEFAULT 0 NOT NULL
+;
+
+UPDATE metadata.job_run
+SET started = created
+WHERE started IS NULL
+;
+
+COMMENT ON COLUMN metadata.job_run.started IS 'Time the job run was first started. A resumed job run keeps it, see resumed'
+;
+
+COMMENT ON COLUMN metadata.job_run.finished IS 'Time the job run finished, successfully or not'
+;
+
+COMMENT ON COLUMN metadata.job_run.error IS 'Error that caused the job run to fail'
+;
+
+COMMENT ON COLUMN metadata.job_run.symbols_skipped IS 'Number of symbols skipped because a request failed. The counters of a resumed job run add up all of its attempts'
+;
+
+COMMENT ON COLUMN metadata.job_run.api_retries IS 'Number of api requests that were retried'
+;
@@ -0,0 +1,132 @@
+DROP VIEW IF EXISTS stage.calculate_candles_52wk
+;
+
+DROP VIEW IF EXISTS report.candles_52wk
+;
+
+DROP VIEW IF EXISTS report.candles
+;
+
+UPDATE metadata.job_run_progress
+SET data_type = 'candle'
+WHERE data_type = 'candle_D'
+;
+
+DELETE
+FROM metadata.job_run_progress
+WHERE data_type LIKE 'candle\_%'
+;
+
+DELETE
+FROM stage.candles_52wk
+WHERE resolution <> 'D'
+;
+
+ALTER TABLE stage.candles_52wk
+    DROP CONSTRAINT candles_symbol_resolution_timestamp_fk,
+    DROP CONSTRAINT candles_52wk_pk,
+    DROP COLUMN IF EXISTS resolution,
+    ADD CONSTRAINT candles_52wk_pk
+        PRIMARY KEY (symbol, timestamp)
+;
+
+DELETE
+FROM stage.candles
+WHERE resolution <> 'D'
+;
+
+ALTER TABLE stage.candles
+    DROP CONSTRAINT candles_pk,
+    DROP COLUMN IF EXISTS resolution,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (symbol, timestamp)
+;
+
+COMMENT ON TABLE stage.candles IS 'Contains staged daily stock candles'
+;
+
+ALTER TABLE stage.candles_52wk
+    ADD CONSTRAINT candles_symbol_timestamp_fk
+        FOREIGN KEY (symbol, timestamp)
+            REFERENCES stage.candles
+;
+
+DELETE
+FROM src.candles
+WHERE resolution <> 'D'
+;
+
+ALTER TABLE src.candles
+    DROP CONSTRAINT candles_pk,
+    DROP COLUMN IF EXISTS resolution,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (job_run_id, symbol)
+;
+
+CREATE OR REPLACE VIEW report.candles(symbol, timestamp, open, high, low, close, volume, created, modified) AS
+    SELECT candles.symbol,
+           candles."timestamp",
+           candles.open,
+           candles.high,
+           candles.low,
+           candles.close,
+           candles.volume,
+           candles.created,
+           candles.modified
+    FROM stage.candles
+;
+
+COMMENT ON VIEW report.candles IS 'Exposing daily stock candle data for reporting'
+;
+
+CREATE OR REPLACE VIEW report.candles_52wk
+            (symbol, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified,
+             timestamp_52wk_count)
+AS
+    SELECT symbol,
+           timestamp,
+           high_52wk,
+           low_52wk,
+           volume_52wk_avg,
+           open,
+           high,
+           low,
+           close,
+           volume,
+           created,
+           modified,
+           timestamp_52wk_count
+    FROM stage.candles_52wk
+;
+
+CREATE OR REPLACE VIEW stage.calculate_candles_52wk
+            (symbol, timestamp, open, high, low, close, volume, created, modified, high_52wk, low_52wk, volume_52wk_avg,
+             timestamp_52wk_count)
+AS
+    SELECT anchor.symbol,
+           anchor.timestamp,
+           anchor.open,
+           anchor.high,
+           anchor.low,
+           anchor.close,
+           anchor.volume,
+           anchor.created,
+           anchor.modified,
+           MAX(lag.high)        AS high_52wk,
+           MIN(lag.low)         AS low_52wk,
+           AVG(lag.volume)      AS volume_52wk_avg,
+           COUNT(lag.timestamp) AS timestamp_52wk_count
+    FROM stage.candles anchor
+        JOIN stage.candles lag
+        ON anchor.symbol = lag.symbol
+    WHERE lag."timestamp" BETWEEN anchor.timestamp - INTERVAL '52 weeks' AND anchor.timestamp
+    GROUP BY anchor.symbol,
+             anchor.timestamp,
+             anchor.open,
+             anchor.high,
+             anchor.low,
+             anchor.close,
+             anchor.volume,
+             anchor.created,
+             anchor.modified
+;
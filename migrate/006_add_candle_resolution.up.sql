@@ -0,0 +1,117 @@
+ALTER TABLE src.candles
+    ADD COLUMN IF NOT EXISTS resolution text DEFAULT 'D' NOT NULL,
+    DROP CONSTRAINT candles_pk,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (job_run_id, symbol, resolution)
+;
+
+COMMENT ON COLUMN src.candles.resolution IS 'Resolution of the candles, e.g. D for daily or 60 for hourly candles'
+;
+
+ALTER TABLE stage.candles_52wk
+    DROP CONSTRAINT candles_symbol_timestamp_fk
+;
+
+ALTER TABLE stage.candles
+    ADD COLUMN IF NOT EXISTS resolution text DEFAULT 'D' NOT NULL,
+    DROP CONSTRAINT candles_pk,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (symbol, resolution, timestamp)
+;
+
+COMMENT ON COLUMN stage.candles.resolution IS 'Resolution of the candle, e.g. D for daily or 60 for hourly candles'
+;
+
+COMMENT ON TABLE stage.candles IS 'Contains staged stock candles of each resolution'
+;
+
+ALTER TABLE stage.candles_52wk
+    ADD COLUMN IF NOT EXISTS resolution text DEFAULT 'D' NOT NULL,
+    DROP CONSTRAINT candles_52wk_pk,
+    ADD CONSTRAINT candles_52wk_pk
+        PRIMARY KEY (symbol, resolution, timestamp),
+    ADD CONSTRAINT candles_symbol_resolution_timestamp_fk
+        FOREIGN KEY (symbol, resolution, timestamp)
+            REFERENCES stage.candles
+;
+
+COMMENT ON COLUMN stage.candles_52wk.resolution IS 'Resolution of the candle the statistics were calculated for'
+;
+
+UPDATE metadata.job_run_progress
+SET data_type = 'candle_D'
+WHERE data_type = 'candle'
+;
+
+CREATE OR REPLACE VIEW report.candles(symbol, timestamp, open, high, low, close, volume, created, modified, resolution) AS
+    SELECT candles.symbol,
+           candles."timestamp",
+           candles.open,
+           candles.high,
+           candles.low,
+           candles.close,
+           candles.volume,
+           candles.created,
+           candles.modified,
+           candles.resolution
+    FROM stage.candles
+;
+
+COMMENT ON VIEW report.candles IS 'Exposing stock candle data of each resolution for reporting'
+;
+
+CREATE OR REPLACE VIEW report.candles_52wk
+            (symbol, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified,
+             timestamp_52wk_count, resolution)
+AS
+    SELECT symbol,
+           timestamp,
+           high_52wk,
+           low_52wk,
+           volume_52wk_avg,
+           open,
+           high,
+           low,
+           close,
+           volume,
+           created,
+           modified,
+           timestamp_52wk_count,
+           resolution
+    FROM stage.candles_52wk
+;
+
+CREATE OR REPLACE VIEW stage.calculate_candles_52wk
+            (symbol, timestamp, open, high, low, close, volume, created, modified, high_52wk, low_52wk, volume_52wk_avg,
+             timestamp_52wk_count, resolution)
+AS
+    SELECT anchor.symbol,
+           anchor.timestamp,
+           anchor.open,
+           anchor.high,
+           anchor.low,
+           anchor.close,
+           anchor.volume,
+           anchor.created,
+           anchor.modified,
+           MAX(lag.high)        AS high_52wk,
+           MIN(lag.low)         AS low_52wk,
+           AVG(lag.volume)      AS volume_52wk_avg,
+           COUNT(lag.timestamp) AS timestamp_52wk_count,
+           anchor.resolution
+    FROM stage.candles anchor
+        JOIN stage.candles lag
+        ON anchor.symbol = lag.symbol
+            AND anchor.resolution = lag.resolution
+    WHERE lag."timestamp" BETWEEN anchor.timestamp - INTERVAL '52 weeks' AND anchor.timestamp
+    GROUP BY anchor.symbol,
+             anchor.resolution,
+             anchor.timestamp,
+             anchor.open,
+             anchor.high,
+             anchor.low,
+             anchor.close,
+             anchor.volume,
+             anchor.created,
+             anchor.modified
+;
@@ -0,0 +1,254 @@
+DROP VIEW IF EXISTS stage.calculate_candles_52wk
+;
+
+DROP VIEW IF EXISTS report.candles_52wk
+;
+
+DROP VIEW IF EXISTS report.candles
+;
+
+DROP VIEW IF EXISTS report.company_profiles
+;
+
+DROP VIEW IF EXISTS report.stocks
+;
+
+ALTER TABLE stage.candles_52wk
+    DROP CONSTRAINT candles_stocks_symbol_fk,
+    DROP CONSTRAINT candles_symbol_resolution_timestamp_fk
+;
+
+ALTER TABLE stage.candles
+    DROP CONSTRAINT candles_stocks_symbol_fk
+;
+
+ALTER TABLE stage.company_profiles
+    DROP CONSTRAINT stocks_symbol_fk
+;
+
+DELETE
+FROM metadata.job_run_progress
+WHERE exchange_code <> 'US'
+;
+
+ALTER TABLE metadata.job_run_progress
+    DROP CONSTRAINT job_run_progress_pk,
+    DROP COLUMN IF EXISTS exchange_code,
+    ADD CONSTRAINT job_run_progress_pk
+        PRIMARY KEY (job_run_id, symbol, data_type)
+;
+
+DELETE
+FROM stage.candles_52wk
+WHERE exchange_code <> 'US'
+;
+
+ALTER TABLE stage.candles_52wk
+    DROP CONSTRAINT candles_52wk_pk,
+    DROP COLUMN IF EXISTS exchange_code,
+    ADD CONSTRAINT candles_52wk_pk
+        PRIMARY KEY (symbol, resolution, timestamp)
+;
+
+DELETE
+FROM stage.company_profiles
+WHERE exchange_code <> 'US'
+;
+
+ALTER TABLE stage.company_profiles
+    DROP CONSTRAINT company_profiles_pk,
+    DROP COLUMN IF EXISTS exchange_code,
+    ADD CONSTRAINT company_profiles_pk
+        PRIMARY KEY (symbol)
+;
+
+DELETE
+FROM stage.candles
+WHERE exchange_code <> 'US'
+;
+
+ALTER TABLE stage.candles
+    DROP CONSTRAINT candles_pk,
+    DROP COLUMN IF EXISTS exchange_code,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (symbol, resolution, timestamp)
+;
+
+DELETE
+FROM stage.stocks
+WHERE exchange_code <> 'US'
+;
+
+ALTER TABLE stage.stocks
+    DROP CONSTRAINT stocks_pk,
+    DROP COLUMN IF EXISTS exchange_code,
+    ADD CONSTRAINT stocks_pk
+        PRIMARY KEY (symbol)
+;
+
+ALTER TABLE stage.candles
+    ADD CONSTRAINT candles_stocks_symbol_fk
+        FOREIGN KEY (symbol)
+            REFERENCES stage.stocks
+;
+
+ALTER TABLE stage.candles_52wk
+    ADD CONSTRAINT candles_stocks_symbol_fk
+        FOREIGN KEY (symbol)
+            REFERENCES stage.stocks,
+    ADD CONSTRAINT candles_symbol_resolution_timestamp_fk
+        FOREIGN KEY (symbol, resolution, timestamp)
+            REFERENCES stage.candles
+;
+
+ALTER TABLE stage.company_profiles
+    ADD CONSTRAINT stocks_symbol_fk
+        FOREIGN KEY (symbol)
+            REFERENCES stage.stocks
+;
+
+DELETE
+FROM src.company_profiles
+WHERE exchange_code <> 'US'
+;
+
+ALTER TABLE src.company_profiles
+    DROP CONSTRAINT company_profiles_pk,
+    DROP COLUMN IF EXISTS exchange_code,
+    ADD CONSTRAINT company_profiles_pk
+        PRIMARY KEY (job_run_id, symbol)
+;
+
+DELETE
+FROM src.candles
+WHERE exchange_code <> 'US'
+;
+
+ALTER TABLE src.candles
+    DROP CONSTRAINT candles_pk,
+    DROP COLUMN IF EXISTS exchange_code,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (job_run_id, symbol, resolution)
+;
+
+DELETE
+FROM src.stocks
+WHERE exchange_code <> 'US'
+;
+
+ALTER TABLE src.stocks
+    DROP CONSTRAINT stocks_pk,
+    DROP COLUMN IF EXISTS exchange_code,
+    ADD CONSTRAINT stocks_pk
+        PRIMARY KEY (job_run_id, symbol)
+;
+
+CREATE OR REPLACE VIEW report.stocks(symbol, display_symbol, description, created, modified) AS
+    SELECT stocks.symbol,
+           stocks.display_symbol,
+           stocks.description,
+           stocks.created,
+           stocks.modified
+    FROM stage.stocks
+;
+
+COMMENT ON VIEW report.stocks IS 'Exposes information about stocks for reporting'
+;
+
+CREATE OR REPLACE VIEW report.company_profiles
+            (symbol, country, currency, exchange, name, ticker, ipo, market_capitalization, shares_outstanding, logo,
+             phone, web_url, industry, created, modified)
+AS
+    SELECT company_profiles.symbol,
+           company_profiles.country,
+           company_profiles.currency,
+           company_profiles.exchange,
+           company_profiles.name,
+           company_profiles.ticker,
+           company_profiles.ipo,
+           company_profiles.market_capitalization,
+           company_profiles.shares_outstanding,
+           company_profiles.logo,
+           company_profiles.phone,
+           company_profiles.web_url AS web_url,
+           company_profiles.industry,
+           company_profiles.created,
+           company_profiles.modified
+    FROM stage.company_profiles
+;
+
+COMMENT ON VIEW report.company_profiles IS 'Exposes company profile data for reporting'
+;
+
+CREATE OR REPLACE VIEW report.candles(symbol, timestamp, open, high, low, close, volume, created, modified, resolution) AS
+    SELECT candles.symbol,
+           candles."timestamp",
+           candles.open,
+           candles.high,
+           candles.low,
+           candles.close,
+           candles.volume,
+           candles.created,
+           candles.modified,
+           candles.resolution
+    FROM stage.candles
+;
+
+COMMENT ON VIEW report.candles IS 'Exposing stock candle data of each resolution for reporting'
+;
+
+CREATE OR REPLACE VIEW report.candles_52wk
+            (symbol, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified,
+             timestamp_52wk_count, resolution)
+AS
+    SELECT symbol,
+           timestamp,
+           high_52wk,
+           low_52wk,
+           volume_52wk_avg,
+           open,
+           high,
+           low,
+           close,
+           volume,
+           created,
+           modified,
+           timestamp_52wk_count,
+           resolution
+    FROM stage.candles_52wk
+;
+
+CREATE OR REPLACE VIEW stage.calculate_candles_52wk
+            (symbol, timestamp, open, high, low, close, volume, created, modified, high_52wk, low_52wk, volume_52wk_avg,
+             timestamp_52wk_count, resolution)
+AS
+    SELECT anchor.symbol,
+           anchor.timestamp,
+           anchor.open,
+           anchor.high,
+           anchor.low,
+           anchor.close,
+           anchor.volume,
+           anchor.created,
+           anchor.modified,
+           MAX(lag.high)        AS high_52wk,
+           MIN(lag.low)         AS low_52wk,
+           AVG(lag.volume)      AS volume_52wk_avg,
+           COUNT(lag.timestamp) AS timestamp_52wk_count,
+           anchor.resolution
+    FROM stage.candles anchor
+        JOIN stage.candles lag
+        ON anchor.symbol = lag.symbol
+            AND anchor.resolution = lag.resolution
+    WHERE lag."timestamp" BETWEEN anchor.timestamp - INTERVAL '52 weeks' AND anchor.timestamp
+    GROUP BY anchor.symbol,
+             anchor.resolution,
+             anchor.timestamp,
+             anchor.open,
+             anchor.high,
+             anchor.low,
+             anchor.close,
+             anchor.volume,
+             anchor.created,
+             anchor.modified
+;
@@ -0,0 +1,230 @@
+ALTER TABLE stage.candles_52wk
+    DROP CONSTRAINT candles_stocks_symbol_fk,
+    DROP CONSTRAINT candles_symbol_resolution_timestamp_fk
+;
+
+ALTER TABLE stage.candles
+    DROP CONSTRAINT candles_stocks_symbol_fk
+;
+
+ALTER TABLE stage.company_profiles
+    DROP CONSTRAINT stocks_symbol_fk
+;
+
+ALTER TABLE src.stocks
+    ADD COLUMN IF NOT EXISTS exchange_code text DEFAULT 'US' NOT NULL
+;
+
+ALTER TABLE src.stocks
+    ALTER COLUMN exchange_code DROP DEFAULT,
+    DROP CONSTRAINT stocks_pk,
+    ADD CONSTRAINT stocks_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol)
+;
+
+ALTER TABLE src.candles
+    ADD COLUMN IF NOT EXISTS exchange_code text DEFAULT 'US' NOT NULL
+;
+
+ALTER TABLE src.candles
+    ALTER COLUMN exchange_code DROP DEFAULT,
+    DROP CONSTRAINT candles_pk,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol, resolution)
+;
+
+ALTER TABLE src.company_profiles
+    ADD COLUMN IF NOT EXISTS exchange_code text DEFAULT 'US' NOT NULL
+;
+
+ALTER TABLE src.company_profiles
+    ALTER COLUMN exchange_code DROP DEFAULT,
+    DROP CONSTRAINT company_profiles_pk,
+    ADD CONSTRAINT company_profiles_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol)
+;
+
+ALTER TABLE stage.stocks
+    ADD COLUMN IF NOT EXISTS exchange_code text DEFAULT 'US' NOT NULL
+;
+
+ALTER TABLE stage.stocks
+    ALTER COLUMN exchange_code DROP DEFAULT,
+    DROP CONSTRAINT stocks_pk,
+    ADD CONSTRAINT stocks_pk
+        PRIMARY KEY (exchange_code, symbol)
+;
+
+ALTER TABLE stage.candles
+    ADD COLUMN IF NOT EXISTS exchange_code text DEFAULT 'US' NOT NULL
+;
+
+ALTER TABLE stage.candles
+    ALTER COLUMN exchange_code DROP DEFAULT,
+    DROP CONSTRAINT candles_pk,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (exchange_code, symbol, resolution, timestamp),
+    ADD CONSTRAINT candles_stocks_symbol_fk
+        FOREIGN KEY (exchange_code, symbol)
+            REFERENCES stage.stocks
+;
+
+ALTER TABLE stage.candles_52wk
+    ADD COLUMN IF NOT EXISTS exchange_code text DEFAULT 'US' NOT NULL
+;
+
+ALTER TABLE stage.candles_52wk
+    ALTER COLUMN exchange_code DROP DEFAULT,
+    DROP CONSTRAINT candles_52wk_pk,
+    ADD CONSTRAINT candles_52wk_pk
+        PRIMARY KEY (exchange_code, symbol, resolution, timestamp),
+    ADD CONSTRAINT candles_stocks_symbol_fk
+        FOREIGN KEY (exchange_code, symbol)
+            REFERENCES stage.stocks,
+    ADD CONSTRAINT candles_symbol_resolution_timestamp_fk
+        FOREIGN KEY (exchange_code, symbol, resolution, timestamp)
+            REFERENCES stage.candles
+;
+
+ALTER TABLE stage.company_profiles
+    ADD COLUMN IF NOT EXISTS exchange_code text DEFAULT 'US' NOT NULL
+;
+
+ALTER TABLE stage.company_profiles
+    ALTER COLUMN exchange_code DROP DEFAULT,
+    DROP CONSTRAINT company_profiles_pk,
+    ADD CONSTRAINT company_profiles_pk
+        PRIMARY KEY (exchange_code, symbol),
+    ADD CONSTRAINT stocks_symbol_fk
+        FOREIGN KEY (exchange_code, symbol)
+            REFERENCES stage.stocks
+;
+
+ALTER TABLE metadata.job_run_progress
+    ADD COLUMN IF NOT EXISTS exchange_code text DEFAULT 'US' NOT NULL
+;
+
+ALTER TABLE metadata.job_run_progress
+    ALTER COLUMN exchange_code DROP DEFAULT,
+    DROP CONSTRAINT job_run_progress_pk,
+    ADD CONSTRAINT job_run_progress_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol, data_type)
+;
+
+COMMENT ON COLUMN src.stocks.exchange_code IS 'Code of the exchange the stock was requested for, e.g. US'
+;
+
+COMMENT ON COLUMN stage.stocks.exchange_code IS 'Code of the exchange the stock is traded on, e.g. US'
+;
+
+COMMENT ON COLUMN stage.company_profiles.exchange_code IS 'Code of the exchange the stock is traded on, as opposed to the exchange name provided by the profile'
+;
+
+CREATE OR REPLACE VIEW report.stocks(symbol, display_symbol, description, created, modified, exchange_code) AS
+    SELECT stocks.symbol,
+           stocks.display_symbol,
+           stocks.description,
+           stocks.created,
+           stocks.modified,
+           stocks.exchange_code
+    FROM stage.stocks
+;
+
+CREATE OR REPLACE VIEW report.company_profiles
+            (symbol, country, currency, exchange, name, ticker, ipo, market_capitalization, shares_outstanding, logo,
+             phone, web_url, industry, created, modified, exchange_code)
+AS
+    SELECT company_profiles.symbol,
+           company_profiles.country,
+           company_profiles.currency,
+           company_profiles.exchange,
+           company_profiles.name,
+           company_profiles.ticker,
+           company_profiles.ipo,
+           company_profiles.market_capitalization,
+           company_profiles.shares_outstanding,
+           company_profiles.logo,
+           company_profiles.phone,
+           company_profiles.web_url AS web_url,
+           company_profiles.industry,
+           company_profiles.created,
+           company_profiles.modified,
+           company_profiles.exchange_code
+    FROM stage.company_profiles
+;
+
+CREATE OR REPLACE VIEW report.candles(symbol, timestamp, open, high, low, close, volume, created, modified, resolution,
+                                      exchange_code) AS
+    SELECT candles.symbol,
+           candles."timestamp",
+           candles.open,
+           candles.high,
+           candles.low,
+           candles.close,
+           candles.volume,
+           candles.created,
+           candles.modified,
+           candles.resolution,
+           candles.exchange_code
+    FROM stage.candles
+;
+
+CREATE OR REPLACE VIEW report.candles_52wk
+            (symbol, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified,
+             timestamp_52wk_count, resolution, exchange_code)
+AS
+    SELECT symbol,
+           timestamp,
+           high_52wk,
+           low_52wk,
+           volume_52wk_avg,
+           open,
+           high,
+           low,
+           close,
+           volume,
+           created,
+           modified,
+           timestamp_52wk_count,
+           resolution,
+           exchange_code
+    FROM stage.candles_52wk
+;
+
+CREATE OR REPLACE VIEW stage.calculate_candles_52wk
+            (symbol, timestamp, open, high, low, close, volume, created, modified, high_52wk, low_52wk, volume_52wk_avg,
+             timestamp_52wk_count, resolution, exchange_code)
+AS
+    SELECT anchor.symbol,
+           anchor.timestamp,
+           anchor.open,
+           anchor.high,
+           anchor.low,
+           anchor.close,
+           anchor.volume,
+           anchor.created,
+           anchor.modified,
+           MAX(lag.high)        AS high_52wk,
+           MIN(lag.low)         AS low_52wk,
+           AVG(lag.volume)      AS volume_52wk_avg,
+           COUNT(lag.timestamp) AS timestamp_52wk_count,
+           anchor.resolution,
+           anchor.exchange_code
+    FROM stage.candles anchor
+        JOIN stage.candles lag
+        ON anchor.exchange_code = lag.exchange_code
+            AND anchor.symbol = lag.symbol
+            AND anchor.resolution = lag.resolution
+    WHERE lag."timestamp" BETWEEN anchor.timestamp - INTERVAL '52 weeks' AND anchor.timestamp
+    GROUP BY anchor.exchange_code,
+             anchor.symbol,
+             anchor.resolution,
+             anchor.timestamp,
+             anchor.open,
+             anchor.high,
+             anchor.low,
+             anchor.close,
+             anchor.volume,
+             anchor.created,
+             anchor.modified
+;
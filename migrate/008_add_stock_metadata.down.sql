@@ -0,0 +1,25 @@
+DROP VIEW IF EXISTS report.stocks
+;
+
+ALTER TABLE stage.stocks
+    DROP COLUMN IF EXISTS security_type,
+    DROP COLUMN IF EXISTS currency,
+    DROP COLUMN IF EXISTS mic,
+    DROP COLUMN IF EXISTS figi,
+    DROP COLUMN IF EXISTS share_class_figi,
+    DROP COLUMN IF EXISTS isin,
+    DROP COLUMN IF EXISTS symbol2
+;
+
+CREATE OR REPLACE VIEW report.stocks(symbol, display_symbol, description, created, modified, exchange_code) AS
+    SELECT stocks.symbol,
+           stocks.display_symbol,
+           stocks.description,
+           stocks.created,
+           stocks.modified,
+           stocks.exchange_code
+    FROM stage.stocks
+;
+
+COMMENT ON VIEW report.stocks IS 'Exposes information about stocks for reporting'
+;
@@ -0,0 +1,50 @@
+ALTER TABLE stage.stocks
+    ADD COLUMN IF NOT EXISTS security_type text,
+    ADD COLUMN IF NOT EXISTS currency text,
+    ADD COLUMN IF NOT EXISTS mic text,
+    ADD COLUMN IF NOT EXISTS figi text,
+    ADD COLUMN IF NOT EXISTS share_class_figi text,
+    ADD COLUMN IF NOT EXISTS isin text,
+    ADD COLUMN IF NOT EXISTS symbol2 text
+;
+
+COMMENT ON COLUMN stage.stocks.security_type IS 'Security type, e.g. Common Stock or ETP'
+;
+
+COMMENT ON COLUMN stage.stocks.currency IS 'Currency the stock is traded in'
+;
+
+COMMENT ON COLUMN stage.stocks.mic IS 'Market identifier code of the primary exchange'
+;
+
+COMMENT ON COLUMN stage.stocks.figi IS 'Financial instrument global identifier'
+;
+
+COMMENT ON COLUMN stage.stocks.share_class_figi IS 'Financial instrument global identifier of the share class'
+;
+
+COMMENT ON COLUMN stage.stocks.isin IS 'International securities identification number'
+;
+
+COMMENT ON COLUMN stage.stocks.symbol2 IS 'Alternative ticker of the stock'
+;
+
+CREATE OR REPLACE VIEW report.stocks
+            (symbol, display_symbol, description, created, modified, exchange_code, security_type, currency, mic,
+             figi, share_class_figi, isin, symbol2)
+AS
+    SELECT stocks.symbol,
+           stocks.display_symbol,
+           stocks.description,
+           stocks.created,
+           stocks.modified,
+           stocks.exchange_code,
+           stocks.security_type,
+           stocks.currency,
+           stocks.mic,
+           stocks.figi,
+           stocks.share_class_figi,
+           stocks.isin,
+           stocks.symbol2
+    FROM stage.stocks
+;
@@ -0,0 +1,11 @@
+DROP VIEW IF EXISTS report.company_profiles_history
+;
+
+DROP VIEW IF EXISTS report.stocks_history
+;
+
+DROP TABLE IF EXISTS stage.company_profiles_history
+;
+
+DROP TABLE IF EXISTS stage.stocks_history
+;
@@ -0,0 +1,174 @@
+CREATE TABLE IF NOT EXISTS stage.stocks_history (
+    job_run_id       bigint,
+    exchange_code    text                     NOT NULL,
+    symbol           text                     NOT NULL,
+    display_symbol   text                     NOT NULL,
+    description      text                     NOT NULL,
+    security_type    text,
+    currency         text,
+    mic              text,
+    figi             text,
+    share_class_figi text,
+    isin             text,
+    symbol2          text,
+    valid_from       timestamp WITH TIME ZONE NOT NULL,
+    valid_to         timestamp WITH TIME ZONE,
+    CONSTRAINT stocks_history_pk
+        PRIMARY KEY (exchange_code, symbol, valid_from),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE stage.stocks_history IS 'Contains every version of the staged information about stocks'
+;
+
+COMMENT ON COLUMN stage.stocks_history.valid_from IS 'Time the version was staged'
+;
+
+COMMENT ON COLUMN stage.stocks_history.valid_to IS 'Time the version was replaced by the next one, null for the current version'
+;
+
+CREATE UNIQUE INDEX IF NOT EXISTS ndx_stocks_history_current
+    ON stage.stocks_history (exchange_code, symbol)
+    WHERE valid_to IS NULL
+;
+
+CREATE TABLE IF NOT EXISTS stage.company_profiles_history (
+    job_run_id            bigint,
+    exchange_code         text                     NOT NULL,
+    symbol                text                     NOT NULL,
+    country               text                     NOT NULL,
+    currency              text                     NOT NULL,
+    exchange              text                     NOT NULL,
+    name                  text                     NOT NULL,
+    ticker                text                     NOT NULL,
+    ipo                   date,
+    market_capitalization real                     NOT NULL,
+    shares_outstanding    real                     NOT NULL,
+    logo                  text                     NOT NULL,
+    phone                 text                     NOT NULL,
+    web_url               text                     NOT NULL,
+    industry              text                     NOT NULL,
+    valid_from            timestamp WITH TIME ZONE NOT NULL,
+    valid_to              timestamp WITH TIME ZONE,
+    CONSTRAINT company_profiles_history_pk
+        PRIMARY KEY (exchange_code, symbol, valid_from),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE stage.company_profiles_history IS 'Contains every version of the staged company profiles'
+;
+
+COMMENT ON COLUMN stage.company_profiles_history.valid_from IS 'Time the version was staged'
+;
+
+COMMENT ON COLUMN stage.company_profiles_history.valid_to IS 'Time the version was replaced by the next one, null for the current version'
+;
+
+CREATE UNIQUE INDEX IF NOT EXISTS ndx_company_profiles_history_current
+    ON stage.company_profiles_history (exchange_code, symbol)
+    WHERE valid_to IS NULL
+;
+
+INSERT INTO stage.stocks_history
+    (job_run_id, exchange_code, symbol, display_symbol, description, security_type, currency, mic, figi,
+     share_class_figi, isin, symbol2, valid_from, valid_to)
+SELECT job_run_id,
+       exchange_code,
+       symbol,
+       display_symbol,
+       description,
+       security_type,
+       currency,
+       mic,
+       figi,
+       share_class_figi,
+       isin,
+       symbol2,
+       modified,
+       NULL
+FROM stage.stocks
+ON CONFLICT DO NOTHING
+;
+
+INSERT INTO stage.company_profiles_history
+    (job_run_id, exchange_code, symbol, country, currency, exchange, name, ticker, ipo, market_capitalization,
+     shares_outstanding, logo, phone, web_url, industry, valid_from, valid_to)
+SELECT job_run_id,
+       exchange_code,
+       symbol,
+       country,
+       currency,
+       exchange,
+       name,
+       ticker,
+       ipo,
+       market_capitalization,
+       shares_outstanding,
+       logo,
+       phone,
+       web_url,
+       industry,
+       modified,
+       NULL
+FROM stage.company_profiles
+ON CONFLICT DO NOTHING
+;
+
+CREATE OR REPLACE VIEW report.stocks_history
+            (symbol, display_symbol, description, exchange_code, security_type, currency, mic, figi,
+             share_class_figi, isin, symbol2, valid_from, valid_to, valid_during)
+AS
+    SELECT symbol,
+           display_symbol,
+           description,
+           exchange_code,
+           security_type,
+           currency,
+           mic,
+           figi,
+           share_class_figi,
+           isin,
+           symbol2,
+           valid_from,
+           valid_to,
+           tstzrange(valid_from, valid_to)
+    FROM stage.stocks_history
+;
+
+COMMENT ON VIEW report.stocks_history IS 'Exposes what was known about stocks over time, e.g. WHERE symbol = ''X'' AND valid_during @> ''2020-06-30''::timestamptz'
+;
+
+CREATE OR REPLACE VIEW report.company_profiles_history
+            (symbol, country, currency, exchange, name, ticker, ipo, market_capitalization, shares_outstanding, logo,
+             phone, web_url, industry, exchange_code, valid_from, valid_to, valid_during)
+AS
+    SELECT symbol,
+           country,
+           currency,
+           exchange,
+           name,
+           ticker,
+           ipo,
+           market_capitalization,
+           shares_outstanding,
+           logo,
+           phone,
+           web_url,
+           industry,
+           exchange_code,
+           valid_from,
+           valid_to,
+           tstzrange(valid_from, valid_to)
+    FROM stage.company_profiles_history
+;
+
+COMMENT ON VIEW report.company_profiles_history IS 'Exposes what was known about companies over time, e.g. WHERE symbol = ''X'' AND valid_during @> ''2020-06-30''::timestamptz'
+;
@@ -0,0 +1,65 @@
+DROP VIEW IF EXISTS report.stocks_history
+;
+
+DROP VIEW IF EXISTS report.stocks
+;
+
+ALTER TABLE stage.stocks_history
+    DROP COLUMN IF EXISTS delisted_at
+;
+
+DROP INDEX IF EXISTS stage.ndx_stocks_delisted_at
+;
+
+ALTER TABLE stage.stocks
+    DROP CONSTRAINT IF EXISTS delisted_job_run_id_fk,
+    DROP COLUMN IF EXISTS delisted_job_run_id,
+    DROP COLUMN IF EXISTS delisted_at
+;
+
+CREATE OR REPLACE VIEW report.stocks
+            (symbol, display_symbol, description, created, modified, exchange_code, security_type, currency, mic,
+             figi, share_class_figi, isin, symbol2)
+AS
+    SELECT stocks.symbol,
+           stocks.display_symbol,
+           stocks.description,
+           stocks.created,
+           stocks.modified,
+           stocks.exchange_code,
+           stocks.security_type,
+           stocks.currency,
+           stocks.mic,
+           stocks.figi,
+           stocks.share_class_figi,
+           stocks.isin,
+           stocks.symbol2
+    FROM stage.stocks
+;
+
+COMMENT ON VIEW report.stocks IS 'Exposes information about stocks for reporting'
+;
+
+CREATE OR REPLACE VIEW report.stocks_history
+            (symbol, display_symbol, description, exchange_code, security_type, currency, mic, figi,
+             share_class_figi, isin, symbol2, valid_from, valid_to, valid_during)
+AS
+    SELECT symbol,
+           display_symbol,
+           description,
+           exchange_code,
+           security_type,
+           currency,
+           mic,
+           figi,
+           share_class_figi,
+           isin,
+           symbol2,
+           valid_from,
+           valid_to,
+           tstzrange(valid_from, valid_to)
+    FROM stage.stocks_history
+;
+
+COMMENT ON VIEW report.stocks_history IS 'Exposes what was known about stocks over time, e.g. WHERE symbol = ''X'' AND valid_during @> ''2020-06-30''::timestamptz'
+;
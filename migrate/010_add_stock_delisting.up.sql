@@ -0,0 +1,65 @@
+ALTER TABLE stage.stocks
+    ADD COLUMN IF NOT EXISTS delisted_at timestamp WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS delisted_job_run_id bigint,
+    ADD CONSTRAINT delisted_job_run_id_fk
+        FOREIGN KEY (delisted_job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+;
+
+COMMENT ON COLUMN stage.stocks.delisted_at IS 'Time the stock was first missing from the symbols of its exchange, null while it is listed'
+;
+
+COMMENT ON COLUMN stage.stocks.delisted_job_run_id IS 'Job run that found the stock missing from the symbols of its exchange'
+;
+
+CREATE INDEX IF NOT EXISTS ndx_stocks_delisted_at
+    ON stage.stocks (exchange_code, delisted_at)
+;
+
+ALTER TABLE stage.stocks_history
+    ADD COLUMN IF NOT EXISTS delisted_at timestamp WITH TIME ZONE
+;
+
+CREATE OR REPLACE VIEW report.stocks
+            (symbol, display_symbol, description, created, modified, exchange_code, security_type, currency, mic,
+             figi, share_class_figi, isin, symbol2, delisted_at)
+AS
+    SELECT stocks.symbol,
+           stocks.display_symbol,
+           stocks.description,
+           stocks.created,
+           stocks.modified,
+           stocks.exchange_code,
+           stocks.security_type,
+           stocks.currency,
+           stocks.mic,
+           stocks.figi,
+           stocks.share_class_figi,
+           stocks.isin,
+           stocks.symbol2,
+           stocks.delisted_at
+    FROM stage.stocks
+;
+
+CREATE OR REPLACE VIEW report.stocks_history
+            (symbol, display_symbol, description, exchange_code, security_type, currency, mic, figi,
+             share_class_figi, isin, symbol2, valid_from, valid_to, valid_during, delisted_at)
+AS
+    SELECT symbol,
+           display_symbol,
+           description,
+           exchange_code,
+           security_type,
+           currency,
+           mic,
+           figi,
+           share_class_figi,
+           isin,
+           symbol2,
+           valid_from,
+           valid_to,
+           tstzrange(valid_from, valid_to),
+           delisted_at
+    FROM stage.stocks_history
+;
@@ -0,0 +1,91 @@
+DROP VIEW IF EXISTS stage.calculate_candles_52wk
+;
+
+DROP VIEW IF EXISTS report.dividends
+;
+
+DROP VIEW IF EXISTS report.splits
+;
+
+DROP VIEW IF EXISTS report.candles
+;
+
+ALTER TABLE metadata.job_run
+    DROP COLUMN IF EXISTS corporate_actions_loaded,
+    DROP COLUMN IF EXISTS corporate_actions_staged,
+    DROP COLUMN IF EXISTS corporate_actions_modified
+;
+
+ALTER TABLE stage.candles
+    DROP COLUMN IF EXISTS split_factor,
+    DROP COLUMN IF EXISTS dividend_factor
+;
+
+DROP TABLE IF EXISTS stage.dividends
+;
+
+DROP TABLE IF EXISTS stage.splits
+;
+
+DROP TABLE IF EXISTS src.dividends
+;
+
+DROP TABLE IF EXISTS src.splits
+;
+
+CREATE OR REPLACE VIEW report.candles(symbol, timestamp, open, high, low, close, volume, created, modified, resolution,
+                                      exchange_code) AS
+    SELECT candles.symbol,
+           candles."timestamp",
+           candles.open,
+           candles.high,
+           candles.low,
+           candles.close,
+           candles.volume,
+           candles.created,
+           candles.modified,
+           candles.resolution,
+           candles.exchange_code
+    FROM stage.candles
+;
+
+COMMENT ON VIEW report.candles IS 'Exposing stock candle data of each resolution for reporting'
+;
+
+CREATE OR REPLACE VIEW stage.calculate_candles_52wk
+            (symbol, timestamp, open, high, low, close, volume, created, modified, high_52wk, low_52wk, volume_52wk_avg,
+             timestamp_52wk_count, resolution, exchange_code)
+AS
+    SELECT anchor.symbol,
+           anchor.timestamp,
+           anchor.open,
+           anchor.high,
+           anchor.low,
+           anchor.close,
+           anchor.volume,
+           anchor.created,
+           anchor.modified,
+           MAX(lag.high)        AS high_52wk,
+           MIN(lag.low)         AS low_52wk,
+           AVG(lag.volume)      AS volume_52wk_avg,
+           COUNT(lag.timestamp) AS timestamp_52wk_count,
+           anchor.resolution,
+           anchor.exchange_code
+    FROM stage.candles anchor
+        JOIN stage.candles lag
+        ON anchor.exchange_code = lag.exchange_code
+            AND anchor.symbol = lag.symbol
+            AND anchor.resolution = lag.resolution
+    WHERE lag."timestamp" BETWEEN anchor.timestamp - INTERVAL '52 weeks' AND anchor.timestamp
+    GROUP BY anchor.exchange_code,
+             anchor.symbol,
+             anchor.resolution,
+             anchor.timestamp,
+             anchor.open,
+             anchor.high,
+             anchor.low,
+             anchor.close,
+             anchor.volume,
+             anchor.created,
+             anchor.modified
+;
@@ -0,0 +1,216 @@
+CREATE TABLE IF NOT EXISTS src.splits (
+    job_run_id    bigint,
+    exchange_code text NOT NULL,
+    symbol        text NOT NULL,
+    data          jsonb,
+    CONSTRAINT splits_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE src.splits IS 'Contains the stock splits of each symbol as provided by finnhub'
+;
+
+CREATE TABLE IF NOT EXISTS src.dividends (
+    job_run_id    bigint,
+    exchange_code text NOT NULL,
+    symbol        text NOT NULL,
+    data          jsonb,
+    CONSTRAINT dividends_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE src.dividends IS 'Contains the dividends of each symbol as provided by finnhub'
+;
+
+CREATE TABLE IF NOT EXISTS stage.splits (
+    job_run_id    bigint,
+    exchange_code text                     NOT NULL,
+    symbol        text                     NOT NULL,
+    date          date                     NOT NULL,
+    from_factor   real                     NOT NULL,
+    to_factor     real                     NOT NULL,
+    created       timestamp WITH TIME ZONE NOT NULL,
+    modified      timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT splits_pk
+        PRIMARY KEY (exchange_code, symbol, date),
+    CONSTRAINT splits_stocks_symbol_fk
+        FOREIGN KEY (exchange_code, symbol)
+            REFERENCES stage.stocks (exchange_code, symbol),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE stage.splits IS 'Contains staged stock splits'
+;
+
+COMMENT ON COLUMN stage.splits.date IS 'First day the stock traded at the split price'
+;
+
+COMMENT ON COLUMN stage.splits.from_factor IS 'Number of shares after the split per to_factor shares before it, e.g. 7 for a 7-for-1 split'
+;
+
+CREATE TABLE IF NOT EXISTS stage.dividends (
+    job_run_id       bigint,
+    exchange_code    text                     NOT NULL,
+    symbol           text                     NOT NULL,
+    date             date                     NOT NULL,
+    amount           real                     NOT NULL,
+    adjusted_amount  real                     NOT NULL,
+    pay_date         date,
+    record_date      date,
+    declaration_date date,
+    currency         text,
+    created          timestamp WITH TIME ZONE NOT NULL,
+    modified         timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT dividends_pk
+        PRIMARY KEY (exchange_code, symbol, date),
+    CONSTRAINT dividends_stocks_symbol_fk
+        FOREIGN KEY (exchange_code, symbol)
+            REFERENCES stage.stocks (exchange_code, symbol),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE stage.dividends IS 'Contains staged cash dividends'
+;
+
+COMMENT ON COLUMN stage.dividends.date IS 'Ex-dividend date'
+;
+
+COMMENT ON COLUMN stage.dividends.amount IS 'Dividend per share, not adjusted for later splits'
+;
+
+ALTER TABLE stage.candles
+    ADD COLUMN IF NOT EXISTS split_factor    double precision DEFAULT 1 NOT NULL,
+    ADD COLUMN IF NOT EXISTS dividend_factor double precision DEFAULT 1 NOT NULL
+;
+
+COMMENT ON COLUMN stage.candles.split_factor IS 'Factor that adjusts the prices of the candle for later splits'
+;
+
+COMMENT ON COLUMN stage.candles.dividend_factor IS 'Factor that adjusts the prices of the candle for later dividends'
+;
+
+ALTER TABLE metadata.job_run
+    ADD COLUMN IF NOT EXISTS corporate_actions_loaded   bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS corporate_actions_staged   bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS corporate_actions_modified bigint DEFAULT 0 NOT NULL
+;
+
+CREATE OR REPLACE VIEW report.candles(symbol, timestamp, open, high, low, close, volume, created, modified, resolution,
+                                      exchange_code, split_factor, dividend_factor, adjusted_open, adjusted_high,
+                                      adjusted_low, adjusted_close, adjusted_volume) AS
+    SELECT candles.symbol,
+           candles."timestamp",
+           candles.open,
+           candles.high,
+           candles.low,
+           candles.close,
+           candles.volume,
+           candles.created,
+           candles.modified,
+           candles.resolution,
+           candles.exchange_code,
+           candles.split_factor,
+           candles.dividend_factor,
+           candles.open * candles.split_factor * candles.dividend_factor,
+           candles.high * candles.split_factor * candles.dividend_factor,
+           candles.low * candles.split_factor * candles.dividend_factor,
+           candles.close * candles.split_factor * candles.dividend_factor,
+           candles.volume / candles.split_factor
+    FROM stage.candles
+;
+
+CREATE OR REPLACE VIEW report.splits(symbol, date, from_factor, to_factor, created, modified, exchange_code) AS
+    SELECT splits.symbol,
+           splits.date,
+           splits.from_factor,
+           splits.to_factor,
+           splits.created,
+           splits.modified,
+           splits.exchange_code
+    FROM stage.splits
+;
+
+COMMENT ON VIEW report.splits IS 'Exposes stock splits for reporting'
+;
+
+CREATE OR REPLACE VIEW report.dividends
+            (symbol, date, amount, adjusted_amount, pay_date, record_date, declaration_date, currency, created,
+             modified, exchange_code)
+AS
+    SELECT dividends.symbol,
+           dividends.date,
+           dividends.amount,
+           dividends.adjusted_amount,
+           dividends.pay_date,
+           dividends.record_date,
+           dividends.declaration_date,
+           dividends.currency,
+           dividends.created,
+           dividends.modified,
+           dividends.exchange_code
+    FROM stage.dividends
+;
+
+COMMENT ON VIEW report.dividends IS 'Exposes cash dividends for reporting'
+;
+
+DROP VIEW IF EXISTS stage.calculate_candles_52wk
+;
+
+CREATE OR REPLACE VIEW stage.calculate_candles_52wk
+            (symbol, timestamp, open, high, low, close, volume, created, modified, high_52wk, low_52wk, volume_52wk_avg,
+             timestamp_52wk_count, resolution, exchange_code)
+AS
+    SELECT anchor.symbol,
+           anchor.timestamp,
+           anchor.open,
+           anchor.high,
+           anchor.low,
+           anchor.close,
+           anchor.volume,
+           anchor.created,
+           anchor.modified,
+           MAX(lag.high * lag.split_factor * lag.dividend_factor) / (anchor.split_factor * anchor.dividend_factor) AS high_52wk,
+           MIN(lag.low * lag.split_factor * lag.dividend_factor) / (anchor.split_factor * anchor.dividend_factor)  AS low_52wk,
+           AVG(lag.volume / lag.split_factor) * anchor.split_factor                                               AS volume_52wk_avg,
+           COUNT(lag.timestamp)                                                                                   AS timestamp_52wk_count,
+           anchor.resolution,
+           anchor.exchange_code
+    FROM stage.candles anchor
+        JOIN stage.candles lag
+        ON anchor.exchange_code = lag.exchange_code
+            AND anchor.symbol = lag.symbol
+            AND anchor.resolution = lag.resolution
+    WHERE lag."timestamp" BETWEEN anchor.timestamp - INTERVAL '52 weeks' AND anchor.timestamp
+    GROUP BY anchor.exchange_code,
+             anchor.symbol,
+             anchor.resolution,
+             anchor.timestamp,
+             anchor.open,
+             anchor.high,
+             anchor.low,
+             anchor.close,
+             anchor.volume,
+             anchor.created,
+             anchor.modified,
+             anchor.split_factor,
+             anchor.dividend_factor
+;
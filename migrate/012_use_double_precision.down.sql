@@ -0,0 +1,236 @@
+DROP VIEW IF EXISTS report.candles
+;
+
+DROP VIEW IF EXISTS report.candles_52wk
+;
+
+DROP VIEW IF EXISTS stage.calculate_candles_52wk
+;
+
+DROP VIEW IF EXISTS report.company_profiles
+;
+
+DROP VIEW IF EXISTS report.company_profiles_history
+;
+
+DROP VIEW IF EXISTS report.splits
+;
+
+DROP VIEW IF EXISTS report.dividends
+;
+
+ALTER TABLE stage.candles
+    ALTER COLUMN open TYPE real,
+    ALTER COLUMN high TYPE real,
+    ALTER COLUMN low TYPE real,
+    ALTER COLUMN close TYPE real,
+    ALTER COLUMN volume TYPE real
+;
+
+ALTER TABLE stage.candles_52wk
+    ALTER COLUMN high_52wk TYPE real,
+    ALTER COLUMN low_52wk TYPE real,
+    ALTER COLUMN volume_52wk_avg TYPE real,
+    ALTER COLUMN open TYPE real,
+    ALTER COLUMN high TYPE real,
+    ALTER COLUMN low TYPE real,
+    ALTER COLUMN close TYPE real,
+    ALTER COLUMN volume TYPE real
+;
+
+ALTER TABLE stage.company_profiles
+    ALTER COLUMN market_capitalization TYPE real,
+    ALTER COLUMN shares_outstanding TYPE real
+;
+
+ALTER TABLE stage.company_profiles_history
+    ALTER COLUMN market_capitalization TYPE real,
+    ALTER COLUMN shares_outstanding TYPE real
+;
+
+ALTER TABLE stage.splits
+    ALTER COLUMN from_factor TYPE real,
+    ALTER COLUMN to_factor TYPE real
+;
+
+ALTER TABLE stage.dividends
+    ALTER COLUMN amount TYPE real,
+    ALTER COLUMN adjusted_amount TYPE real
+;
+
+CREATE OR REPLACE VIEW report.candles(symbol, timestamp, open, high, low, close, volume, created, modified, resolution,
+                                      exchange_code, split_factor, dividend_factor, adjusted_open, adjusted_high,
+                                      adjusted_low, adjusted_close, adjusted_volume) AS
+    SELECT candles.symbol,
+           candles."timestamp",
+           candles.open,
+           candles.high,
+           candles.low,
+           candles.close,
+           candles.volume,
+           candles.created,
+           candles.modified,
+           candles.resolution,
+           candles.exchange_code,
+           candles.split_factor,
+           candles.dividend_factor,
+           candles.open * candles.split_factor * candles.dividend_factor,
+           candles.high * candles.split_factor * candles.dividend_factor,
+           candles.low * candles.split_factor * candles.dividend_factor,
+           candles.close * candles.split_factor * candles.dividend_factor,
+           candles.volume / candles.split_factor
+    FROM stage.candles
+;
+
+COMMENT ON VIEW report.candles IS 'Exposing stock candle data of each resolution for reporting'
+;
+
+CREATE OR REPLACE VIEW report.candles_52wk
+            (symbol, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified,
+             timestamp_52wk_count, resolution, exchange_code)
+AS
+    SELECT symbol,
+           timestamp,
+           high_52wk,
+           low_52wk,
+           volume_52wk_avg,
+           open,
+           high,
+           low,
+           close,
+           volume,
+           created,
+           modified,
+           timestamp_52wk_count,
+           resolution,
+           exchange_code
+    FROM stage.candles_52wk
+;
+
+CREATE OR REPLACE VIEW stage.calculate_candles_52wk
+            (symbol, timestamp, open, high, low, close, volume, created, modified, high_52wk, low_52wk, volume_52wk_avg,
+             timestamp_52wk_count, resolution, exchange_code)
+AS
+    SELECT anchor.symbol,
+           anchor.timestamp,
+           anchor.open,
+           anchor.high,
+           anchor.low,
+           anchor.close,
+           anchor.volume,
+           anchor.created,
+           anchor.modified,
+           MAX(lag.high * lag.split_factor * lag.dividend_factor) / (anchor.split_factor * anchor.dividend_factor) AS high_52wk,
+           MIN(lag.low * lag.split_factor * lag.dividend_factor) / (anchor.split_factor * anchor.dividend_factor)  AS low_52wk,
+           AVG(lag.volume / lag.split_factor) * anchor.split_factor                                               AS volume_52wk_avg,
+           COUNT(lag.timestamp)                                                                                   AS timestamp_52wk_count,
+           anchor.resolution,
+           anchor.exchange_code
+    FROM stage.candles anchor
+        JOIN stage.candles lag
+        ON anchor.exchange_code = lag.exchange_code
+            AND anchor.symbol = lag.symbol
+            AND anchor.resolution = lag.resolution
+    WHERE lag."timestamp" BETWEEN anchor.timestamp - INTERVAL '52 weeks' AND anchor.timestamp
+    GROUP BY anchor.exchange_code,
+             anchor.symbol,
+             anchor.resolution,
+             anchor.timestamp,
+             anchor.open,
+             anchor.high,
+             anchor.low,
+             anchor.close,
+             anchor.volume,
+             anchor.created,
+             anchor.modified,
+             anchor.split_factor,
+             anchor.dividend_factor
+;
+
+CREATE OR REPLACE VIEW report.company_profiles
+            (symbol, country, currency, exchange, name, ticker, ipo, market_capitalization, shares_outstanding, logo,
+             phone, web_url, industry, created, modified, exchange_code)
+AS
+    SELECT company_profiles.symbol,
+           company_profiles.country,
+           company_profiles.currency,
+           company_profiles.exchange,
+           company_profiles.name,
+           company_profiles.ticker,
+           company_profiles.ipo,
+           company_profiles.market_capitalization,
+           company_profiles.shares_outstanding,
+           company_profiles.logo,
+           company_profiles.phone,
+           company_profiles.web_url AS web_url,
+           company_profiles.industry,
+           company_profiles.created,
+           company_profiles.modified,
+           company_profiles.exchange_code
+    FROM stage.company_profiles
+;
+
+COMMENT ON VIEW report.company_profiles IS 'Exposes company profile data for reporting'
+;
+
+CREATE OR REPLACE VIEW report.company_profiles_history
+            (symbol, country, currency, exchange, name, ticker, ipo, market_capitalization, shares_outstanding, logo,
+             phone, web_url, industry, exchange_code, valid_from, valid_to, valid_during)
+AS
+    SELECT symbol,
+           country,
+           currency,
+           exchange,
+           name,
+           ticker,
+           ipo,
+           market_capitalization,
+           shares_outstanding,
+           logo,
+           phone,
+           web_url,
+           industry,
+           exchange_code,
+           valid_from,
+           valid_to,
+           tstzrange(valid_from, valid_to)
+    FROM stage.company_profiles_history
+;
+
+COMMENT ON VIEW report.company_profiles_history IS 'Exposes what was known about companies over time, e.g. WHERE symbol = ''X'' AND valid_during @> ''2020-06-30''::timestamptz'
+;
+
+CREATE OR REPLACE VIEW report.splits(symbol, date, from_factor, to_factor, created, modified, exchange_code) AS
+    SELECT splits.symbol,
+           splits.date,
+           splits.from_factor,
+           splits.to_factor,
+           splits.created,
+           splits.modified,
+           splits.exchange_code
+    FROM stage.splits
+;
+
+COMMENT ON VIEW report.splits IS 'Exposes stock splits for reporting'
+;
+
+CREATE OR REPLACE VIEW report.dividends
+            (symbol, date, amount, adjusted_amount, pay_date, record_date, declaration_date, currency, created,
+             modified, exchange_code)
+AS
+    SELECT dividends.symbol,
+           dividends.date,
+           dividends.amount,
+           dividends.adjusted_amount,
+           dividends.pay_date,
+           dividends.record_date,
+           dividends.declaration_date,
+           dividends.currency,
+           dividends.created,
+           dividends.modified,
+           dividends.exchange_code
+    FROM stage.dividends
+;
+
+COMMENT ON VIEW report.dividends IS 'Exposes cash dividends for reporting'
+;
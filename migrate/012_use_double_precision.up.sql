@@ -0,0 +1,352 @@
+DROP VIEW IF EXISTS report.candles
+;
+
+DROP VIEW IF EXISTS report.candles_52wk
+;
+
+DROP VIEW IF EXISTS stage.calculate_candles_52wk
+;
+
+DROP VIEW IF EXISTS report.company_profiles
+;
+
+DROP VIEW IF EXISTS report.company_profiles_history
+;
+
+DROP VIEW IF EXISTS report.splits
+;
+
+DROP VIEW IF EXISTS report.dividends
+;
+
+ALTER TABLE stage.candles
+    ALTER COLUMN open TYPE double precision,
+    ALTER COLUMN high TYPE double precision,
+    ALTER COLUMN low TYPE double precision,
+    ALTER COLUMN close TYPE double precision,
+    ALTER COLUMN volume TYPE double precision
+;
+
+ALTER TABLE stage.candles_52wk
+    ALTER COLUMN high_52wk TYPE double precision,
+    ALTER COLUMN low_52wk TYPE double precision,
+    ALTER COLUMN volume_52wk_avg TYPE double precision,
+    ALTER COLUMN open TYPE double precision,
+    ALTER COLUMN high TYPE double precision,
+    ALTER COLUMN low TYPE double precision,
+    ALTER COLUMN close TYPE double precision,
+    ALTER COLUMN volume TYPE double precision
+;
+
+ALTER TABLE stage.company_profiles
+    ALTER COLUMN market_capitalization TYPE double precision,
+    ALTER COLUMN shares_outstanding TYPE double precision
+;
+
+ALTER TABLE stage.company_profiles_history
+    ALTER COLUMN market_capitalization TYPE double precision,
+    ALTER COLUMN shares_outstanding TYPE double precision
+;
+
+ALTER TABLE stage.splits
+    ALTER COLUMN from_factor TYPE double precision,
+    ALTER COLUMN to_factor TYPE double precision
+;
+
+ALTER TABLE stage.dividends
+    ALTER COLUMN amount TYPE double precision,
+    ALTER COLUMN adjusted_amount TYPE double precision
+;
+
+CREATE OR REPLACE VIEW report.candles(symbol, timestamp, open, high, low, close, volume, created, modified, resolution,
+                                      exchange_code, split_factor, dividend_factor, adjusted_open, adjusted_high,
+                                      adjusted_low, adjusted_close, adjusted_volume) AS
+    SELECT candles.symbol,
+           candles."timestamp",
+           candles.open,
+           candles.high,
+           candles.low,
+           candles.close,
+           candles.volume,
+           candles.created,
+           candles.modified,
+           candles.resolution,
+           candles.exchange_code,
+           candles.split_factor,
+           candles.dividend_factor,
+           candles.open * candles.split_factor * candles.dividend_factor,
+           candles.high * candles.split_factor * candles.dividend_factor,
+           candles.low * candles.split_factor * candles.dividend_factor,
+           candles.close * candles.split_factor * candles.dividend_factor,
+           candles.volume / candles.split_factor
+    FROM stage.candles
+;
+
+COMMENT ON VIEW report.candles IS 'Exposing stock candle data of each resolution for reporting'
+;
+
+CREATE OR REPLACE VIEW report.candles_52wk
+            (symbol, timestamp, high_52wk, low_52wk, volume_52wk_avg, open, high, low, close, volume, created, modified,
+             timestamp_52wk_count, resolution, exchange_code)
+AS
+    SELECT symbol,
+           timestamp,
+           high_52wk,
+           low_52wk,
+           volume_52wk_avg,
+           open,
+           high,
+           low,
+           close,
+           volume,
+           created,
+           modified,
+           timestamp_52wk_count,
+           resolution,
+           exchange_code
+    FROM stage.candles_52wk
+;
+
+CREATE OR REPLACE VIEW stage.calculate_candles_52wk
+            (symbol, timestamp, open, high, low, close, volume, created, modified, high_52wk, low_52wk, volume_52wk_avg,
+             timestamp_52wk_count, resolution, exchange_code)
+AS
+    SELECT anchor.symbol,
+           anchor.timestamp,
+           anchor.open,
+           anchor.high,
+           anchor.low,
+           anchor.close,
+           anchor.volume,
+           anchor.created,
+           anchor.modified,
+           MAX(lag.high * lag.split_factor * lag.dividend_factor) / (anchor.split_factor * anchor.dividend_factor) AS high_52wk,
+           MIN(lag.low * lag.split_factor * lag.dividend_factor) / (anchor.split_factor * anchor.dividend_factor)  AS low_52wk,
+           AVG(lag.volume / lag.split_factor) * anchor.split_factor                                               AS volume_52wk_avg,
+           COUNT(lag.timestamp)                                                                                   AS timestamp_52wk_count,
+           anchor.resolution,
+           anchor.exchange_code
+    FROM stage.candles anchor
+        JOIN stage.candles lag
+        ON anchor.exchange_code = lag.exchange_code
+            AND anchor.symbol = lag.symbol
+            AND anchor.resolution = lag.resolution
+    WHERE lag."timestamp" BETWEEN anchor.timestamp - INTERVAL '52 weeks' AND anchor.timestamp
+    GROUP BY anchor.exchange_code,
+             anchor.symbol,
+             anchor.resolution,
+             anchor.timestamp,
+             anchor.open,
+             anchor.high,
+             anchor.low,
+             anchor.close,
+             anchor.volume,
+             anchor.created,
+             anchor.modified,
+             anchor.split_factor,
+             anchor.dividend_factor
+;
+
+CREATE OR REPLACE VIEW report.company_profiles
+            (symbol, country, currency, exchange, name, ticker, ipo, market_capitalization, shares_outstanding, logo,
+             phone, web_url, industry, created, modified, exchange_code)
+AS
+    SELECT company_profiles.symbol,
+           company_profiles.country,
+           company_profiles.currency,
+           company_profiles.exchange,
+           company_profiles.name,
+           company_profiles.ticker,
+           company_profiles.ipo,
+           company_profiles.market_capitalization,
+           company_profiles.shares_outstanding,
+           company_profiles.logo,
+           company_profiles.phone,
+           company_profiles.web_url AS web_url,
+           company_profiles.industry,
+           company_profiles.created,
+           company_profiles.modified,
+           company_profiles.exchange_code
+    FROM stage.company_profiles
+;
+
+COMMENT ON VIEW report.company_profiles IS 'Exposes company profile data for reporting'
+;
+
+CREATE OR REPLACE VIEW report.company_profiles_history
+            (symbol, country, currency, exchange, name, ticker, ipo, market_capitalization, shares_outstanding, logo,
+             phone, web_url, industry, exchange_code, valid_from, valid_to, valid_during)
+AS
+    SELECT symbol,
+           country,
+           currency,
+           exchange,
+           name,
+           ticker,
+           ipo,
+           market_capitalization,
+           shares_outstanding,
+           logo,
+           phone,
+           web_url,
+           industry,
+           exchange_code,
+           valid_from,
+           valid_to,
+           tstzrange(valid_from, valid_to)
+    FROM stage.company_profiles_history
+;
+
+COMMENT ON VIEW report.company_profiles_history IS 'Exposes what was known about companies over time, e.g. WHERE symbol = ''X'' AND valid_during @> ''2020-06-30''::timestamptz'
+;
+
+CREATE OR REPLACE VIEW report.splits(symbol, date, from_factor, to_factor, created, modified, exchange_code) AS
+    SELECT splits.symbol,
+           splits.date,
+           splits.from_factor,
+           splits.to_factor,
+           splits.created,
+           splits.modified,
+           splits.exchange_code
+    FROM stage.splits
+;
+
+COMMENT ON VIEW report.splits IS 'Exposes stock splits for reporting'
+;
+
+CREATE OR REPLACE VIEW report.dividends
+            (symbol, date, amount, adjusted_amount, pay_date, record_date, declaration_date, currency, created,
+             modified, exchange_code)
+AS
+    SELECT dividends.symbol,
+           dividends.date,
+           dividends.amount,
+           dividends.adjusted_amount,
+           dividends.pay_date,
+           dividends.record_date,
+           dividends.declaration_date,
+           dividends.currency,
+           dividends.created,
+           dividends.modified,
+           dividends.exchange_code
+    FROM stage.dividends
+;
+
+COMMENT ON VIEW report.dividends IS 'Exposes cash dividends for reporting'
+;
+
+-- Re-stage the candles and company profiles that are still in the src schema
+-- from their json, which holds more digits than the real columns did. Older
+-- candles keep their widened values until they are requested again.
+UPDATE stage.candles
+SET open     = restaged.open,
+    high     = restaged.high,
+    low      = restaged.low,
+    close    = restaged.close,
+    volume   = restaged.volume,
+    modified = CURRENT_TIMESTAMP
+FROM (
+         SELECT DISTINCT ON (candles.exchange_code, candles.symbol, candles.resolution, to_timestamp(t.value::bigint))
+                candles.exchange_code,
+                candles.symbol,
+                candles.resolution,
+                to_timestamp(t.value::bigint)                                    AS timestamp,
+                (candles.data -> 'o' ->> (t.ndx - 1)::int)::double precision AS open,
+                (candles.data -> 'h' ->> (t.ndx - 1)::int)::double precision AS high,
+                (candles.data -> 'l' ->> (t.ndx - 1)::int)::double precision AS low,
+                (candles.data -> 'c' ->> (t.ndx - 1)::int)::double precision AS close,
+                (candles.data -> 'v' ->> (t.ndx - 1)::int)::double precision AS volume
+         FROM src.candles
+             CROSS JOIN LATERAL jsonb_array_elements_text(candles.data -> 't') WITH ORDINALITY AS t(value, ndx)
+         ORDER BY candles.exchange_code,
+                  candles.symbol,
+                  candles.resolution,
+                  to_timestamp(t.value::bigint),
+                  candles.job_run_id DESC
+     ) AS restaged
+WHERE candles.exchange_code = restaged.exchange_code
+  AND candles.symbol = restaged.symbol
+  AND candles.resolution = restaged.resolution
+  AND candles.timestamp = restaged.timestamp
+  AND (
+        candles.open IS DISTINCT FROM restaged.open OR
+        candles.high IS DISTINCT FROM restaged.high OR
+        candles.low IS DISTINCT FROM restaged.low OR
+        candles.close IS DISTINCT FROM restaged.close OR
+        candles.volume IS DISTINCT FROM restaged.volume
+    )
+;
+
+UPDATE stage.candles_52wk
+SET high_52wk            = calculated.high_52wk,
+    low_52wk             = calculated.low_52wk,
+    volume_52wk_avg      = calculated.volume_52wk_avg,
+    open                 = calculated.open,
+    high                 = calculated.high,
+    low                  = calculated.low,
+    close                = calculated.close,
+    volume               = calculated.volume,
+    timestamp_52wk_count = calculated.timestamp_52wk_count,
+    modified             = CURRENT_TIMESTAMP
+FROM (
+         SELECT exchange_code,
+                symbol,
+                resolution,
+                timestamp,
+                open,
+                high,
+                low,
+                close,
+                volume,
+                MAX(high * split_factor * dividend_factor) OVER w / (split_factor * dividend_factor) AS high_52wk,
+                MIN(low * split_factor * dividend_factor) OVER w / (split_factor * dividend_factor)  AS low_52wk,
+                AVG(volume / split_factor) OVER w * split_factor                                     AS volume_52wk_avg,
+                COUNT(timestamp) OVER w                                                              AS timestamp_52wk_count
+         FROM stage.candles
+         WINDOW w AS (PARTITION BY exchange_code, symbol, resolution ORDER BY timestamp RANGE BETWEEN INTERVAL '52 weeks' PRECEDING AND CURRENT ROW)
+     ) AS calculated
+WHERE candles_52wk.exchange_code = calculated.exchange_code
+  AND candles_52wk.symbol = calculated.symbol
+  AND candles_52wk.resolution = calculated.resolution
+  AND candles_52wk.timestamp = calculated.timestamp
+  AND (
+        candles_52wk.high_52wk IS DISTINCT FROM calculated.high_52wk OR
+        candles_52wk.low_52wk IS DISTINCT FROM calculated.low_52wk OR
+        candles_52wk.volume_52wk_avg IS DISTINCT FROM calculated.volume_52wk_avg OR
+        candles_52wk.open IS DISTINCT FROM calculated.open OR
+        candles_52wk.high IS DISTINCT FROM calculated.high OR
+        candles_52wk.low IS DISTINCT FROM calculated.low OR
+        candles_52wk.close IS DISTINCT FROM calculated.close OR
+        candles_52wk.volume IS DISTINCT FROM calculated.volume
+    )
+;
+
+UPDATE stage.company_profiles
+SET market_capitalization = restaged.market_capitalization,
+    shares_outstanding    = restaged.shares_outstanding,
+    modified              = CURRENT_TIMESTAMP
+FROM (
+         SELECT DISTINCT ON (exchange_code, symbol)
+                exchange_code,
+                symbol,
+                COALESCE((data ->> 'marketCapitalization')::double precision, 0) AS market_capitalization,
+                COALESCE((data ->> 'shareOutstanding')::double precision, 0)     AS shares_outstanding
+         FROM src.company_profiles
+         ORDER BY exchange_code, symbol, job_run_id DESC
+     ) AS restaged
+WHERE company_profiles.exchange_code = restaged.exchange_code
+  AND company_profiles.symbol = restaged.symbol
+  AND (
+        company_profiles.market_capitalization IS DISTINCT FROM restaged.market_capitalization OR
+        company_profiles.shares_outstanding IS DISTINCT FROM restaged.shares_outstanding
+    )
+;
+
+UPDATE stage.company_profiles_history
+SET market_capitalization = company_profiles.market_capitalization,
+    shares_outstanding    = company_profiles.shares_outstanding
+FROM stage.company_profiles
+WHERE company_profiles_history.exchange_code = company_profiles.exchange_code
+  AND company_profiles_history.symbol = company_profiles.symbol
+  AND company_profiles_history.valid_to IS NULL
+;
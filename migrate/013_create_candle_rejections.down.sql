@@ -0,0 +1,10 @@
+DROP VIEW IF EXISTS report.candle_rejections
+;
+
+ALTER TABLE metadata.job_run
+    DROP COLUMN IF EXISTS candles_rejected,
+    DROP COLUMN IF EXISTS candles_flagged
+;
+
+DROP TABLE IF EXISTS stage.candle_rejections
+;
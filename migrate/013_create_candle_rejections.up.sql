@@ -0,0 +1,69 @@
+CREATE TABLE IF NOT EXISTS stage.candle_rejections (
+    job_run_id    bigint                   NOT NULL,
+    exchange_code text                     NOT NULL,
+    symbol        text                     NOT NULL,
+    resolution    text                     NOT NULL,
+    timestamp     timestamp WITH TIME ZONE NOT NULL,
+    open          double precision,
+    high          double precision,
+    low           double precision,
+    close         double precision,
+    volume        double precision,
+    reason        text                     NOT NULL,
+    detail        text,
+    staged        boolean                  NOT NULL,
+    created       timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT candle_rejections_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol, resolution, timestamp, reason),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE CASCADE
+)
+;
+
+COMMENT ON TABLE stage.candle_rejections IS 'Contains the candles that failed validation while being staged'
+;
+
+COMMENT ON COLUMN stage.candle_rejections.reason IS 'Check the candle failed: high_below_low, open_out_of_range, close_out_of_range, negative_volume, duplicate_timestamp or close_jump'
+;
+
+COMMENT ON COLUMN stage.candle_rejections.staged IS 'Whether the candle was staged anyway. Only candles flagged for a close_jump are staged'
+;
+
+CREATE INDEX IF NOT EXISTS candle_rejections_symbol_idx
+    ON stage.candle_rejections (exchange_code, symbol, resolution, timestamp)
+;
+
+ALTER TABLE metadata.job_run
+    ADD COLUMN IF NOT EXISTS candles_rejected bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS candles_flagged  bigint DEFAULT 0 NOT NULL
+;
+
+COMMENT ON COLUMN metadata.job_run.candles_rejected IS 'Number of candles that failed validation and were not staged'
+;
+
+COMMENT ON COLUMN metadata.job_run.candles_flagged IS 'Number of candles that failed validation but were staged anyway'
+;
+
+CREATE OR REPLACE VIEW report.candle_rejections(job_run_id, symbol, timestamp, open, high, low, close, volume, resolution,
+                                                exchange_code, reason, detail, staged, created) AS
+    SELECT candle_rejections.job_run_id,
+           candle_rejections.symbol,
+           candle_rejections.timestamp,
+           candle_rejections.open,
+           candle_rejections.high,
+           candle_rejections.low,
+           candle_rejections.close,
+           candle_rejections.volume,
+           candle_rejections.resolution,
+           candle_rejections.exchange_code,
+           candle_rejections.reason,
+           candle_rejections.detail,
+           candle_rejections.staged,
+           candle_rejections.created
+    FROM stage.candle_rejections
+;
+
+COMMENT ON VIEW report.candle_rejections IS 'Exposes candles that failed validation for reporting'
+;
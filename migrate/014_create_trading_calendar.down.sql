@@ -0,0 +1,19 @@
+DROP VIEW IF EXISTS report.candle_gaps
+;
+
+ALTER TABLE metadata.job_run
+    DROP COLUMN IF EXISTS candle_gaps_detected,
+    DROP COLUMN IF EXISTS candle_gaps_filled
+;
+
+DROP TABLE IF EXISTS stage.candle_gaps
+;
+
+DROP FUNCTION IF EXISTS metadata.trading_sessions(text, date, date)
+;
+
+DROP TABLE IF EXISTS metadata.trading_holidays
+;
+
+DROP TABLE IF EXISTS metadata.trading_calendars
+;
@@ -0,0 +1,107 @@
+CREATE TABLE IF NOT EXISTS metadata.trading_calendars (
+    exchange_code text                     NOT NULL,
+    version       text                     NOT NULL,
+    covered_from  date                     NOT NULL,
+    covered_to    date                     NOT NULL,
+    created       timestamp WITH TIME ZONE NOT NULL,
+    modified      timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT trading_calendars_pk
+        PRIMARY KEY (exchange_code)
+)
+;
+
+COMMENT ON TABLE metadata.trading_calendars IS 'Contains the exchanges whose trading sessions are known. Loaded from the trading calendar files of calendarDir'
+;
+
+COMMENT ON COLUMN metadata.trading_calendars.version IS 'Version of the trading calendar file the holidays of the exchange were loaded from. The etl and backfill commands replace the holidays when the version of the file differs'
+;
+
+COMMENT ON COLUMN metadata.trading_calendars.covered_from IS 'First day the holidays of the exchange are known for'
+;
+
+COMMENT ON COLUMN metadata.trading_calendars.covered_to IS 'Last day the holidays of the exchange are known for'
+;
+
+CREATE TABLE IF NOT EXISTS metadata.trading_holidays (
+    exchange_code text NOT NULL,
+    date          date NOT NULL,
+    name          text NOT NULL,
+    CONSTRAINT trading_holidays_pk
+        PRIMARY KEY (exchange_code, date),
+    CONSTRAINT trading_holidays_calendar_fk
+        FOREIGN KEY (exchange_code)
+            REFERENCES metadata.trading_calendars
+            ON DELETE CASCADE
+)
+;
+
+COMMENT ON TABLE metadata.trading_holidays IS 'Contains the weekdays on which an exchange is closed'
+;
+
+CREATE OR REPLACE FUNCTION metadata.trading_sessions(p_exchange_code text, p_from date, p_to date)
+    RETURNS TABLE (session date)
+    LANGUAGE sql
+    STABLE
+AS
+$$
+SELECT d::date
+FROM metadata.trading_calendars calendar,
+     generate_series(GREATEST(p_from, calendar.covered_from), LEAST(p_to, calendar.covered_to), INTERVAL '1 day') d
+WHERE calendar.exchange_code = p_exchange_code
+  AND EXTRACT(ISODOW FROM d) < 6
+  AND NOT EXISTS(SELECT
+                 FROM metadata.trading_holidays holiday
+                 WHERE holiday.exchange_code = p_exchange_code
+                   AND holiday.date = d::date)
+ORDER BY d
+$$
+;
+
+COMMENT ON FUNCTION metadata.trading_sessions(text, date, date) IS 'Returns the trading sessions of an exchange between two dates. Days the calendar of the exchange does not cover are omitted'
+;
+
+CREATE TABLE IF NOT EXISTS stage.candle_gaps (
+    job_run_id    bigint,
+    exchange_code text                     NOT NULL,
+    symbol        text                     NOT NULL,
+    resolution    text                     NOT NULL,
+    date          date                     NOT NULL,
+    detections    integer                  NOT NULL,
+    created       timestamp WITH TIME ZONE NOT NULL,
+    modified      timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT candle_gaps_pk
+        PRIMARY KEY (exchange_code, symbol, resolution, date),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE stage.candle_gaps IS 'Contains the trading sessions missing from stage.candles between the first and last candle of a symbol'
+;
+
+COMMENT ON COLUMN stage.candle_gaps.job_run_id IS 'Last job run that detected the gap'
+;
+
+COMMENT ON COLUMN stage.candle_gaps.detections IS 'Number of job runs that detected the gap. Gaps are re-requested until it exceeds candleGaps.maxRetries'
+;
+
+ALTER TABLE metadata.job_run
+    ADD COLUMN IF NOT EXISTS candle_gaps_detected bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS candle_gaps_filled   bigint DEFAULT 0 NOT NULL
+;
+
+CREATE OR REPLACE VIEW report.candle_gaps(symbol, date, detections, created, modified, resolution, exchange_code) AS
+    SELECT candle_gaps.symbol,
+           candle_gaps.date,
+           candle_gaps.detections,
+           candle_gaps.created,
+           candle_gaps.modified,
+           candle_gaps.resolution,
+           candle_gaps.exchange_code
+    FROM stage.candle_gaps
+;
+
+COMMENT ON VIEW report.candle_gaps IS 'Exposes trading sessions missing from the candles of each symbol for reporting'
+;
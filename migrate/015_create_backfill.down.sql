@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS metadata.job_run_backfill
+;
+
+DELETE
+FROM metadata.job_definition
+WHERE name = 'Finnhub Backfill'
+;
@@ -0,0 +1,23 @@
+INSERT INTO
+    metadata.job_definition (name)
+VALUES ('Finnhub Backfill')
+;
+
+CREATE TABLE IF NOT EXISTS metadata.job_run_backfill (
+    job_run_id    bigint NOT NULL,
+    exchange_code text   NOT NULL,
+    symbols       text[] NOT NULL,
+    resolutions   text[] NOT NULL,
+    "from"        timestamp WITH TIME ZONE NOT NULL,
+    "to"          timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT job_run_backfill_pk
+        PRIMARY KEY (job_run_id),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE CASCADE
+)
+;
+
+COMMENT ON TABLE metadata.job_run_backfill IS 'Contains the symbols and range of a backfill job run, so that it can be resumed'
+;
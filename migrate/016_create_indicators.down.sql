@@ -0,0 +1,10 @@
+DROP VIEW IF EXISTS report.indicators
+;
+
+ALTER TABLE metadata.job_run
+    DROP COLUMN IF EXISTS indicators_staged,
+    DROP COLUMN IF EXISTS indicators_modified
+;
+
+DROP TABLE IF EXISTS stage.indicators
+;
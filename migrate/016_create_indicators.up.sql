@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS stage.indicators (
+    job_run_id    bigint,
+    exchange_code text                     NOT NULL,
+    symbol        text                     NOT NULL,
+    resolution    text                     NOT NULL,
+    timestamp     timestamp WITH TIME ZONE NOT NULL,
+    indicator     text                     NOT NULL,
+    value         double precision         NOT NULL,
+    created       timestamp WITH TIME ZONE NOT NULL,
+    modified      timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT indicators_pk
+        PRIMARY KEY (exchange_code, symbol, resolution, timestamp, indicator),
+    CONSTRAINT indicators_candles_fk
+        FOREIGN KEY (exchange_code, symbol, resolution, timestamp)
+            REFERENCES stage.candles (exchange_code, symbol, resolution, timestamp)
+            ON DELETE CASCADE,
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE stage.indicators IS 'Contains technical indicators of the staged candles, one row per candle and indicator'
+;
+
+COMMENT ON COLUMN stage.indicators.indicator IS 'Name of the indicator and its parameters, e.g. sma_20, rsi_14, macd_signal_12_26_9 or bollinger_upper_20_2'
+;
+
+COMMENT ON COLUMN stage.indicators.value IS 'Value of the indicator. Prices are on the scale of the candle, like stage.candles_52wk'
+;
+
+ALTER TABLE metadata.job_run
+    ADD COLUMN IF NOT EXISTS indicators_staged   bigint DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS indicators_modified bigint DEFAULT 0 NOT NULL
+;
+
+CREATE OR REPLACE VIEW report.indicators(symbol, timestamp, indicator, value, created, modified, resolution,
+                                         exchange_code) AS
+    SELECT indicators.symbol,
+           indicators.timestamp,
+           indicators.indicator,
+           indicators.value,
+           indicators.created,
+           indicators.modified,
+           indicators.resolution,
+           indicators.exchange_code
+    FROM stage.indicators
+;
+
+COMMENT ON VIEW report.indicators IS 'Exposes technical indicators for reporting'
+;
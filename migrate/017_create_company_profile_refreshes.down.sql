@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS metadata.company_profile_refreshes
+;
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS metadata.company_profile_refreshes (
+    job_run_id    bigint,
+    exchange_code text                     NOT NULL,
+    symbol        text                     NOT NULL,
+    found         boolean                  NOT NULL,
+    refreshed     timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT company_profile_refreshes_pk
+        PRIMARY KEY (exchange_code, symbol),
+    CONSTRAINT job_run_id_fk
+        FOREIGN KEY (job_run_id)
+            REFERENCES metadata.job_run
+            ON DELETE SET NULL
+)
+;
+
+COMMENT ON TABLE metadata.company_profile_refreshes IS 'Contains the last time the company profile of each stock was requested, including requests the provider had no profile for. Decides which profiles are due for a refresh'
+;
+
+COMMENT ON COLUMN metadata.company_profile_refreshes.job_run_id IS 'Last job run that requested the profile'
+;
+
+COMMENT ON COLUMN metadata.company_profile_refreshes.found IS 'Whether the provider returned a profile on the last request'
+;
+
+INSERT INTO metadata.company_profile_refreshes (job_run_id, exchange_code, symbol, found, refreshed)
+SELECT job_run_id, exchange_code, symbol, TRUE, modified
+FROM stage.company_profiles
+ON CONFLICT (exchange_code, symbol) DO NOTHING
+;
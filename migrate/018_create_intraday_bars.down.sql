@@ -0,0 +1,5 @@
+DROP VIEW IF EXISTS report.intraday_bars
+;
+
+DROP TABLE IF EXISTS stage.intraday_bars
+;
@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS stage.intraday_bars (
+    exchange_code text                     NOT NULL,
+    symbol        text                     NOT NULL,
+    timestamp     timestamp WITH TIME ZONE NOT NULL,
+    open          double precision         NOT NULL,
+    high          double precision         NOT NULL,
+    low           double precision         NOT NULL,
+    close         double precision         NOT NULL,
+    volume        double precision         NOT NULL,
+    trades        integer                  NOT NULL,
+    first_trade   timestamp WITH TIME ZONE NOT NULL,
+    last_trade    timestamp WITH TIME ZONE NOT NULL,
+    created       timestamp WITH TIME ZONE NOT NULL,
+    modified      timestamp WITH TIME ZONE NOT NULL,
+    CONSTRAINT intraday_bars_pk
+        PRIMARY KEY (exchange_code, symbol, timestamp),
+    CONSTRAINT intraday_bars_stocks_symbol_fk
+        FOREIGN KEY (exchange_code, symbol)
+            REFERENCES stage.stocks (exchange_code, symbol)
+)
+;
+
+COMMENT ON TABLE stage.intraday_bars IS 'Contains one minute bars aggregated from the trades streamed by finnhub''s websocket api'
+;
+
+COMMENT ON COLUMN stage.intraday_bars.timestamp IS 'Start of the minute of the bar'
+;
+
+COMMENT ON COLUMN stage.intraday_bars.first_trade IS 'Time of the trade that set the open price. Used to merge trades that arrive after the bar was flushed'
+;
+
+COMMENT ON COLUMN stage.intraday_bars.last_trade IS 'Time of the trade that set the close price. Used to merge trades that arrive after the bar was flushed'
+;
+
+CREATE OR REPLACE VIEW report.intraday_bars(symbol, timestamp, open, high, low, close, volume, trades, created, modified,
+                                            exchange_code) AS
+    SELECT intraday_bars.symbol,
+           intraday_bars.timestamp,
+           intraday_bars.open,
+           intraday_bars.high,
+           intraday_bars.low,
+           intraday_bars.close,
+           intraday_bars.volume,
+           intraday_bars.trades,
+           intraday_bars.created,
+           intraday_bars.modified,
+           intraday_bars.exchange_code
+    FROM stage.intraday_bars
+;
+
+COMMENT ON VIEW report.intraday_bars IS 'Exposes one minute bars for reporting'
+;
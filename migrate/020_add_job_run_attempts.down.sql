@@ -0,0 +1,4 @@
+ALTER TABLE metadata.job_run
+    DROP COLUMN IF EXISTS attempts,
+    DROP COLUMN IF EXISTS resumed
+;
@@ -0,0 +1,10 @@
+ALTER TABLE metadata.job_run
+    ADD COLUMN IF NOT EXISTS attempts integer DEFAULT 1 NOT NULL,
+    ADD COLUMN IF NOT EXISTS resumed  timestamp WITH TIME ZONE
+;
+
+COMMENT ON COLUMN metadata.job_run.attempts IS 'Number of times the job run was started, i.e. 1 plus the number of times it was resumed. The counters of the job run add up all attempts'
+;
+
+COMMENT ON COLUMN metadata.job_run.resumed IS 'Time the job run was most recently resumed, or NULL if it was never resumed'
+;
@@ -0,0 +1,10 @@
+ALTER TABLE metadata.job_run
+    DROP COLUMN IF EXISTS exchange_first,
+    DROP COLUMN IF EXISTS exchange_last
+;
+
+COMMENT ON COLUMN metadata.job_run.symbol_skip IS 'Number of symbols (ordered by symbol) skipped by the job run, or NULL when no symbols were skipped'
+;
+
+COMMENT ON COLUMN metadata.job_run.symbol_limit IS 'Maximum number of symbols (ordered by symbol) processed by the job run, or NULL when unlimited'
+;
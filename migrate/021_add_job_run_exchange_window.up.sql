@@ -0,0 +1,16 @@
+ALTER TABLE metadata.job_run
+    ADD COLUMN IF NOT EXISTS exchange_first text,
+    ADD COLUMN IF NOT EXISTS exchange_last  text
+;
+
+COMMENT ON COLUMN metadata.job_run.exchange_first IS 'Exchange code of symbol_first'
+;
+
+COMMENT ON COLUMN metadata.job_run.exchange_last IS 'Exchange code of symbol_last'
+;
+
+COMMENT ON COLUMN metadata.job_run.symbol_skip IS 'Number of symbols (ordered by exchange code and symbol) skipped by the job run, or NULL when no symbols were skipped'
+;
+
+COMMENT ON COLUMN metadata.job_run.symbol_limit IS 'Maximum number of symbols (ordered by exchange code and symbol) processed by the job run, or NULL when unlimited'
+;
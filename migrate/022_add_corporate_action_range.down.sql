@@ -0,0 +1,21 @@
+COMMENT ON COLUMN stage.candles_52wk.volume_52wk_avg IS NULL
+;
+
+COMMENT ON COLUMN stage.candles_52wk.low_52wk IS NULL
+;
+
+COMMENT ON COLUMN stage.candles_52wk.high_52wk IS NULL
+;
+
+COMMENT ON VIEW stage.calculate_candles_52wk IS NULL
+;
+
+ALTER TABLE src.dividends
+    DROP COLUMN IF EXISTS "from",
+    DROP COLUMN IF EXISTS "to"
+;
+
+ALTER TABLE src.splits
+    DROP COLUMN IF EXISTS "from",
+    DROP COLUMN IF EXISTS "to"
+;
@@ -0,0 +1,33 @@
+ALTER TABLE src.splits
+    ADD COLUMN IF NOT EXISTS "from" timestamp WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS "to"   timestamp WITH TIME ZONE
+;
+
+COMMENT ON COLUMN src.splits."from" IS 'Start of the requested range of split dates, or NULL for the complete history'
+;
+
+COMMENT ON COLUMN src.splits."to" IS 'End of the requested range of split dates, or NULL for the complete history'
+;
+
+ALTER TABLE src.dividends
+    ADD COLUMN IF NOT EXISTS "from" timestamp WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS "to"   timestamp WITH TIME ZONE
+;
+
+COMMENT ON COLUMN src.dividends."from" IS 'Start of the requested range of ex-dividend dates, or NULL for the complete history'
+;
+
+COMMENT ON COLUMN src.dividends."to" IS 'End of the requested range of ex-dividend dates, or NULL for the complete history'
+;
+
+COMMENT ON VIEW stage.calculate_candles_52wk IS 'Calculates 52 week statistics from split and dividend adjusted candles and converts them back to the raw scale of each candle, so a split within the window is not a new high or low. Before migration 011 the statistics were calculated from raw candles. report.candles exposes the adjusted prices'
+;
+
+COMMENT ON COLUMN stage.candles_52wk.high_52wk IS 'Highest adjusted high of the 52 weeks up to the candle, converted back to the raw scale of the candle'
+;
+
+COMMENT ON COLUMN stage.candles_52wk.low_52wk IS 'Lowest adjusted low of the 52 weeks up to the candle, converted back to the raw scale of the candle'
+;
+
+COMMENT ON COLUMN stage.candles_52wk.volume_52wk_avg IS 'Average split adjusted volume of the 52 weeks up to the candle, converted back to the raw scale of the candle'
+;
@@ -0,0 +1,19 @@
+DELETE
+FROM src.candles
+WHERE EXISTS(SELECT
+             FROM src.candles later
+             WHERE later.job_run_id = candles.job_run_id
+               AND later.exchange_code = candles.exchange_code
+               AND later.symbol = candles.symbol
+               AND later.resolution = candles.resolution
+               AND (later."from", later."to") > (candles."from", candles."to"))
+;
+
+ALTER TABLE src.candles
+    DROP CONSTRAINT candles_pk,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol, resolution)
+;
+
+COMMENT ON TABLE src.candles IS 'Contains daily stock candles as far back as provided by finnhub'
+;
@@ -0,0 +1,8 @@
+ALTER TABLE src.candles
+    DROP CONSTRAINT candles_pk,
+    ADD CONSTRAINT candles_pk
+        PRIMARY KEY (job_run_id, exchange_code, symbol, resolution, "from", "to")
+;
+
+COMMENT ON TABLE src.candles IS 'Contains the candles loaded by each job run, one row per requested range, e.g. each chunk of a backfill'
+;